@@ -0,0 +1,64 @@
+// +build muxarena
+
+package npsmux
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// arenaChunk is the count of packagers allocated at once by a session arena
+const arenaChunk = 64
+
+// sessionArena keeps the packagers of a mux in a free list, built with the
+// muxarena tag, instead of the global pool, all of them are dropped
+// wholesale when the mux closed, the servers with a high session churn
+// leave less objects to the gc
+type sessionArena struct {
+	free   []*muxPackager
+	freed  bool
+	chunks int
+	sync.Mutex
+}
+
+func (Self *sessionArena) getPack() (pack *muxPackager) {
+	atomic.AddInt64(&pooledPackagers, 1)
+	Self.Lock()
+	if n := len(Self.free); n > 0 {
+		pack = Self.free[n-1]
+		Self.free = Self.free[:n-1]
+		Self.Unlock()
+		return
+	}
+	Self.chunks++
+	Self.Unlock()
+	chunk := make([]muxPackager, arenaChunk)
+	free := make([]*muxPackager, 0, arenaChunk-1)
+	for i := 1; i < arenaChunk; i++ {
+		free = append(free, &chunk[i])
+	}
+	Self.Lock()
+	if !Self.freed {
+		Self.free = append(Self.free, free...)
+	}
+	Self.Unlock()
+	return &chunk[0]
+}
+
+func (Self *sessionArena) putPack(pack *muxPackager) {
+	atomic.AddInt64(&pooledPackagers, -1)
+	pack.reset()
+	Self.Lock()
+	if !Self.freed {
+		Self.free = append(Self.free, pack)
+	}
+	Self.Unlock()
+}
+
+// release drops all the packagers, the packagers put back later are dropped too
+func (Self *sessionArena) release() {
+	Self.Lock()
+	Self.freed = true
+	Self.free = nil
+	Self.Unlock()
+}
@@ -0,0 +1,17 @@
+// +build !muxarena
+
+package npsmux
+
+// sessionArena takes the packagers from the global pool, build with the
+// muxarena tag to keep them per session
+type sessionArena struct{}
+
+func (Self *sessionArena) getPack() *muxPackager {
+	return muxPack.Get()
+}
+
+func (Self *sessionArena) putPack(pack *muxPackager) {
+	muxPack.Put(pack)
+}
+
+func (Self *sessionArena) release() {}
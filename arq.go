@@ -0,0 +1,655 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ARQConfig runs the mux over an unreliable datagram transport, as a udp socket
+// or an icmp tunnel, without kcp underneath. every Write of the transport sends
+// a datagram, every Read receives one, the datagrams may be lost, duplicated or
+// reordered. the bytes of the mux are cut into the segments of the datagrams,
+// the receiver acknowledges them selectively, the segments not acknowledged in
+// the retransmission timeout, or skipped by three acks, are sent again. the
+// losses slow down the pacer of the mux as the congestion notified by the peer,
+// so the congestion controller is shared, enable Pacing with it
+type ARQConfig struct {
+	// SegmentSize is the largest datagram sent, zero means 1200
+	SegmentSize int
+	// Window is the segments sent but not acknowledged, zero means 256
+	Window int
+	// Interval is the tick of the retransmission timer, the ack of a single
+	// segment is delayed by it at most, zero means 10ms
+	Interval time.Duration
+	// MinRTO is the lowest retransmission timeout, zero means 100ms
+	MinRTO time.Duration
+	// MaxRetries is the sends of a segment not acknowledged, the transport
+	// fails with ErrTimeout beyond it, zero means 10
+	MaxRetries int
+	// DataShards and ParityShards enable the forward error correction, as for the
+	// satellite and the mobile links losing several percent, the datagrams are
+	// grouped by DataShards, and ParityShards datagrams of the reed-solomon parity
+	// follow a group, any DataShards of them recover the group without waiting
+	// for the retransmission. zero means no correction, both sides need the same
+	DataShards   int
+	ParityShards int
+}
+
+// the segment is kind(1) seq(4) ack(4) sack(4) payload, ack is the next seq
+// expected, the bit i of sack is set if the seq ack+1+i received
+const (
+	arqData uint8 = iota
+	arqAck
+	arqProbe    // the mtu probe, see mtu.go
+	arqProbeAck // the answer of the probe
+)
+
+const (
+	arqHeaderSize  = 13
+	arqFastResend  = 3 // the acks skipping a segment before it sent again
+	arqMaxRTO      = time.Second * 30
+	arqInitialRTO  = time.Second
+	arqAckSegments = 2 // the segments received before acknowledged at once
+)
+
+func (s *ARQConfig) segmentSize() int {
+	if s.SegmentSize > arqHeaderSize {
+		return s.SegmentSize
+	}
+	return 1200
+}
+
+// payload returns the bytes of the mux in a segment
+func (s *ARQConfig) payload() int {
+	n := s.segmentSize() - arqHeaderSize
+	if s.fec() {
+		n -= fecOverhead
+	}
+	return n
+}
+
+func (s *ARQConfig) fec() bool {
+	return s.DataShards > 0 && s.ParityShards > 0
+}
+
+func (s *ARQConfig) window() int {
+	if s.Window > 0 {
+		return s.Window
+	}
+	return 256
+}
+
+func (s *ARQConfig) interval() time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return time.Millisecond * 10
+}
+
+func (s *ARQConfig) minRTO() time.Duration {
+	if s.MinRTO > 0 {
+		return s.MinRTO
+	}
+	return time.Millisecond * 100
+}
+
+func (s *ARQConfig) maxRetries() int {
+	if s.MaxRetries > 0 {
+		return s.MaxRetries
+	}
+	return 10
+}
+
+// arqConn is the reliable byte stream over the datagram transport
+type arqConn struct {
+	retransmits uint64 // accessed atomically, keep them first for 64bit alignment
+	recovered   uint64 // the datagrams recovered by the forward error correction
+	mtu         uint32 // the largest datagram sent, lowered by the mtu discovery, accessed atomically
+	net.Conn           // the datagram transport
+	config      ARQConfig
+	mux         *Mux
+	mu          sync.Mutex
+	wmu         sync.Mutex  // serializes the datagrams written
+	fecEnc      *fecEncoder // guarded by wmu, nil without the correction
+	fecDec      *fecDecoder // owned by the reader
+
+	// the sender
+	sndNext  uint32
+	flight   []*arqSegment // sent but not acknowledged cumulatively, by the seq
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	lastLoss time.Time
+	sendCh   chan struct{}
+	probeID  uint32
+	probes   map[uint32]chan struct{} // the mtu probes waiting for the answers
+
+	// the receiver
+	rcvNext    uint32
+	held       map[uint32][]byte // the segments arrived early
+	readBuf    []byte
+	ackPending int
+	recvCh     chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	err           error
+	closeCh       chan struct{}
+	once          sync.Once
+}
+
+type arqSegment struct {
+	seq    uint32
+	data   []byte
+	sentAt time.Time
+	sends  int
+	skips  int
+	acked  bool // acknowledged selectively
+}
+
+func newARQConn(mux *Mux, c net.Conn, config ARQConfig) *arqConn {
+	if config.DataShards > fecMaxShards {
+		config.DataShards = fecMaxShards
+	}
+	if config.ParityShards > fecMaxShards {
+		config.ParityShards = fecMaxShards
+	}
+	a := &arqConn{
+		Conn:    c,
+		config:  config,
+		mux:     mux,
+		rto:     arqInitialRTO,
+		held:    make(map[uint32][]byte),
+		sendCh:  make(chan struct{}, 1),
+		recvCh:  make(chan struct{}, 1),
+		closeCh: make(chan struct{}),
+	}
+	a.mtu = uint32(config.segmentSize())
+	if config.fec() {
+		a.fecEnc = newFECEncoder(config.DataShards, config.ParityShards)
+		a.fecDec = newFECDecoder(config.ParityShards)
+	}
+	return a
+}
+
+// start runs the reader of the datagrams and the retransmission timer
+func (Self *arqConn) start() {
+	Self.mux.goroutine(Self.readLoop)
+	Self.mux.goroutine(Self.timerLoop)
+	if Self.mux.config.MTUDiscovery {
+		Self.mux.goroutine(Self.mtuSession)
+	}
+}
+
+// payload returns the bytes of the mux in a segment of the size probed
+func (Self *arqConn) payload() int {
+	n := int(atomic.LoadUint32(&Self.mtu)) - arqHeaderSize
+	if Self.config.fec() {
+		n -= fecOverhead
+	}
+	return n
+}
+
+// seqBefore reports whether the seq a is before b, the seqs wrap around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (Self *arqConn) Write(p []byte) (n int, err error) {
+	payload := Self.payload()
+	for len(p) > 0 {
+		size := len(p)
+		if size > payload {
+			size = payload
+		}
+		if err = Self.waitWindow(); err != nil {
+			return
+		}
+		seg := &arqSegment{data: append([]byte(nil), p[:size]...)}
+		Self.mu.Lock()
+		seg.seq = Self.sndNext
+		Self.sndNext++
+		Self.flight = append(Self.flight, seg)
+		Self.mu.Unlock()
+		if err = Self.send(seg); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// waitWindow blocks until a segment can be sent
+func (Self *arqConn) waitWindow() error {
+	for {
+		Self.mu.Lock()
+		full := len(Self.flight) >= Self.config.window()
+		err, deadline := Self.err, Self.writeDeadline
+		Self.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !full {
+			return nil
+		}
+		if err = Self.wait(Self.sendCh, deadline); err != nil {
+			return err
+		}
+	}
+}
+
+func (Self *arqConn) Read(p []byte) (n int, err error) {
+	for {
+		Self.mu.Lock()
+		if len(Self.readBuf) > 0 {
+			n = copy(p, Self.readBuf)
+			Self.readBuf = Self.readBuf[n:]
+			if len(Self.readBuf) == 0 {
+				Self.readBuf = nil
+			}
+			Self.mu.Unlock()
+			return
+		}
+		err, deadline := Self.err, Self.readDeadline
+		Self.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err = Self.wait(Self.recvCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait blocks until ch signaled, the conn closed or the deadline
+func (Self *arqConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := deadline.Sub(Self.mux.clock.Now())
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := Self.mux.clock.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case <-ch:
+	case <-timeout:
+		return ErrTimeout
+	case <-Self.closeCh:
+	}
+	return nil
+}
+
+// header returns the header of the segment, with the acks of the segments received
+func (Self *arqConn) header(kind uint8, seq uint32) []byte {
+	b := make([]byte, arqHeaderSize, Self.config.segmentSize())
+	b[0] = kind
+	binary.LittleEndian.PutUint32(b[1:5], seq)
+	binary.LittleEndian.PutUint32(b[5:9], Self.rcvNext)
+	var sack uint32
+	for i := uint32(0); i < 32; i++ {
+		if _, ok := Self.held[Self.rcvNext+1+i]; ok {
+			sack |= 1 << i
+		}
+	}
+	binary.LittleEndian.PutUint32(b[9:13], sack)
+	Self.ackPending = 0
+	return b
+}
+
+func (Self *arqConn) send(seg *arqSegment) error {
+	Self.mu.Lock()
+	seg.sentAt = Self.mux.clock.Now()
+	seg.sends++
+	seg.skips = 0
+	b := append(Self.header(arqData, seg.seq), seg.data...)
+	Self.mu.Unlock()
+	return Self.writeDatagram(b)
+}
+
+func (Self *arqConn) sendAck() error {
+	Self.mu.Lock()
+	b := Self.header(arqAck, 0)
+	Self.mu.Unlock()
+	return Self.writeDatagram(b)
+}
+
+func (Self *arqConn) writeDatagram(b []byte) (err error) {
+	Self.wmu.Lock()
+	defer Self.wmu.Unlock()
+	if Self.fecEnc == nil {
+		_, err = Self.Conn.Write(b)
+		return
+	}
+	return Self.writeShards(Self.fecEnc.add(b))
+}
+
+// flushGroup sends the parity of the group not full, the datagrams wait
+// for the recovery no longer than the tick
+func (Self *arqConn) flushGroup() error {
+	if Self.fecEnc == nil {
+		return nil
+	}
+	Self.wmu.Lock()
+	defer Self.wmu.Unlock()
+	return Self.writeShards(Self.fecEnc.close())
+}
+
+func (Self *arqConn) writeShards(shards [][]byte) error {
+	for _, shard := range shards {
+		if _, err := Self.Conn.Write(shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (Self *arqConn) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := Self.Conn.Read(buf)
+		if err != nil {
+			Self.fail(err)
+			return
+		}
+		datagram, recovered := buf[:n], [][]byte(nil)
+		if Self.fecDec != nil {
+			datagram, recovered = Self.fecDec.input(datagram)
+			atomic.AddUint64(&Self.recovered, uint64(len(recovered)))
+		}
+		for _, d := range append(recovered, datagram) {
+			if len(d) < arqHeaderSize {
+				continue // not a segment
+			}
+			if err = Self.input(d); err != nil {
+				Self.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// input handles the segment received
+func (Self *arqConn) input(b []byte) error {
+	seq := binary.LittleEndian.Uint32(b[1:5])
+	ack := binary.LittleEndian.Uint32(b[5:9])
+	sack := binary.LittleEndian.Uint32(b[9:13])
+	var ackNow, delivered bool
+	var probeAck []byte
+	Self.mu.Lock()
+	resend, progressed := Self.acknowledge(ack, sack)
+	switch b[0] {
+	case arqData:
+		delivered, ackNow = Self.receive(seq, b[arqHeaderSize:])
+		Self.ackPending++
+		ackNow = ackNow || Self.ackPending >= arqAckSegments
+	case arqProbe:
+		probeAck = Self.header(arqProbeAck, seq)
+	case arqProbeAck:
+		if ch, ok := Self.probes[seq]; ok {
+			signal(ch)
+		}
+	}
+	Self.mu.Unlock()
+	if probeAck != nil {
+		if err := Self.writeDatagram(probeAck); err != nil {
+			return err
+		}
+	}
+	if progressed {
+		signal(Self.sendCh)
+	}
+	if delivered {
+		signal(Self.recvCh)
+	}
+	if len(resend) > 0 {
+		Self.lost()
+	}
+	for _, seg := range resend {
+		atomic.AddUint64(&Self.retransmits, 1)
+		if err := Self.send(seg); err != nil {
+			return err
+		}
+	}
+	if ackNow {
+		return Self.sendAck()
+	}
+	return nil
+}
+
+// acknowledge removes the segments acknowledged, resend is the segments
+// skipped by the acks, lost
+func (Self *arqConn) acknowledge(ack, sack uint32) (resend []*arqSegment, progressed bool) {
+	now := Self.mux.clock.Now()
+	for len(Self.flight) > 0 && seqBefore(Self.flight[0].seq, ack) {
+		seg := Self.flight[0]
+		if seg.sends == 1 && !seg.acked {
+			Self.sample(now.Sub(seg.sentAt))
+		}
+		Self.flight[0] = nil
+		Self.flight = Self.flight[1:]
+		progressed = true
+	}
+	var highest uint32
+	var sacked bool
+	for _, seg := range Self.flight {
+		if i := seg.seq - ack - 1; i < 32 && sack&(1<<i) != 0 {
+			if !seg.acked && seg.sends == 1 {
+				Self.sample(now.Sub(seg.sentAt))
+			}
+			seg.acked = true
+			highest, sacked = seg.seq, true
+		}
+	}
+	if !sacked {
+		return
+	}
+	for _, seg := range Self.flight {
+		if !seqBefore(seg.seq, highest) {
+			break
+		}
+		if !seg.acked {
+			if seg.skips++; seg.skips == arqFastResend {
+				resend = append(resend, seg)
+			}
+		}
+	}
+	return
+}
+
+// sample updates the retransmission timeout by the rtt, as rfc 6298
+func (Self *arqConn) sample(rtt time.Duration) {
+	if Self.srtt == 0 {
+		Self.srtt, Self.rttvar = rtt, rtt/2
+	} else {
+		d := Self.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		Self.rttvar = (3*Self.rttvar + d) / 4
+		Self.srtt = (7*Self.srtt + rtt) / 8
+	}
+	Self.rto = Self.srtt + 4*Self.rttvar
+	if min := Self.config.minRTO(); Self.rto < min {
+		Self.rto = min
+	}
+	if Self.rto > arqMaxRTO {
+		Self.rto = arqMaxRTO
+	}
+}
+
+// receive takes the data segment, ackNow is true if it is not the next one,
+// the peer learns the hole or the ack lost at once
+func (Self *arqConn) receive(seq uint32, data []byte) (delivered, ackNow bool) {
+	switch {
+	case seq == Self.rcvNext:
+		Self.readBuf = append(Self.readBuf, data...)
+		Self.rcvNext++
+		for {
+			d, ok := Self.held[Self.rcvNext]
+			if !ok {
+				break
+			}
+			delete(Self.held, Self.rcvNext)
+			Self.readBuf = append(Self.readBuf, d...)
+			Self.rcvNext++
+		}
+		return true, len(Self.held) > 0
+	case seqBefore(seq, Self.rcvNext):
+		return false, true // received twice, the ack was lost
+	case seq-Self.rcvNext < uint32(Self.config.window()):
+		if _, ok := Self.held[seq]; !ok {
+			Self.held[seq] = append([]byte(nil), data...)
+		}
+		return false, true
+	}
+	return false, false // beyond the window, the sender never sends it
+}
+
+func (Self *arqConn) timerLoop() {
+	interval := Self.config.interval()
+	timer := Self.mux.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+		case <-Self.closeCh:
+			return
+		}
+		if err := Self.tick(); err != nil {
+			Self.fail(err)
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// tick sends again the segments timed out, and the acks delayed
+func (Self *arqConn) tick() error {
+	now := Self.mux.clock.Now()
+	var resend []*arqSegment
+	Self.mu.Lock()
+	for _, seg := range Self.flight {
+		if seg.acked {
+			continue
+		}
+		rto := Self.rto << uint(seg.sends-1)
+		if rto > arqMaxRTO || rto <= 0 {
+			rto = arqMaxRTO
+		}
+		if now.Sub(seg.sentAt) < rto {
+			continue
+		}
+		if seg.sends >= Self.config.maxRetries() {
+			Self.mu.Unlock()
+			return ErrTimeout
+		}
+		resend = append(resend, seg)
+	}
+	ack := Self.ackPending > 0
+	Self.mu.Unlock()
+	if len(resend) > 0 {
+		Self.lost()
+	}
+	for _, seg := range resend {
+		atomic.AddUint64(&Self.retransmits, 1)
+		if err := Self.send(seg); err != nil {
+			return err
+		}
+	}
+	if ack && len(resend) == 0 {
+		if err := Self.sendAck(); err != nil {
+			return err
+		}
+	}
+	return Self.flushGroup()
+}
+
+// lost tells the mux the segments lost, once per rtt at most, a burst of
+// the losses is one congestion
+func (Self *arqConn) lost() {
+	now := Self.mux.clock.Now()
+	Self.mu.Lock()
+	if now.Sub(Self.lastLoss) < Self.srtt {
+		Self.mu.Unlock()
+		return
+	}
+	Self.lastLoss = now
+	Self.mu.Unlock()
+	Self.mux.transportLost()
+}
+
+// fail closes the conn for the error, the reads and writes return it then
+func (Self *arqConn) fail(err error) {
+	Self.mu.Lock()
+	if Self.err == nil {
+		Self.err = err
+	}
+	Self.mu.Unlock()
+	_ = Self.Close()
+}
+
+func (Self *arqConn) Close() (err error) {
+	err = io.ErrClosedPipe
+	Self.once.Do(func() {
+		Self.mu.Lock()
+		if Self.err == nil {
+			Self.err = io.ErrClosedPipe
+		}
+		Self.mu.Unlock()
+		close(Self.closeCh)
+		err = Self.Conn.Close()
+	})
+	return
+}
+
+func (Self *arqConn) SetDeadline(t time.Time) error {
+	_ = Self.SetReadDeadline(t)
+	return Self.SetWriteDeadline(t)
+}
+
+func (Self *arqConn) SetReadDeadline(t time.Time) error {
+	Self.mu.Lock()
+	Self.readDeadline = t
+	Self.mu.Unlock()
+	signal(Self.recvCh)
+	return nil
+}
+
+func (Self *arqConn) SetWriteDeadline(t time.Time) error {
+	Self.mu.Lock()
+	Self.writeDeadline = t
+	Self.mu.Unlock()
+	signal(Self.sendCh)
+	return nil
+}
+
+// transportLost slows down the pacer for the segments lost by the transport,
+// as the congestion notified by the peer
+func (s *Mux) transportLost() {
+	if s.pacer != nil {
+		s.ackedBw.scale(congestionBackOff)
+	}
+}
+
+// arqStats returns the segments sent again and the datagrams recovered
+func (s *Mux) arqStats() (retransmits, recovered uint64) {
+	if s.arq == nil {
+		return
+	}
+	return atomic.LoadUint64(&s.arq.retransmits), atomic.LoadUint64(&s.arq.recovered)
+}
@@ -0,0 +1,94 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// maxBatchIds is the count of connection ids one batch frame can carry
+const maxBatchIds = maximumSegmentSize / 4
+
+type idBatch struct {
+	ids []int32
+	sync.Mutex
+}
+
+// add appends the id to the batch, returns true if the batch was empty,
+// the caller need to push a batch frame into the write queue then
+func (Self *idBatch) add(id int32) (first bool) {
+	Self.Lock()
+	Self.ids = append(Self.ids, id)
+	first = len(Self.ids) == 1
+	Self.Unlock()
+	return
+}
+
+// take removes at most max ids from the batch, more reports whether
+// there are still some ids left
+func (Self *idBatch) take(max int) (ids []int32, more bool) {
+	Self.Lock()
+	if len(Self.ids) > max {
+		ids = make([]int32, max)
+		copy(ids, Self.ids[:max])
+		Self.ids = append(Self.ids[:0], Self.ids[max:]...)
+		more = true
+	} else {
+		ids = Self.ids
+		Self.ids = nil
+	}
+	Self.Unlock()
+	return
+}
+
+func decodeBatch(content []byte) (ids []int32) {
+	ids = make([]int32, 0, len(content)/4)
+	for i := 0; i+4 <= len(content); i += 4 {
+		ids = append(ids, int32(binary.LittleEndian.Uint32(content[i:i+4])))
+	}
+	return
+}
+
+// sendBatched sends the new conn or new conn ok signal, if the peer
+// supports, signals sent during a connection storm are merged into one frame
+func (s *Mux) sendBatched(flag uint8, id int32) {
+	if atomic.LoadUint32(&s.peerFeatures)&featureOpenBatch == 0 {
+		s.sendInfo(flag, id, nil)
+		return
+	}
+	switch flag {
+	case muxNewConn:
+		if s.newConnBatch.add(id) {
+			s.sendInfo(muxNewConnBatch, 0, nil)
+		}
+	case muxNewConnOk:
+		if s.newConnOkBatch.add(id) {
+			s.sendInfo(muxNewConnOkBatch, 0, nil)
+		}
+	}
+}
+
+// fillBatch is invoked by write session, it collects all the ids added
+// since the batch frame pushed into the write queue
+func (s *Mux) fillBatch(pack *muxPackager) {
+	batch, single := &s.newConnBatch, muxNewConn
+	if pack.flag == muxNewConnOkBatch {
+		batch, single = &s.newConnOkBatch, muxNewConnOk
+	}
+	ids, more := batch.take(maxBatchIds)
+	if more {
+		s.sendInfo(pack.flag, 0, nil)
+		// ids left, need another frame
+	}
+	if len(ids) == 1 {
+		pack.flag = single
+		pack.id = ids[0]
+		return
+	}
+	pack.content = windowBuff.Get()
+	for i, id := range ids {
+		binary.LittleEndian.PutUint32(pack.content[i*4:i*4+4], uint32(id))
+	}
+	pack.content = pack.content[:len(ids)*4]
+	pack.setLength()
+}
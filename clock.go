@@ -0,0 +1,54 @@
+package npsmux
+
+import "time"
+
+// Clock is the source of time used by the mux,
+// replace it in MuxConfig to control the time in tests
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the Clock version of time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the Clock version of time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (s systemTimer) C() <-chan time.Time {
+	return s.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (s systemTicker) C() <-chan time.Time {
+	return s.Ticker.C
+}
@@ -0,0 +1,227 @@
+package npsmux
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the battery is meant to run with the race detector, like this
+//
+//	go test -race -run CloseRace
+//
+// every case tears the muxes down while the streams are busy,
+// and fails if anything hangs, panics or leaks
+
+const closeRaceTimeout = time.Second * 20
+
+// failConn fails the transport after limit writes, or when broken
+type failConn struct {
+	net.Conn
+	limit  int32
+	broken uint32
+}
+
+var errInjected = errors.New("mux: injected transport error")
+
+func (s *failConn) Write(p []byte) (int, error) {
+	if atomic.LoadUint32(&s.broken) == 1 || atomic.AddInt32(&s.limit, -1) < 0 {
+		_ = s.Conn.Close()
+		return 0, errInjected
+	}
+	return s.Conn.Write(p)
+}
+
+func (s *failConn) Read(p []byte) (int, error) {
+	if atomic.LoadUint32(&s.broken) == 1 {
+		_ = s.Conn.Close()
+		return 0, errInjected
+	}
+	return s.Conn.Read(p)
+}
+
+func (s *failConn) breakDown() {
+	atomic.StoreUint32(&s.broken, 1)
+	_ = s.Conn.Close()
+}
+
+// closeRacePair returns a pair of muxes, the transport of the client
+// fails after limit writes, negative limit never fails by itself
+func closeRacePair(limit int32) (client, server *Mux, fc *failConn) {
+	c1, c2 := net.Pipe()
+	if limit < 0 {
+		limit = 1 << 30
+	}
+	fc = &failConn{Conn: c1, limit: limit}
+	return NewMux(fc, "tcp", 0), NewMux(c2, "tcp", 0), fc
+}
+
+// echoAccept echoes every stream accepted until the mux closed
+func echoAccept(m *Mux, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		c, err := m.Accept()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			_, _ = io.Copy(c, c)
+			_ = c.Close()
+		}(c)
+	}
+}
+
+// streamLoad opens streams and writes, reads and closes them until the mux fails
+func streamLoad(m *Mux, wg *sync.WaitGroup) {
+	defer wg.Done()
+	b := make([]byte, 4096)
+	for {
+		c, err := m.NewConn()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			// the reader, racing the writer and the close
+			_, _ = io.Copy(ioutil.Discard, c)
+		}(c)
+		for i := 0; i < 4; i++ {
+			if _, err = c.Write(b); err != nil {
+				break
+			}
+		}
+		_ = c.Close()
+	}
+}
+
+// waitGroupTimeout fails the test if wg not done in time
+func waitGroupTimeout(t *testing.T, wg *sync.WaitGroup, what string) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeRaceTimeout):
+		t.Fatalf("%s hangs after close", what)
+	}
+}
+
+func runCloseRace(t *testing.T, limit int32, teardown func(client, server *Mux, fc *failConn)) {
+	client, server, fc := closeRacePair(limit)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go echoAccept(server, &wg)
+	go echoAccept(client, &wg)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go streamLoad(client, &wg)
+	}
+	wg.Add(1)
+	go streamLoad(server, &wg)
+	time.Sleep(time.Millisecond * 50)
+	teardown(client, server, fc)
+	// both sides must see the failure sooner or later
+	_ = client.Close()
+	_ = server.Close()
+	waitGroupTimeout(t, &wg, "stream")
+	if err := CheckLeaks(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseRaceConcurrentClose(t *testing.T) {
+	runCloseRace(t, -1, func(client, server *Mux, fc *failConn) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_ = client.Close()
+			}()
+			go func() {
+				defer wg.Done()
+				_ = server.Close()
+			}()
+		}
+		waitGroupTimeout(t, &wg, "close")
+	})
+}
+
+func TestCloseRaceTransportError(t *testing.T) {
+	runCloseRace(t, -1, func(client, server *Mux, fc *failConn) {
+		fc.breakDown()
+	})
+}
+
+func TestCloseRaceWriteLimit(t *testing.T) {
+	for _, limit := range []int32{0, 1, 10, 100} {
+		runCloseRace(t, limit, func(client, server *Mux, fc *failConn) {})
+	}
+}
+
+func TestCloseRaceBreakWhileClosing(t *testing.T) {
+	runCloseRace(t, -1, func(client, server *Mux, fc *failConn) {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = client.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			fc.breakDown()
+		}()
+		waitGroupTimeout(t, &wg, "close")
+	})
+}
+
+// TestCloseRaceStreams closes the streams from both sides and the mux at once
+func TestCloseRaceStreams(t *testing.T) {
+	client, server, _ := closeRacePair(-1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go echoAccept(server, &wg)
+	conns := make([]net.Conn, 0, 32)
+	for i := 0; i < 32; i++ {
+		c, err := client.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	var closers sync.WaitGroup
+	for _, c := range conns {
+		closers.Add(3)
+		go func(c net.Conn) {
+			defer closers.Done()
+			_, _ = c.Write(make([]byte, 100000))
+		}(c)
+		go func(c net.Conn) {
+			defer closers.Done()
+			_, _ = c.Read(make([]byte, 100))
+		}(c)
+		go func(c net.Conn) {
+			defer closers.Done()
+			_ = c.Close()
+			_ = c.Close()
+		}(c)
+	}
+	_ = client.Close()
+	waitGroupTimeout(t, &closers, "stream")
+	_ = server.Close()
+	waitGroupTimeout(t, &wg, "accept")
+	if err := CheckLeaks(); err != nil {
+		t.Error(err)
+	}
+}
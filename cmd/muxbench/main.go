@@ -0,0 +1,236 @@
+// Command muxbench runs the traffic through a mux for a long time, checks
+// the data echoed by the checksums, and reports the memory and goroutines,
+// their growth shows the leaks.
+//
+// both endpoints run in this process by default, or serve the echo endpoint
+//
+//	muxbench -listen :8024
+//
+// and run the traffic from the other side
+//
+//	muxbench -addr 10.0.0.1:8024 -pattern mixed -duration 12h
+//
+// the patterns are short (many short streams), bulk (few streams of large
+// data), burst (many streams opened at once every second) and mixed
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps-mux"
+)
+
+var (
+	addr     = flag.String("addr", "", "the echo endpoint, empty runs both endpoints in this process")
+	listen   = flag.String("listen", "", "serve the echo endpoint at the address")
+	pattern  = flag.String("pattern", "mixed", "the traffic: short, bulk, burst or mixed")
+	duration = flag.Duration("duration", time.Hour, "how long the traffic runs")
+	interval = flag.Duration("report", time.Minute, "the interval of the reports")
+	workers  = flag.Int("c", 16, "the concurrent streams of the short and bulk traffic")
+	bulkSize = flag.Int("bulk", 64<<20, "the bytes of a bulk stream")
+)
+
+type counters struct {
+	streams  int64
+	bytes    int64
+	failures int64
+}
+
+func main() {
+	flag.Parse()
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		serve(l)
+		return
+	}
+	target := *addr
+	if target == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go serve(l)
+		target = l.Addr().String()
+	}
+	c, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	m := npsmux.NewMux(c, "tcp", 0)
+	var cnt counters
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	switch *pattern {
+	case "short":
+		start(&wg, *workers, func() { short(m, &cnt) }, stop)
+	case "bulk":
+		start(&wg, *workers, func() { bulk(m, &cnt) }, stop)
+	case "burst":
+		start(&wg, 1, func() { burst(m, &cnt) }, stop)
+	case "mixed":
+		start(&wg, *workers, func() { short(m, &cnt) }, stop)
+		start(&wg, 2, func() { bulk(m, &cnt) }, stop)
+		start(&wg, 1, func() { burst(m, &cnt) }, stop)
+	default:
+		log.Fatalln("unknown pattern", *pattern)
+	}
+	begin := time.Now()
+	base := run(&cnt, stop)
+	wg.Wait()
+	_ = m.Close()
+	fmt.Print("done, ")
+	report(time.Since(begin), &cnt, base)
+	if atomic.LoadInt64(&cnt.failures) > 0 {
+		os.Exit(1)
+	}
+}
+
+// serve echoes the streams of the muxes connected
+func serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			m := npsmux.NewMuxWithConfig(c, "tcp", &npsmux.MuxConfig{Server: true})
+			for {
+				conn, err := m.AcceptConn()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(conn, conn)
+					_ = conn.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// start runs n workers calling f until stopped
+func start(wg *sync.WaitGroup, n int, f func(), stop chan struct{}) {
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f()
+			}
+		}()
+	}
+}
+
+// run reports every interval until the duration passed, returns the first report
+func run(cnt *counters, stop chan struct{}) (base *runtime.MemStats) {
+	begin := time.Now()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for time.Since(begin) < *duration {
+		<-ticker.C
+		ms := report(time.Since(begin), cnt, base)
+		if base == nil {
+			base = ms // the growth is measured from the first report, after warmed up
+		}
+	}
+	close(stop)
+	return
+}
+
+func report(elapsed time.Duration, cnt *counters, base *runtime.MemStats) *runtime.MemStats {
+	ms := new(runtime.MemStats)
+	runtime.GC()
+	runtime.ReadMemStats(ms)
+	res := npsmux.CurrentResources()
+	fmt.Printf("%v streams %d, bytes %d, failures %d, heap %d KB, sys %d KB, goroutines %d, mux goroutines %d, buffers %d, packagers %d",
+		elapsed.Round(time.Second), atomic.LoadInt64(&cnt.streams), atomic.LoadInt64(&cnt.bytes),
+		atomic.LoadInt64(&cnt.failures), ms.HeapAlloc>>10, ms.Sys>>10, runtime.NumGoroutine(),
+		res.Goroutines, res.Buffers, res.Packagers)
+	if base != nil {
+		fmt.Printf(", heap growth %d KB", int64(ms.HeapAlloc>>10)-int64(base.HeapAlloc>>10))
+	}
+	fmt.Println()
+	return ms
+}
+
+// transfer sends n random bytes through a new stream, and checks the
+// checksum of the data echoed
+func transfer(m *npsmux.Mux, cnt *counters, n int) {
+	conn, err := m.NewConn()
+	if err != nil {
+		atomic.AddInt64(&cnt.failures, 1)
+		log.Println("open:", err)
+		time.Sleep(time.Second)
+		return
+	}
+	defer conn.Close()
+	sum := make(chan uint32, 1)
+	go func() {
+		h := crc32.NewIEEE()
+		buf := make([]byte, 32*1024)
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for left := n; left > 0; {
+			p := buf
+			if left < len(p) {
+				p = p[:left]
+			}
+			r.Read(p)
+			h.Write(p)
+			if _, err := conn.Write(p); err != nil {
+				break
+			}
+			left -= len(p)
+		}
+		sum <- h.Sum32()
+	}()
+	h := crc32.NewIEEE()
+	got, err := io.CopyN(h, conn, int64(n))
+	want := <-sum
+	if err != nil || h.Sum32() != want {
+		atomic.AddInt64(&cnt.failures, 1)
+		log.Println("integrity check failed, bytes echoed", got, "of", n, err)
+		return
+	}
+	atomic.AddInt64(&cnt.streams, 1)
+	atomic.AddInt64(&cnt.bytes, int64(n))
+}
+
+func short(m *npsmux.Mux, cnt *counters) {
+	transfer(m, cnt, 1+rand.Intn(16*1024))
+}
+
+func bulk(m *npsmux.Mux, cnt *counters) {
+	transfer(m, cnt, *bulkSize)
+}
+
+func burst(m *npsmux.Mux, cnt *counters) {
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transfer(m, cnt, 1+rand.Intn(4096))
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Second)
+}
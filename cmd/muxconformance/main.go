@@ -0,0 +1,76 @@
+// Command muxconformance tests the implementations of the mux protocol.
+//
+// with -dial, it runs the conformance checks against the server at the
+// address, the server must accept the streams and echo their data back:
+//
+//	muxconformance -dial 127.0.0.1:8024
+//
+// with -listen, it serves the reference echo server, for testing the clients:
+//
+//	muxconformance -listen :8024
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"ehang.io/nps-mux"
+	"ehang.io/nps-mux/protocol"
+)
+
+func main() {
+	dial := flag.String("dial", "", "run the checks against the server at the address")
+	listen := flag.String("listen", "", "serve the reference echo server at the address")
+	flag.Parse()
+	switch {
+	case *dial != "":
+		c, err := net.Dial("tcp", *dial)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = protocol.Run(c, func(name string, err error) {
+			if err != nil {
+				fmt.Printf("FAIL %s: %v\n", name, err)
+			} else {
+				fmt.Printf("ok   %s\n", name)
+			}
+		})
+		_ = c.Close()
+		if err != nil {
+			os.Exit(1)
+		}
+	case *listen != "":
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				log.Fatalln(err)
+			}
+			go serve(npsmux.NewMuxWithConfig(c, "tcp", &npsmux.MuxConfig{Server: true}))
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// serve echoes the streams opened by the client
+func serve(m *npsmux.Mux) {
+	for {
+		c, err := m.AcceptConn()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(c, c)
+			_ = c.Close()
+		}()
+	}
+}
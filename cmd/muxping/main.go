@@ -0,0 +1,180 @@
+// Command muxping measures a mux endpoint, as iperf for the mux layer.
+//
+// it dials the endpoint, pings it, opens the streams and sends the data
+// through them, the endpoint must echo the streams back, as served by
+//
+//	muxping -listen :8024
+//
+// then at the other side:
+//
+//	muxping -addr 10.0.0.1:8024 -n 8 -size 4194304
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"ehang.io/nps-mux"
+	"github.com/xtaci/kcp-go"
+)
+
+var (
+	addr    = flag.String("addr", "", "the endpoint to measure")
+	listen  = flag.String("listen", "", "serve the echo endpoint at the address")
+	network = flag.String("type", "tcp", "the transport, tcp or kcp")
+	streams = flag.Int("n", 4, "the streams opened at the same time")
+	size    = flag.Int("size", 1<<20, "the bytes sent through every stream")
+	pings   = flag.Int("c", 10, "the pings sent")
+)
+
+func main() {
+	flag.Parse()
+	switch {
+	case *listen != "":
+		serve()
+	case *addr != "":
+		if err := measure(); err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func serve() {
+	var l net.Listener
+	var err error
+	if *network == "kcp" {
+		l, err = kcp.ListenWithOptions(*listen, nil, 0, 0)
+	} else {
+		l, err = net.Listen("tcp", *listen)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			m := npsmux.NewMuxWithConfig(c, *network, &npsmux.MuxConfig{Server: true})
+			for {
+				conn, err := m.AcceptConn()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(conn, conn)
+					_ = conn.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func measure() error {
+	var c net.Conn
+	var err error
+	if *network == "kcp" {
+		c, err = kcp.DialWithOptions(*addr, nil, 0, 0)
+	} else {
+		c, err = net.Dial("tcp", *addr)
+	}
+	if err != nil {
+		return err
+	}
+	m := npsmux.NewMux(c, *network, 0)
+	defer m.Close()
+
+	rtts := make([]time.Duration, 0, *pings)
+	for i := 0; i < *pings; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		start := time.Now()
+		err = m.HealthCheck(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("ping lost:", err)
+			continue
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	report("rtt", rtts)
+
+	opens := make([]time.Duration, *streams)
+	errs := make([]error, *streams)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opened := time.Now()
+			conn, err := m.NewConn()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			opens[i] = time.Since(opened)
+			errs[i] = echo(conn, i)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("stream %d: %v", i, err)
+		}
+	}
+	report("open", opens)
+	total := float64(*streams) * float64(*size)
+	fmt.Printf("throughput: %.2f MB/s each way, %d streams of %d bytes in %v\n",
+		total/elapsed.Seconds()/1e6, *streams, *size, elapsed.Round(time.Millisecond))
+	l := m.Latency()
+	fmt.Printf("mux latency: min %v, smoothed %v, variance %v, loss adjusted %v\n",
+		l.Min, l.Smoothed, l.Variance, l.Adjusted())
+	return nil
+}
+
+// echo sends the data through the stream, and checks it echoed back
+func echo(conn *npsmux.Conn, i int) error {
+	defer conn.Close()
+	data := bytes.Repeat([]byte{byte(i)}, *size)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errCh <- err
+	}()
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, data) {
+		return fmt.Errorf("data echoed differs")
+	}
+	return <-errCh
+}
+
+func report(name string, ds []time.Duration) {
+	if len(ds) == 0 {
+		fmt.Println(name + ": no sample")
+		return
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	fmt.Printf("%s: min %v, avg %v, max %v, %d samples\n",
+		name, ds[0], sum/time.Duration(len(ds)), ds[len(ds)-1], len(ds))
+}
@@ -0,0 +1,311 @@
+package npsmux
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	defaultMaxQueueDelay       = time.Millisecond * 100
+	defaultWriteQueueHighWater = 64
+	defaultMaxTenants          = 1024
+)
+
+// Action tells the mux what to do when something goes wrong
+type Action int
+
+const (
+	// ActionClose closes the mux, it is the default action
+	ActionClose Action = iota
+	// ActionIgnore keeps the mux working, as nothing happened
+	ActionIgnore
+	// ActionMigrate keeps the mux open, but stops the checking,
+	// the application moves the streams to another transport and closes the mux itself
+	ActionMigrate
+)
+
+// MuxConfig is the optional settings of a mux, the zero value is the default
+type MuxConfig struct {
+	// Server makes the mux allocate even stream ids, the client allocates odd ones.
+	// the peers of the protocol revision 13 negotiate the ids apart anyway, it is
+	// needed on one side with the older peers, if both sides open streams
+	Server bool
+
+	// PingCheckThreshold is the count of ping intervals without anything received,
+	// the ping times out after it, zero means the one of the profile. PingTimeout
+	// overrides it
+	PingCheckThreshold int
+
+	// PingInterval is the time between the pings, zero means 5s
+	PingInterval time.Duration
+
+	// PingTimeout is the longest time nothing received from the peer, neither the
+	// ping return nor any other frame, the ping times out after it. the time is
+	// measured by the monotonic clock. zero means PingCheckThreshold times of
+	// PingInterval
+	PingTimeout time.Duration
+
+	// OnPingTimeout is invoked when the ping times out, the mux is
+	// closed if it is nil or returns ActionClose
+	OnPingTimeout func(*Mux) Action
+
+	// StreamKeepAlive is the idle time of a stream before the keep alive probe sent,
+	// the stream is closed if the probe not answered in the same time, zero means disabled.
+	// it can be changed per stream by Conn.SetKeepAlive
+	StreamKeepAlive time.Duration
+
+	// PeerReadTimeout closes the stream if the data sent is pending, but not read by
+	// the peer app in the time, though the peer mux answers the probes, as the peer
+	// app hung. a slow or paused reader is closed too, zero means disabled
+	PeerReadTimeout time.Duration
+
+	// MaxSessionLifetime is the longest time the mux works, after it the mux
+	// sends GoAway, no more new streams, and closes when all the streams closed.
+	// zero means no limit
+	MaxSessionLifetime time.Duration
+
+	// OnGoAway is invoked when this side or the other side sends GoAway,
+	// the owner should establish a fresh mux for the new streams
+	OnGoAway func(*Mux)
+
+	// OnProtocolError is invoked when a malformed frame received, the mux is closed
+	// if it is nil or returns ActionClose. ActionIgnore skips the frame by the length
+	// in its header, it only works on the reliable transports framing well
+	OnProtocolError func(*Mux, *ProtocolError) Action
+
+	// WindowWatchdogRtts enables the window deadlock watchdog, a stream is reported
+	// if its writer waits for the window update longer than the count of rtt,
+	// while the stream is not closing. zero means disabled
+	WindowWatchdogRtts int
+
+	// WindowWatchdogReset closes the streams reported by the window deadlock watchdog
+	WindowWatchdogReset bool
+
+	// MaxQueueDelay is the longest time the frames of a priority class wait in the write queue
+	// while the higher classes keep sending, zero means 100ms, negative disables it
+	MaxQueueDelay time.Duration
+
+	// OnQuotaExceeded is invoked when the quota used up, the conn is nil
+	// if it is the quota of the mux. the stream or the mux is closed then
+	OnQuotaExceeded func(*Mux, *Conn)
+
+	// MaxTenants limits the tenants without the limits set, the streams of the new
+	// tenants beyond it are accounted to the tenant of the empty name, so the peer
+	// can not grow the tenants without a bound. zero means 1024
+	MaxTenants int
+
+	// NewConnRate limits the streams opened by the other side per second, the streams
+	// beyond the rate are refused. zero means no limit
+	NewConnRate float64
+
+	// NewConnBurst is the count of the streams can be opened at once beyond NewConnRate,
+	// zero means the same as the rate
+	NewConnBurst int
+
+	// CompactHeader sends the frames with the compact header, if the other side supports,
+	// it cuts the header of the small frames from 7 bytes to 3 bytes
+	CompactHeader bool
+
+	// Padding sends random padding frames and delays the bursts of the frames randomly by the profile,
+	// it makes the traffic harder to be fingerprinted, nil means disabled
+	Padding *PaddingProfile
+
+	// WireTransform scrambles the bytes on the wire, nil means no transform,
+	// the mux can not be exported with it
+	WireTransform WireTransform
+
+	// Handoff records the frame being read, it is needed by Export
+	Handoff bool
+
+	// SlowConsumerTimeout is the longest time the receive window of a stream keeps full,
+	// as the application not reading, zero means no limit. it can be changed per stream
+	// by Conn.SetSlowConsumerTimeout
+	SlowConsumerTimeout time.Duration
+
+	// OnSlowConsumer is invoked when a stream exceeded the slow consumer timeout,
+	// the stream is reset if it is nil or returns ActionClose, ActionIgnore waits for
+	// another timeout
+	OnSlowConsumer func(*Conn) Action
+
+	// OnWriteQueueDrained is invoked in a new goroutine, when the write queue becomes empty,
+	// after its length reached WriteQueueHighWater. the application can stop reading
+	// the upstream when the mux congested, and continue after drained
+	OnWriteQueueDrained func(*Mux)
+
+	// WriteQueueHighWater is the length of the write queue as congested, zero means 64
+	WriteQueueHighWater int
+
+	// Pacing spreads the data frames at 1.25 times of the rate the peer acknowledged,
+	// instead of filling the socket buffer at once, it reduces the latency of the
+	// interactive streams sharing the mux with bulk transfers
+	Pacing bool
+
+	// CongestionThreshold is the bytes received but not read by all the streams,
+	// the peer is notified to slow down beyond it, zero means never notify.
+	// the peer slows down with Pacing enabled
+	CongestionThreshold int
+
+	// MaxIdleTime closes the mux, after it has no stream and no payload for the time,
+	// zero means never. OnIdleClose is invoked before closed
+	MaxIdleTime time.Duration
+	OnIdleClose func(*Mux)
+
+	// RetryAfter is sent with the refusals of the streams for the overload, as
+	// beyond NewConnRate, the tenant limits or not accepted in AcceptTimeout, the
+	// opener waits for it before opening again, NewConnRetry does. zero means no hint
+	RetryAfter time.Duration
+
+	// AcceptTimeout is the longest time a stream opened by the peer waits for AcceptConn,
+	// the peer is refused after it, zero means waiting forever
+	AcceptTimeout time.Duration
+
+	// MaxPendingOpens limits the NewConn waiting for the reply of the peer, the others
+	// wait for them, or fail at once if PendingOpensFailFast set. zero means no limit
+	MaxPendingOpens      int
+	PendingOpensFailFast bool
+
+	// Tracer creates a span for every stream, nil means no tracing
+	Tracer Tracer
+
+	// AcceptWindow returns the initial receive window of the stream opened by the peer,
+	// before it accepted, as OpenOptions.ReceiveWindow, zero means the default
+	AcceptWindow func(c *Conn) int
+
+	// NewScheduler creates the scheduler of the write queue for every mux, nil means
+	// the priority classes built in, see NewDefaultScheduler. MaxQueueDelay is not
+	// used by the others
+	NewScheduler func() Scheduler
+
+	// Profile is the tuning of the transport, nil means ProfileKCPNormal
+	// for kcp, ProfileTCPWAN for others
+	Profile *TransportProfile
+
+	// TCP tunes the tcp transport, nil keeps the transport as is
+	TCP *TCPConfig
+
+	// ARQ runs the mux over an unreliable datagram transport, as a udp socket, with
+	// the retransmission of the segments lost, nil means the transport is reliable
+	ARQ *ARQConfig
+
+	// MTUDiscovery probes the largest datagram the path carries in the ARQ mode,
+	// and limits the segments to it, ARQ.SegmentSize at most, the segments
+	// fragmented on the path are lost much more often, both sides need it. over
+	// kcp, the connType "kcp", it limits the data frames sent to the largest the
+	// probes pass in time, see mtu.go. it is ignored over the other transports
+	MTUDiscovery bool
+
+	// Integrity checks the data of the streams by the checksums, the Read returns
+	// ErrIntegrity if the data corrupted, both sides need it
+	Integrity bool
+
+	// Sequenced sends the data of the streams with the offsets, the peer delivers
+	// the frames arriving out of order in order and drops the frames received twice,
+	// as the frames moved to another class by SetPriority, or sent over the links
+	// of a bonding. it costs 8 bytes per data frame, sent only if the peer understands
+	Sequenced bool
+
+	// ProtocolRevision limits the protocol to the revision, for the rolling upgrades,
+	// the new versions speak as the old fleet until all of them upgraded. zero
+	// means LatestProtocolRevision
+	ProtocolRevision int
+
+	// Hints tells the mux more about the transport, as tls, nil means nothing known
+	Hints *TransportHints
+
+	// RequireEncryption forbids the plaintext transports, the mux over a transport
+	// neither tls nor told encrypted by Hints is refused before any session started,
+	// NewMuxChecked returns ErrPlaintext, the mux of NewMuxWithConfig is closed and
+	// Err returns it. set Hints.Encrypted to override it for the transports encrypted otherwise
+	RequireEncryption bool
+
+	// OnPanic is invoked with the value and the stack, when a goroutine of the mux,
+	// as the read session, the write session or the ping panics, the mux is closed
+	// then, so a malformed frame only breaks its session. nil means panic again
+	OnPanic func(v interface{}, stack []byte)
+
+	// OnTransportClose is invoked instead of closing the transport when the mux closed,
+	// for the transports shared with others, as a channel of ssh or quic, which must
+	// not be closed with the mux. it is invoked after the read and the write session
+	// exited, they are woken up by the deadline. nil means closing the transport
+	OnTransportClose func(conn net.Conn) error
+
+	// Logger receives the logs of the mux, nil means the log package
+	Logger Logger
+
+	// LogLevel is the lowest level logged, the normal closes are LogDebug,
+	// zero means LogInfo
+	LogLevel LogLevel
+
+	// SlowLog logs the frame writes, the opens and the Reads slower than the
+	// thresholds, nil logs none of them
+	SlowLog *SlowLogConfig
+
+	// Clock is the source of time, nil means the system time
+	Clock Clock
+
+	sim simScheduler // the simulation tests only
+}
+
+func (s *MuxConfig) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return systemClock{}
+}
+
+func (s *MuxConfig) profile(connType string) *TransportProfile {
+	if s.Profile != nil {
+		return s.Profile
+	}
+	return defaultProfile(connType)
+}
+
+func (s *MuxConfig) pingCheckThreshold(connType string) uint32 {
+	if s.PingCheckThreshold > 0 {
+		return uint32(s.PingCheckThreshold)
+	}
+	if n := s.profile(connType).PingCheckThreshold; n > 0 {
+		return uint32(n)
+	}
+	return 60
+}
+
+const defaultPingInterval = time.Second * 5
+
+func (s *MuxConfig) pingInterval() time.Duration {
+	if s.PingInterval > 0 {
+		return s.PingInterval
+	}
+	return defaultPingInterval
+}
+
+func (s *MuxConfig) pingTimeout(connType string) time.Duration {
+	if s.PingTimeout > 0 {
+		return s.PingTimeout
+	}
+	return s.pingInterval() * time.Duration(s.pingCheckThreshold(connType))
+}
+
+func (s *MuxConfig) writeQueueHighWater() int {
+	if s.WriteQueueHighWater > 0 {
+		return s.WriteQueueHighWater
+	}
+	return defaultWriteQueueHighWater
+}
+
+func (s *MuxConfig) maxTenants() int {
+	if s.MaxTenants > 0 {
+		return s.MaxTenants
+	}
+	return defaultMaxTenants
+}
+
+func (s *MuxConfig) maxQueueDelay() time.Duration {
+	if s.MaxQueueDelay == 0 {
+		return defaultMaxQueueDelay
+	}
+	if s.MaxQueueDelay < 0 {
+		return 0
+	}
+	return s.MaxQueueDelay
+}
@@ -0,0 +1,92 @@
+package npsmux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// closeConfirms are the CloseAndConfirm waiting for the answer of the peer
+type closeConfirms struct {
+	waiters map[int32]chan int64
+	sync.Mutex
+}
+
+func (Self *closeConfirms) add(id int32) (ch chan int64) {
+	ch = make(chan int64, 1)
+	Self.Lock()
+	if Self.waiters == nil {
+		Self.waiters = make(map[int32]chan int64)
+	}
+	Self.waiters[id] = ch
+	Self.Unlock()
+	return
+}
+
+func (Self *closeConfirms) remove(id int32) {
+	Self.Lock()
+	delete(Self.waiters, id)
+	Self.Unlock()
+}
+
+// done passes the bytes received by the peer to the waiting CloseAndConfirm
+func (Self *closeConfirms) done(id int32, content []byte) {
+	if len(content) < 8 {
+		return
+	}
+	Self.Lock()
+	ch, ok := Self.waiters[id]
+	delete(Self.waiters, id)
+	Self.Unlock()
+	if ok {
+		ch <- int64(binary.LittleEndian.Uint64(content))
+	}
+}
+
+// confirmClose answers muxConnCloseConfirm with the bytes received by the stream,
+// -1 if the stream is already gone. the bytes are counted by the offset of the
+// stream, not by the traffic, which ResetTraffic may reset
+func (s *Mux) confirmClose(id int32) {
+	received := int64(-1)
+	if c, ok := s.connMap.Get(id); ok {
+		received = int64(c.seqNext) // in the read session
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(received))
+	s.sendInfo(muxConnCloseAck, id, b[:])
+}
+
+// CloseAndConfirm closes the stream, and waits for the peer tells the bytes it received,
+// err is nil only if all the bytes written are received by the peer
+func (s *Conn) CloseAndConfirm(ctx context.Context) (delivered int64, err error) {
+	mux := s.receiveWindow.mux
+	if atomic.LoadUint32(&mux.peerFeatures)&featureCloseConfirm == 0 {
+		_ = s.Close()
+		return 0, errors.New("mux: close confirm is not supported by the peer")
+	}
+	if s.closed() {
+		return 0, ErrStreamClosed
+	}
+	ch := mux.closeConfirms.add(s.connId)
+	defer mux.closeConfirms.remove(s.connId)
+	atomic.StoreUint32(&s.confirm, 1)
+	_ = s.Close()
+	sent := int64(atomic.LoadUint64(&s.sendWindow.seqOffset))
+	select {
+	case delivered = <-ch:
+	case <-mux.closeChan:
+		return 0, ErrMuxClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if delivered < 0 {
+		return 0, fmt.Errorf("mux: closed by the peer before confirmed: %w", ErrStreamClosed)
+	}
+	if delivered < sent {
+		return delivered, errors.New("mux: part of the data not delivered")
+	}
+	return delivered, nil
+}
@@ -0,0 +1,43 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	congestionCheckInterval = time.Millisecond * 100
+	congestionBackOff       = 0.5 // the pacing rate is cut by half per notification
+)
+
+// checkCongestion is invoked by the read session after a data frame handled,
+// if the streams buffered too much, notifies the peer, at most once per interval
+func (s *Mux) checkCongestion() {
+	if s.config.CongestionThreshold <= 0 ||
+		atomic.LoadUint32(&s.peerFeatures)&featureCongestion == 0 {
+		return
+	}
+	now := s.clock.Now().UnixNano()
+	if now-s.congestCheck < int64(congestionCheckInterval) {
+		return
+	}
+	s.congestCheck = now
+	var buffered int
+	s.connMap.Range(func(id int32, c *Conn) bool {
+		buffered += int(c.receiveWindow.bufQueue.Len())
+		return true
+	})
+	if buffered > s.config.CongestionThreshold {
+		s.sendInfo(muxCongestion, 0, nil)
+	}
+}
+
+// congestionNotified slows down the pacing, the receiver falls behind
+func (s *Mux) congestionNotified() {
+	n := atomic.AddUint64(&s.congestion, 1)
+	if s.pacer == nil {
+		return
+	}
+	s.logln(LogDebug, "congestion notified by the peer, total:", n)
+	s.ackedBw.scale(congestionBackOff)
+}
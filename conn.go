@@ -1,9 +1,9 @@
-package nps_mux
+package npsmux
 
 import (
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"math"
 	"net"
 	"runtime"
@@ -12,22 +12,64 @@ import (
 	"time"
 )
 
-type conn struct {
+// Conn is a stream connection transferred through the mux,
+// it implements net.Conn, returned by Mux.NewConn and Mux.AcceptConn
+type Conn struct {
+	lastActive  int64 // unix nano, accessed atomically, keep 64bit alignment
+	probeSent   int64 // unix nano the keep alive probe sent, zero means not sent
+	keepAlive   int64 // keep alive idle time, zero means disabled
+	peerRead    int64 // unix nano the peer app last read the data sent, or nothing pending
+	readProbe   int64 // unix nano the probe for the read progress sent, zero means not sent
+	slowTimeout int64 // slow consumer timeout, zero means the mux default, negative disabled
+	fullSince   int64 // unix nano the receive window became full, zero means not full
+	traffic     trafficCounter
+	quota       int64 // the payload bytes limit, zero means no limit
+	stats       streamStats
 	net.Conn
 	connStatusOkCh   chan struct{}
 	connStatusFailCh chan struct{}
 	connId           int32
-	isClose          bool
-	closingFlag      bool // closing conn flag
+	openState        uint32 // accessed atomically, see connOpened
+	collided         uint32 // the peer opened the same id at the same time, accessed atomically
+	quotaHit         uint32
+	draining         uint32 // accessed atomically, set by Drain
+	writing          int32  // the writes in progress, accessed atomically
+	confirm          uint32 // accessed atomically, set by CloseAndConfirm
+	isClose          uint32 // accessed atomically, see closed
+	closingFlag      uint32 // closing conn flag, accessed atomically
+	writeClosed      uint32 // accessed atomically, set by CloseWrite
 	receiveWindow    *receiveWindow
 	sendWindow       *sendWindow
 	once             sync.Once
+	tags             map[string]interface{}
+	tagLock          sync.RWMutex
+	span             StreamSpan // nil if no tracer
+	sent             streamSum  // owned by the write session
+	received         streamSum  // owned by the read session
+	integrityErr     atomic.Value
+	tenant           *tenant // nil if the stream has no tenant
+	tenantLeft       uint32
+	group            atomic.Value      // *StreamGroup, nil if not in any group
+	initWindow       uint32            // the initial receive window told to the opener, zero means the default
+	retryAfter       uint32            // the milliseconds the peer asked to wait by the refusal, accessed atomically
+	seqNext          uint64            // the stream bytes delivered, owned by the read session
+	seqHeld          map[uint64][]byte // the sequenced data arrived early by the offset, owned by the read session
+	openCanceled     chan struct{}     // closed by the muxConnOpenCancel of the opener, nil for the streams opened here
+	openCtx          *OpenContext      // attached by the opener, nil if none
 }
 
-func NewConn(connId int32, mux *Mux) *conn {
-	c := &conn{
-		connStatusOkCh:   make(chan struct{}),
-		connStatusFailCh: make(chan struct{}),
+// open states of the connection, only the connection opened by NewConn
+// goes through opening, the read session and NewConn race to leave it
+const (
+	connOpened    uint32 = iota // the connection is usable
+	connOpening                 // NewConn is waiting for the reply
+	connAbandoned               // NewConn gave up waiting, the reply is too late
+)
+
+func newConn(connId int32, mux *Mux) *Conn {
+	c := &Conn{
+		connStatusOkCh:   make(chan struct{}, 1),
+		connStatusFailCh: make(chan struct{}, 1),
 		connId:           connId,
 		receiveWindow:    new(receiveWindow),
 		sendWindow:       new(sendWindow),
@@ -35,73 +77,227 @@ func NewConn(connId int32, mux *Mux) *conn {
 	}
 	c.receiveWindow.New(mux)
 	c.sendWindow.New(mux)
+	c.sendWindow.id = connId
+	c.sendWindow.conn = c
+	c.stats.init(mux.clock)
+	c.lastActive = mux.clock.Now().UnixNano()
+	c.peerRead = c.lastActive
+	c.keepAlive = int64(mux.config.StreamKeepAlive)
+	if mux.config.Tracer != nil {
+		c.span = mux.config.Tracer.StartStream(c)
+	}
 	return c
 }
 
-func (s *conn) Read(buf []byte) (n int, err error) {
-	if s.isClose || buf == nil {
-		return 0, errors.New("the conn has closed")
+// ID returns the connection id, unique in the mux
+func (s *Conn) ID() int32 {
+	return s.connId
+}
+
+// SetTag attaches a user value to the connection, such as routing metadata,
+// it can be retrieved by Tag, Set a nil value removes the key
+func (s *Conn) SetTag(key string, v interface{}) {
+	s.tagLock.Lock()
+	if v == nil {
+		delete(s.tags, key)
+	} else {
+		if s.tags == nil {
+			s.tags = make(map[string]interface{})
+		}
+		s.tags[key] = v
+	}
+	s.tagLock.Unlock()
+}
+
+// Tag returns the user value attached by SetTag, or nil if not exist
+func (s *Conn) Tag(key string) (v interface{}) {
+	s.tagLock.RLock()
+	v = s.tags[key]
+	s.tagLock.RUnlock()
+	return
+}
+
+func (s *Conn) Read(buf []byte) (n int, err error) {
+	defer func() {
+		err = s.withCause(err)
+	}()
+	if err = s.integrityError(); err != nil {
+		return
+	}
+	if err = s.checkQuota(); err != nil {
+		return
+	}
+	if s.closed() || buf == nil {
+		return 0, ErrStreamClosed
 	}
 	if len(buf) == 0 {
 		return 0, nil
 	}
 	// waiting for takeout from receive window finish or timeout
 	n, err = s.receiveWindow.Read(buf, s.connId)
+	if err != nil {
+		if e := s.integrityError(); e != nil {
+			err = e // closed for the corruption
+		}
+	}
 	return
 }
 
-func (s *conn) Write(buf []byte) (n int, err error) {
-	if s.isClose {
-		return 0, errors.New("the conn has closed")
-	}
-	if s.closingFlag {
-		return 0, errors.New("io: write on closed conn")
+func (s *Conn) Write(buf []byte) (n int, err error) {
+	defer func() {
+		err = s.withCause(err)
+	}()
+	if err = s.writable(); err != nil || len(buf) == 0 {
+		return
 	}
-	if len(buf) == 0 {
-		return 0, nil
+	atomic.AddInt32(&s.writing, 1)
+	defer atomic.AddInt32(&s.writing, -1)
+	if atomic.LoadUint32(&s.draining) != 0 {
+		return 0, errors.New("mux: write on draining conn")
 	}
 	n, err = s.sendWindow.WriteFull(buf, s.connId)
 	return
 }
 
-func (s *conn) Close() (err error) {
+// writable checks the stream can be written, before the write
+func (s *Conn) writable() error {
+	if err := s.checkQuota(); err != nil {
+		return err
+	}
+	if s.closed() {
+		return ErrStreamClosed
+	}
+	if s.closing() {
+		return fmt.Errorf("mux: write on the stream closed by the peer: %w", ErrStreamClosed)
+	}
+	if atomic.LoadUint32(&s.writeClosed) != 0 {
+		return fmt.Errorf("mux: write after CloseWrite: %w", ErrStreamClosed)
+	}
+	return nil
+}
+
+// Pause tells the peer the receive window is zero, the peer stops writing
+// after the data in flight, until Resume, for the backpressure of the stream,
+// as pausing the producer of the peer while the consumer is busy, instead of
+// buffering the data. Read still returns the data received
+func (s *Conn) Pause() {
+	if s.closed() || !atomic.CompareAndSwapUint32(&s.receiveWindow.paused, 0, 1) {
+		return
+	}
+	s.receiveWindow.tell(s.connId, s.receiveWindow.ackPriority(), 0, 0)
+}
+
+// Resume tells the peer the receive window again, after Pause
+func (s *Conn) Resume() {
+	if s.closed() || !atomic.CompareAndSwapUint32(&s.receiveWindow.paused, 1, 0) {
+		return
+	}
+	s.receiveWindow.resendStatus(s.connId)
+}
+
+// Paused reports whether the stream is paused by Pause
+func (s *Conn) Paused() bool {
+	return atomic.LoadUint32(&s.receiveWindow.paused) != 0
+}
+
+// Readable returns the channel signaled when the data received, or the stream
+// closed, so the Read does not block, for the event loops selecting on many streams
+// instead of a goroutine blocked per stream. the signals are merged, read until
+// Buffered is zero before waiting for it again
+func (s *Conn) Readable() <-chan struct{} {
+	return s.receiveWindow.readable
+}
+
+// Buffered returns the bytes received but not read yet
+func (s *Conn) Buffered() int {
+	return int(s.receiveWindow.bufQueue.Len())
+}
+
+// AvailableWriteBuffer returns the bytes can be written now without blocking,
+// the send window the peer allows, but not used yet
+func (s *Conn) AvailableWriteBuffer() int {
+	return int(s.sendWindow.available())
+}
+
+// TryWrite is Write, but never blocks, on the window nor on the mux paused,
+// it writes all of buf, or nothing and returns ErrWouldBlock, the caller may
+// drop or downsample then. it is not safe for concurrent use with Write, as Write
+func (s *Conn) TryWrite(buf []byte) (n int, err error) {
+	defer func() {
+		err = s.withCause(err)
+	}()
+	if err = s.writable(); err != nil || len(buf) == 0 {
+		return
+	}
+	atomic.AddInt32(&s.writing, 1)
+	defer atomic.AddInt32(&s.writing, -1)
+	if atomic.LoadUint32(&s.draining) != 0 {
+		return 0, errors.New("mux: write on draining conn")
+	}
+	return s.sendWindow.tryWriteFull(buf, s.connId)
+}
+
+func (s *Conn) Close() (err error) {
 	s.once.Do(s.closeProcess)
 	return
 }
 
-func (s *conn) closeProcess() {
-	s.isClose = true
+// closed reports whether the connection has been closed locally
+func (s *Conn) closed() bool {
+	return atomic.LoadUint32(&s.isClose) != 0
+}
+
+// closing reports whether the peer has closed the connection
+func (s *Conn) closing() bool {
+	return atomic.LoadUint32(&s.closingFlag) != 0
+}
+
+func (s *Conn) closeProcess() {
+	atomic.StoreUint32(&s.isClose, 1)
+	s.leaveTenant()
+	s.receiveWindow.mux.quarantine(s)
 	s.receiveWindow.mux.connMap.Delete(s.connId)
-	if !s.receiveWindow.mux.IsClose {
+	if !s.receiveWindow.mux.Closed() {
 		// if server or user close the conn while reading, will Get a io.EOF
 		// and this Close method will be invoke, send this signal to close other side
-		s.receiveWindow.mux.sendInfo(muxConnClose, s.connId, nil)
+		flag := muxConnClose
+		if atomic.LoadUint32(&s.confirm) != 0 {
+			flag = muxConnCloseConfirm
+		}
+		mux := s.receiveWindow.mux
+		if pack := mux.newPack(flag, s.connId, s.sendWindow.getPriority(), nil); pack != nil {
+			if mux.integrity() {
+				pack.conn = s // the checksum of the data left is sent before
+			}
+			mux.writeQueue.Push(pack)
+		}
 	}
 	s.sendWindow.CloseWindow()
 	s.receiveWindow.CloseWindow()
+	s.traceEnd()
 	return
 }
 
-func (s *conn) LocalAddr() net.Addr {
+func (s *Conn) LocalAddr() net.Addr {
 	return s.receiveWindow.mux.conn.LocalAddr()
 }
 
-func (s *conn) RemoteAddr() net.Addr {
+func (s *Conn) RemoteAddr() net.Addr {
 	return s.receiveWindow.mux.conn.RemoteAddr()
 }
 
-func (s *conn) SetDeadline(t time.Time) error {
+func (s *Conn) SetDeadline(t time.Time) error {
 	_ = s.SetReadDeadline(t)
 	_ = s.SetWriteDeadline(t)
 	return nil
 }
 
-func (s *conn) SetReadDeadline(t time.Time) error {
+func (s *Conn) SetReadDeadline(t time.Time) error {
 	s.receiveWindow.SetTimeOut(t)
 	return nil
 }
 
-func (s *conn) SetWriteDeadline(t time.Time) error {
+func (s *Conn) SetWriteDeadline(t time.Time) error {
 	s.sendWindow.SetTimeOut(t)
 	return nil
 }
@@ -114,7 +310,8 @@ type window struct {
 	// wait   maxSize  useless  done
 	// wait zero means false, one means true
 	off       uint32
-	closeOp   bool
+	priority  uint32 // the class of the frames, accessed atomically
+	closeOp   uint32 // accessed atomically, see closed
 	closeOpCh chan struct{}
 	mux       *Mux
 }
@@ -147,35 +344,108 @@ func (Self *window) pack(maxSize, done uint32, wait bool) uint64 {
 
 func (Self *window) New() {
 	Self.closeOpCh = make(chan struct{}, 2)
+	Self.priority = uint32(PriorityBulk)
 }
 
 func (Self *window) CloseWindow() {
-	if !Self.closeOp {
-		Self.closeOp = true
+	if atomic.CompareAndSwapUint32(&Self.closeOp, 0, 1) {
 		Self.closeOpCh <- struct{}{}
 		Self.closeOpCh <- struct{}{}
 	}
 }
 
+func (Self *window) closed() bool {
+	return atomic.LoadUint32(&Self.closeOp) != 0
+}
+
 type receiveWindow struct {
 	window
 	bufQueue *receiveWindowQueue
-	element  *listElement
-	count    int8
-	bw       *writeBandwidth
-	once     sync.Once
+	// the class of the stream data of the peer, accessed atomically
+	peerPriority  uint32
+	count         int8
+	bw            *writeBandwidth
+	once          sync.Once
+	readable      chan struct{} // see Conn.Readable
+	paused        uint32        // accessed atomically, see Conn.Pause
+	readSince     int64         // unix nano the Read began to wait, zero means not waiting, see slowlog.go
+	stallReported uint32        // the stall of the Read logged
+	updates       uint64        // the window updates sent, accessed atomically
+	told          uint32        // the window advertised by the last update, accessed atomically
+	peak          uint32        // the largest window the peer may fill, accessed atomically
+	stopped       uint32        // no more data pushed, accessed atomically, see Stop
 	// receive window send the current max size and read size to send window
 	// means done size actually store the size receive window has read
 }
 
 func (Self *receiveWindow) New(mux *Mux) {
 	// initial a window for receive
-	Self.bufQueue = newReceiveWindowQueue()
-	Self.element = listEle.Get()
+	Self.bufQueue = newReceiveWindowQueue(mux.clock)
 	Self.maxSizeDone = Self.pack(maximumSegmentSize*30, 0, false)
 	Self.mux = mux
 	Self.window.New()
-	Self.bw = newWriteBandwidth()
+	Self.peerPriority = uint32(PriorityBulk)
+	Self.bw = newWriteBandwidth(mux.clock)
+	Self.readable = make(chan struct{}, 1)
+}
+
+// setInitial sets the initial window before any data received,
+// zero keeps the default
+func (Self *window) setInitial(n uint32) {
+	if n > 0 {
+		atomic.StoreUint64(&Self.maxSizeDone, Self.pack(n, 0, false))
+	}
+}
+
+// clampWindow limits the window asked to the range the windows work in,
+// zero or below means the default, returns zero then
+func clampWindow(n int) uint32 {
+	switch {
+	case n <= 0:
+		return 0
+	case n < maximumSegmentSize:
+		return maximumSegmentSize
+	case n > maximumWindowSize:
+		return maximumWindowSize
+	}
+	return uint32(n)
+}
+
+// advertised returns the window told to the peer, zero while paused
+func (Self *receiveWindow) advertised(maxSize uint32) uint32 {
+	if atomic.LoadUint32(&Self.paused) != 0 {
+		return 0
+	}
+	return maxSize
+}
+
+// tell sends the window update of maxSize and the bytes read since the last
+// update, all the updates of the stream are sent by it, and counted
+func (Self *receiveWindow) tell(id int32, p Priority, maxSize, read uint32) {
+	maxSize = Self.advertised(maxSize)
+	Self.raisePeak(maxSize)
+	atomic.StoreUint32(&Self.told, maxSize)
+	atomic.AddUint64(&Self.updates, 1)
+	Self.mux.sendWindowUpdate(id, p, Self.pack(maxSize, read, false))
+}
+
+// raisePeak keeps the largest window the peer may have, the data beyond it
+// breaks the protocol, it is refused instead of buffered
+func (Self *receiveWindow) raisePeak(n uint32) {
+	for {
+		peak := atomic.LoadUint32(&Self.peak)
+		if n <= peak || atomic.CompareAndSwapUint32(&Self.peak, peak, n) {
+			return
+		}
+	}
+}
+
+// notifyReadable signals the Readable channel, the signals not taken are merged
+func (Self *receiveWindow) notifyReadable() {
+	select {
+	case Self.readable <- struct{}{}:
+	default:
+	}
 }
 
 func (Self *receiveWindow) remainingSize(maxSize uint32, delta uint16) (n uint32) {
@@ -191,7 +461,7 @@ func (Self *receiveWindow) remainingSize(maxSize uint32, delta uint16) (n uint32
 func (Self *receiveWindow) calcSize() {
 	// calculating maximum receive window size
 	if Self.count == 0 {
-		muxBw := Self.mux.bw.Get()
+		muxBw, _ := Self.mux.bw.Get()
 		connBw := Self.bw.Get()
 		latency := math.Float64frombits(atomic.LoadUint64(&Self.mux.latency))
 		var n uint32
@@ -211,6 +481,7 @@ func (Self *receiveWindow) calcSize() {
 			// network pipeline need fill more data that we can measure the max bandwidth
 			n = uint32(float64(maximumSegmentSize*3000) * latency)
 		}
+		n = Self.mux.profile.windowSize(n)
 		for {
 			ptrs := atomic.LoadUint64(&Self.maxSizeDone)
 			size, read, wait := Self.unpack(ptrs)
@@ -241,7 +512,7 @@ func (Self *receiveWindow) calcSize() {
 			if connBw > 0 && muxBw > 0 {
 				limit := uint32(maximumWindowSize * (connBw / (muxBw + connBw)))
 				if n > limit {
-					log.Println("window too large, calculated:", n, "limit:", limit, connBw, muxBw)
+					Self.mux.logln(LogDebug, "window too large, calculated:", n, "limit:", limit, connBw, muxBw)
 					n = limit
 				}
 			}
@@ -257,13 +528,20 @@ func (Self *receiveWindow) calcSize() {
 	return
 }
 
-func (Self *receiveWindow) Write(buf []byte, l uint16, part bool, id int32) (err error) {
-	if Self.closeOp {
+// Write copies the buf into the queue, the buf is put back to the pool
+func (Self *receiveWindow) Write(buf []byte, l uint16, id int32) (err error) {
+	defer windowBuff.Put(buf)
+	if Self.closed() {
 		return errors.New("conn.receiveWindow: write on closed window")
 	}
-	element, err := newListElement(buf, l, part)
-	if err != nil {
-		return
+	if uint16(len(buf)) != l {
+		return errors.New("conn.receiveWindow: buf length not match")
+	}
+	// the window before calculated, the initial one is assumed by the peer untold
+	initial, _, _ := Self.unpack(atomic.LoadUint64(&Self.maxSizeDone))
+	Self.raisePeak(initial)
+	if int64(Self.bufQueue.Len())+int64(l) > int64(atomic.LoadUint32(&Self.peak))+maximumSegmentSize {
+		return errors.New("conn.receiveWindow: data beyond the window")
 	}
 	Self.calcSize() // calculate the max window size
 	var wait bool
@@ -288,71 +566,52 @@ start:
 		}
 	} // maybe there are still some data received even if window is full, just keep the wait status
 	// and push into queue. when receive window read enough, send window will be acknowledged.
-	Self.bufQueue.Push(element)
-	// status check finish, now we can push the element into the queue
-	if !wait {
-		Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
-		// send the current status to send window
+	Self.bufQueue.Push(buf)
+	// status check finish, now we can push the data into the queue
+	Self.notifyReadable()
+	if !wait && (read > 0 || Self.advertised(maxSize) != atomic.LoadUint32(&Self.told)) {
+		Self.tell(id, Self.ackPriority(), maxSize, read)
+		// send the current status to send window, if anything new to tell
 	}
 	return nil
 }
 
 func (Self *receiveWindow) Read(p []byte, id int32) (n int, err error) {
-	if Self.closeOp {
+	if Self.closed() {
 		return 0, io.EOF // receive close signal, returns eof
 	}
 	Self.bw.StartRead()
+	done := Self.readStart()
 	n, err = Self.readFromQueue(p, id)
+	done()
 	Self.bw.SetCopySize(uint16(n))
 	return
 }
 
 func (Self *receiveWindow) readFromQueue(p []byte, id int32) (n int, err error) {
-	pOff := 0
-	l := 0
-copyData:
-	if Self.off == uint32(Self.element.L) {
-		// on the first Read method invoked, Self.off and Self.element.l
-		// both zero value
-		listEle.Put(Self.element)
-		if Self.closeOp {
-			return 0, io.EOF
-		}
-		Self.element, err = Self.bufQueue.Pop()
-		// if the queue is empty, Pop method will wait until one element push
-		// into the queue successful, or timeout.
-		// timer start on timeout parameter is set up
-		Self.off = 0
-		if err != nil {
-			Self.CloseWindow() // also close the window, to avoid read twice
-			return             // queue receive stop or time out, break the loop and return
-		}
+	if Self.closed() {
+		return 0, io.EOF
 	}
-	l = copy(p[pOff:], Self.element.Buf[Self.off:Self.element.L])
-	pOff += l
-	Self.off += uint32(l)
-	n += l
-	l = 0
-	if Self.off == uint32(Self.element.L) {
-		windowBuff.Put(Self.element.Buf)
-		Self.sendStatus(id, Self.element.L)
-		// check the window full status
-	}
-	if pOff < len(p) && Self.element.Part {
-		// element is a part of the segments, trying to fill up buf p
-		goto copyData
+	n, err = Self.bufQueue.Read(p)
+	// if the queue is empty, Read method will wait until some data pushed
+	// into the queue, or timeout.
+	if err != nil {
+		Self.CloseWindow() // also close the window, to avoid read twice
+		return             // queue receive stop or time out, break the loop and return
 	}
-	return // buf p is full or all of segments in buf, return
+	Self.sendStatus(id, uint32(n))
+	// check the window full status
+	return
 }
 
-func (Self *receiveWindow) sendStatus(id int32, l uint16) {
+func (Self *receiveWindow) sendStatus(id int32, l uint32) {
 	var maxSize, read uint32
 	var wait bool
 	for {
 		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
 		maxSize, read, wait = Self.unpack(ptrs)
-		if read <= (read+uint32(l))&mask31 {
-			read += uint32(l)
+		if read <= (read+l)&mask31 {
+			read += l
 			remain := Self.remainingSize(maxSize, 0)
 			if wait && remain > 0 || read >= maxSize/2 || remain == maxSize {
 				if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, 0, false)) {
@@ -360,7 +619,7 @@ func (Self *receiveWindow) sendStatus(id int32, l uint16) {
 					// receive window free up some space we need acknowledge send window, also reset the read size
 					// still having a condition that receive window is empty and not send the status to send window
 					// so send the status here
-					Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
+					Self.tell(id, Self.ackPriority(), maxSize, read)
 					break
 				}
 			} else {
@@ -372,9 +631,9 @@ func (Self *receiveWindow) sendStatus(id int32, l uint16) {
 			}
 		} else {
 			//overflow
-			if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, uint32(l), wait)) {
+			if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, l, wait)) {
 				// reset to l
-				Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
+				Self.tell(id, Self.ackPriority(), maxSize, read)
 				break
 			}
 		}
@@ -384,6 +643,20 @@ func (Self *receiveWindow) sendStatus(id int32, l uint16) {
 	return
 }
 
+// resendStatus sends the current window status to send window again,
+// the send window asks for it when no window update received for a long time
+func (Self *receiveWindow) resendStatus(id int32) {
+	for {
+		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
+		maxSize, read, wait := Self.unpack(ptrs)
+		if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, 0, wait)) {
+			// the read size will be sent, reset it
+			Self.tell(id, higherPriority(PriorityRetransmit, Self.ackPriority()), maxSize, read)
+			return
+		}
+	}
+}
+
 func (Self *receiveWindow) SetTimeOut(t time.Time) {
 	// waiting for FIFO queue Pop method
 	Self.bufQueue.SetTimeOut(t)
@@ -391,7 +664,9 @@ func (Self *receiveWindow) SetTimeOut(t time.Time) {
 
 func (Self *receiveWindow) Stop() {
 	// queue has no more data to push, so unblock pop method
+	atomic.StoreUint32(&Self.stopped, 1)
 	Self.once.Do(Self.bufQueue.Stop)
+	Self.notifyReadable() // Read returns the eof now
 }
 
 func (Self *receiveWindow) CloseWindow() {
@@ -401,29 +676,22 @@ func (Self *receiveWindow) CloseWindow() {
 }
 
 func (Self *receiveWindow) release() {
-	//if Self.element != nil {
-	//	if Self.element.Buf != nil {
-	//		common.WindowBuff.Put(Self.element.Buf)
-	//	}
-	//	common.ListElementPool.Put(Self.element)
-	//}
-	for {
-		ele := Self.bufQueue.TryPop()
-		if ele == nil {
-			return
-		}
-		if ele.Buf != nil {
-			windowBuff.Put(ele.Buf)
-		}
-		listEle.Put(ele)
-	} // release resource
+	Self.bufQueue.Reset() // release resource
 }
 
 type sendWindow struct {
+	waitSince  int64  // unix nano the writer began to wait, zero means not waiting
+	lastUpdate int64  // unix nano the last window update received
+	seqOffset  uint64 // the stream bytes sent, written by the writer atomically
+	// keep them before window, for 64bit alignment
 	window
 	buf       []byte
 	setSizeCh chan struct{}
 	timeout   time.Time
+	id        int32
+	reported  uint32 // the watchdog reported the current wait
+	conn      *Conn  // the stream of the window, for the stats
+	seqBuf    []byte // the content of the muxMsgSeq frame
 	// send window receive the receive window max size and read size
 	// done size store the size send window has send, send and read will be totally equal
 	// so send minus read, send window can get the current window size remaining
@@ -450,6 +718,12 @@ func (Self *sendWindow) remainingSize(maxSize, send uint32) uint32 {
 	return 0
 }
 
+// available returns the window not used yet
+func (Self *sendWindow) available() uint32 {
+	maxSize, send, _ := Self.unpack(atomic.LoadUint64(&Self.maxSizeDone))
+	return Self.remainingSize(maxSize, send)
+}
+
 func (Self *sendWindow) SetSize(currentMaxSizeDone uint64) (closed bool) {
 	// set the window size from receive window
 	defer func() {
@@ -457,10 +731,11 @@ func (Self *sendWindow) SetSize(currentMaxSizeDone uint64) (closed bool) {
 			closed = true
 		}
 	}()
-	if Self.closeOp {
+	if Self.closed() {
 		close(Self.setSizeCh)
 		return true
 	}
+	atomic.StoreInt64(&Self.lastUpdate, Self.mux.clock.Now().UnixNano())
 	var maxsize, send uint32
 	var wait, newWait bool
 	currentMaxSize, read, _ := Self.unpack(currentMaxSizeDone)
@@ -468,7 +743,7 @@ func (Self *sendWindow) SetSize(currentMaxSizeDone uint64) (closed bool) {
 		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
 		maxsize, send, wait = Self.unpack(ptrs)
 		if read > send {
-			log.Println("window read > send: max size:", currentMaxSize, "read:", read, "send", send)
+			Self.mux.logln(LogWarn, "window read > send: max size:", currentMaxSize, "read:", read, "send", send)
 			return
 		}
 		if read == 0 && currentMaxSize == maxsize {
@@ -526,8 +801,8 @@ func (Self *sendWindow) sent(sentSize uint32) {
 func (Self *sendWindow) WriteTo() (p []byte, sendSize uint32, part bool, err error) {
 	// returns buf segments, return only one segments, need a loop outside
 	// until err = io.EOF
-	if Self.closeOp {
-		return nil, 0, false, errors.New("conn.writeWindow: window closed")
+	if Self.closed() {
+		return nil, 0, false, ErrStreamClosed
 	}
 	if Self.off == uint32(len(Self.buf)) {
 		return nil, 0, false, io.EOF
@@ -551,8 +826,12 @@ start:
 		goto start
 	}
 	// there are still remaining window
-	if len(Self.buf[Self.off:]) > maximumSegmentSize {
-		sendSize = maximumSegmentSize
+	if err = Self.admitData(); err != nil {
+		return nil, 0, false, err
+	}
+	mss := Self.mss()
+	if uint32(len(Self.buf[Self.off:])) > mss {
+		sendSize = mss
 	} else {
 		sendSize = uint32(len(Self.buf[Self.off:]))
 	}
@@ -571,31 +850,41 @@ start:
 }
 
 func (Self *sendWindow) waitReceiveWindow() (err error) {
-	t := Self.timeout.Sub(time.Now())
-	if t < 0 { // not set the timeout, wait for it as long as connection close
+	Self.mux.simYield(simWindowWait)
+	var timeout, stall <-chan time.Time
+	clock := Self.mux.clock
+	t := Self.timeout.Sub(clock.Now())
+	if t >= 0 { // t < 0 means not set the timeout, wait for it as long as connection close
+		timer := clock.NewTimer(t)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	var stallTimer Timer
+	if Self.mux.profile.Lossy {
+		// window update may be dropped on the lossy link, probe it after some rtt
+		stallTimer = clock.NewTimer(Self.mux.stallTimeout())
+		defer stallTimer.Stop()
+		stall = stallTimer.C()
+	}
+	atomic.StoreUint32(&Self.reported, 0)
+	atomic.StoreInt64(&Self.waitSince, clock.Now().UnixNano())
+	defer atomic.StoreInt64(&Self.waitSince, 0)
+	// waiting for receive usable window size, or timeout
+	for {
 		select {
 		case _, ok := <-Self.setSizeCh:
 			if !ok {
-				return errors.New("conn.writeWindow: window closed")
+				return ErrStreamClosed
 			}
 			return nil
+		case <-timeout:
+			return ErrTimeout
 		case <-Self.closeOpCh:
-			return errors.New("conn.writeWindow: window closed")
-		}
-	}
-	timer := time.NewTimer(t)
-	defer timer.Stop()
-	// waiting for receive usable window size, or timeout
-	select {
-	case _, ok := <-Self.setSizeCh:
-		if !ok {
-			return errors.New("conn.writeWindow: window closed")
+			return ErrStreamClosed
+		case <-stall:
+			Self.mux.windowStalled(Self.id)
+			stallTimer.Reset(Self.mux.stallTimeout())
 		}
-		return nil
-	case <-timer.C:
-		return errors.New("conn.writeWindow: write to time out")
-	case <-Self.closeOpCh:
-		return errors.New("conn.writeWindow: window closed")
 	}
 }
 
@@ -616,17 +905,119 @@ func (Self *sendWindow) WriteFull(buf []byte, id int32) (n int, err error) {
 			break
 		}
 		n += int(l)
-		l = 0
-		if part {
-			Self.mux.sendInfo(muxNewMsgPart, id, bufSeg)
-		} else {
-			Self.mux.sendInfo(muxNewMsg, id, bufSeg)
+		if err = Self.queue(bufSeg, part, id); err != nil {
+			return
 		}
 		// send to other side, not send nil data to other side
 	}
 	return
 }
 
+// tryWriteFull is WriteFull, but it admits the frames and uses the window
+// for all of buf at once, or returns ErrWouldBlock, it never waits
+func (Self *sendWindow) tryWriteFull(buf []byte, id int32) (n int, err error) {
+	if Self.closed() {
+		return 0, ErrStreamClosed
+	}
+	mss := int(Self.mss())
+	frames := int32((len(buf) + mss - 1) / mss)
+	if !Self.tryAdmit(frames) {
+		return 0, ErrWouldBlock
+	}
+	if !Self.reserve(uint32(len(buf))) {
+		Self.unadmit(frames)
+		return 0, ErrWouldBlock
+	}
+	for len(buf) > 0 {
+		l, part := len(buf), false
+		if l > mss {
+			l, part = mss, true
+		}
+		frames--
+		if err = Self.queue(buf[:l], part, id); err != nil {
+			Self.unadmit(frames)
+			return
+		}
+		n += l
+		buf = buf[l:]
+	}
+	return
+}
+
+// mss returns the payload of a data frame at most
+func (Self *sendWindow) mss() uint32 {
+	mss := uint32(maximumSegmentSize)
+	if size := atomic.LoadUint32(&Self.mux.segmentSize); size > 0 && size-contentHeaderSize < mss {
+		mss = size - contentHeaderSize // the mtu discovery over kcp
+	}
+	if Self.mux.sequenced() {
+		mss -= seqHeaderSize
+	}
+	return mss
+}
+
+// reserve uses the window for size bytes, only if it is all available
+func (Self *sendWindow) reserve(size uint32) bool {
+	for {
+		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
+		maxSize, send, wait := Self.unpack(ptrs)
+		if Self.remainingSize(maxSize, send) < size {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, send+size, wait)) {
+			return true
+		}
+	}
+}
+
+// queue pushes the segment admitted and sent from the window to the write queue
+func (Self *sendWindow) queue(bufSeg []byte, part bool, id int32) error {
+	l := len(bufSeg)
+	Self.countOut(l)
+	flag := muxNewMsg
+	if part {
+		flag = muxNewMsgPart
+	}
+	if Self.mux.sequenced() && len(bufSeg)+seqHeaderSize <= maximumSegmentSize {
+		flag, bufSeg = muxMsgSeq, Self.seqFrame(bufSeg)
+	}
+	atomic.AddUint64(&Self.seqOffset, uint64(l))
+	pack := Self.mux.newPack(flag, id, Self.getPriority(), bufSeg)
+	if pack == nil {
+		Self.unadmit(1)
+		return ErrMuxClosed
+	}
+	if Self.conn != nil {
+		pack.conn = Self.conn
+		pack.queued = Self.mux.clock.Now().UnixNano()
+	}
+	Self.mux.writeQueue.Push(pack)
+	return nil
+}
+
+// countOut counts the payload sent
+func (Self *sendWindow) countOut(n int) {
+	Self.mux.goodput.addOut(n)
+	if Self.conn != nil {
+		Self.conn.traffic.addOut(n)
+		if Self.conn.tenant != nil {
+			Self.conn.tenant.traffic.addOut(n)
+		}
+		Self.conn.stats.writeRate.add(n)
+	}
+}
+
+// sentEarly counts the early data sent with the open, as a write, before
+// the stream is used by the write session
+func (Self *sendWindow) sentEarly(p []byte) {
+	Self.sent(uint32(len(p)))
+	atomic.AddUint64(&Self.seqOffset, uint64(len(p)))
+	Self.countOut(len(p))
+	if Self.mux.integrity() {
+		Self.conn.sent.add(p)
+	}
+}
+
 func (Self *sendWindow) SetTimeOut(t time.Time) {
 	// waiting for receive a receive window size
 	Self.timeout = t
@@ -638,19 +1029,20 @@ type writeBandwidth struct {
 	duration  float64
 	bufLength uint32
 	ratio     uint32
+	clock     Clock
 }
 
 const writeCalcThreshold uint32 = 5 * 1024 * 1024
 
-func newWriteBandwidth() *writeBandwidth {
-	return &writeBandwidth{ratio: 1}
+func newWriteBandwidth(clock Clock) *writeBandwidth {
+	return &writeBandwidth{ratio: 1, clock: clock}
 }
 
 func (Self *writeBandwidth) StartRead() {
 	if Self.readEnd.IsZero() {
-		Self.readEnd = time.Now()
+		Self.readEnd = Self.clock.Now()
 	}
-	Self.duration += time.Now().Sub(Self.readEnd).Seconds()
+	Self.duration += Self.clock.Now().Sub(Self.readEnd).Seconds()
 	if Self.bufLength >= writeCalcThreshold*atomic.LoadUint32(&Self.ratio) {
 		Self.calcBandWidth()
 	}
@@ -662,7 +1054,7 @@ func (Self *writeBandwidth) SetCopySize(n uint16) {
 }
 
 func (Self *writeBandwidth) endRead() {
-	Self.readEnd = time.Now()
+	Self.readEnd = Self.clock.Now()
 }
 
 func (Self *writeBandwidth) calcBandWidth() {
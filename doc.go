@@ -0,0 +1,10 @@
+// Package npsmux is a net connection multiplexing implementation,
+// it transfers many stream connections through one tcp or kcp connection.
+//
+// The package was named nps_mux before, import it like this
+//
+//	import "ehang.io/nps-mux"
+//
+// and use it as npsmux. Code still using the old identifier can switch the
+// import path to ehang.io/nps-mux/nps_mux, it re-exports the same api.
+package npsmux
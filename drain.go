@@ -0,0 +1,39 @@
+package npsmux
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const connDrainInterval = time.Millisecond * 10
+
+// Drain stops the new writes of the stream, waits for the writes in progress done,
+// and all the data sent acknowledged by the peer, or the ctx done.
+// the stream is still readable, close it after drained
+func (s *Conn) Drain(ctx context.Context) error {
+	atomic.StoreUint32(&s.draining, 1)
+	mux := s.receiveWindow.mux
+	ticker := mux.clock.NewTicker(connDrainInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt32(&s.writing) == 0 && s.sendWindow.unacked() == 0 {
+			return nil
+		}
+		if s.closed() || s.closing() || mux.Closed() {
+			return fmt.Errorf("mux: closed before drained: %w", ErrStreamClosed)
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// unacked returns the bytes sent, but not acknowledged by the peer
+func (Self *sendWindow) unacked() uint32 {
+	_, send, _ := Self.unpack(atomic.LoadUint64(&Self.maxSizeDone))
+	return send
+}
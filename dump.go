@@ -0,0 +1,54 @@
+package npsmux
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Dump writes a human-readable snapshot of the mux and all its streams to w,
+// includes the window status, the pending bytes, the queue depths and the rtt,
+// it helps to find out why a stream hangs
+func (s *Mux) Dump(w io.Writer) {
+	now := s.clock.Now()
+	min, srtt, rttVar := s.counter.Get()
+	bw, _ := s.Bandwidth()
+	sent, acked, _ := s.WriteBandwidth()
+	_, _ = fmt.Fprintf(w, "mux[%d] %v -> %v closed=%v going_away=%v peer_features=%#x\n",
+		s.sessionID, s.conn.LocalAddr(), s.conn.RemoteAddr(), s.Closed(), s.GoingAway(), atomic.LoadUint32(&s.peerFeatures))
+	_, _ = fmt.Fprintf(w, "  rtt min=%s srtt=%s rttvar=%s bandwidth=%.0fB/s sent=%.0fB/s acked=%.0fB/s\n",
+		seconds(min), seconds(srtt), seconds(rttVar), bw, sent, acked)
+	_, _ = fmt.Fprintf(w, "  streams=%d write_queue=%d accept_queue=%d window_stalls=%d\n",
+		s.connMap.Size(), s.writeQueue.Len(), s.newConnQueue.Len(), atomic.LoadUint64(&s.windowStalls))
+	var conns []*Conn
+	s.connMap.Range(func(id int32, c *Conn) bool {
+		conns = append(conns, c)
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].connId < conns[j].connId
+	})
+	for _, c := range conns {
+		c.dump(w, now)
+	}
+}
+
+func (s *Conn) dump(w io.Writer, now time.Time) {
+	sendMax, sendDone, sendWait := s.sendWindow.unpack(atomic.LoadUint64(&s.sendWindow.maxSizeDone))
+	recvMax, recvDone, recvWait := s.receiveWindow.unpack(atomic.LoadUint64(&s.receiveWindow.maxSizeDone))
+	// only the atomic counters, the buffer of the writer is not read here
+	traffic := s.traffic.get()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+	_, _ = fmt.Fprintf(w, "  stream %d closed=%v closing=%v idle=%s\n",
+		s.connId, s.closed(), s.closing(), idle.Truncate(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "    send max=%d done=%d wait=%v writing=%d bytes=%d\n",
+		sendMax, sendDone, sendWait, atomic.LoadInt32(&s.writing), traffic.BytesOut)
+	_, _ = fmt.Fprintf(w, "    receive max=%d done=%d wait=%v pending=%d\n",
+		recvMax, recvDone, recvWait, s.receiveWindow.bufQueue.Len())
+}
+
+func seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second)).Truncate(time.Microsecond)
+}
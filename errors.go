@@ -0,0 +1,118 @@
+package npsmux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// the errors of the mux, the errors returned may wrap them with more details,
+// check them by errors.Is
+var (
+	// ErrMuxClosed is returned by the operations on a closed mux
+	ErrMuxClosed = errors.New("mux: the mux has closed")
+	// ErrStreamClosed is returned by the operations on a stream closed by any side
+	ErrStreamClosed = errors.New("mux: the stream has closed")
+	// ErrTimeout is returned if a deadline or a timeout exceeded, it is a net.Error
+	// with Timeout true
+	ErrTimeout error = timeoutError{}
+	// ErrRefused is returned by NewConn if the peer or a local limit refused the stream
+	ErrRefused = errors.New("mux: the stream refused")
+	// ErrQuotaExceeded is returned by the Read and Write of the stream,
+	// after the quota of the stream or the mux used up
+	ErrQuotaExceeded = errors.New("mux: quota exceeded")
+	// ErrQuota is ErrQuotaExceeded
+	ErrQuota = ErrQuotaExceeded
+	// ErrWouldBlock is returned by TryWrite if the send window is not enough
+	ErrWouldBlock = errors.New("mux: the send window is full")
+	// ErrPlaintext is the error of the mux over a plaintext transport, if
+	// MuxConfig.RequireEncryption set
+	ErrPlaintext = errors.New("mux: the transport is not encrypted")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errPingTimeout = fmt.Errorf("mux: ping: %w", ErrTimeout)
+
+// RefusedError is returned by NewConn if the peer refused the stream for the
+// overload, and asked to wait before opening again, errors.Is reports it is ErrRefused
+type RefusedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("mux: the stream refused, retry after %v", e.RetryAfter)
+}
+
+func (e *RefusedError) Is(target error) bool {
+	return target == ErrRefused
+}
+
+// RetryAfter returns the wait the peer asked for by the refusal err, zero if no hint
+func RetryAfter(err error) time.Duration {
+	var refused *RefusedError
+	if errors.As(err, &refused) {
+		return refused.RetryAfter
+	}
+	return 0
+}
+
+// failure boxes the error of Mux.Err, the errors of different types can not be
+// stored in one atomic.Value
+type failure struct {
+	err error
+}
+
+// TransportError is returned by the stream operations failed as the mux failed,
+// it carries both the error of the operation and the error the mux failed by,
+// errors.Is matches any of them, errors.Unwrap returns the error of the mux
+type TransportError struct {
+	Op  error // the error of the stream operation
+	Err error // the error the mux failed by, as Mux.Err
+}
+
+func (e *TransportError) Error() string {
+	return e.Op.Error() + ": " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Is(target error) bool {
+	return errors.Is(e.Op, target)
+}
+
+// withCause attaches the error the mux failed by to the error of a stream operation
+func (s *Conn) withCause(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*TransportError); ok || err == io.EOF && s.closing() {
+		return err // the eof of the stream closed by the peer before
+	}
+	if cause := s.receiveWindow.mux.Err(); cause != nil && err != cause {
+		return &TransportError{Op: err, Err: cause}
+	}
+	return err
+}
+
+// ProtocolError is returned when a frame received breaks the mux protocol,
+// it carries the offending header bytes for diagnosis
+type ProtocolError struct {
+	Flag   uint8
+	ID     int32
+	Length uint16 // the content length declared in the header
+	Header []byte // the raw header bytes
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("mux: protocol error: %s, flag: %d, id: %d, length: %d, header: %x",
+		e.Reason, e.Flag, e.ID, e.Length, e.Header)
+}
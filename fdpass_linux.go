@@ -0,0 +1,89 @@
+// +build linux
+
+package npsmux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// maxLeaseSize is the max size of the lease sent with the stream socket
+const maxLeaseSize = 4096
+
+// HandOff passes the data path of the stream to another process over the unix socket uc.
+// the stream shares the transport with the others, it has no fd to pass, so a socket pair
+// is created, one end is sent by SCM_RIGHTS with the stream id and the lease, the lease
+// tells the other process what the stream is for, it is defined by the application.
+// the mux keeps relaying the data between the stream and the other end by Relay, the
+// bytes still go through this process, the half close of either side is passed on,
+// the other process gets the socket by ReceiveStream
+func (s *Conn) HandOff(uc *net.UnixConn, lease []byte) error {
+	if len(lease) > maxLeaseSize {
+		return errors.New("mux: lease too large")
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	local := os.NewFile(uintptr(fds[0]), "stream")
+	remote := os.NewFile(uintptr(fds[1]), "stream")
+	defer remote.Close()
+	c, err := net.FileConn(local)
+	_ = local.Close()
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 6+len(lease))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(s.connId))
+	binary.LittleEndian.PutUint16(msg[4:6], uint16(len(lease)))
+	copy(msg[6:], lease)
+	if _, _, err = uc.WriteMsgUnix(msg, syscall.UnixRights(fds[1]), nil); err != nil {
+		_ = c.Close()
+		return err
+	}
+	s.receiveWindow.mux.goroutine(func() {
+		_, _ = Relay(context.Background(), s, c)
+	})
+	return nil
+}
+
+// ReceiveStream receives the stream passed by HandOff from the unix socket uc,
+// returns the socket to read and write the stream, the id of the stream and the lease
+func ReceiveStream(uc *net.UnixConn) (conn net.Conn, id int32, lease []byte, err error) {
+	msg := make([]byte, 6+maxLeaseSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := uc.ReadMsgUnix(msg, oob)
+	if err != nil {
+		return
+	}
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	if len(cmsgs) != 1 {
+		err = errors.New("mux: stream socket not received")
+		return
+	}
+	fds, err := syscall.ParseUnixRights(&cmsgs[0])
+	if err != nil {
+		return
+	}
+	if len(fds) != 1 {
+		err = errors.New("mux: stream socket not received")
+		return
+	}
+	f := os.NewFile(uintptr(fds[0]), "stream")
+	defer f.Close()
+	if n < 6 || n < 6+int(binary.LittleEndian.Uint16(msg[4:6])) {
+		err = errors.New("mux: malformed stream lease")
+		return
+	}
+	id = int32(binary.LittleEndian.Uint32(msg[0:4]))
+	lease = append([]byte(nil), msg[6:6+int(binary.LittleEndian.Uint16(msg[4:6]))]...)
+	conn, err = net.FileConn(f)
+	return
+}
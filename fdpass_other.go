@@ -0,0 +1,20 @@
+// +build !linux
+
+package npsmux
+
+import (
+	"errors"
+	"net"
+)
+
+// HandOff passes the data path of the stream to another process, relayed by
+// this process, it is only supported on linux
+func (s *Conn) HandOff(uc *net.UnixConn, lease []byte) error {
+	return errors.New("mux: stream hand off is only supported on linux")
+}
+
+// ReceiveStream receives the stream passed by HandOff, it is only supported on linux
+func ReceiveStream(uc *net.UnixConn) (conn net.Conn, id int32, lease []byte, err error) {
+	err = errors.New("mux: stream hand off is only supported on linux")
+	return
+}
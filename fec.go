@@ -0,0 +1,218 @@
+package npsmux
+
+import (
+	"encoding/binary"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// the forward error correction of the ARQ mode, the datagrams are the data
+// shards of the groups, a group is closed by DataShards datagrams or by the
+// tick of the timer, then its parity shards are sent. a shard is group(4)
+// index(1) count(1) body, the body of a data shard is length(2) datagram,
+// the parity shards are the reed-solomon parity of the bodies padded to the
+// longest, count is the data shards of the group in the parity shards. the
+// parity is by klauspost/reedsolomon of count data shards and ParityShards
+// parity shards, any count shards recover the group
+
+const (
+	fecHeaderSize = 6
+	fecOverhead   = fecHeaderSize + 2 // the header and the length of the datagram
+	fecMaxShards  = 128               // the parity shards are indexed from it
+	fecKeepGroups = 64                // the groups kept for the recovery, the older are dropped
+)
+
+// fecCodecs are the codecs by the data shards of the group, the groups closed
+// by the timer have less than DataShards
+type fecCodecs struct {
+	parity int
+	codecs map[int]reedsolomon.Encoder
+}
+
+// get returns the codec of count data shards, nil if it can not be created
+func (Self *fecCodecs) get(count int) reedsolomon.Encoder {
+	if c, ok := Self.codecs[count]; ok {
+		return c
+	}
+	c, err := reedsolomon.New(count, Self.parity)
+	if err != nil {
+		return nil
+	}
+	if Self.codecs == nil {
+		Self.codecs = make(map[int]reedsolomon.Encoder)
+	}
+	Self.codecs[count] = c
+	return c
+}
+
+// fecEncoder cuts the datagrams into the groups, guarded by the write lock
+type fecEncoder struct {
+	data   int
+	codecs fecCodecs
+	group  uint32
+	bodies [][]byte // the data shards of the group open
+}
+
+func newFECEncoder(data, parity int) *fecEncoder {
+	return &fecEncoder{data: data, codecs: fecCodecs{parity: parity}}
+}
+
+func fecShard(group uint32, index, count, size int) []byte {
+	b := make([]byte, fecHeaderSize+size)
+	binary.LittleEndian.PutUint32(b, group)
+	b[4], b[5] = byte(index), byte(count)
+	return b
+}
+
+// add returns the shard of the datagram, and the parity shards if the group closed
+func (Self *fecEncoder) add(datagram []byte) (shards [][]byte) {
+	shard := fecShard(Self.group, len(Self.bodies), 0, 2+len(datagram))
+	binary.LittleEndian.PutUint16(shard[fecHeaderSize:], uint16(len(datagram)))
+	copy(shard[fecOverhead:], datagram)
+	Self.bodies = append(Self.bodies, shard[fecHeaderSize:])
+	shards = append(shards, shard)
+	if len(Self.bodies) >= Self.data {
+		shards = append(shards, Self.close()...)
+	}
+	return
+}
+
+// close returns the parity shards of the group open, and opens the next
+func (Self *fecEncoder) close() (shards [][]byte) {
+	count := len(Self.bodies)
+	if count == 0 {
+		return
+	}
+	defer func() {
+		Self.group++
+		Self.bodies = Self.bodies[:0]
+	}()
+	codec := Self.codecs.get(count)
+	if codec == nil {
+		return
+	}
+	var size int
+	for _, body := range Self.bodies {
+		if len(body) > size {
+			size = len(body)
+		}
+	}
+	bodies := make([][]byte, count, count+Self.codecs.parity)
+	for j, body := range Self.bodies {
+		bodies[j] = make([]byte, size)
+		copy(bodies[j], body)
+	}
+	for i := 0; i < Self.codecs.parity; i++ {
+		shard := fecShard(Self.group, fecMaxShards+i, count, size)
+		bodies = append(bodies, shard[fecHeaderSize:])
+		shards = append(shards, shard)
+	}
+	if codec.Encode(bodies) != nil {
+		return nil
+	}
+	return
+}
+
+// fecDecoder recovers the datagrams lost, owned by the reader of the datagrams
+type fecDecoder struct {
+	codecs fecCodecs
+	groups map[uint32]*fecGroup
+	newest uint32
+}
+
+type fecGroup struct {
+	count  int            // the data shards, zero before a parity shard received
+	bodies map[int][]byte // by the index
+	done   bool
+}
+
+func newFECDecoder(parity int) *fecDecoder {
+	return &fecDecoder{codecs: fecCodecs{parity: parity}, groups: make(map[uint32]*fecGroup)}
+}
+
+// input returns the datagram of the data shard, and the datagrams recovered by it
+func (Self *fecDecoder) input(shard []byte) (datagram []byte, recovered [][]byte) {
+	if len(shard) < fecOverhead {
+		return
+	}
+	group := binary.LittleEndian.Uint32(shard)
+	index, count, body := int(shard[4]), int(shard[5]), shard[fecHeaderSize:]
+	if index < fecMaxShards {
+		if l := int(binary.LittleEndian.Uint16(body)); l <= len(body)-2 {
+			datagram = body[2 : 2+l]
+		}
+	} else if index-fecMaxShards >= Self.codecs.parity {
+		return // the parity shards beyond ours, the sides differ
+	}
+	if seqBefore(group, Self.newest-fecKeepGroups) {
+		return // too late to recover
+	}
+	if seqBefore(Self.newest, group) {
+		Self.newest = group
+		for id := range Self.groups {
+			if seqBefore(id, group-fecKeepGroups) {
+				delete(Self.groups, id)
+			}
+		}
+	}
+	g := Self.groups[group]
+	if g == nil {
+		g = &fecGroup{bodies: make(map[int][]byte)}
+		Self.groups[group] = g
+	}
+	if _, ok := g.bodies[index]; ok || g.done {
+		return
+	}
+	g.bodies[index] = append([]byte(nil), body...)
+	if index >= fecMaxShards {
+		g.count = count
+	}
+	if g.count > 0 && len(g.bodies) >= g.count {
+		g.done = true
+		recovered = g.recover(Self.codecs.get(g.count), Self.codecs.parity)
+	}
+	return
+}
+
+// recover returns the datagrams of the data shards lost, by count shards received
+func (g *fecGroup) recover(codec reedsolomon.Encoder, parity int) (datagrams [][]byte) {
+	if codec == nil {
+		return
+	}
+	var size int
+	for i := fecMaxShards; i < fecMaxShards+parity; i++ {
+		if body, ok := g.bodies[i]; ok {
+			size = len(body)
+		}
+	}
+	bodies := make([][]byte, g.count+parity)
+	var missing []int
+	for j := range bodies {
+		index := j
+		if j >= g.count {
+			index = fecMaxShards + j - g.count
+		}
+		body, ok := g.bodies[index]
+		switch {
+		case !ok:
+			if j < g.count {
+				missing = append(missing, j)
+			}
+		case len(body) > size:
+			return // malformed, the bodies are padded to the parity
+		default:
+			bodies[j] = make([]byte, size)
+			copy(bodies[j], body)
+		}
+	}
+	if len(missing) == 0 || codec.ReconstructData(bodies) != nil {
+		return
+	}
+	for _, j := range missing {
+		body := bodies[j]
+		if l := int(binary.LittleEndian.Uint16(body)); l <= size-2 {
+			datagrams = append(datagrams, body[2:2+l])
+		}
+	}
+	return
+}
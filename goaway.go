@@ -0,0 +1,121 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	goAwayLocal  uint32 = 1 << iota // this side sent GoAway
+	goAwayRemote                    // the other side sent GoAway
+)
+
+const drainCheckInterval = time.Second
+
+// acceptNewConn handles the new connection opened by the other side,
+// it is refused if the mux is going away, the id is in use, or beyond the rate
+func (s *Mux) acceptNewConn(id int32) {
+	meta := s.takeMeta(id)
+	if atomic.LoadUint32(&s.goAway) != 0 {
+		s.sendInfo(muxNewConnFail, id, nil)
+		return
+	}
+	if c, ok := s.connMap.Get(id); ok {
+		// both sides opened the stream with the same id, refuse it,
+		// the other side refuses ours too
+		atomic.StoreUint32(&c.collided, 1)
+		s.logln(LogWarn, "stream id collision, conn id:", id)
+		s.sendInfo(muxNewConnFail, id, nil)
+		return
+	}
+	if s.newConnLimiter != nil && !s.newConnLimiter.allow() {
+		atomic.AddUint64(&s.refusedConns, 1)
+		s.refuse(id, true)
+		return
+	}
+	conn := newConn(id, s)
+	if meta != nil && !conn.applyMeta(meta) {
+		s.refuse(id, true)
+		return
+	}
+	if s.config.AcceptWindow != nil {
+		conn.initWindow = clampWindow(s.config.AcceptWindow(conn))
+		conn.receiveWindow.setInitial(conn.initWindow)
+	}
+	if meta != nil {
+		s.earlyData(conn, meta)
+	}
+	s.pendingOpen(conn)
+	s.newConnQueue.Push(conn)
+}
+
+// GoAway tells the other side the mux is retiring, both sides stop opening
+// new streams, the existing streams keep working, the mux closes itself
+// when all of them closed
+func (s *Mux) GoAway() {
+	if !s.setGoAway(goAwayLocal) {
+		return
+	}
+	s.logln(LogInfo, "go away")
+	s.sendInfo(muxGoAway, 0, nil)
+	s.goingAway()
+}
+
+// GoingAway reports whether GoAway sent by any side
+func (s *Mux) GoingAway() bool {
+	return atomic.LoadUint32(&s.goAway) != 0
+}
+
+func (s *Mux) remoteGoAway() {
+	if s.setGoAway(goAwayRemote) {
+		s.goroutine(s.goingAway)
+	}
+}
+
+func (s *Mux) setGoAway(flag uint32) (first bool) {
+	for {
+		old := atomic.LoadUint32(&s.goAway)
+		if old&flag != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&s.goAway, old, old|flag) {
+			return true
+		}
+	}
+}
+
+func (s *Mux) goingAway() {
+	s.drainOnce.Do(func() {
+		if s.config.OnGoAway != nil {
+			s.config.OnGoAway(s)
+		}
+		s.goroutine(s.drainSession)
+	})
+}
+
+func (s *Mux) lifetimeSession() {
+	timer := s.clock.NewTimer(s.config.MaxSessionLifetime)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		s.GoAway()
+	case <-s.closeChan:
+	}
+}
+
+// drainSession waits for all the streams closed, then closes the mux
+func (s *Mux) drainSession() {
+	ticker := s.clock.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		if s.connMap.Size() == 0 {
+			_ = s.Close()
+			return
+		}
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package npsmux
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// the data frames of the streams in a group wait in the group, instead of the
+// chain of the class. in each class, the groups and the chain share the writes
+// by deficit round robin, by the weights, the chain weighs 1. the chain is all
+// the streams not in any group together, not a flow per stream. in a group,
+// the streams take turns
+
+// StreamGroup is a set of streams sharing a weighted slice of the bandwidth
+// of the mux, as all the streams of one origin. it is not used with a custom
+// Scheduler
+type StreamGroup struct {
+	mux     *Mux
+	weight  int
+	classes [numClasses]groupFlow // guarded by the groups of the write queue
+}
+
+// groupFlow is the frames of a group waiting in a class
+type groupFlow struct {
+	streams map[int32][]*muxPackager
+	ring    []int32 // the streams with frames, in turn
+	deficit int
+	active  bool // in the active groups of the class
+}
+
+// NewStreamGroup creates a group of the weight, the streams in it share weight
+// times of the bandwidth as all the streams not in any group together, not as
+// each of them, while both have the data to write. weight below 1 is 1
+func (s *Mux) NewStreamGroup(weight int) *StreamGroup {
+	if weight < 1 {
+		weight = 1
+	}
+	return &StreamGroup{mux: s, weight: weight}
+}
+
+// Weight returns the weight of the group
+func (g *StreamGroup) Weight() int {
+	return g.weight
+}
+
+// NewConn is Mux.NewConn, the stream is in the group
+func (g *StreamGroup) NewConn() (*Conn, error) {
+	c, err := g.mux.NewConn()
+	if err == nil {
+		err = g.Add(c)
+	}
+	return c, err
+}
+
+// Add puts the stream into the group, as a stream accepted. call it before the
+// first write, the frames queued before may be reordered. a stream is in one group
+func (g *StreamGroup) Add(c *Conn) error {
+	if c.receiveWindow.mux != g.mux {
+		return errors.New("mux: the stream is not of the mux of the group")
+	}
+	c.group.Store(g)
+	return nil
+}
+
+// Group returns the group of the stream, nil if not in any group
+func (s *Conn) Group() *StreamGroup {
+	g, _ := s.group.Load().(*StreamGroup)
+	return g
+}
+
+// groupSched is the group flows of the classes in the write queue
+type groupSched struct {
+	lengths [numClasses]int32 // the frames in the groups, accessed atomically
+	classes [numClasses]groupClass
+	sync.Mutex
+}
+
+type groupClass struct {
+	active       []*StreamGroup // the groups with frames
+	next         int            // the turn, zero is the chain, i is active[i-1]
+	fresh        bool           // the quantum of the turn not added yet
+	chainDeficit int
+}
+
+func (Self *groupSched) push(g *StreamGroup, p Priority, pack *muxPackager) {
+	Self.Lock()
+	f := &g.classes[p]
+	if f.streams == nil {
+		f.streams = make(map[int32][]*muxPackager)
+	}
+	frames := f.streams[pack.id]
+	if len(frames) == 0 {
+		f.ring = append(f.ring, pack.id)
+	}
+	f.streams[pack.id] = append(frames, pack)
+	if !f.active {
+		f.active = true
+		c := &Self.classes[p]
+		c.active = append(c.active, g)
+	}
+	atomic.AddInt32(&Self.lengths[p], 1)
+	Self.Unlock()
+}
+
+// pop pops the frame of the class by deficit round robin, the chain is the
+// streams not in any group, chainLen is the frames in it
+func (Self *groupSched) pop(p Priority, chain *bufChain, chainLen int32) (pack *muxPackager) {
+	Self.Lock()
+	defer Self.Unlock()
+	c := &Self.classes[p]
+	// every flow is visited twice at most, the quantum covers a frame
+	for i := 0; i < 2*(len(c.active)+1); i++ {
+		if c.next > len(c.active) {
+			c.next, c.fresh = 0, true
+		}
+		if c.next == 0 {
+			if chainLen <= 0 {
+				c.chainDeficit = 0
+				c.next, c.fresh = 1, true
+				continue
+			}
+			if c.fresh {
+				c.chainDeficit += maximumSegmentSize
+				c.fresh = false
+			}
+			if c.chainDeficit > 0 {
+				if ptr, ok := chain.popTail(); ok {
+					pack = (*muxPackager)(ptr)
+					c.chainDeficit -= int(pack.length)
+					return
+				}
+				chainLen = 0
+				continue
+			}
+			c.next, c.fresh = 1, true
+			continue
+		}
+		g := c.active[c.next-1]
+		f := &g.classes[p]
+		if c.fresh {
+			f.deficit += g.weight * maximumSegmentSize
+			c.fresh = false
+		}
+		if f.deficit > 0 {
+			pack = f.popStream()
+			f.deficit -= int(pack.length)
+			atomic.AddInt32(&Self.lengths[p], -1)
+			if len(f.ring) == 0 {
+				// the group has nothing more, leaves the turns
+				f.deficit, f.active = 0, false
+				c.active = append(c.active[:c.next-1], c.active[c.next:]...)
+				c.fresh = true
+			}
+			return
+		}
+		c.next++
+		c.fresh = true
+	}
+	return
+}
+
+// popStream pops the frame of the stream in turn
+func (f *groupFlow) popStream() (pack *muxPackager) {
+	id := f.ring[0]
+	frames := f.streams[id]
+	pack = frames[0]
+	frames[0] = nil
+	f.ring = f.ring[1:]
+	if len(frames) == 1 {
+		delete(f.streams, id)
+	} else {
+		f.streams[id] = frames[1:]
+		f.ring = append(f.ring, id)
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package npsmux
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// if the peer announced featureHalfClose, CloseWrite sends muxConnCloseWrite
+// after the data written, the peer reads io.EOF after the data, as the FIN of
+// tcp, and writes on, so a request-response relay is not truncated
+
+var errNoHalfClose = errors.New("mux: the peer does not support the half close")
+
+// CloseWrite shuts down the writing side of the stream, the peer reads io.EOF
+// after the data written, the stream still reads the data of the peer, until
+// Close. it fails if the peer is too old to understand it, close the stream then
+func (s *Conn) CloseWrite() error {
+	mux := s.receiveWindow.mux
+	if s.closed() {
+		return ErrStreamClosed
+	}
+	if atomic.LoadUint32(&mux.peerFeatures)&featureHalfClose == 0 {
+		return errNoHalfClose
+	}
+	if !atomic.CompareAndSwapUint32(&s.writeClosed, 0, 1) {
+		return nil
+	}
+	if pack := mux.newPack(muxConnCloseWrite, s.connId, s.sendWindow.getPriority(), nil); pack != nil {
+		if mux.integrity() {
+			pack.conn = s // the checksum of the data left is sent before
+		}
+		mux.writeQueue.Push(pack)
+	}
+	return nil
+}
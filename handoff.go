@@ -0,0 +1,279 @@
+package npsmux
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// frameRecorder records the bytes of the frame being read, if the read session
+// stopped by Export in the middle of a frame, the bytes go to the new process
+type frameRecorder struct {
+	r       io.Reader
+	pending []byte // read by the previous read session, served first
+	frame   []byte
+}
+
+func (Self *frameRecorder) Read(p []byte) (n int, err error) {
+	if len(Self.pending) > 0 {
+		n = copy(p, Self.pending)
+		Self.pending = Self.pending[n:]
+	} else {
+		n, err = Self.r.Read(p)
+	}
+	Self.frame = append(Self.frame, p[:n]...)
+	return
+}
+
+// muxState is the session state exported
+type muxState struct {
+	ConnType     string
+	Server       bool
+	NextID       int32
+	PeerFeatures uint32
+	GoAway       uint32
+	CompactRead  uint32
+	CompactWrite uint32
+	Quarantined  []int32 // the ids waiting for the close of the peer
+	Pending      []byte  // the frame partly read
+	Streams      []streamState
+}
+
+// streamState is the stream exported, the windows are packed as window.pack,
+// the tags, the deadlines, the limits and the stats of the stream are not kept
+type streamState struct {
+	ID           int32
+	Priority     uint32
+	PeerPriority uint32
+	SendWindow   uint64 // the window of the peer, and the bytes sent but not read by it
+	SeqOffset    uint64
+	RecvWindow   uint64 // the window told, and the bytes read but not told yet
+	Told         uint32
+	Peak         uint32
+	Paused       bool
+	Buffered     []byte // received but not read yet
+	Stopped      bool   // the peer sends no more
+	Closing      bool
+	WriteClosed  bool
+	SeqNext      uint64
+	SeqHeld      map[uint64][]byte
+	Sent         sumState
+	Received     sumState
+}
+
+type sumState struct {
+	Off, Start int64
+	Crc        uint32
+}
+
+// Export stops the mux and hands its transport to another process, as the
+// binary upgrade. it returns the duplicated socket and the session state,
+// pass both to the new process and call Import there. the mux needs
+// MuxConfig.Handoff, it is closed after exported. the streams open go to the
+// new process too, with the data received but not read yet, they must not be
+// read nor written during Export, the ones still being opened fail it
+func (s *Mux) Export() (f *os.File, state []byte, err error) {
+	if s.recorder == nil {
+		return nil, nil, errors.New("mux: export needs the handoff config")
+	}
+	if s.config.WireTransform != nil {
+		return nil, nil, errors.New("mux: the mux with wire transform can not be exported")
+	}
+	fc, ok := s.conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, nil, errors.New("mux: the transport can not be exported")
+	}
+	if err = s.streamsBusy(); err != nil {
+		return nil, nil, err
+	}
+	if !atomic.CompareAndSwapUint32(&s.exporting, 0, 1) {
+		return nil, nil, errors.New("mux: export in progress")
+	}
+	// the ping return wakes up the read session, it stops after the frame,
+	// the deadline may not work, the socket is in blocking mode if its fd got.
+	s.sendInfo(muxPingFlag, muxPing, s.pingStamp())
+	// the frames queued are flushed before the write session exited
+	s.writeQueue.Stop()
+	<-s.writeDone
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.stallTimeout()))
+	<-s.readDone
+	if s.Closed() {
+		return nil, nil, ErrMuxClosed
+	}
+	if err = s.streamsBusy(); err != nil {
+		s.resume()
+		return nil, nil, err
+	}
+	if f, err = fc.File(); err != nil {
+		s.resume()
+		return nil, nil, err
+	}
+	state, err = json.Marshal(&muxState{
+		ConnType:     s.connType,
+		Server:       atomic.LoadUint32(&s.idRole) == 1,
+		NextID:       atomic.LoadInt32(&s.id),
+		PeerFeatures: atomic.LoadUint32(&s.peerFeatures),
+		GoAway:       atomic.LoadUint32(&s.goAway),
+		CompactRead:  atomic.LoadUint32(&s.compactRead),
+		CompactWrite: atomic.LoadUint32(&s.compactWrite),
+		Quarantined:  s.quarantinedIds(),
+		Pending:      append(s.recorder.frame, s.staging.buffered()...),
+		Streams:      s.exportStreams(),
+	})
+	if err != nil {
+		_ = f.Close()
+		s.resume()
+		return nil, nil, err
+	}
+	s.logln(LogInfo, "exported")
+	// only closes the socket of this process
+	_ = s.Close()
+	return
+}
+
+// Import rebuilds the mux exported by Export in another process, the streams
+// exported are found by Mux.Range, by their ids the old process used.
+// the caller still owns f, it can be closed after Import returns
+func Import(f *os.File, state []byte, config *MuxConfig) (*Mux, error) {
+	var st muxState
+	if err := json.Unmarshal(state, &st); err != nil {
+		return nil, err
+	}
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = new(MuxConfig)
+	}
+	if err = config.check(c); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	cfg := *config
+	cfg.Server = st.Server
+	m := newMux(c, st.ConnType, &cfg)
+	if m.recorder == nil {
+		m.recorder = &frameRecorder{r: m.reader}
+		m.reader = m.recorder
+	}
+	m.recorder.pending = st.Pending
+	m.id = st.NextID
+	m.peerFeatures = st.PeerFeatures
+	m.goAway = st.GoAway
+	m.compactRead = st.CompactRead
+	m.compactWrite = st.CompactWrite
+	m.compactSent = st.CompactWrite
+	for i := range st.Streams {
+		m.importStream(&st.Streams[i])
+	}
+	for _, id := range st.Quarantined {
+		if m.quarantined == nil {
+			m.quarantined = make(map[int32]struct{})
+		}
+		m.quarantined[id] = struct{}{}
+	}
+	m.start()
+	if m.goAway != 0 {
+		m.goingAway()
+	}
+	return m, nil
+}
+
+// streamsBusy fails the export of the streams being opened or written
+func (s *Mux) streamsBusy() (err error) {
+	s.pendingLock.Lock()
+	accepting := len(s.pendingOpens)
+	s.pendingLock.Unlock()
+	if accepting > 0 || s.newConnQueue.Len() > 0 {
+		return errors.New("mux: export with streams being opened")
+	}
+	s.connMap.Range(func(id int32, c *Conn) bool {
+		if atomic.LoadUint32(&c.openState) != connOpened {
+			err = errors.New("mux: export with streams being opened")
+		} else if atomic.LoadInt32(&c.writing) != 0 {
+			err = errors.New("mux: export with streams being written")
+		}
+		return err == nil
+	})
+	return
+}
+
+// exportStreams takes the state of the streams, after the sessions stopped
+func (s *Mux) exportStreams() (streams []streamState) {
+	s.connMap.Range(func(id int32, c *Conn) bool {
+		if c.closed() {
+			return true
+		}
+		rw, sw := c.receiveWindow, c.sendWindow
+		streams = append(streams, streamState{
+			ID:           id,
+			Priority:     atomic.LoadUint32(&sw.priority),
+			PeerPriority: atomic.LoadUint32(&rw.peerPriority),
+			SendWindow:   atomic.LoadUint64(&sw.maxSizeDone),
+			SeqOffset:    atomic.LoadUint64(&sw.seqOffset),
+			RecvWindow:   atomic.LoadUint64(&rw.maxSizeDone),
+			Told:         atomic.LoadUint32(&rw.told),
+			Peak:         atomic.LoadUint32(&rw.peak),
+			Paused:       atomic.LoadUint32(&rw.paused) != 0,
+			Buffered:     rw.bufQueue.bytes(),
+			Stopped:      atomic.LoadUint32(&rw.stopped) != 0,
+			Closing:      c.closing(),
+			WriteClosed:  atomic.LoadUint32(&c.writeClosed) != 0,
+			SeqNext:      c.seqNext,
+			SeqHeld:      c.seqHeld,
+			Sent:         sumState{c.sent.off, c.sent.start, c.sent.crc},
+			Received:     sumState{c.received.off, c.received.start, c.received.crc},
+		})
+		return true
+	})
+	return
+}
+
+// importStream rebuilds the stream exported, before the sessions started
+func (s *Mux) importStream(st *streamState) {
+	c := newConn(st.ID, s)
+	rw, sw := c.receiveWindow, c.sendWindow
+	sw.priority = st.Priority
+	maxSize, send, _ := sw.unpack(st.SendWindow)
+	sw.maxSizeDone = sw.pack(maxSize, send, false) // no writer waiting here
+	sw.seqOffset = st.SeqOffset
+	rw.peerPriority = st.PeerPriority
+	rw.maxSizeDone = st.RecvWindow
+	rw.told = st.Told
+	rw.peak = st.Peak
+	if st.Paused {
+		rw.paused = 1
+	}
+	if len(st.Buffered) > 0 {
+		rw.bufQueue.Push(st.Buffered)
+	}
+	if st.Closing {
+		c.closingFlag = 1
+	}
+	if st.WriteClosed {
+		c.writeClosed = 1
+	}
+	c.seqNext = st.SeqNext
+	c.seqHeld = st.SeqHeld
+	c.sent = streamSum{st.Sent.Off, st.Sent.Start, st.Sent.Crc}
+	c.received = streamSum{st.Received.Off, st.Received.Start, st.Received.Crc}
+	s.connMap.Set(st.ID, c)
+	if st.Stopped {
+		rw.Stop()
+	}
+}
+
+// resume restarts the sessions stopped by Export
+func (s *Mux) resume() {
+	s.recorder.pending = append([]byte(nil), s.recorder.frame...)
+	_ = s.conn.SetReadDeadline(time.Time{})
+	atomic.StoreUint32(&s.exporting, 0)
+	s.writeQueue.Resume()
+	s.startReadLoop()
+	s.writeSession()
+}
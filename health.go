@@ -0,0 +1,87 @@
+package npsmux
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+)
+
+// healthPrefix marks the content of the out-of-band ping sent by HealthCheck,
+// the peer echoes the content back, it never parses as a time for the latency
+var healthPrefix = []byte("health ")
+
+type healthChecks struct {
+	seq     uint64
+	waiters map[uint64]chan struct{}
+	sync.Mutex
+}
+
+func (Self *healthChecks) add() (seq uint64, ch chan struct{}) {
+	Self.Lock()
+	Self.seq++
+	seq = Self.seq
+	ch = make(chan struct{})
+	if Self.waiters == nil {
+		Self.waiters = make(map[uint64]chan struct{})
+	}
+	Self.waiters[seq] = ch
+	Self.Unlock()
+	return
+}
+
+func (Self *healthChecks) remove(seq uint64) {
+	Self.Lock()
+	delete(Self.waiters, seq)
+	Self.Unlock()
+}
+
+// done wakes up the HealthCheck waiting for the ping return
+func (Self *healthChecks) done(content []byte) {
+	content = content[len(healthPrefix):]
+	if i := bytes.IndexByte(content, ' '); i >= 0 {
+		content = content[:i] // the padding of the mtu probe
+	}
+	seq, err := strconv.ParseUint(string(content), 10, 64)
+	if err != nil {
+		return
+	}
+	Self.Lock()
+	if ch, ok := Self.waiters[seq]; ok {
+		close(ch)
+		delete(Self.waiters, seq)
+	}
+	Self.Unlock()
+}
+
+func isHealthReturn(content []byte) bool {
+	return bytes.HasPrefix(content, healthPrefix)
+}
+
+// HealthCheck sends an out-of-band ping, and waits for the peer returns it,
+// or the ctx done. nil means the mux is live
+func (s *Mux) HealthCheck(ctx context.Context) error {
+	return s.healthPing(ctx, 0)
+}
+
+// healthPing is HealthCheck, the ping is padded to the size, if it is larger
+func (s *Mux) healthPing(ctx context.Context, size int) error {
+	if s.Closed() {
+		return ErrMuxClosed
+	}
+	seq, ch := s.health.add()
+	defer s.health.remove(seq)
+	content := strconv.AppendUint(append([]byte{}, healthPrefix...), seq, 10)
+	if pad := size - len(content); pad > 0 {
+		content = append(append(content, ' '), make([]byte, pad-1)...)
+	}
+	s.sendInfo(muxPingFlag, muxPing, content)
+	select {
+	case <-ch:
+		return nil
+	case <-s.closeChan:
+		return ErrMuxClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
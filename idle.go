@@ -0,0 +1,35 @@
+package npsmux
+
+import "time"
+
+const idleCheckInterval = time.Second
+
+// idleSession closes the mux without any stream and payload in MaxIdleTime
+func (s *Mux) idleSession() {
+	ticker := s.clock.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	var last Traffic
+	since := s.clock.Now()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+		now := s.clock.Now()
+		if t := s.goodput.get(); t != last || s.connMap.Size() > 0 {
+			last = t
+			since = now
+			continue
+		}
+		if now.Sub(since) < s.config.MaxIdleTime {
+			continue
+		}
+		s.logln(LogInfo, "idle for", now.Sub(since), "close it")
+		if s.config.OnIdleClose != nil {
+			s.config.OnIdleClose(s)
+		}
+		_ = s.Close()
+		return
+	}
+}
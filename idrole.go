@@ -0,0 +1,66 @@
+package npsmux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// the two sides open the streams with the ids apart, one side allocates the
+// even ids, the other the odd ones. with the peers of featureIdRole, the roles
+// configured by MuxConfig.Server are negotiated: both sides send muxIdRole with
+// a random nonce in the id field, the low bit set if configured as the server.
+// the sides configured apart keep the roles, the sides configured the same are
+// told apart by the nonces, the greater one allocates the even ids. the streams
+// opened by both sides with the same id before it are refused on both sides,
+// and opened again with the ids of the roles negotiated
+
+// newIdNonce returns a random nonce, the low bit is left for the role configured
+func newIdNonce() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.LittleEndian.Uint32(b[:]) &^ 1
+}
+
+// localIdRole returns the nonce and the role configured of this side
+func (s *Mux) localIdRole() uint32 {
+	if s.config.Server {
+		return s.idNonce | 1
+	}
+	return s.idNonce
+}
+
+// sendIdRole announces the nonce and the role configured to the peer
+func (s *Mux) sendIdRole() {
+	s.sendInfo(muxIdRole, int32(s.localIdRole()), nil)
+}
+
+// idRoleReceived decides the roles by the muxIdRole of the peer
+func (s *Mux) idRoleReceived(peer uint32) {
+	local := s.localIdRole()
+	if peer == local {
+		// the same nonce, both sides try again with the new ones
+		s.idNonce = newIdNonce()
+		s.sendIdRole()
+		return
+	}
+	even := local > peer
+	if peer&1 != local&1 {
+		even = s.config.Server // configured apart already
+	}
+	s.setIdRole(even)
+}
+
+// setIdRole moves the id allocation to the even or odd ids
+func (s *Mux) setIdRole(even bool) {
+	var role uint32
+	if even {
+		role = 1
+	}
+	defer atomic.StoreUint32(&s.idRoleSet, 1)
+	if atomic.SwapUint32(&s.idRole, role) == role {
+		return
+	}
+	atomic.AddInt32(&s.id, 1)
+	s.logln(LogInfo, "the id role negotiated, even ids:", even)
+}
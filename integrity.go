@@ -0,0 +1,122 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// integrityBlock is the stream bytes covered by a checksum frame
+const integrityBlock = 1 << 20
+
+// ErrIntegrity is returned by the Read of the stream, if the data received
+// differs from the data the peer sent, the error is an *IntegrityError
+var ErrIntegrity = errors.New("mux: stream data corrupted")
+
+// IntegrityError tells the range of the stream corrupted, errors.Is reports
+// it is ErrIntegrity
+type IntegrityError struct {
+	ID     int32
+	Offset int64 // the first byte of the range checked
+	Length int64
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("mux: stream data corrupted, conn id: %d, bytes %d to %d", e.ID, e.Offset, e.Offset+e.Length)
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrIntegrity
+}
+
+// streamSum is the checksum of a block of the stream, the sent one is owned
+// by the write session, the received one by the read session
+type streamSum struct {
+	off   int64 // the stream bytes summed
+	start int64 // the first byte of the block
+	crc   uint32
+}
+
+func (Self *streamSum) add(p []byte) {
+	Self.crc = crc32.Update(Self.crc, crc32.IEEETable, p)
+	Self.off += int64(len(p))
+}
+
+// take returns the checksum frame content of the block, and starts the next block
+func (Self *streamSum) take() []byte {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(Self.start))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(Self.off-Self.start))
+	binary.LittleEndian.PutUint32(b[12:16], Self.crc)
+	Self.start, Self.crc = Self.off, 0
+	return b[:]
+}
+
+func (s *Mux) integrity() bool {
+	return atomic.LoadUint32(&s.peerFeatures)&featureIntegrity != 0
+}
+
+// sumSent is invoked by the write session before the frame of the stream
+// packed, the checksum frame is written before the close frame, or after
+// the last data frame of the block if after returned
+func (s *Mux) sumSent(pack *muxPackager, writer io.Writer) (after bool, err error) {
+	c := pack.conn
+	switch pack.flag {
+	case muxNewMsg, muxNewMsgPart:
+		c.sent.add(pack.content[:pack.length])
+		after = c.sent.off-c.sent.start >= integrityBlock
+	case muxMsgSeq:
+		c.sent.add(pack.content[seqHeaderSize:pack.length])
+		after = c.sent.off-c.sent.start >= integrityBlock
+	case muxConnClose, muxConnCloseConfirm:
+		if c.sent.off > c.sent.start {
+			err = s.writeChecksum(writer, c)
+		}
+	}
+	return
+}
+
+func (s *Mux) writeChecksum(writer io.Writer, c *Conn) error {
+	pack := s.arena.getPack()
+	if err := pack.Set(muxChecksum, c.connId, c.sent.take()); err != nil {
+		pack.release()
+		s.arena.putPack(pack)
+		return err
+	}
+	pack.compact = atomic.LoadUint32(&s.compactWrite) != 0
+	n, err := pack.Pack(writer)
+	s.arena.putPack(pack)
+	s.countFrame(muxChecksum, int(n), false)
+	return err
+}
+
+// checkSum is invoked by the read session for the checksum frame, the stream
+// is closed if the block received differs
+func (s *Mux) checkSum(c *Conn, content []byte) {
+	if len(content) < 16 {
+		return
+	}
+	start := int64(binary.LittleEndian.Uint64(content[0:8]))
+	length := int64(binary.LittleEndian.Uint32(content[8:12]))
+	crc := binary.LittleEndian.Uint32(content[12:16])
+	got := c.received
+	c.received.start, c.received.crc = c.received.off, 0
+	if got.start == start && got.off-got.start == length && got.crc == crc {
+		return
+	}
+	err := &IntegrityError{ID: c.connId, Offset: start, Length: length}
+	s.logln(LogWarn, err)
+	c.integrityErr.Store(err)
+	_ = c.Close()
+}
+
+// integrityError returns the error if the data received corrupted
+func (s *Conn) integrityError() error {
+	if err, ok := s.integrityErr.Load().(error); ok {
+		return err
+	}
+	return nil
+}
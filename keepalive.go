@@ -0,0 +1,110 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const keepAliveCheckInterval = time.Second
+
+// the probe is answered by the read session of the peer mux, so the answer
+// only tells the peer mux alive. the peer app hung is told by the read window
+// if PeerReadTimeout set, the data sent is not read by the peer app, while the
+// probes answered, the probe makes the peer tell the bytes read, the small
+// reads are not told else
+
+// SetKeepAlive enables the keep alive probe of the stream, if no data received
+// from the other side in d, a probe frame is sent, the other side echoes the window status,
+// the stream is closed if the echo not received in another d. zero d disables it
+func (s *Conn) SetKeepAlive(d time.Duration) {
+	s.active()
+	s.peerReading()
+	atomic.StoreInt64(&s.keepAlive, int64(d))
+	if d > 0 {
+		s.receiveWindow.mux.startKeepAlive()
+	}
+}
+
+// active marks the stream received some frames
+func (s *Conn) active() {
+	atomic.StoreInt64(&s.lastActive, s.receiveWindow.mux.clock.Now().UnixNano())
+	atomic.StoreInt64(&s.probeSent, 0)
+}
+
+// peerReading marks the peer app read some data sent, or nothing is pending
+func (s *Conn) peerReading() {
+	atomic.StoreInt64(&s.peerRead, s.receiveWindow.mux.clock.Now().UnixNano())
+	atomic.StoreInt64(&s.readProbe, 0)
+}
+
+func (s *Mux) startKeepAlive() {
+	s.keepAliveOnce.Do(func() {
+		s.goroutine(s.keepAliveSession)
+	})
+}
+
+func (s *Mux) keepAliveSession() {
+	ticker := s.clock.NewTicker(keepAliveCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+		if atomic.LoadUint32(&s.peerFeatures)&featureWindowProbe == 0 {
+			continue // the other side not answers the probe
+		}
+		now := s.clock.Now().UnixNano()
+		s.connMap.Range(func(id int32, c *Conn) bool {
+			if c.closed() {
+				return true
+			}
+			if timeout := s.config.PeerReadTimeout; timeout > 0 {
+				if s.checkPeerReading(c, now, int64(timeout)); c.closed() {
+					return true
+				}
+			}
+			keepAlive := atomic.LoadInt64(&c.keepAlive)
+			if keepAlive <= 0 {
+				return true
+			}
+			if probe := atomic.LoadInt64(&c.probeSent); probe != 0 {
+				if now-probe > keepAlive {
+					s.logln(LogInfo, "stream keep alive timeout, conn id:", id)
+					c.traceEvent(EventKeepAliveTimeout)
+					_ = c.Close()
+				}
+				return true
+			}
+			if now-atomic.LoadInt64(&c.lastActive) > keepAlive {
+				atomic.StoreInt64(&c.probeSent, now)
+				s.sendInfo(muxWindowProbe, id, nil)
+			}
+			return true
+		})
+	}
+}
+
+// checkPeerReading closes the stream if the data sent is not read by the peer
+// app in timeout, after the half it probes for the bytes read not told yet
+func (s *Mux) checkPeerReading(c *Conn, now, timeout int64) {
+	if c.sendWindow.unacked() == 0 {
+		c.peerReading()
+		return
+	}
+	since := now - atomic.LoadInt64(&c.peerRead)
+	if since <= timeout/2 {
+		return
+	}
+	if atomic.LoadInt64(&c.readProbe) == 0 {
+		atomic.StoreInt64(&c.readProbe, now)
+		s.sendInfo(muxWindowProbe, c.connId, nil)
+		return
+	}
+	if since > timeout {
+		s.logln(LogInfo, "stream peer not reading, conn id:", c.connId, "unacked:", c.sendWindow.unacked())
+		c.traceEvent(EventPeerNotReading)
+		_ = c.Close()
+	}
+}
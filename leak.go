@@ -0,0 +1,65 @@
+package npsmux
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	liveRoutines  int64 // mux goroutines still running
+	pooledBuffers int64 // window buffers got from the pool, but not put back
+	// packagers got from the pool, but not put back
+	pooledPackagers int64
+)
+
+const leakCheckTimeout = time.Second * 5
+
+// Resources is the count of the resources held by all the muxes, for
+// finding the leaks in the long running processes
+type Resources struct {
+	Goroutines int64 // the mux goroutines running
+	Buffers    int64 // the window buffers got from the pool, but not put back
+	Packagers  int64 // the packagers got from the pool, but not put back
+}
+
+// CurrentResources returns the resources held by all the muxes now
+func CurrentResources() Resources {
+	return Resources{
+		Goroutines: atomic.LoadInt64(&liveRoutines),
+		Buffers:    atomic.LoadInt64(&pooledBuffers),
+		Packagers:  atomic.LoadInt64(&pooledPackagers),
+	}
+}
+
+// goroutine starts f in a new goroutine, registered for the leak detector,
+// the panic of f is handled by OnPanic
+func (s *Mux) goroutine(f func()) {
+	atomic.AddInt64(&liveRoutines, 1)
+	go func() {
+		defer atomic.AddInt64(&liveRoutines, -1)
+		defer s.recoverPanic()
+		f()
+	}()
+}
+
+// CheckLeaks returns an error if any mux goroutine is still running, or any
+// pooled buffer or packager is not returned after all the muxes closed.
+// Goroutines exit asynchronously after Close, so it waits for a while
+// before reporting. the tests may use npsmuxtest.VerifyNoLeaks
+func CheckLeaks() error {
+	deadline := time.Now().Add(leakCheckTimeout)
+	for {
+		routines := atomic.LoadInt64(&liveRoutines)
+		buffers := atomic.LoadInt64(&pooledBuffers)
+		packagers := atomic.LoadInt64(&pooledPackagers)
+		if routines == 0 && buffers == 0 && packagers == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("npsmux: found leaks, %d goroutines running, %d buffers and %d packagers not returned to pool",
+				routines, buffers, packagers)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,97 @@
+package npsmux
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+var sessionIDs uint64 // the last session id assigned
+
+// SessionID returns the id of the mux, unique in the process, it is in
+// the logs, the stats and the dumps of the mux
+func (s *Mux) SessionID() uint64 {
+	return s.sessionID
+}
+
+// SessionID returns the id of the mux the stream belongs to
+func (s *Conn) SessionID() uint64 {
+	return s.receiveWindow.mux.sessionID
+}
+
+func newSessionID() uint64 {
+	return atomic.AddUint64(&sessionIDs, 1)
+}
+
+// LogLevel is the severity of a log, the zero value is LogInfo
+type LogLevel int
+
+const (
+	// LogDebug is the normal path, as the mux closed by the owner
+	LogDebug LogLevel = iota - 1
+	// LogInfo is the things worth knowing, as a stream reset by a policy
+	LogInfo
+	// LogWarn is the abnormal things, as the ping timeout or a protocol error
+	LogWarn
+	// LogError is the bugs, as a goroutine panic
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Logger receives the logs of the mux at MuxConfig.LogLevel or above,
+// the msg is prefixed with the session id, as "mux[id]: ..."
+type Logger interface {
+	Log(level LogLevel, msg string)
+}
+
+// logln logs with the session id, by the Logger or the log package
+func (s *Mux) logln(level LogLevel, v ...interface{}) {
+	if level < s.config.LogLevel {
+		return
+	}
+	s.output(level, strings.TrimSuffix(fmt.Sprintln(append([]interface{}{s.logPrefix()}, v...)...), "\n"))
+}
+
+func (s *Mux) logf(level LogLevel, format string, v ...interface{}) {
+	if level < s.config.LogLevel {
+		return
+	}
+	s.output(level, s.logPrefix()+" "+fmt.Sprintf(format, v...))
+}
+
+func (s *Mux) output(level LogLevel, msg string) {
+	if s.config.Logger != nil {
+		s.config.Logger.Log(level, msg)
+		return
+	}
+	log.Println(msg)
+}
+
+func (s *Mux) logPrefix() string {
+	return fmt.Sprintf("mux[%d]:", s.sessionID)
+}
+
+// errLevel returns the level of a transport error, it is normal if
+// the mux closed, or the peer closed the transport
+func (s *Mux) errLevel(err error) LogLevel {
+	if s.Closed() || err == io.EOF || err == io.ErrClosedPipe ||
+		strings.Contains(err.Error(), "use of closed network connection") {
+		return LogDebug
+	}
+	return LogWarn
+}
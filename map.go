@@ -1,18 +1,18 @@
-package nps_mux
+package npsmux
 
 import (
 	"sync"
 )
 
 type connMap struct {
-	cMap map[int32]*conn
+	cMap map[int32]*Conn
 	//closeCh chan struct{}
 	sync.RWMutex
 }
 
 func NewConnMap() *connMap {
 	cMap := &connMap{
-		cMap: make(map[int32]*conn),
+		cMap: make(map[int32]*Conn),
 	}
 	return cMap
 }
@@ -24,7 +24,7 @@ func (s *connMap) Size() (n int) {
 	return
 }
 
-func (s *connMap) Get(id int32) (*conn, bool) {
+func (s *connMap) Get(id int32) (*Conn, bool) {
 	s.RLock()
 	v, ok := s.cMap[id]
 	s.RUnlock()
@@ -34,18 +34,36 @@ func (s *connMap) Get(id int32) (*conn, bool) {
 	return nil, false
 }
 
-func (s *connMap) Set(id int32, v *conn) {
+func (s *connMap) Set(id int32, v *Conn) {
 	s.Lock()
 	s.cMap[id] = v
 	s.Unlock()
 }
 
-func (s *connMap) Close() {
+// Range calls f sequentially for each connection in the map,
+// if f returns false, range stops the iteration
+func (s *connMap) Range(f func(id int32, v *Conn) bool) {
+	s.RLock()
+	conns := make([]*Conn, 0, len(s.cMap))
 	for _, v := range s.cMap {
-		_ = v.Close() // close all the connections in the mux
+		conns = append(conns, v)
+	}
+	s.RUnlock()
+	// f may close the connection, so not call it in the lock
+	for _, v := range conns {
+		if !f(v.connId, v) {
+			return
+		}
 	}
 }
 
+func (s *connMap) Close() {
+	s.Range(func(id int32, v *Conn) bool {
+		_ = v.Close() // close all the connections in the mux
+		return true
+	})
+}
+
 func (s *connMap) Delete(id int32) {
 	s.Lock()
 	delete(s.cMap, id)
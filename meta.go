@@ -0,0 +1,217 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// the keys of the stream metadata, the metadata is sent by muxStreamMeta just before
+// the muxNewConn of the stream, or for the stream open to update it, the entries are
+// key(1) length(2) value
+const (
+	metaTenant     uint8 = iota + 1 // the tenant of the stream
+	metaPriority                    // the class of the stream data, sent for the streams open only
+	metaWindow                      // the initial receive window of the opener, uint32
+	metaEarlyData                   // the first bytes of the stream, see OpenOptions.EarlyData
+	metaRetryAfter                  // the milliseconds to wait, uint32, sent just before muxNewConnFail
+	metaDeadline                    // the nanoseconds left of OpenContext.Deadline, uint64
+	metaTrace                       // OpenContext.Trace
+	metaValues                      // OpenContext.Values
+)
+
+// MaxEarlyData is the most bytes of OpenOptions.EarlyData
+const MaxEarlyData = maximumSegmentSize - 64
+
+// OpenOptions are the options of a stream opened by NewConnOptions
+type OpenOptions struct {
+	// Tenant is the tenant of the stream, see NewTenantConn
+	Tenant string
+	// ReceiveWindow is the initial receive window of the stream, small for the
+	// interactive streams, large for the bulk ones, the window still grows or
+	// shrinks by the bandwidth later. zero means the default. it is not told to
+	// the old peers, they send by the default window
+	ReceiveWindow int
+	// EarlyData is written with the open, instead of after the stream accepted,
+	// it saves a round trip for the short exchanges as a dns query. the acceptor
+	// reads it first, as the data written. at most MaxEarlyData bytes, it is
+	// written after accepted for the old peers
+	EarlyData []byte
+	// Context is attached to the stream, the acceptor gets it by Conn.OpenContext,
+	// nil means none
+	Context *OpenContext
+}
+
+// meta encodes the metadata sent with the open, nil if nothing to send,
+// the early data is in it if early, the deadline is counted from now
+func (s *OpenOptions) meta(early bool, now time.Time) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if len(s.EarlyData) > MaxEarlyData {
+		return nil, errMetaTooLarge
+	}
+	entries := make(map[uint8][]byte)
+	if s.Tenant != "" {
+		entries[metaTenant] = []byte(s.Tenant)
+	}
+	if w := clampWindow(s.ReceiveWindow); w > 0 {
+		entries[metaWindow] = make([]byte, 4)
+		binary.LittleEndian.PutUint32(entries[metaWindow], w)
+	}
+	if early && len(s.EarlyData) > 0 {
+		entries[metaEarlyData] = s.EarlyData
+	}
+	if s.Context != nil {
+		if err := s.Context.encode(entries, now); err != nil {
+			return nil, err
+		}
+	}
+	return encodeMeta(entries)
+}
+
+// NewConnOptions is NewConn with the options
+func (s *Mux) NewConnOptions(opts OpenOptions) (*Conn, error) {
+	return s.openConn(nil, &opts)
+}
+
+var errMetaTooLarge = errors.New("mux: stream metadata too large")
+
+func encodeMeta(entries map[uint8][]byte) ([]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	keys := make([]int, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	var b []byte
+	for _, k := range keys {
+		v := entries[uint8(k)]
+		if len(b)+3+len(v) > maximumSegmentSize {
+			return nil, errMetaTooLarge
+		}
+		b = append(b, uint8(k), 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(v)))
+		b = append(b, v...)
+	}
+	return b, nil
+}
+
+func decodeMeta(b []byte) (map[uint8][]byte, error) {
+	entries := make(map[uint8][]byte)
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("mux: malformed stream metadata")
+		}
+		l := int(binary.LittleEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, errors.New("mux: malformed stream metadata")
+		}
+		entries[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	return entries, nil
+}
+
+// sendOpen sends the open of the stream, with the metadata if the peer supports,
+// the metadata is dropped for the old peers
+func (s *Mux) sendOpen(id int32, meta []byte) {
+	if meta == nil || atomic.LoadUint32(&s.peerFeatures)&featureStreamMeta == 0 {
+		s.sendBatched(muxNewConn, id)
+		return
+	}
+	// both in the control class, the metadata arrives first
+	s.sendInfo(muxStreamMeta, id, meta)
+	s.sendInfo(muxNewConn, id, nil)
+}
+
+// handleMeta applies the metadata to the stream, or keeps it for the open,
+// the priority of a stream closed is dropped
+func (s *Mux) handleMeta(id int32, content []byte) {
+	if c, ok := s.connMap.Get(id); ok {
+		c.updateMeta(content)
+		return
+	}
+	entries, err := decodeMeta(content)
+	if err != nil {
+		s.logln(LogWarn, err, "conn id:", id)
+		return
+	}
+	if _, ok := entries[metaPriority]; ok {
+		return
+	}
+	if _, ok := entries[metaRetryAfter]; ok {
+		return // the open given up already
+	}
+	s.storeMeta(id, content)
+}
+
+// updateMeta applies the metadata sent for the stream open
+func (s *Conn) updateMeta(content []byte) {
+	entries, err := decodeMeta(content)
+	if err != nil {
+		s.receiveWindow.mux.logln(LogWarn, err, "conn id:", s.connId)
+		return
+	}
+	if v := entries[metaPriority]; len(v) == 1 && Priority(v[0]) < numPriorities {
+		atomic.StoreUint32(&s.receiveWindow.peerPriority, uint32(v[0]))
+	}
+	if v := entries[metaRetryAfter]; len(v) == 4 {
+		atomic.StoreUint32(&s.retryAfter, binary.LittleEndian.Uint32(v))
+	}
+}
+
+// refuse answers muxNewConnFail to the open of the peer, with the RetryAfter
+// hint if refused for the overload and the peer understands
+func (s *Mux) refuse(id int32, overload bool) {
+	if d := s.config.RetryAfter; overload && d > 0 && atomic.LoadUint32(&s.peerFeatures)&featureStreamMeta != 0 {
+		v := make([]byte, 4)
+		binary.LittleEndian.PutUint32(v, uint32(d/time.Millisecond))
+		meta, _ := encodeMeta(map[uint8][]byte{metaRetryAfter: v})
+		s.sendInfo(muxStreamMeta, id, meta)
+	}
+	s.sendInfo(muxNewConnFail, id, nil)
+}
+
+// refused returns the error of the open refused by the peer
+func (s *Conn) refused() error {
+	if ms := atomic.LoadUint32(&s.retryAfter); ms > 0 {
+		return &RefusedError{RetryAfter: time.Duration(ms) * time.Millisecond}
+	}
+	return ErrRefused
+}
+
+// storeMeta keeps the metadata received until the muxNewConn of the stream
+func (s *Mux) storeMeta(id int32, content []byte) {
+	s.openMetaLock.Lock()
+	if s.openMeta == nil {
+		s.openMeta = make(map[int32][]byte)
+	}
+	s.openMeta[id] = append([]byte(nil), content...)
+	s.openMetaLock.Unlock()
+}
+
+// earlyData delivers the early data of the stream accepted, as the data received
+func (s *Mux) earlyData(c *Conn, meta []byte) {
+	entries, err := decodeMeta(meta)
+	if err != nil || len(entries[metaEarlyData]) == 0 {
+		return
+	}
+	data := entries[metaEarlyData]
+	content := windowBuff.GetSize(len(data))
+	copy(content, data)
+	s.deliver(c, content, uint16(len(data)))
+}
+
+func (s *Mux) takeMeta(id int32) (meta []byte) {
+	s.openMetaLock.Lock()
+	if meta = s.openMeta[id]; meta != nil {
+		delete(s.openMeta, id)
+	}
+	s.openMetaLock.Unlock()
+	return
+}
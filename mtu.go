@@ -0,0 +1,183 @@
+package npsmux
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// the mtu discovery of the ARQ mode, the segments are the datagrams of the
+// path, a segment fragmented on the path is lost much more often. the probe is
+// a segment of the kind arqProbe padded to the size, the seq is the id of the
+// probe, the peer answers it by the header of the kind arqProbeAck with the id.
+// the largest size answered is the size of the segments then.
+//
+// kcp sends a write smaller than its mtu as a datagram, and sends it again
+// until it passes, so over kcp a probe always passes, but late. the probes are
+// the health pings padded to the size of the frame, they must all be answered
+// in time, as the probes of the smallest size are, the data frames are limited
+// to the largest size passed then, the other frames are smaller. it is for the
+// paths fragmenting the larger datagrams, as the vpn in vpn, not for the paths
+// dropping them all, the kcp mtu still limits the datagrams, its header is on top
+
+const (
+	minSegmentSize    = 512  // the datagram every path carries
+	kcpMTULimit       = 1500 // the largest mtu kcp takes
+	kcpProbeCount     = 4    // the probes of a size, all answered in time, it passes
+	contentHeaderSize = 7    // flag(1) id(4) length(2) of a frame with the content
+	mtuProbeStep      = 32   // the search stops when the range is smaller
+	mtuProbeTimeout   = time.Second * 3
+	mtuProbeInterval  = time.Minute * 10 // probes again for the path changed
+)
+
+// SegmentSize returns the largest datagram sent in the ARQ mode, it is lowered
+// by the mtu discovery if the path can not carry the full segments. over kcp,
+// it is the largest frame the discovery found, zero before found, or without it
+func (s *Mux) SegmentSize() int {
+	if s.arq == nil {
+		return int(atomic.LoadUint32(&s.segmentSize))
+	}
+	return int(atomic.LoadUint32(&s.arq.mtu))
+}
+
+// mtuSession probes the largest datagram the path carries, the segments are
+// limited to the size found
+func (Self *arqConn) mtuSession() {
+	for {
+		hi := Self.config.segmentSize()
+		lo := minSegmentSize
+		if lo > hi {
+			lo = hi
+		}
+		size := searchSegmentSize(lo, hi, Self.probe)
+		select {
+		case <-Self.closeCh:
+			return
+		default:
+		}
+		if old := atomic.SwapUint32(&Self.mtu, uint32(size)); old != uint32(size) {
+			Self.mux.logln(LogInfo, "segment size probed", size)
+		}
+		timer := Self.mux.clock.NewTimer(mtuProbeInterval)
+		select {
+		case <-timer.C():
+		case <-Self.closeCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// kcpMTUSession probes the largest frame the path carries in time over kcp,
+// the data frames are limited to the size found
+func (s *Mux) kcpMTUSession() {
+	for {
+		if timeout, ok := s.kcpProbeTimeout(); ok {
+			size := searchSegmentSize(minSegmentSize, kcpMTULimit, func(size int) bool {
+				return s.kcpProbe(size, timeout)
+			})
+			if atomic.SwapUint32(&s.segmentSize, uint32(size)) != uint32(size) {
+				s.logln(LogInfo, "segment size probed", size)
+			}
+		}
+		timer := s.clock.NewTimer(mtuProbeInterval)
+		select {
+		case <-timer.C():
+		case <-s.closeChan:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// kcpProbeTimeout returns the time the probes must be answered in,
+// twice the slowest of the probes of the smallest size
+func (s *Mux) kcpProbeTimeout() (timeout time.Duration, ok bool) {
+	for i := 0; i < kcpProbeCount; i++ {
+		start := s.clock.Now()
+		if !s.kcpPing(minSegmentSize, mtuProbeTimeout) {
+			return 0, false
+		}
+		if d := s.clock.Now().Sub(start); d > timeout {
+			timeout = d
+		}
+	}
+	return timeout * 2, true
+}
+
+// kcpProbe reports whether the probes of the size are all answered in time
+func (s *Mux) kcpProbe(size int, timeout time.Duration) bool {
+	for i := 0; i < kcpProbeCount; i++ {
+		if !s.kcpPing(size, timeout) {
+			// the probe late is still sent, wait for it through
+			s.kcpPing(0, mtuProbeTimeout)
+			return false
+		}
+	}
+	return true
+}
+
+// kcpPing sends a health ping of the frame size, and reports whether it is answered in time
+func (s *Mux) kcpPing(size int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.healthPing(ctx, size-contentHeaderSize) == nil
+}
+
+// searchSegmentSize returns the largest size in [lo, hi] probe succeeds,
+// lo is assumed to work
+func searchSegmentSize(lo, hi int, probe func(size int) bool) int {
+	if probe(hi) {
+		return hi
+	}
+	for hi-lo > mtuProbeStep {
+		mid := (lo + hi) / 2
+		if probe(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// probe sends a probe of the datagram size, and waits for the peer answers it
+func (Self *arqConn) probe(size int) bool {
+	ch := make(chan struct{}, 1)
+	Self.mu.Lock()
+	Self.probeID++
+	id := Self.probeID
+	if Self.probes == nil {
+		Self.probes = make(map[uint32]chan struct{})
+	}
+	Self.probes[id] = ch
+	// the acks carried may be lost with the probe, they are sent again
+	pending := Self.ackPending
+	b := Self.header(arqProbe, id)
+	Self.ackPending = pending
+	Self.mu.Unlock()
+	defer func() {
+		Self.mu.Lock()
+		delete(Self.probes, id)
+		Self.mu.Unlock()
+	}()
+	pad := size - len(b)
+	if Self.config.fec() {
+		pad -= fecOverhead
+	}
+	if pad > 0 {
+		b = append(b, make([]byte, pad)...)
+	}
+	if Self.writeDatagram(b) != nil {
+		return false
+	}
+	timer := Self.mux.clock.NewTimer(mtuProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C():
+	case <-Self.closeCh:
+	}
+	return false
+}
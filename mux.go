@@ -1,12 +1,15 @@
-package nps_mux
+package npsmux
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"math"
 	"net"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,129 +24,543 @@ const (
 	muxNewConn
 	muxConnClose
 	muxPingReturn
-	muxPing            int32 = -1
-	maximumSegmentSize       = poolSizeWindow
-	maximumWindowSize        = 1 << 27 // 1<<31-1 TCP slide window size is very large,
+	muxFeatures
+	muxNewConnBatch
+	muxNewConnOkBatch
+	muxWindowProbe
+	muxGoAway
+	muxCompactHeader          // the frames after it use the compact header
+	muxPadding                // random content, dropped by the receiver
+	muxCongestion             // the receiver falls behind, the sender slows down
+	muxConnCloseConfirm       // muxConnClose, the closer asks for the bytes received
+	muxConnCloseAck           // the answer of muxConnCloseConfirm, carries the bytes received
+	muxChecksum               // the checksum of a block of the stream data sent
+	muxStreamMeta             // the metadata of the stream opened by the next muxNewConn
+	muxMsgSeq                 // the data with the offset in the stream, see seqHeaderSize
+	muxConnOpenCancel         // the opener gave up waiting for the reply of muxNewConn
+	muxConnCloseWrite         // the sender writes no more, the stream reads on
+	muxIdRole                 // the nonce deciding which side allocates the even ids
+	muxPing             int32 = -1
+	maximumSegmentSize        = poolSizeWindow
+	maximumWindowSize         = 1 << 27 // 1<<31-1 TCP slide window size is very large,
 	// we use 128M, reduce memory usage
+	pingChSize = 4 // ping returns waiting for the latency calculation, the more are dropped
 )
 
+const (
+	featureOpenBatch     uint32 = 1 << iota // peer understands muxNewConnBatch and muxNewConnOkBatch
+	featureWindowProbe                      // peer answers muxWindowProbe with the window status
+	featureCompactHeader                    // peer decodes the compact header after muxCompactHeader
+	featurePadding                          // peer drops muxPadding
+	featureCongestion                       // peer understands muxCongestion
+	featureCloseConfirm                     // peer answers muxConnCloseConfirm
+	featureIntegrity                        // peer checks the stream data by muxChecksum, only if configured
+	featureStreamMeta                       // peer understands muxStreamMeta
+	featureIdQuarantine                     // peer opens an id again only after the muxConnClose of both sides
+	featureSequence                         // peer reorders the data by muxMsgSeq
+	featureOpenCancel                       // peer drops the stream not accepted by muxConnOpenCancel
+	featureHalfClose                        // peer reads io.EOF by muxConnCloseWrite
+	featureIdRole                           // peer negotiates the id spaces by muxIdRole
+)
+
+// localFeatures are announced to the other side by the muxFeatures frame,
+// the feature bits are carried in the id field, so old peers just drop it
+const localFeatures = featureOpenBatch | featureWindowProbe | featureCompactHeader | featurePadding |
+	featureCongestion | featureCloseConfirm | featureStreamMeta | featureIdQuarantine | featureSequence |
+	featureOpenCancel | featureHalfClose | featureIdRole
+
+// LatestProtocolRevision is the protocol revision of this version, the revision 1
+// is the base protocol without the muxFeatures frame, every later revision adds
+// a feature, the optional features are not in any revision
+const LatestProtocolRevision = 13
+
+// revisionAdds is the feature added by each revision
+var revisionAdds = [...]uint32{2: featureOpenBatch, 3: featureWindowProbe, 4: featureCompactHeader,
+	5: featurePadding, 6: featureCongestion, 7: featureCloseConfirm, 8: featureStreamMeta,
+	9: featureIdQuarantine, 10: featureSequence, 11: featureOpenCancel, 12: featureHalfClose,
+	13: featureIdRole}
+
+// revisionFeatures returns the features announced by the revision, zero means the latest
+func revisionFeatures(revision int) (features uint32) {
+	if revision <= 0 || revision >= LatestProtocolRevision {
+		return localFeatures
+	}
+	for r := 2; r <= revision; r++ {
+		features |= revisionAdds[r]
+	}
+	return
+}
+
 type Mux struct {
-	latency uint64 // we store latency in bits, but it's float64
+	latency      uint64         // we store latency in bits, but it's float64
+	traffic      trafficCounter // 64bit alignment
+	goodput      trafficCounter // the payload traffic of all the streams
+	quota        int64          // the payload bytes limit, zero means no limit
+	refusedConns uint64         // the streams refused by the rate limit
+	// the sequenced frames held for the frames before them, and dropped as received twice
+	reorderedFrames uint64
+	duplicateFrames uint64
+	staleFrames     uint64 // the late frames of the ids quarantined
+	congestion      uint64 // the congestion notifications received
+	lastReceived    int64  // the monotonic nano a frame received last time
+	congestCheck    int64  // unix nano of the last congestion check
 	net.Listener
-	conn               net.Conn
-	connMap            *connMap
-	newConnCh          chan *conn
-	id                 int32
-	closeChan          chan struct{}
-	IsClose            bool
-	counter            *latencyCounter
-	bw                 *bandwidth
-	pingCh             chan []byte
-	pingCheckTime      uint32 // we check the ping per 5s
-	pingCheckThreshold uint32
-	connType           string
-	writeQueue         priorityQueue
-	newConnQueue       connQueue
+	conn      net.Conn
+	arq       *arqConn // the conn is it in the ARQ mode
+	connMap   *connMap
+	newConnCh chan *Conn
+	id        int32
+	closeChan chan struct{}
+	failure   atomic.Value // the error the mux failed by, see Err
+	// Deprecated: racy, use Closed instead, it is only set for compatibility
+	IsClose          bool
+	closed           uint32 // accessed atomically, set once by Close
+	quotaHit         uint32
+	counter          *latencyCounter
+	bw               *bandwidth // the read bandwidth
+	sentBw           *bandwidth // the bytes written to the transport, only the write session updates it
+	ackedBw          *bandwidth // the bytes acknowledged by the peer, only the read session updates it
+	pingCh           chan []byte
+	sessionID        uint64        // unique in the process, see SessionID
+	epoch            time.Time     // the monotonic times are since it
+	pingTimeout      time.Duration // closes the mux if nothing received for it
+	connType         string
+	profile          *TransportProfile
+	writeQueue       priorityQueue
+	newConnQueue     connQueue
+	peerFeatures     uint32 // the features both sides announced
+	features         uint32 // the features announced by this side
+	idRole           uint32 // 1 if this side allocates the even ids, accessed atomically
+	idNonce          uint32 // decides the id roles, only the read session uses it
+	idRoleSet        uint32 // the id roles negotiated, accessed atomically
+	newConnBatch     idBatch
+	newConnOkBatch   idBatch
+	windowStalls     uint64
+	newConnLimiter   *tokenBucket
+	reader           io.Reader      // the transport, or the recorder reading it
+	recorder         *frameRecorder // not nil if handoff enabled
+	staging          *stagingReader // the transport read in large chunks
+	exporting        uint32
+	flags            []trafficCounter // the traffic of each flag, allocated for 64bit alignment
+	shaper           *shaper
+	pacer            *pacer
+	compactSent      uint32 // muxCompactHeader pushed into the write queue
+	compactWrite     uint32 // the frames written use the compact header
+	compactRead      uint32 // the frames read use the compact header
+	readDone         chan struct{}
+	writeDone        chan struct{}
+	openSlots        chan struct{} // the NewConn waiting for the reply, nil means no limit
+	keepAliveOnce    sync.Once
+	slowConsumerOnce sync.Once
+	health           healthChecks
+	closeConfirms    closeConfirms
+	arena            sessionArena // the packagers of the mux
+	tenants          map[string]*tenant
+	tenantLock       sync.Mutex
+	openMeta         map[int32][]byte // the metadata received, waiting for muxNewConn
+	openMetaLock     sync.Mutex
+	pendingOpens     map[int32]*Conn // the streams opened by the peer, not accepted yet
+	pendingLock      sync.Mutex
+	quarantined      map[int32]struct{} // the ids closed here, waiting for the close of the peer
+	quarantineLock   sync.Mutex
+	segmentSize      uint32 // the largest frame over kcp by the mtu discovery, accessed atomically
+	goAway           uint32
+	paused           uint32        // accessed atomically, see pause.go
+	dataQueued       int32         // the data frames admitted, not written yet
+	resumeCh         chan struct{} // closed by Resume
+	pauseLock        sync.Mutex
+	drainOnce        sync.Once
+	config           MuxConfig
+	clock            Clock
 }
 
 func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
-	//c.(*net.TCPConn).SetReadBuffer(0)
-	//c.(*net.TCPConn).SetWriteBuffer(0)
-	fd, err := getConnFd(c)
-	if err != nil {
-		log.Println(err)
+	return NewMuxWithConfig(c, connType, &MuxConfig{PingCheckThreshold: pingCheckThreshold})
+}
+
+// NewMuxWithConfig is like NewMux, but with the settings in config, nil config means default.
+// if the config refuses the transport, as RequireEncryption over a plaintext one, the mux
+// returned is failed without any session started, see NewMuxChecked
+func NewMuxWithConfig(c net.Conn, connType string, config *MuxConfig) *Mux {
+	m := newMux(c, connType, config)
+	if err := m.config.check(c); err != nil {
+		m.logln(LogError, "transport refused:", err, "remote:", c.RemoteAddr())
+		m.fail(err)
+		return m
 	}
-	var checkThreshold uint32
-	if pingCheckThreshold <= 0 {
-		if connType == "kcp" {
-			checkThreshold = 20
-		} else {
-			checkThreshold = 60
+	m.start()
+	return m
+}
+
+// NewMuxChecked is like NewMuxWithConfig, but returns the error if the config refuses
+// the transport, as ErrPlaintext, nothing is started then and the caller still owns c
+func NewMuxChecked(c net.Conn, connType string, config *MuxConfig) (*Mux, error) {
+	if config != nil {
+		if err := config.check(c); err != nil {
+			return nil, err
 		}
 	}
+	return NewMuxWithConfig(c, connType, config), nil
+}
+
+// newMux initials the mux, but not starts any session
+func newMux(c net.Conn, connType string, config *MuxConfig) *Mux {
+	if config == nil {
+		config = new(MuxConfig)
+	}
+	fd, fdErr := getConnFd(c)
 	m := &Mux{
-		conn:               c,
-		connMap:            NewConnMap(),
-		id:                 0,
-		closeChan:          make(chan struct{}, 1),
-		newConnCh:          make(chan *conn),
-		bw:                 NewBandwidth(fd),
-		IsClose:            false,
-		connType:           connType,
-		pingCh:             make(chan []byte),
-		pingCheckThreshold: checkThreshold,
-		counter:            newLatencyCounter(),
-	}
-	m.writeQueue.New()
+		conn:        c,
+		connMap:     NewConnMap(),
+		closeChan:   make(chan struct{}, 1),
+		newConnCh:   make(chan *Conn),
+		bw:          NewBandwidth(fd),
+		sentBw:      &bandwidth{clock: config.clock()},
+		ackedBw:     &bandwidth{clock: config.clock()},
+		connType:    connType,
+		flags:       make([]trafficCounter, numFlags),
+		profile:     config.profile(connType),
+		pingCh:      make(chan []byte, pingChSize),
+		pingTimeout: config.pingTimeout(connType),
+		counter:     newLatencyCounter(),
+		config:      *config,
+		clock:       config.clock(),
+	}
+	m.bw.clock = m.clock
+	m.epoch = m.clock.Now()
+	m.sessionID = newSessionID()
+	m.tuneTCP()
+	if fdErr != nil {
+		m.logln(LogDebug, fdErr) // normal for the transports without the fd, as kcp and the pipes
+	}
+	if config.Server {
+		m.idRole = 1
+	}
+	m.idNonce = newIdNonce()
+	m.id = m.idBase()
+	if config.NewConnRate > 0 {
+		m.newConnLimiter = newTokenBucket(m.clock, config.NewConnRate, config.NewConnBurst)
+	}
+	if config.Padding != nil {
+		m.shaper = newShaper(m, *config.Padding)
+	}
+	if config.Pacing {
+		m.pacer = newPacer(m)
+	}
+	if config.MaxPendingOpens > 0 {
+		m.openSlots = make(chan struct{}, config.MaxPendingOpens)
+	}
+	m.features = revisionFeatures(config.ProtocolRevision)
+	if config.Integrity {
+		m.features |= featureIntegrity
+	}
+	if config.ARQ != nil {
+		m.arq = newARQConn(m, c, *config.ARQ)
+		m.conn = m.arq
+		c = m.arq
+	}
+	m.staging = newStagingReader(c)
+	m.reader = m.staging
+	if config.WireTransform != nil {
+		m.reader = &transformReader{t: config.WireTransform, r: m.staging}
+	}
+	if config.Handoff {
+		m.recorder = &frameRecorder{r: m.reader}
+		m.reader = m.recorder
+	}
+	m.writeQueue.New(m.clock, config.maxQueueDelay())
+	if config.NewScheduler != nil {
+		m.writeQueue.sched = config.NewScheduler()
+	}
 	m.newConnQueue.New()
+	return m
+}
+
+func (s *Mux) start() {
+	if s.config.ProtocolRevision != 1 {
+		s.sendInfo(muxFeatures, int32(s.features), nil)
+		// the base protocol has no muxFeatures
+	}
+	if s.arq != nil {
+		s.arq.start()
+	} else if s.connType == "kcp" && s.config.MTUDiscovery {
+		s.goroutine(s.kcpMTUSession)
+	}
 	//read session by flag
-	m.readSession()
+	s.readSession()
 	//ping
-	m.ping()
-	m.writeSession()
-	return m
+	s.ping()
+	s.writeSession()
+	if s.config.StreamKeepAlive > 0 || s.config.PeerReadTimeout > 0 {
+		s.startKeepAlive()
+	}
+	if s.config.MaxSessionLifetime > 0 {
+		s.goroutine(s.lifetimeSession)
+	}
+	if s.config.WindowWatchdogRtts > 0 {
+		s.goroutine(s.watchdogSession)
+	}
+	if s.config.SlowConsumerTimeout > 0 {
+		s.startSlowConsumer()
+	}
+	if s.config.MaxIdleTime > 0 {
+		s.goroutine(s.idleSession)
+	}
+	if s.slowLog().ReadStall > 0 {
+		s.goroutine(s.slowReadSession)
+	}
 }
 
-func (s *Mux) NewConn() (*conn, error) {
-	if s.IsClose {
-		return nil, errors.New("the mux has closed")
+// NewConn opens a new connection to the other side, and waits for it accepted
+func (s *Mux) NewConn() (*Conn, error) {
+	return s.openConn(nil, nil)
+}
+
+// openConn is NewConn, it gives up waiting once cancel closed
+func (s *Mux) openConn(cancel <-chan struct{}, opts *OpenOptions) (_ *Conn, err error) {
+	if s.Closed() {
+		return nil, ErrMuxClosed
 	}
-	conn := NewConn(s.getId(), s)
-	//it must be Set before send
-	s.connMap.Set(conn.connId, conn)
-	s.sendInfo(muxNewConn, conn.connId, nil)
+	if atomic.LoadUint32(&s.goAway) != 0 {
+		return nil, fmt.Errorf("mux: the mux is going away: %w", ErrRefused)
+	}
+	start := s.clock.Now()
 	//Set a timer timeout 120 second
-	timer := time.NewTimer(time.Minute * 2)
+	timer := s.clock.NewTimer(time.Minute * 2)
 	defer timer.Stop()
+	if s.openSlots != nil {
+		if err := s.acquireOpenSlot(timer, cancel); err != nil {
+			return nil, err
+		}
+		defer func() { <-s.openSlots }()
+	}
+	// the early data is written after accepted, if the peer drops the metadata
+	early := opts != nil && len(opts.EarlyData) > 0
+	withMeta := atomic.LoadUint32(&s.peerFeatures)&featureStreamMeta != 0
+	meta, err := opts.meta(withMeta, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	var conn *Conn
+	defer func() { s.slowOpen(conn.connId, start, err) }()
+open:
+	conn = newConn(s.getId(), s)
+	conn.openState = connOpening
+	if opts != nil && opts.Tenant != "" && !conn.joinTenant(opts.Tenant) {
+		return nil, errTenantStreams
+	}
+	if opts != nil {
+		conn.receiveWindow.setInitial(clampWindow(opts.ReceiveWindow))
+	}
+	if early && withMeta {
+		conn.sendWindow.sentEarly(opts.EarlyData)
+	}
+	//it must be Set before send
+	s.connMap.Set(conn.connId, conn)
+	s.sendOpen(conn.connId, meta)
+	var abandoned error
 	select {
 	case <-conn.connStatusOkCh:
+		if early && !withMeta {
+			if _, err = conn.Write(opts.EarlyData); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
 		return conn, nil
-	case <-timer.C:
+	case <-conn.connStatusFailCh:
+		err = conn.refused()
+	case <-timer.C():
+		abandoned = fmt.Errorf("mux: wait for the stream accepted: %w", ErrTimeout)
+	case <-cancel:
+		abandoned = errors.New("mux: open canceled")
+	case <-s.closeChan:
+		// the mux closed while opening, no reply any more
+		abandoned = ErrMuxClosed
+	}
+	if abandoned != nil {
+		err = abandoned
+		if !atomic.CompareAndSwapUint32(&conn.openState, connOpening, connAbandoned) {
+			// the reply arrived at the same time, the read session is sending it
+			select {
+			case <-conn.connStatusOkCh:
+				return conn, nil
+			case <-conn.connStatusFailCh:
+				err = conn.refused()
+			}
+		} else if abandoned != ErrMuxClosed {
+			s.sendOpenCancel(conn.connId)
+		}
 	}
-	return nil, errors.New("create connection fail，the server refused the connection")
+	s.connMap.Delete(conn.connId)
+	conn.leaveTenant()
+	conn.traceEvent(EventOpenFailed)
+	conn.traceEnd()
+	if abandoned == nil && atomic.LoadUint32(&conn.collided) != 0 && atomic.LoadUint32(&s.idRoleSet) != 0 {
+		// opened by both sides before the roles negotiated, the ids are apart now
+		goto open
+	}
+	return nil, err
 }
 
-func (s *Mux) Accept() (net.Conn, error) {
-	if s.IsClose {
-		return nil, errors.New("accpet error,the mux has closed")
+// acquireOpenSlot takes a slot of the pending NewConn, waits for one released,
+// or fails at once if PendingOpensFailFast set
+func (s *Mux) acquireOpenSlot(timer Timer, cancel <-chan struct{}) error {
+	select {
+	case s.openSlots <- struct{}{}:
+		return nil
+	default:
 	}
-	conn := <-s.newConnCh
-	if conn == nil {
-		return nil, errors.New("accpet error,the conn has closed")
+	if s.config.PendingOpensFailFast {
+		return fmt.Errorf("mux: too many pending opens: %w", ErrRefused)
+	}
+	select {
+	case s.openSlots <- struct{}{}:
+		return nil
+	case <-s.closeChan:
+		return ErrMuxClosed
+	case <-timer.C():
+		return fmt.Errorf("mux: wait for pending opens: %w", ErrTimeout)
+	case <-cancel:
+		return errors.New("mux: wait for pending opens canceled")
+	}
+}
+
+// Accept waits for and returns the next connection opened by the other side,
+// it implements net.Listener, the returned net.Conn is always a *Conn
+func (s *Mux) Accept() (net.Conn, error) {
+	conn, err := s.AcceptConn()
+	if err != nil {
+		return nil, err
 	}
 	return conn, nil
 }
 
+// AcceptConn is like Accept, but returns the *Conn directly
+func (s *Mux) AcceptConn() (*Conn, error) {
+	if s.Closed() {
+		return nil, ErrMuxClosed
+	}
+	select {
+	case conn := <-s.newConnCh:
+		return conn, nil
+	case <-s.closeChan:
+		return nil, ErrMuxClosed
+	}
+}
+
+// CloseStream closes the connection with the given id,
+// the other connections in the mux are not affected
+func (s *Mux) CloseStream(id int32) error {
+	connection, ok := s.connMap.Get(id)
+	if !ok {
+		return ErrStreamClosed
+	}
+	return connection.Close()
+}
+
+// Range calls f for each connection in the mux, until f returns false
+func (s *Mux) Range(f func(*Conn) bool) {
+	s.connMap.Range(func(id int32, v *Conn) bool {
+		return f(v)
+	})
+}
+
+// Bandwidth returns the estimated read bandwidth of the mux in bytes per second,
+// ok is false if not estimated yet
+func (s *Mux) Bandwidth() (bw float64, ok bool) {
+	return s.bw.Get()
+}
+
+// WriteBandwidth returns the estimated write bandwidth of the mux in bytes per second,
+// sent is written to the transport, acked is acknowledged by the windows of the peer,
+// the sent above the acked is buffered on the path. ok is false if not estimated yet
+func (s *Mux) WriteBandwidth() (sent, acked float64, ok bool) {
+	sent, ok = s.sentBw.Get()
+	acked, _ = s.ackedBw.Get()
+	return
+}
+
 func (s *Mux) Addr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
-func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
-	if s.IsClose {
-		return
+func (s *Mux) sendInfo(flag uint8, id int32, data []byte) {
+	s.sendInfoPriority(flag, id, s.framePriority(flag, id), data)
+}
+
+// sendInfoPriority pushes the frame into the write queue as the class p
+func (s *Mux) sendInfoPriority(flag uint8, id int32, p Priority, data []byte) {
+	if pack := s.newPack(flag, id, p, data); pack != nil {
+		s.writeQueue.Push(pack)
 	}
-	var err error
-	pack := muxPack.Get()
-	err = pack.Set(flag, id, data)
-	if err != nil {
-		muxPack.Put(pack)
-		log.Println("mux: New Pack err", err)
-		_ = s.Close()
+}
+
+// sendWindowUpdate pushes the muxMsgSendOk of the window into the write queue as the class p
+func (s *Mux) sendWindowUpdate(id int32, p Priority, window uint64) {
+	if s.Closed() {
 		return
 	}
+	pack := s.arena.getPack()
+	pack.SetWindow(id, window)
+	pack.priority = p
 	s.writeQueue.Push(pack)
-	return
+}
+
+// newPack gets a packager of the class p, it returns nil if the mux closed
+func (s *Mux) newPack(flag uint8, id int32, p Priority, data []byte) *muxPackager {
+	if s.Closed() {
+		return nil
+	}
+	pack := s.arena.getPack()
+	if err := pack.Set(flag, id, data); err != nil {
+		pack.release()
+		s.arena.putPack(pack)
+		s.logln(LogWarn, "new pack err", err)
+		_ = s.Close()
+		return nil
+	}
+	pack.priority = p
+	return pack
 }
 
 func (s *Mux) writeSession() {
-	go func() {
+	done := make(chan struct{})
+	s.writeDone = done
+	s.goroutine(func() {
+		defer close(done)
+		writer, records := s.newWriter()
+		highWater := s.config.writeQueueHighWater()
+		var congested bool
 		for {
-			if s.IsClose {
+			if s.Closed() {
 				break
 			}
+			if records != nil && s.writeQueue.Len() == 0 {
+				if err := records.Flush(); err != nil {
+					s.logln(s.errLevel(err), "pack err", err)
+					s.fail(err)
+					break
+				}
+				// nothing to gather, flush before waiting
+			}
+			s.simYield(simQueuePop)
+			burst := s.writeQueue.Len() == 0 // the frame popped begins a burst
 			pack := s.writeQueue.Pop()
-			if s.IsClose {
-				break
+			if s.Closed() || pack == nil {
+				if records != nil {
+					_ = records.Flush()
+				}
+				break // closed, or stopped by Export
+			}
+			if n := s.writeQueue.Len(); n+1 >= highWater {
+				congested = true
+			} else if n == 0 && congested {
+				congested = false
+				s.writeQueueDrained()
+			}
+			if pack.flag == muxNewConnBatch || pack.flag == muxNewConnOkBatch {
+				s.fillBatch(pack)
 			}
 			//if pack.flag == muxNewMsg || pack.flag == muxNewMsgPart {
 			//	if pack.length >= 100 {
@@ -152,104 +569,333 @@ func (s *Mux) writeSession() {
 			//		log.Println("write session id", pack.id, "\n", string(pack.content[:pack.length]))
 			//	}
 			//}
-			err := pack.Pack(s.conn)
-			muxPack.Put(pack)
+			if s.shaper != nil && burst {
+				s.shaper.delay()
+			}
+			if s.pacer != nil && isData(pack.flag) {
+				s.pacer.wait(int(pack.length))
+			}
+			var n uint16
+			var err error
+			var sumAfter bool
+			c := pack.conn
+			if pack.flag == muxPingFlag {
+				s.restampPing(pack)
+			}
+			if records != nil {
+				// the whole frame in one record
+				err = records.begin(int(pack.length) + poolSizeHeader)
+			}
+			if err == nil && c != nil && s.integrity() {
+				sumAfter, err = s.sumSent(pack, writer)
+			}
+			if err == nil {
+				pack.compact = atomic.LoadUint32(&s.compactWrite) != 0
+				start := s.clock.Now()
+				n, err = pack.Pack(writer)
+				s.slowFrameWrite(pack, n, start)
+			} else {
+				pack.release()
+			}
+			if err == nil && sumAfter {
+				err = s.writeChecksum(writer, c)
+			}
+			if pack.flag == muxCompactHeader {
+				atomic.StoreUint32(&s.compactWrite, 1)
+				// the other side decodes the compact header from the next frame
+			}
+			if pack.conn != nil {
+				pack.conn.stats.frameSent(time.Duration(s.clock.Now().UnixNano() - pack.queued))
+			}
+			if isData(pack.flag) {
+				atomic.AddInt32(&s.dataQueued, -1)
+			}
+			s.countFrame(pack.flag, int(n), false)
+			s.sentBw.add(uint32(n))
+			s.arena.putPack(pack)
+			if err == nil && s.shaper != nil {
+				err = s.shaper.pad(writer)
+			}
 			if err != nil {
-				log.Println("mux: Pack err", err)
-				_ = s.Close()
+				s.logln(s.errLevel(err), "pack err", err)
+				s.fail(err)
 				break
 			}
 		}
-	}()
+	})
+}
+
+const (
+	maxWriteRetries = 8
+	writeRetryDelay = time.Millisecond * 10
+)
+
+// retryWriter writes all the data to the transport, the partial write
+// is continued, the temporary error is retried with backoff, only the
+// permanent error is returned
+type retryWriter struct {
+	w   io.Writer
+	mux *Mux
+}
+
+func (Self *retryWriter) Write(p []byte) (n int, err error) {
+	var l, retries int
+	delay := writeRetryDelay
+	for n < len(p) {
+		l, err = Self.w.Write(p[n:])
+		n += l
+		if err == nil {
+			if l == 0 {
+				return n, io.ErrShortWrite
+			}
+			continue // partial write without error, write the left
+		}
+		if ne, ok := err.(net.Error); !ok || !(ne.Temporary() || ne.Timeout()) || retries >= maxWriteRetries {
+			return
+		}
+		retries++
+		Self.mux.logln(LogInfo, "temporary write err, retry", retries, err)
+		timer := Self.mux.clock.NewTimer(delay)
+		<-timer.C()
+		delay *= 2
+	}
+	return n, nil
+}
+
+// drainPingCh puts back the ping returns left in the channel,
+// it is invoked after the read session exited, nobody sends to the channel then
+func (s *Mux) drainPingCh() {
+	for {
+		select {
+		case data := <-s.pingCh:
+			windowBuff.Put(data)
+		default:
+			return
+		}
+	}
+}
+
+// pingStampSize is the content of the ping, the session id(8) and the monotonic
+// nano since the mux created(8), the peer returns it as is, so the wall clock
+// steps are not in the latency. the write session stamps the ping again when
+// written, the time queued is not in the latency
+const pingStampSize = 16
+
+func (s *Mux) pingStamp() []byte {
+	b := make([]byte, pingStampSize)
+	s.putPingStamp(b)
+	return b
+}
+
+func (s *Mux) putPingStamp(b []byte) {
+	binary.LittleEndian.PutUint64(b, s.sessionID)
+	binary.LittleEndian.PutUint64(b[8:], uint64(s.monotonic()))
+}
+
+// pingSent returns the monotonic nano the ping returned was sent, false if it
+// is not stamped by this mux, as by the process exported the mux
+func (s *Mux) pingSent(b []byte) (int64, bool) {
+	if len(b) != pingStampSize || binary.LittleEndian.Uint64(b) != s.sessionID {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(b[8:])), true
+}
+
+// restampPing sets the time the ping written
+func (s *Mux) restampPing(pack *muxPackager) {
+	if pack.id != muxPing || int(pack.length) != pingStampSize || isHealthReturn(pack.content) {
+		return
+	}
+	s.putPingStamp(pack.content)
+}
+
+// monotonic returns the nano since the mux created, by the monotonic clock,
+// the timeouts are not broken by the wall clock changed
+func (s *Mux) monotonic() int64 {
+	return int64(s.clock.Now().Sub(s.epoch))
 }
 
 func (s *Mux) ping() {
-	go func() {
-		now, _ := time.Now().UTC().MarshalText()
-		s.sendInfo(muxPingFlag, muxPing, now)
+	s.goroutine(func() {
+		s.sendInfo(muxPingFlag, muxPing, s.pingStamp())
 		// send the ping flag and Get the latency first
-		ticker := time.NewTicker(time.Second * 5)
+		ticker := s.clock.NewTicker(s.config.pingInterval())
 		defer ticker.Stop()
+		check := true
 		for {
-			if s.IsClose {
+			if s.Closed() {
 				break
 			}
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
+			case <-s.closeChan:
+				return
 			}
-			if atomic.LoadUint32(&s.pingCheckTime) > s.pingCheckThreshold {
-				log.Println("mux: ping time out")
-				_ = s.Close()
-				// more than limit times not receive the ping return package,
-				// mux conn is damaged, maybe a packet drop, close it
-				break
+			if check && s.monotonic()-atomic.LoadInt64(&s.lastReceived) > int64(s.pingTimeout) {
+				s.logln(LogWarn, "ping time out, nothing received in", s.pingTimeout)
+				action := ActionClose
+				if s.config.OnPingTimeout != nil {
+					action = s.config.OnPingTimeout(s)
+				}
+				switch action {
+				case ActionIgnore:
+					atomic.StoreInt64(&s.lastReceived, s.monotonic())
+					// wait for another timeout
+				case ActionMigrate:
+					check = false
+					// application takes over, keep sending ping to measure the latency
+				default:
+					s.fail(errPingTimeout)
+					// more than limit times not receive the ping return package,
+					// mux conn is damaged, maybe a packet drop, close it
+					return
+				}
 			}
-			now, _ := time.Now().UTC().MarshalText()
-			s.sendInfo(muxPingFlag, muxPing, now)
-			atomic.AddUint32(&s.pingCheckTime, 1)
+			s.sendInfo(muxPingFlag, muxPing, s.pingStamp())
 		}
 		return
-	}()
+	})
 
-	go func() {
-		var now time.Time
+	s.goroutine(func() {
 		var data []byte
 		for {
-			if s.IsClose {
-				break
-			}
 			select {
 			case data = <-s.pingCh:
-				atomic.StoreUint32(&s.pingCheckTime, 0)
 			case <-s.closeChan:
-				break
+				return
 			}
-			_ = now.UnmarshalText(data)
-			latency := time.Now().UTC().Sub(now).Seconds()
-			if latency > 0 {
+			sent, ok := s.pingSent(data)
+			if latency := time.Duration(s.monotonic() - sent).Seconds(); ok && latency > 0 {
 				atomic.StoreUint64(&s.latency, math.Float64bits(s.counter.Latency(latency)))
 				// convert float64 to bits, store it atomic
 				//log.Println("ping", math.Float64frombits(atomic.LoadUint64(&s.latency)))
 			}
-			if cap(data) > 0 && !s.IsClose {
-				windowBuff.Put(data)
-			}
+			windowBuff.Put(data)
 		}
-	}()
+	})
 }
 
 func (s *Mux) readSession() {
-	go func() {
-		var connection *conn
+	s.goroutine(func() {
+		var connection *Conn
 		for {
-			if s.IsClose {
+			if s.Closed() {
 				break
 			}
 			connection = s.newConnQueue.Pop()
-			if s.IsClose {
+			if s.Closed() {
 				break // make sure that is closed
 			}
 			s.connMap.Set(connection.connId, connection) //it has been Set before send ok
-			s.newConnCh <- connection
-			s.sendInfo(muxNewConnOk, connection.connId, nil)
+			accepted := s.handOver(connection)
+			s.openHandled(connection.connId)
+			if !accepted {
+				continue
+			}
+			if w := connection.initWindow; w > 0 {
+				// tells the window before the reply, the opener writes after the reply
+				connection.receiveWindow.tell(connection.connId, PriorityControl, w, 0)
+			}
+			s.sendBatched(muxNewConnOk, connection.connId)
+		}
+	})
+	s.startReadLoop()
+}
+
+// handOver passes the connection to AcceptConn, if nobody accepts it in AcceptTimeout
+// since it arrived, it is refused, returns false then
+func (s *Mux) handOver(connection *Conn) bool {
+	canceled := connection.openCanceled
+	select {
+	case <-canceled:
+		s.dropOpen(connection)
+		return false
+	default:
+	}
+	if s.config.AcceptTimeout <= 0 {
+		select {
+		case s.newConnCh <- connection:
+			return true
+		case <-canceled:
+			s.dropOpen(connection)
+			return false
+		case <-s.closeChan:
+			_ = connection.Close()
+			return false
+		}
+	}
+	wait := time.Duration(atomic.LoadInt64(&connection.lastActive) + int64(s.config.AcceptTimeout) - s.clock.Now().UnixNano())
+	if wait > 0 {
+		timer := s.clock.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case s.newConnCh <- connection:
+			return true
+		case <-timer.C():
+		case <-canceled:
+			s.dropOpen(connection)
+			return false
+		case <-s.closeChan:
+			_ = connection.Close()
+			return false
 		}
-	}()
-	go func() {
+	} else {
+		select {
+		case s.newConnCh <- connection:
+			return true
+		default:
+		}
+	}
+	s.logln(LogWarn, "stream not accepted in time, refuse it, conn id:", connection.connId)
+	s.refuse(connection.connId, true)
+	s.dropOpen(connection)
+	return false
+}
+
+// dropOpen releases the stream opened by the peer, but not accepted
+func (s *Mux) dropOpen(connection *Conn) {
+	s.connMap.Delete(connection.connId)
+	atomic.StoreUint32(&connection.isClose, 1)
+	connection.leaveTenant()
+	connection.sendWindow.CloseWindow()
+	connection.receiveWindow.CloseWindow()
+	connection.traceEvent(EventOpenFailed)
+	connection.traceEnd()
+}
+
+func (s *Mux) startReadLoop() {
+	done := make(chan struct{})
+	s.readDone = done
+	s.goroutine(func() {
 		var pack *muxPackager
 		var l uint16
 		var err error
+		defer close(done)
+		defer s.drainPingCh()
 		for {
-			if s.IsClose {
-				return
+			if s.Closed() || atomic.LoadUint32(&s.exporting) != 0 {
+				return // stopped by Export at the frame boundary
 			}
-			pack = muxPack.Get()
-			s.bw.StartRead()
-			if l, err = pack.UnPack(s.conn); err != nil {
-				log.Println("mux: read session unpack from connection err", err)
-				_ = s.Close()
+			if s.recorder != nil {
+				s.recorder.frame = s.recorder.frame[:0]
+			}
+			pack = s.arena.getPack()
+			pack.compact = atomic.LoadUint32(&s.compactRead) != 0
+			if l, err = pack.UnPack(s.reader); err != nil {
+				s.arena.putPack(pack)
+				if pErr, ok := err.(*ProtocolError); ok && s.protocolError(pErr) {
+					continue
+				}
+				if atomic.LoadUint32(&s.exporting) != 0 {
+					return // stopped by Export, the frame read is kept by the recorder
+				}
+				s.logln(s.errLevel(err), "read session unpack from connection err", err)
+				s.fail(err)
 				break
 			}
 			s.bw.SetCopySize(l)
+			atomic.StoreInt64(&s.lastReceived, s.monotonic())
+			s.countFrame(pack.flag, int(l), true)
 			//if pack.flag == muxNewMsg || pack.flag == muxNewMsgPart {
 			//	if pack.length >= 100 {
 			//		log.Printf("read session id %d pointer %p\n%v", pack.id, pack.content, string(pack.content[:100]))
@@ -257,93 +903,261 @@ func (s *Mux) readSession() {
 			//		log.Printf("read session id %d pointer %p\n%v", pack.id, pack.content, string(pack.content[:pack.length]))
 			//	}
 			//}
-			switch pack.flag {
-			case muxNewConn: //New connection
-				connection := NewConn(pack.id, s)
-				s.newConnQueue.Push(connection)
-				continue
-			case muxPingFlag: //ping
-				s.sendInfo(muxPingReturn, muxPing, pack.content)
-				windowBuff.Put(pack.content)
-				continue
-			case muxPingReturn:
-				s.pingCh <- pack.content
-				continue
+			s.simYield(simReceive)
+			s.handlePack(pack)
+			if isData(pack.flag) {
+				s.checkCongestion()
 			}
-			if connection, ok := s.connMap.Get(pack.id); ok && !connection.isClose {
-				switch pack.flag {
-				case muxNewMsg, muxNewMsgPart: //New msg from remote connection
-					err = s.newMsg(connection, pack)
-					if err != nil {
-						log.Println("mux: read session connection New msg err", err)
-						_ = connection.Close()
-					}
-					continue
-				case muxNewConnOk: //connection ok
-					connection.connStatusOkCh <- struct{}{}
-					continue
-				case muxNewConnFail:
-					connection.connStatusFailCh <- struct{}{}
-					continue
-				case muxMsgSendOk:
-					if connection.isClose {
-						continue
-					}
-					connection.sendWindow.SetSize(pack.window)
-					continue
-				case muxConnClose: //close the connection
-					connection.closingFlag = true
-					connection.receiveWindow.Stop() // close signal to receive window
-					continue
-				}
-			} else if pack.flag == muxConnClose {
-				continue
+			if pack.content != nil {
+				windowBuff.Put(pack.content)
+				// the content not taken by anyone
 			}
-			muxPack.Put(pack)
+			s.arena.putPack(pack)
 		}
-	}()
+	})
 }
 
-func (s *Mux) newMsg(connection *conn, pack *muxPackager) (err error) {
-	if connection.isClose {
+// handlePack handles the frame received, the read session owns the packager,
+// and puts it back to the pool after handled. if the content is taken by others,
+// set it to nil, otherwise the read session puts it back to the pool too
+func (s *Mux) handlePack(pack *muxPackager) {
+	switch pack.flag {
+	case muxNewConn: //New connection
+		s.acceptNewConn(pack.id)
+		return
+	case muxPingFlag: //ping
+		s.sendInfo(muxPingReturn, muxPing, pack.content)
+		return
+	case muxPingReturn:
+		if isHealthReturn(pack.content) {
+			s.health.done(pack.content)
+			return
+		}
+		select {
+		case s.pingCh <- pack.content:
+			pack.content = nil
+		default:
+			// the read session must not be blocked, drop it, only a latency sample lost
+		}
+		return
+	case muxGoAway:
+		s.remoteGoAway()
+		return
+	case muxStreamMeta:
+		s.handleMeta(pack.id, pack.content)
+		return
+	case muxFeatures:
+		if s.config.ProtocolRevision == 1 {
+			return // dropped as the base protocol did
+		}
+		features := uint32(pack.id) & s.features
+		atomic.StoreUint32(&s.peerFeatures, features)
+		if features&featureIdRole != 0 {
+			s.sendIdRole()
+		}
+		if s.config.CompactHeader && features&featureCompactHeader != 0 &&
+			atomic.CompareAndSwapUint32(&s.compactSent, 0, 1) {
+			s.sendInfo(muxCompactHeader, 0, nil)
+		}
+		return
+	case muxCompactHeader:
+		atomic.StoreUint32(&s.compactRead, 1)
+		return
+	case muxIdRole:
+		s.idRoleReceived(uint32(pack.id))
+		return
+	case muxPadding:
+		return
+	case muxCongestion:
+		s.congestionNotified()
+		return
+	case muxConnCloseAck:
+		s.closeConfirms.done(pack.id, pack.content)
+		return
+	case muxConnCloseConfirm:
+		s.confirmClose(pack.id)
+	case muxNewConnBatch:
+		for _, id := range decodeBatch(pack.content) {
+			s.acceptNewConn(id)
+		}
+		return
+	case muxNewConnOkBatch:
+		for _, id := range decodeBatch(pack.content) {
+			s.newConnReply(id, true)
+		}
+		return
+	case muxNewConnOk:
+		s.newConnReply(pack.id, true)
+		return
+	case muxNewConnFail:
+		s.newConnReply(pack.id, false)
+		return
+	case muxConnOpenCancel:
+		s.cancelOpen(pack.id)
+		return
+	}
+	connection, ok := s.connMap.Get(pack.id)
+	if !ok || connection.closed() {
+		s.lateFrame(connection, pack.flag, pack.id)
+		return
+	}
+	connection.active()
+	switch pack.flag {
+	case muxNewMsg, muxNewMsgPart, muxMsgSeq: //New msg from remote connection
+		s.receiveData(connection, pack)
+	case muxMsgSendOk:
+		_, read, _ := connection.sendWindow.unpack(pack.window)
+		s.ackedBw.add(read)
+		if read > 0 {
+			connection.peerReading()
+		}
+		connection.sendWindow.SetSize(pack.window)
+	case muxWindowProbe:
+		connection.receiveWindow.resendStatus(pack.id)
+	case muxChecksum:
+		s.checkSum(connection, pack.content)
+	case muxConnClose, muxConnCloseConfirm: //close the connection
+		connection.traceEvent(EventRemoteClose)
+		atomic.StoreUint32(&connection.closingFlag, 1)
+		connection.receiveWindow.Stop() // close signal to receive window
+	case muxConnCloseWrite:
+		connection.traceEvent(EventRemoteCloseWrite)
+		connection.receiveWindow.Stop() // the writes go on
+	}
+}
+
+// newConnReply wakes up the NewConn waiting for the reply of the peer,
+// if NewConn already gave up, the stream opened by the peer is useless,
+// tell the peer to close it
+func (s *Mux) newConnReply(id int32, ok bool) {
+	connection, exist := s.connMap.Get(id)
+	if !exist {
+		if ok {
+			s.sendInfo(muxConnClose, id, nil)
+		}
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&connection.openState, connOpening, connOpened) {
+		if ok && atomic.LoadUint32(&connection.openState) == connAbandoned {
+			s.sendInfo(muxConnClose, id, nil)
+		}
+		// duplicated reply, ignore it
+		return
+	}
+	ch := connection.connStatusFailCh
+	if ok {
+		ch = connection.connStatusOkCh
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+		// the state guarantees only one reply sent, should not happen
+		s.logln(LogWarn, "new conn reply dropped", id)
+	}
+}
+
+// protocolError handles the malformed frame, returns true if the frame is
+// skipped and the read session can go on
+func (s *Mux) protocolError(err *ProtocolError) (skipped bool) {
+	s.logln(LogWarn, err)
+	if s.config.OnProtocolError == nil || s.config.OnProtocolError(s, err) != ActionIgnore {
+		return false
+	}
+	// the length in header is trusted, skip the content to the next frame boundary
+	if _, e := io.CopyN(ioutil.Discard, s.reader, int64(err.Length)); e != nil {
+		return false
+	}
+	return true
+}
+
+// newMsg writes the data into the receive window of the stream, the content is taken
+func (s *Mux) newMsg(connection *Conn, content []byte, length uint16) (err error) {
+	if connection.closed() {
+		windowBuff.Put(content)
 		err = io.ErrClosedPipe
 		return
 	}
 	//insert into queue
-	if pack.flag == muxNewMsgPart {
-		err = connection.receiveWindow.Write(pack.content, pack.length, true, pack.id)
-	}
-	if pack.flag == muxNewMsg {
-		err = connection.receiveWindow.Write(pack.content, pack.length, false, pack.id)
+	connection.traffic.addIn(int(length))
+	if connection.tenant != nil {
+		connection.tenant.traffic.addIn(int(length))
 	}
+	connection.stats.readRate.add(int(length))
+	s.goodput.addIn(int(length))
+	err = connection.receiveWindow.Write(content, length, connection.connId)
+	// receive window puts it back
 	return
 }
 
+// Closed reports whether the mux has been closed
+func (s *Mux) Closed() bool {
+	return atomic.LoadUint32(&s.closed) != 0
+}
+
+// fail closes the mux for the error of the transport, the error is kept for
+// the stream operations failed then, it is ignored if the mux closed already
+func (s *Mux) fail(err error) {
+	if !s.Closed() {
+		s.failure.Store(&failure{err})
+	}
+	_ = s.Close()
+}
+
+// Err returns the error the mux failed by, as the error of the transport or the
+// ping timeout, nil if the mux is open or closed by Close
+func (s *Mux) Err() error {
+	if f, ok := s.failure.Load().(*failure); ok {
+		return f.err
+	}
+	return nil
+}
+
 func (s *Mux) Close() (err error) {
-	if s.IsClose {
-		return errors.New("the mux has closed")
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return ErrMuxClosed
 	}
 	s.IsClose = true
-	log.Println("close mux")
+	s.logln(LogDebug, "close")
 	s.connMap.Close()
 	//s.connMap = nil
-	s.closeChan <- struct{}{}
-	close(s.newConnCh)
-	err = s.conn.Close()
+	close(s.closeChan)
+	// newConnCh is left open, the read session may be sending on it
+	if s.config.OnTransportClose != nil {
+		s.detach()
+	} else {
+		err = s.conn.Close()
+	}
 	s.release()
+	s.arena.release()
 	return
 }
 
+// detach hands the transport to OnTransportClose, after the sessions stopped
+// using it. the deadline wakes them up, Close may be called by the sessions,
+// so they are not waited for here
+func (s *Mux) detach() {
+	_ = s.conn.SetDeadline(s.clock.Now())
+	s.goroutine(func() {
+		if s.readDone != nil {
+			// nil if the sessions never started, as the plaintext refused
+			<-s.readDone
+			<-s.writeDone
+		}
+		_ = s.conn.SetDeadline(time.Time{})
+		if err := s.config.OnTransportClose(s.conn); err != nil {
+			s.logln(LogWarn, "transport close err", err)
+		}
+	})
+}
+
 func (s *Mux) release() {
 	for {
 		pack := s.writeQueue.TryPop()
 		if pack == nil {
 			break
 		}
-		if pack.basePackager.content != nil {
-			windowBuff.Put(pack.basePackager.content)
-		}
-		muxPack.Put(pack)
+		pack.release()
+		s.arena.putPack(pack)
 	}
 	for {
 		connection := s.newConnQueue.TryPop()
@@ -356,154 +1170,220 @@ func (s *Mux) release() {
 	s.newConnQueue.Stop()
 }
 
-//Get New connId as unique flag
-func (s *Mux) getId() (id int32) {
-	//Avoid going beyond the scope
-	if (math.MaxInt32 - s.id) < 10000 {
-		atomic.StoreInt32(&s.id, 0)
+const (
+	stallRtts       = 8
+	minStallTimeout = time.Millisecond * 500
+)
+
+// stallTimeout returns how long a send window waits for the window update,
+// before it thinks the update is lost
+func (s *Mux) stallTimeout() time.Duration {
+	return s.rttTimeout(s.profile.stallRtts())
+}
+
+// rttTimeout returns the time of n rtt, at least minStallTimeout
+func (s *Mux) rttTimeout(n int) time.Duration {
+	t := time.Duration(math.Float64frombits(atomic.LoadUint64(&s.latency)) * float64(n) * float64(time.Second))
+	if t < minStallTimeout {
+		t = minStallTimeout
 	}
-	id = atomic.AddInt32(&s.id, 1)
-	if _, ok := s.connMap.Get(id); ok {
-		return s.getId()
+	return t
+}
+
+// windowStalled is invoked when the send window of connection id still waiting
+// after stall timeout, ask the receive window for the current status, if the
+// peer answers muxWindowProbe
+func (s *Mux) windowStalled(id int32) {
+	n := atomic.AddUint64(&s.windowStalls, 1)
+	if c, ok := s.connMap.Get(id); ok {
+		c.traceEvent(EventWindowStall)
 	}
-	return
+	s.logln(LogInfo, "send window stalled, conn id:", id, "total stalls:", n)
+	if atomic.LoadUint32(&s.peerFeatures)&featureWindowProbe != 0 {
+		s.sendInfo(muxWindowProbe, id, nil)
+	}
+}
+
+// idBase returns the id before the first one, the client allocates
+// the odd ids, the server allocates the even ids, see idrole.go
+func (s *Mux) idBase() int32 {
+	if atomic.LoadUint32(&s.idRole) == 1 {
+		return 0
+	}
+	return -1
 }
 
+// Get New connId as unique flag
+func (s *Mux) getId() (id int32) {
+	for {
+		id = atomic.AddInt32(&s.id, 2)
+		if math.MaxInt32-id < 10000 {
+			//Avoid going beyond the scope
+			atomic.CompareAndSwapInt32(&s.id, id, s.idBase())
+			continue
+		}
+		if _, ok := s.connMap.Get(id); !ok && !s.isQuarantined(id) {
+			return
+		}
+	}
+}
+
+// bandwidth estimates the read bandwidth of the mux connection,
+// samples are taken in a short window, and smoothed by EWMA.
+// the read gap longer than bwIdleTimeout is not counted,
+// the estimate decays while the connection keeps idle
 type bandwidth struct {
 	readBandwidth uint64 // store in bits, but it's float64
-	readStart     time.Time
-	lastReadStart time.Time
+	lastRead      int64  // unix nano of the last read, accessed atomically
+	sampleStart   time.Time
 	bufLength     uint32
 	fd            *os.File
 	calcThreshold uint32
+	clock         Clock
 }
 
-func NewBandwidth(fd *os.File) *bandwidth {
-	return &bandwidth{fd: fd}
-}
+const (
+	bwSampleInterval = time.Millisecond * 100
+	bwIdleTimeout    = time.Second
+	bwHalfLife       = time.Second * 5 // the estimate halves every 5s while idle
+	bwAlpha          = 0.25            // EWMA weight of the new sample
+)
 
-func (Self *bandwidth) StartRead() {
-	if Self.readStart.IsZero() {
-		Self.readStart = time.Now()
-	}
-	if Self.bufLength >= Self.calcThreshold {
-		Self.lastReadStart, Self.readStart = Self.readStart, time.Now()
-		Self.calcBandWidth()
+func NewBandwidth(fd *os.File) *bandwidth {
+	bw := &bandwidth{fd: fd, clock: systemClock{}}
+	if bufferSize, err := sysGetSock(fd); err == nil {
+		bw.calcThreshold = uint32(bufferSize)
+		// filling the whole socket buffer is also a sample
 	}
+	return bw
 }
 
 func (Self *bandwidth) SetCopySize(n uint16) {
-	Self.bufLength += uint32(n)
+	Self.add(uint32(n))
 }
 
-func (Self *bandwidth) calcBandWidth() {
-	t := Self.readStart.Sub(Self.lastReadStart)
-	bufferSize, err := sysGetSock(Self.fd)
-	if err != nil {
-		log.Println(err)
+// add counts n bytes into the sample, it is not safe for concurrent use
+func (Self *bandwidth) add(n uint32) {
+	now := Self.clock.Now()
+	last := atomic.SwapInt64(&Self.lastRead, now.UnixNano())
+	if last == 0 || now.Sub(time.Unix(0, last)) > bwIdleTimeout {
+		// the first read, or the connection has been idle, drop the sample, start a new one from now
+		Self.sampleStart = now
 		Self.bufLength = 0
 		return
 	}
-	if Self.bufLength >= uint32(bufferSize) {
-		atomic.StoreUint64(&Self.readBandwidth, math.Float64bits(float64(Self.bufLength)/t.Seconds()))
-		// calculate the whole socket buffer, the time meaning to fill the buffer
-	} else {
-		Self.calcThreshold = uint32(bufferSize)
+	Self.bufLength += n
+	t := now.Sub(Self.sampleStart)
+	if t >= bwSampleInterval || (Self.calcThreshold > 0 && Self.bufLength >= Self.calcThreshold) {
+		Self.calcBandWidth(t)
+		Self.sampleStart = now
+	}
+}
+
+func (Self *bandwidth) calcBandWidth(t time.Duration) {
+	if t <= 0 {
+		return
 	}
-	// socket buffer size is bigger than bufLength, so we don't calculate it
+	sample := float64(Self.bufLength) / t.Seconds()
 	Self.bufLength = 0
+	old := math.Float64frombits(atomic.LoadUint64(&Self.readBandwidth))
+	if old > 0 {
+		sample = old*(1-bwAlpha) + sample*bwAlpha
+	}
+	atomic.StoreUint64(&Self.readBandwidth, math.Float64bits(sample))
+}
+
+// scale multiplies the estimated bandwidth by r
+func (Self *bandwidth) scale(r float64) {
+	for {
+		old := atomic.LoadUint64(&Self.readBandwidth)
+		bw := math.Float64frombits(old) * r
+		if atomic.CompareAndSwapUint64(&Self.readBandwidth, old, math.Float64bits(bw)) {
+			return
+		}
+	}
 }
 
-func (Self *bandwidth) Get() (bw float64) {
-	// The zero value, 0 for numeric types
+// Get returns the estimated bandwidth in bytes per second,
+// ok is false if there is no sample yet
+func (Self *bandwidth) Get() (bw float64, ok bool) {
 	bw = math.Float64frombits(atomic.LoadUint64(&Self.readBandwidth))
 	if bw <= 0 {
-		bw = 0
+		return 0, false
 	}
-	return
+	idle := Self.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&Self.lastRead))) - bwIdleTimeout
+	if idle > 0 {
+		bw *= math.Pow(0.5, idle.Seconds()/bwHalfLife.Seconds())
+	}
+	return bw, true
 }
 
 const counterBits = 4
 const counterMask = 1<<counterBits - 1
 
 func newLatencyCounter() *latencyCounter {
-	return &latencyCounter{
-		buf:     make([]float64, 1<<counterBits, 1<<counterBits),
-		headMin: 0,
-	}
+	return &latencyCounter{}
 }
 
+// latencyCounter tracks the rtt of the mux like tcp does (RFC 6298),
+// smoothed rtt and rtt variance are updated by every sample,
+// the minimal rtt is taken from a sliding window of the last 16 samples
 type latencyCounter struct {
-	buf []float64 //buf is a fixed length ring buffer,
-	// if buffer is full, New value will replace the oldest one.
-	headMin uint8 //head indicate the head in ring buffer,
-	// in meaning, slot in list will be replaced;
-	// min indicate this slot value is minimal in list.
-
-	// we delineate the effective range with three times the minimum latency
-	// average of effective latency for all current data as a mux latency
+	buf    [1 << counterBits]float64 // ring buffer, the New value replaces the oldest one
+	head   uint8                     // the slot will be replaced next
+	count  uint8                     // count of slots in use
+	srtt   float64
+	rttVar float64
+	sync.Mutex
 }
 
-func (Self *latencyCounter) unpack(idxs uint8) (head, min uint8) {
-	head = (idxs >> counterBits) & counterMask
-	// we Set head is 4 bits
-	min = idxs & counterMask
-	return
-}
-
-func (Self *latencyCounter) pack(head, min uint8) uint8 {
-	return head<<counterBits |
-		min&counterMask
-}
+const (
+	rttAlpha = 0.125 // smoothed rtt gain
+	rttBeta  = 0.25  // rtt variance gain
+)
 
 func (Self *latencyCounter) add(value float64) {
-	head, min := Self.unpack(Self.headMin)
-	Self.buf[head] = value
-	if head == min {
-		min = Self.minimal()
-		//if head equals min, means the min slot already be replaced,
-		// so we need to find another minimal value in the list,
-		// and change the min indicator
+	Self.buf[Self.head] = value
+	Self.head = (Self.head + 1) & counterMask
+	if Self.count <= counterMask {
+		Self.count++
 	}
-	if Self.buf[min] > value {
-		min = head
+	if Self.srtt == 0 {
+		// the first sample
+		Self.srtt = value
+		Self.rttVar = value / 2
+		return
 	}
-	head++
-	Self.headMin = Self.pack(head, min)
+	Self.rttVar = (1-rttBeta)*Self.rttVar + rttBeta*math.Abs(Self.srtt-value)
+	Self.srtt = (1-rttAlpha)*Self.srtt + rttAlpha*value
 }
 
-func (Self *latencyCounter) minimal() (min uint8) {
-	var val float64
+func (Self *latencyCounter) minimal() (min float64) {
 	var i uint8
-	for i = 0; i < counterMask; i++ {
-		if Self.buf[i] > 0 {
-			if val > Self.buf[i] {
-				val = Self.buf[i]
-				min = i
-			}
+	for i = 0; i < Self.count; i++ {
+		if min == 0 || Self.buf[i] < min {
+			min = Self.buf[i]
 		}
 	}
 	return
 }
 
+// Latency adds a rtt sample in seconds, returns the smoothed rtt
 func (Self *latencyCounter) Latency(value float64) (latency float64) {
+	if value <= 0 {
+		return
+	}
+	Self.Lock()
 	Self.add(value)
-	latency = Self.countSuccess()
+	latency = Self.srtt
+	Self.Unlock()
 	return
 }
 
-const lossRatio = 3
-
-func (Self *latencyCounter) countSuccess() (successRate float64) {
-	var i, success uint8
-	_, min := Self.unpack(Self.headMin)
-	for i = 0; i < counterMask; i++ {
-		if Self.buf[i] <= lossRatio*Self.buf[min] && Self.buf[i] > 0 {
-			success++
-			successRate += Self.buf[i]
-		}
-	}
-	// counting all the data in the ring buf, except zero
-	successRate = successRate / float64(success)
+// Get returns the minimal rtt, smoothed rtt and rtt variance in seconds
+func (Self *latencyCounter) Get() (min, srtt, rttVar float64) {
+	Self.Lock()
+	min, srtt, rttVar = Self.minimal(), Self.srtt, Self.rttVar
+	Self.Unlock()
 	return
 }
@@ -1,23 +1,36 @@
-package nps_mux
+package npsmux
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 	"unsafe"
+
+	"ehang.io/nps-mux/protocol"
+	"github.com/xtaci/kcp-go"
 )
 
 var conn1 net.Conn
@@ -118,7 +131,7 @@ func TestServer(t *testing.T) {
 	}
 	defer clientBridgeConn.Close()
 	// new mux
-	mux := NewMux(clientBridgeConn, "tcp")
+	mux := NewMux(clientBridgeConn, "tcp", 0)
 	// start server port
 	serverListener, err := net.Listen("tcp", serverIp+":"+serverPort)
 	if err != nil {
@@ -135,21 +148,22 @@ func TestServer(t *testing.T) {
 			// create a conn from mux
 			clientConn, err := mux.NewConn()
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			go io.Copy(userConn, clientConn)
 			go func() {
 				writeResult([]float64{
-					mux.bw.Get() / 1024 / 1024,
+					muxBandwidth(mux) / 1024 / 1024,
 					math.Float64frombits(atomic.LoadUint64(&mux.latency)),
 				}, serverResultFileName)
 				ticker := time.NewTicker(time.Second * 1)
 				for {
 					select {
 					case <-ticker.C:
-						fmt.Println(mux.bw.Get()/1024/1024, math.Float64frombits(atomic.LoadUint64(&mux.latency)))
+						fmt.Println(muxBandwidth(mux)/1024/1024, math.Float64frombits(atomic.LoadUint64(&mux.latency)))
 						appendResult([]float64{
-							mux.bw.Get() / 1024 / 1024,
+							muxBandwidth(mux) / 1024 / 1024,
 							math.Float64frombits(atomic.LoadUint64(&mux.latency)),
 						}, serverResultFileName)
 					}
@@ -174,7 +188,7 @@ func TestClient(t *testing.T) {
 		t.Fatal(err)
 	}
 	// crete mux by serverConn
-	mux := NewMux(serverConn, "tcp")
+	mux := NewMux(serverConn, "tcp", 0)
 	// start accept user connection
 	for {
 		userConn, err := mux.Accept()
@@ -185,14 +199,15 @@ func TestClient(t *testing.T) {
 			// connect to app
 			appConn, err := net.Dial("tcp", appIp+":"+appPort)
 			if err != nil {
-				t.Fatal()
+				t.Error()
+				return
 			}
 			defer appConn.Close()
 			defer userConn.Close()
 			go io.Copy(userConn, appConn)
 			go func() {
 				writeResult([]float64{
-					mux.bw.Get() / 1024 / 1024,
+					muxBandwidth(mux) / 1024 / 1024,
 					math.Float64frombits(atomic.LoadUint64(&mux.latency)),
 				}, clientResultFileName)
 				ticker := time.NewTicker(time.Second * 1)
@@ -200,7 +215,7 @@ func TestClient(t *testing.T) {
 					select {
 					case <-ticker.C:
 						appendResult([]float64{
-							mux.bw.Get() / 1024 / 1024,
+							muxBandwidth(mux) / 1024 / 1024,
 							math.Float64frombits(atomic.LoadUint64(&mux.latency)),
 						}, clientResultFileName)
 					}
@@ -236,10 +251,12 @@ func TestApp(t *testing.T) {
 			for i := 0; i < dataSize/1024; i++ {
 				n, err := userConn.Write(b)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
+					return
 				}
 				if n != 1024 {
-					t.Fatal("the write len is not right")
+					t.Error("the write len is not right")
+					return
 				}
 			}
 			// send bandwidth
@@ -260,7 +277,8 @@ func TestApp(t *testing.T) {
 				}
 			}
 			if readLen != dataSize {
-				t.Fatal("the read len is not right")
+				t.Error("the read len is not right")
+				return
 			}
 			userConn.Write([]byte{0})
 			// read bandwidth
@@ -268,7 +286,8 @@ func TestApp(t *testing.T) {
 			// save result
 			err := writeResult([]float64{writeBw, readBw}, appResultFileName)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			os.Exit(0)
 		}(userConn)
@@ -344,7 +363,7 @@ func TestNewMux2(t *testing.T) {
 		rate.Start()
 		conn2 = NewRateConn(rate, conn2)
 		go func() {
-			m2 := NewMux(conn2, "tcp")
+			m2 := NewMux(conn2, "tcp", 0)
 			for {
 				c, err := m2.Accept()
 				if err != nil {
@@ -358,7 +377,7 @@ func TestNewMux2(t *testing.T) {
 			}
 		}()
 
-		m1 := NewMux(conn1, "tcp")
+		m1 := NewMux(conn1, "tcp", 0)
 		tmpCpnn, err := m1.NewConn()
 		if err != nil {
 			log.Println("nps new conn err ", err)
@@ -371,7 +390,7 @@ func TestNewMux2(t *testing.T) {
 		for {
 			n, err := tmpCpnn.Read(buf)
 			count += float64(n)
-			log.Println(m1.bw.Get())
+			log.Println(m1.Bandwidth())
 			log.Println(uint32(math.Float64frombits(atomic.LoadUint64(&m1.latency))))
 			if err != nil {
 				log.Println(err)
@@ -390,7 +409,7 @@ func TestNewMux(t *testing.T) {
 	client("")
 	time.Sleep(time.Second * 3)
 	go func() {
-		m2 := NewMux(conn2, "tcp")
+		m2 := NewMux(conn2, "tcp", 0)
 		for {
 			//log.Println("npc starting accept")
 			c, err := m2.Accept()
@@ -407,7 +426,7 @@ func TestNewMux(t *testing.T) {
 			}
 			//c2.(*net.TCPConn).SetReadBuffer(0)
 			//c2.(*net.TCPConn).SetReadBuffer(0)
-			go func(c2 net.Conn, c *conn) {
+			go func(c2 net.Conn, c *Conn) {
 				go func() {
 					buf := make([]byte, 32<<10)
 					_, err = io.CopyBuffer(c2, c, buf)
@@ -424,12 +443,12 @@ func TestNewMux(t *testing.T) {
 				//}
 				c2.Close()
 				c.Close()
-			}(c2, c.(*conn))
+			}(c2, c.(*Conn))
 		}
 	}()
 
 	go func() {
-		m1 := NewMux(conn1, "tcp")
+		m1 := NewMux(conn1, "tcp", 0)
 		l, err := net.Listen("tcp", "127.0.0.1:7777")
 		if err != nil {
 			log.Println(err)
@@ -450,7 +469,7 @@ func TestNewMux(t *testing.T) {
 				continue
 			}
 			//logs.Warn("nps New conn success ", tmpCpnn.connId)
-			go func(tmpCpnn *conn, conns net.Conn) {
+			go func(tmpCpnn *Conn, conns net.Conn) {
 				go func() {
 					buf := make([]byte, 32<<10)
 					_, _ = io.CopyBuffer(tmpCpnn, conns, buf)
@@ -649,6 +668,112 @@ func TestChain(t *testing.T) {
 	time.Sleep(time.Second * 100000)
 }
 
+func muxBandwidth(m *Mux) float64 {
+	bw, _ := m.Bandwidth()
+	return bw
+}
+
+func pipeMux() (client, server *Mux) {
+	c1, c2 := net.Pipe()
+	return NewMux(c1, "tcp", 0), NewMux(c2, "tcp", 0)
+}
+
+func TestNewConnBatch(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(c, b); err == nil {
+					_, _ = c.Write(b)
+				}
+			}(c)
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+	// wait for the features exchanged
+	if atomic.LoadUint32(&client.peerFeatures)&featureOpenBatch == 0 {
+		t.Fatal("peer features not received")
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 300)
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := client.NewConn()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			b := []byte(strconv.Itoa(1000 + i))
+			if _, err = c.Write(b); err != nil {
+				errCh <- err
+				return
+			}
+			r := make([]byte, 4)
+			if _, err = io.ReadFull(c, r); err != nil {
+				errCh <- err
+				return
+			}
+			if !bytes.Equal(b, r) {
+				errCh <- fmt.Errorf("conn %d get %s", c.connId, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseStream(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	var ids []int32
+	for i := 0; i < 3; i++ {
+		c, err := client.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, c.ID())
+	}
+	if err := client.CloseStream(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseStream(ids[1]); err == nil {
+		t.Fatal("close a closed stream should fail")
+	}
+	var left []int32
+	client.Range(func(c *Conn) bool {
+		left = append(left, c.ID())
+		return true
+	})
+	if len(left) != 2 {
+		t.Fatal("range get", left, "closed", ids[1])
+	}
+	for _, id := range left {
+		if id == ids[1] {
+			t.Fatal("closed stream still in range")
+		}
+	}
+}
+
 //func TestReceive(t *testing.T) {
 //	go func() {
 //		log.Println(http.ListenAndServe("0.0.0.0:8889", nil))
@@ -701,3 +826,4452 @@ func TestChain(t *testing.T) {
 //	}()
 //	time.Sleep(time.Second * 100000)
 //}
+
+func TestCheckLeaks(t *testing.T) {
+	client, server := pipeMux()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}(c)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		c, err := client.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := bytes.Repeat([]byte{byte(i)}, 100000)
+		go func() { _, _ = c.Write(b) }()
+		r := make([]byte, len(b))
+		if _, err = io.ReadFull(c, r); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+	_ = client.Close()
+	_ = server.Close()
+	if err := CheckLeaks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatencyCounter(t *testing.T) {
+	c := newLatencyCounter()
+	if l := c.Latency(0.1); l != 0.1 {
+		t.Fatal("first sample should be the smoothed rtt, get", l)
+	}
+	if _, srtt, rttVar := c.Get(); srtt != 0.1 || rttVar != 0.05 {
+		t.Fatal("get", srtt, rttVar)
+	}
+	c.Latency(0.2)
+	if _, srtt, rttVar := c.Get(); math.Abs(srtt-0.1125) > 1e-9 || math.Abs(rttVar-0.0625) > 1e-9 {
+		t.Fatal("get", srtt, rttVar)
+	}
+	if min, _, _ := c.Get(); min != 0.1 {
+		t.Fatal("min should be 0.1, get", min)
+	}
+	for i := 0; i < 16; i++ {
+		c.Latency(0.3)
+	}
+	// the samples 0.1 and 0.2 slide out of the window
+	if min, _, _ := c.Get(); min != 0.3 {
+		t.Fatal("min should be 0.3, get", min)
+	}
+	c.Latency(0.05)
+	if min, _, _ := c.Get(); min != 0.05 {
+		t.Fatal("min should be 0.05, get", min)
+	}
+}
+
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	sync.Mutex
+}
+
+type fakeTimer struct {
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+	clock  *fakeClock
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (s *fakeClock) Now() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.now
+}
+
+func (s *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	s.Lock()
+	defer s.Unlock()
+	t := &fakeTimer{c: make(chan time.Time, 1), when: s.now.Add(d), period: period, active: true, clock: s}
+	s.timers = append(s.timers, t)
+	return t
+}
+
+func (s *fakeClock) NewTimer(d time.Duration) Timer {
+	return s.newTimer(d, 0)
+}
+
+func (s *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{s.newTimer(d, d)}
+}
+
+// Advance moves the time forward, and fires the timers expired
+func (s *fakeClock) Advance(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.now = s.now.Add(d)
+	for _, t := range s.timers {
+		if !t.active || t.when.After(s.now) {
+			continue
+		}
+		select {
+		case t.c <- s.now:
+		default:
+		}
+		if t.period > 0 {
+			for !t.when.After(s.now) {
+				t.when = t.when.Add(t.period)
+			}
+		} else {
+			t.active = false
+		}
+	}
+}
+
+func (s *fakeTimer) C() <-chan time.Time {
+	return s.c
+}
+
+func (s *fakeTimer) Stop() bool {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	active := s.active
+	s.active = false
+	return active
+}
+
+func (s *fakeTimer) Reset(d time.Duration) bool {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	active := s.active
+	s.active = true
+	s.when = s.clock.now.Add(d)
+	return active
+}
+
+func (s fakeTicker) Stop() {
+	s.fakeTimer.Stop()
+}
+
+func TestPingTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() {
+		// never return the ping
+		_, _ = io.Copy(ioutil.Discard, c2)
+	}()
+	clock := newFakeClock()
+	timeout := make(chan struct{}, 1)
+	m := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		PingCheckThreshold: 2,
+		Clock:              clock,
+		OnPingTimeout: func(*Mux) Action {
+			timeout <- struct{}{}
+			return ActionClose
+		},
+	})
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second * 5)
+		select {
+		case <-timeout:
+			time.Sleep(time.Millisecond * 10)
+			if !m.Closed() {
+				t.Fatal("mux should be closed after ping timeout")
+			}
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("ping not timeout")
+}
+
+func TestStreamKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{StreamKeepAlive: time.Second * 10,
+		PeerReadTimeout: time.Second * 20, Clock: clock})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Clock: clock})
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	alive, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the other side forgets the stream, probes will not be answered
+	server.connMap.Delete(dead.ID())
+	// the peer app hangs, the probes are answered by the peer mux
+	hung, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer app reads, too little to be told without the probe
+	reading, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		c := <-accepted
+		if c.(*Conn).ID() == reading.ID() {
+			go func() { _, _ = io.Copy(ioutil.Discard, c) }()
+		}
+	}
+	if _, err = hung.Write([]byte("hung")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reading.Write([]byte("reading")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	for i := 0; i < 30; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond * 5)
+	}
+	if !dead.closed() {
+		t.Fatal("the stream without probe echo should be closed")
+	}
+	if alive.closed() {
+		t.Fatal("the stream answered the probe should be alive")
+	}
+	if !hung.closed() {
+		t.Fatal("the stream the peer app not reading should be closed")
+	}
+	if reading.closed() {
+		t.Fatal("the stream the peer app reading should be alive")
+	}
+}
+
+func TestMaxSessionLifetime(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	goAway := make(chan *Mux, 2)
+	onGoAway := func(m *Mux) { goAway <- m }
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{MaxSessionLifetime: time.Minute, OnGoAway: onGoAway, Clock: clock})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{OnGoAway: onGoAway, Clock: clock})
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-goAway:
+		case <-time.After(time.Second):
+			t.Fatal("go away callback not invoked")
+		}
+	}
+	if _, err = server.NewConn(); err == nil {
+		t.Fatal("new conn should fail after go away")
+	}
+	if client.Closed() || server.Closed() {
+		t.Fatal("mux should not close before the streams closed")
+	}
+	_ = c.Close()
+	for i := 0; i < 20 && !(client.Closed() && server.Closed()); i++ {
+		clock.Advance(drainCheckInterval)
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !client.Closed() || !server.Closed() {
+		t.Fatal("mux should close after drained")
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyWriter writes at most 3 bytes once, and fails every other write
+type flakyWriter struct {
+	bytes.Buffer
+	count int
+}
+
+func (s *flakyWriter) Write(p []byte) (int, error) {
+	s.count++
+	if s.count%2 == 0 {
+		return 0, tempError{}
+	}
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return s.Buffer.Write(p)
+}
+
+func TestRetryWriter(t *testing.T) {
+	fw := new(flakyWriter)
+	w := &retryWriter{w: fw, mux: &Mux{clock: systemClock{}}}
+	n, err := w.Write([]byte("0123456789"))
+	if err != nil || n != 10 || fw.String() != "0123456789" {
+		t.Fatal(n, err, fw.String())
+	}
+	w = &retryWriter{w: errWriter{}, mux: &Mux{clock: systemClock{}}}
+	if _, err = w.Write([]byte("0")); err != io.ErrClosedPipe {
+		t.Fatal("permanent error should be returned, get", err)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestProtocolErrorSkip(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go func() { _, _ = io.Copy(ioutil.Discard, c2) }()
+	errCh := make(chan *ProtocolError, 1)
+	m := NewMuxWithConfig(c1, "tcp", &MuxConfig{OnProtocolError: func(m *Mux, err *ProtocolError) Action {
+		errCh <- err
+		return ActionIgnore
+	}})
+	defer m.Close()
+	// an oversize frame, then a valid one
+	frame := []byte{muxNewMsg, 1, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(frame[5:7], 5000)
+	frame = append(frame, make([]byte, 5000)...)
+	frame = append(frame, muxFeatures, byte(featureOpenBatch), 0, 0, 0)
+	if _, err := c2.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if err.Length != 5000 || err.Flag != muxNewMsg || err.ID != 1 || len(err.Header) != 7 {
+			t.Fatal("unexpected protocol error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("protocol error not reported")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if m.Closed() || atomic.LoadUint32(&m.peerFeatures) != featureOpenBatch {
+		t.Fatal("the frame after the malformed one should be read")
+	}
+}
+
+func TestNewConnLateReply(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Clock: clock})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.NewConn()
+		errCh <- err
+	}()
+	var err error
+loop:
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Minute)
+		select {
+		case err = <-errCh:
+			break loop
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if err == nil {
+		t.Fatal("new conn should time out")
+	}
+	// the server accepts too late, the client should close the stream
+	conn, err := server.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatal("the late stream should be closed, got", err)
+	}
+}
+
+func TestReadSessionNotBlocked(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < pingChSize*4; i++ {
+			pack := &muxPackager{}
+			pack.flag = muxPingReturn
+			pack.content = windowBuff.Get()
+			client.handlePack(pack)
+			if pack.content != nil {
+				windowBuff.Put(pack.content)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("read session blocked by the ping returns")
+	}
+}
+
+func TestDump(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	_, _ = conn.Read(make([]byte, 5))
+	var buf bytes.Buffer
+	client.Dump(&buf)
+	if !strings.Contains(buf.String(), fmt.Sprintf("stream %d ", conn.ID())) {
+		t.Fatal("stream not dumped", buf.String())
+	}
+	// dumped while writing, for the race detector
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		data := make([]byte, 64*1024)
+		for i := 0; i < 16; i++ {
+			_, _ = conn.Write(data)
+		}
+	}()
+	go func() { _, _ = io.Copy(ioutil.Discard, conn) }()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			client.Dump(ioutil.Discard)
+		}
+	}
+}
+
+func TestWindowWatchdog(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		Clock:               clock,
+		WindowWatchdogRtts:  2,
+		WindowWatchdogReset: true,
+	})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		// accept, but never read
+		_, _ = server.AcceptConn()
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maximumSegmentSize)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		select {
+		case <-errCh:
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("the deadlocked stream not reset")
+}
+
+func TestSlowConsumer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	reported := make(chan int32, 1)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{
+		Clock:               clock,
+		SlowConsumerTimeout: time.Second * 5,
+		OnSlowConsumer: func(c *Conn) Action {
+			select {
+			case reported <- c.connId:
+			default:
+			}
+			return ActionClose
+		},
+	})
+	client := NewMux(c1, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		// accept, but never read
+		_, _ = server.AcceptConn()
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maximumSegmentSize)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		select {
+		case id := <-reported:
+			if id != conn.connId {
+				t.Fatal("wrong stream reported", id)
+			}
+			// the reset stream is closed on both sides
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatal("want eof, got", err)
+			}
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("the slow consumer not reported")
+}
+
+func TestPriorityQueue(t *testing.T) {
+	q := new(priorityQueue)
+	q.New(systemClock{}, 0)
+	push := func(p Priority, n int) {
+		for i := 0; i < n; i++ {
+			q.Push(&muxPackager{priority: p})
+		}
+	}
+	push(PriorityBulk, 1)
+	push(PriorityInteractive, 1)
+	push(PriorityControl, 1)
+	for _, want := range []Priority{PriorityControl, PriorityInteractive, PriorityBulk} {
+		if got := q.TryPop().priority; got != want {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+	// the bulk frame is not starved by the flood of control frames
+	push(PriorityBulk, 1)
+	push(PriorityControl, 100)
+	for i := 0; i <= int(maxStarving); i++ {
+		if q.TryPop().priority == PriorityBulk {
+			return
+		}
+	}
+	t.Fatal("the bulk frame starved")
+}
+
+func TestPriorityQueueAging(t *testing.T) {
+	clock := newFakeClock()
+	q := new(priorityQueue)
+	q.New(clock, time.Millisecond*100)
+	q.Push(&muxPackager{priority: PriorityBulk})
+	for i := 0; i < 100; i++ {
+		q.Push(&muxPackager{priority: PriorityControl})
+		q.Push(&muxPackager{priority: PriorityInteractive})
+	}
+	if q.TryPop().priority != PriorityControl {
+		t.Fatal("the control frame should be sent first")
+	}
+	clock.Advance(time.Millisecond * 200)
+	if got := q.TryPop().priority; got != PriorityBulk {
+		t.Fatal("the aged bulk frame should be sent, got", got)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMux(c2, "tcp", 0)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := client.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if err := client.HealthCheck(ctx); err == nil {
+		t.Fatal("health check passed on closed mux")
+	}
+}
+
+func TestMTUDiscovery(t *testing.T) {
+	var probes int
+	size := searchSegmentSize(minSegmentSize, maximumSegmentSize, func(n int) bool {
+		probes++
+		return n <= 1400
+	})
+	if size > 1400 || size < 1400-mtuProbeStep || probes > 10 {
+		t.Fatal("wrong size searched", size, probes)
+	}
+	// the link drops the datagrams larger than 1000
+	c1, c2 := lossyPair(0)
+	c1.(*lossyLink).mtu, c2.(*lossyLink).mtu = 1000, 1000
+	clock := newFakeClock()
+	arq := &ARQConfig{SegmentSize: 1400, Interval: time.Millisecond * 5, MinRTO: time.Millisecond * 20}
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{ARQ: arq, MTUDiscovery: true, Clock: clock})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{ARQ: arq, MTUDiscovery: true, Clock: clock})
+	defer server.Close()
+	defer client.Close()
+	for i := 0; i < 100 && (client.SegmentSize() > 1000 || server.SegmentSize() > 1000); i++ {
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond * 5)
+	}
+	if size := client.SegmentSize(); size > 1000 || size < 1000-mtuProbeStep {
+		t.Fatal("wrong segment size probed", size)
+	}
+	c3, c4 := net.Pipe()
+	plain := NewMux(c3, "kcp", 0)
+	defer plain.Close()
+	defer c4.Close()
+	if plain.SegmentSize() != 0 {
+		t.Fatal("segment size without ARQ, nor kcp")
+	}
+	go func() {
+		for !client.Closed() {
+			clock.Advance(time.Millisecond * 5)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go func() { _, _ = conn.Write(data) }()
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, b); err != nil || !bytes.Equal(b, data) {
+		t.Fatal("the data differs over the link of the small mtu", err)
+	}
+	_ = conn.Close()
+}
+
+func TestKCPMTUDiscovery(t *testing.T) {
+	// the link fragments the datagrams larger than 1000, they are lost often
+	c1, c2 := lossyPair(0)
+	for _, c := range []*lossyLink{c1.(*lossyLink), c2.(*lossyLink)} {
+		c.mtu, c.mtuLoss = 1000, 0.5
+	}
+	l, err := kcp.ServeConn(nil, 0, 0, packetLink{c2.(*lossyLink)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sess, err := kcp.NewConn(c1.LocalAddr().String(), nil, 0, 0, packetLink{c1.(*lossyLink)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.SetNoDelay(1, 10, 2, 1)
+	_, _ = sess.Write([]byte{}) // the listener accepts the session by its first datagram
+	go func() {
+		c, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		c.SetNoDelay(1, 10, 2, 1)
+		server := NewMux(c, "kcp", 0)
+		defer server.Close()
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn) }()
+		}
+	}()
+	client := NewMuxWithConfig(sess, "kcp", &MuxConfig{MTUDiscovery: true})
+	defer client.Close()
+	deadline := time.Now().Add(time.Second * 20)
+	for client.SegmentSize() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no kcp mtu probed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the kcp header of 24 bytes is on top of the frames
+	size := client.SegmentSize()
+	if size > 1000-24 || size < 1000-24-mtuProbeStep*2 {
+		t.Fatal("wrong segment size probed over kcp", size)
+	}
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go func() { _, _ = conn.Write(data) }()
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, b); err != nil || !bytes.Equal(b, data) {
+		t.Fatal("the data differs over kcp of the mtu probed", err)
+	}
+	flags := client.Stats().Flags
+	if n := flags["msg"].FramesOut + flags["msgPart"].FramesOut; n < uint64(len(data)/size) {
+		t.Fatal("the data frames larger than the segment size", n)
+	}
+}
+
+func TestProtocolSpec(t *testing.T) {
+	if protocol.FlagConnCloseAck != muxConnCloseAck || protocol.NumFlags != numFlags ||
+		protocol.FlagCompactHeader != muxCompactHeader || protocol.FeatureCloseConfirm != featureCloseConfirm ||
+		protocol.FeatureIntegrity != featureIntegrity || protocol.FeatureStreamMeta != featureStreamMeta ||
+		protocol.FeatureIdQuarantine != featureIdQuarantine || protocol.FeatureSequence != featureSequence ||
+		protocol.FeatureOpenCancel != featureOpenCancel || protocol.FeatureHalfClose != featureHalfClose ||
+		protocol.FeatureIdRole != featureIdRole ||
+		protocol.MaxContentSize != maximumSegmentSize || protocol.PingID != muxPing ||
+		protocol.LatestRevision != LatestProtocolRevision {
+		t.Fatal("the protocol package differs from the mux")
+	}
+	for flag := uint8(0); flag < numFlags; flag++ {
+		if protocol.HasContent(flag) != hasContent(flag) {
+			t.Fatal("content differs", flagName(flag))
+		}
+	}
+	var w window
+	if w.pack(1000, 20, true) != protocol.PackWindow(1000, 20, true) {
+		t.Fatal("window encoding differs")
+	}
+	frames := []protocol.Frame{
+		{Flag: protocol.FlagMsg, ID: 3, Content: []byte("hello")},
+		{Flag: protocol.FlagMsg, ID: -70000, Content: make([]byte, 300)},
+		{Flag: protocol.FlagSendOk, ID: 5, Window: 1 << 40},
+		{Flag: protocol.FlagNewConn, ID: 7},
+	}
+	for _, compact := range []bool{false, true} {
+		for _, f := range frames {
+			pack := new(muxPackager)
+			var err error
+			if f.Flag == protocol.FlagSendOk {
+				pack.SetWindow(f.ID, f.Window)
+			} else {
+				err = pack.Set(f.Flag, f.ID, f.Content)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			pack.compact = compact
+			var got bytes.Buffer
+			if _, err = pack.Pack(&got); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := f.Append(nil)
+			if compact {
+				want, _ = f.AppendCompact(nil)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatal("frame encoding differs", compact, f.Flag, got.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Server: true})
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	err := protocol.Run(c1, func(name string, err error) {
+		t.Log(name, err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c1.Close()
+}
+
+// revisionFlags are the flags a peer of the revision may receive, besides
+// the flags of the base protocol, muxFeatures is dropped by the base protocol
+var revisionFlags = map[uint8]int{
+	muxNewConnBatch:     2,
+	muxNewConnOkBatch:   2,
+	muxWindowProbe:      3,
+	muxCompactHeader:    4,
+	muxPadding:          5,
+	muxCongestion:       6,
+	muxConnCloseConfirm: 7,
+	muxConnCloseAck:     7,
+	muxStreamMeta:       8,
+	muxMsgSeq:           10,
+	muxConnOpenCancel:   11,
+	muxConnCloseWrite:   12,
+	muxIdRole:           13,
+}
+
+// TestProtocolRevisions runs the sessions between every pair of the protocol
+// revisions, as the fleets in the rolling upgrades, the old side must never
+// receive the frames it does not understand
+func TestProtocolRevisions(t *testing.T) {
+	for a := 1; a <= LatestProtocolRevision; a++ {
+		for b := 1; b <= LatestProtocolRevision; b++ {
+			t.Run(fmt.Sprintf("%d-%d", a, b), func(t *testing.T) {
+				testRevisions(t, a, b)
+			})
+		}
+	}
+}
+
+func testRevisions(t *testing.T, a, b int) {
+	c1, c2 := net.Pipe()
+	config := func(revision int, server bool) *MuxConfig {
+		return &MuxConfig{
+			ProtocolRevision: revision,
+			Server:           server,
+			CompactHeader:    true,
+			Padding:          &PaddingProfile{Probability: 0.2, MinSize: 1, MaxSize: 64},
+		}
+	}
+	client := NewMuxWithConfig(c1, "tcp", config(a, false))
+	server := NewMuxWithConfig(c2, "tcp", config(b, true))
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := client.NewConn()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			data := bytes.Repeat([]byte{byte(i)}, maximumSegmentSize*3+i)
+			go func() { _, _ = conn.Write(data) }()
+			buf := make([]byte, len(data))
+			if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+				errs <- fmt.Errorf("stream %d echoed wrong: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := client.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a > 1 && b > 1 && client.peerFeatures != revisionFeatures(a)&revisionFeatures(b) {
+		t.Fatal("wrong features negotiated", client.peerFeatures)
+	}
+	for _, side := range []struct {
+		m        *Mux
+		revision int
+	}{{client, a}, {server, b}} {
+		for flag, rev := range revisionFlags {
+			if n := side.m.Stats().Flags[flagName(flag)].FramesIn; rev > side.revision && n > 0 {
+				t.Fatal("revision", side.revision, "received", flagName(flag), n)
+			}
+		}
+	}
+}
+
+func TestMuxLatency(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for client.Latency().Smoothed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no latency measured")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if l := client.Latency(); l.Min <= 0 || l.Min > l.Smoothed*2 || l.Adjusted() < l.Smoothed {
+		t.Fatal("wrong latency", l)
+	}
+}
+
+func TestCurrentResources(t *testing.T) {
+	before := CurrentResources()
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMux(c2, "tcp", 0)
+	if CurrentResources().Goroutines <= before.Goroutines {
+		t.Fatal("mux goroutines not counted", CurrentResources())
+	}
+	_ = client.Close()
+	_ = server.Close()
+}
+
+// corruptConn flips a byte of the nth data frame content written
+type corruptConn struct {
+	net.Conn
+	nth int32
+}
+
+func (s *corruptConn) Write(p []byte) (int, error) {
+	if len(p) == maximumSegmentSize && atomic.AddInt32(&s.nth, -1) == 0 {
+		q := append([]byte(nil), p...)
+		q[100] ^= 1
+		return s.Conn.Write(q)
+	}
+	return s.Conn.Write(p)
+}
+
+func TestIntegrity(t *testing.T) {
+	for _, corrupt := range []bool{false, true} {
+		c1, c2 := net.Pipe()
+		var wc net.Conn = c1
+		if corrupt {
+			wc = &corruptConn{Conn: c1, nth: 300}
+		}
+		client := NewMuxWithConfig(wc, "tcp", &MuxConfig{Integrity: true})
+		server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Integrity: true})
+		data := make([]byte, integrityBlock*2+12345)
+		go func() {
+			conn, err := client.NewConn()
+			if err == nil {
+				_, _ = conn.Write(data)
+				_ = conn.Close()
+			}
+		}()
+		conn, err := server.AcceptConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, conn)
+		var ie *IntegrityError
+		if corrupt {
+			if !errors.Is(err, ErrIntegrity) || !errors.As(err, &ie) ||
+				ie.Offset > 299*maximumSegmentSize || ie.Offset+ie.Length <= 299*maximumSegmentSize {
+				t.Fatal("corruption not detected", n, err)
+			}
+		} else if err != nil || n != int64(len(data)) || server.Stats().Flags["checksum"].FramesIn != 3 {
+			t.Fatal("wrong data", n, err, server.Stats().Flags["checksum"])
+		}
+		_ = c1.Close()
+		_ = c2.Close()
+	}
+}
+
+// simulation drives the fake network and the fake clock by the seed, the mux
+// goroutines yield to it at the sim points. the goroutines of go are not all
+// controlled, the seed replays the decisions of the scheduler, which brings
+// back most interleavings, replay a failure by
+//
+//	MUX_SIM_SEED=<seed> go test -run TestSimulation
+type simulation struct {
+	rand      *rand.Rand // the decisions of the scheduler goroutine
+	yieldRand *rand.Rand // the decisions at the yield points
+	clock     *fakeClock
+	trace     []string // the decisions of the scheduler, the latest last
+	sync.Mutex
+	cond *sync.Cond
+}
+
+const (
+	simPipeCap  = 256 * 1024 // the bytes written but not delivered, then the writer waits
+	simTraceLen = 64
+)
+
+type simPipe struct {
+	pending []byte // written, not delivered by the scheduler yet
+	ready   []byte // delivered, for the reader
+	closed  bool
+}
+
+type simConn struct {
+	sim     *simulation
+	in, out *simPipe
+}
+
+func newSimulation(seed int64) *simulation {
+	sim := &simulation{
+		rand:      rand.New(rand.NewSource(seed)),
+		yieldRand: rand.New(rand.NewSource(seed ^ 0x5eed)),
+		clock:     newFakeClock(),
+	}
+	sim.cond = sync.NewCond(&sim.Mutex)
+	return sim
+}
+
+func (s *simulation) pipe() (c1, c2 *simConn, pipes [2]*simPipe) {
+	pipes = [2]*simPipe{new(simPipe), new(simPipe)}
+	return &simConn{s, pipes[0], pipes[1]}, &simConn{s, pipes[1], pipes[0]}, pipes
+}
+
+func (s *simulation) record(format string, v ...interface{}) {
+	if len(s.trace) == simTraceLen {
+		s.trace = s.trace[1:]
+	}
+	s.trace = append(s.trace, fmt.Sprintf(format, v...))
+}
+
+func (s *simulation) yield(p simPoint) {
+	s.Lock()
+	n := s.yieldRand.Intn(3)
+	s.Unlock()
+	for i := 0; i < n; i++ {
+		runtime.Gosched()
+	}
+}
+
+// step delivers a random part of the bytes written, or advances the clock
+func (s *simulation) step(pipes [2]*simPipe) {
+	s.Lock()
+	if s.rand.Intn(10) == 0 {
+		d := time.Duration(1+s.rand.Intn(50)) * time.Millisecond
+		s.record("advance %v", d)
+		s.Unlock()
+		s.clock.Advance(d)
+		return
+	}
+	d := s.rand.Intn(2)
+	p := pipes[d]
+	n := 1 + s.rand.Intn(8192)
+	if n > len(p.pending) {
+		n = len(p.pending)
+	}
+	if n > 0 {
+		s.record("deliver %d bytes to %d", n, d)
+		p.ready = append(p.ready, p.pending[:n]...)
+		p.pending = p.pending[n:]
+		s.cond.Broadcast()
+	}
+	s.Unlock()
+	runtime.Gosched()
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	c.sim.Lock()
+	defer c.sim.Unlock()
+	for len(c.in.ready) == 0 && !c.in.closed {
+		c.sim.cond.Wait()
+	}
+	if len(c.in.ready) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.in.ready)
+	c.in.ready = c.in.ready[n:]
+	return n, nil
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	c.sim.Lock()
+	defer c.sim.Unlock()
+	for len(c.out.pending) > simPipeCap && !c.out.closed {
+		c.sim.cond.Wait()
+	}
+	if c.out.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.out.pending = append(c.out.pending, b...)
+	return len(b), nil
+}
+
+func (c *simConn) Close() error {
+	c.sim.Lock()
+	c.in.closed, c.out.closed = true, true
+	c.sim.cond.Broadcast()
+	c.sim.Unlock()
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *simConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *simConn) SetDeadline(t time.Time) error      { return nil }
+func (c *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// runSimulation echoes the streams through the muxes on the simulated network,
+// it returns an error if the streams not done in time, as a window deadlock
+func runSimulation(seed int64) error {
+	sim := newSimulation(seed)
+	c1, c2, pipes := sim.pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Clock: sim.clock, sim: sim})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Clock: sim.clock, sim: sim, Server: true})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	const streams = 4
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		data := make([]byte, 100*1024+int(seed)%1000*i)
+		rand.New(rand.NewSource(seed + int64(i))).Read(data)
+		go func() {
+			conn, err := client.NewConn()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			go func() { _, _ = conn.Write(data) }()
+			buf := make([]byte, len(data))
+			if _, err = io.ReadFull(conn, buf); err == nil && !bytes.Equal(buf, data) {
+				err = errors.New("data echoed differs")
+			}
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for done := 0; done < streams; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				return err
+			}
+			done++
+			continue
+		default:
+		}
+		if time.Now().After(deadline) {
+			sim.Lock()
+			defer sim.Unlock()
+			return fmt.Errorf("streams not done, %d of %d, last decisions:\n%s", done, streams, strings.Join(sim.trace, "\n"))
+		}
+		sim.step(pipes)
+	}
+	return nil
+}
+
+func TestSimulation(t *testing.T) {
+	seeds := []int64{1, 2, 3, 4, 5, 6, 7, 8}
+	if s := os.Getenv("MUX_SIM_SEED"); s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = []int64{seed}
+	}
+	for _, seed := range seeds {
+		if err := runSimulation(seed); err != nil {
+			t.Fatalf("seed %d: %v\nreplay by MUX_SIM_SEED=%d", seed, err, seed)
+		}
+	}
+}
+
+func TestTuneTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			NewMux(c, "tcp", 0)
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &TCPConfig{KeepAlive: time.Second * 10, UserTimeout: time.Second * 30}
+	client := NewMuxWithConfig(c, "tcp", &MuxConfig{TCP: config})
+	defer client.Close()
+	if runtime.GOOS == "linux" {
+		if err := setUserTimeout(c.(*net.TCPConn), config.UserTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	listeners, err := ListenReusePort("tcp", "127.0.0.1:0", 2)
+	if err != nil {
+		t.Skip(err)
+	}
+	if len(listeners) != 2 || listeners[0].Addr().String() != listeners[1].Addr().String() {
+		t.Fatal("want 2 listeners on the same address")
+	}
+	muxes := make(chan *Mux, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeReusePort(listeners, "tcp", nil, func(m *Mux) { muxes <- m })
+	}()
+	c, err := net.Dial("tcp", listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-muxes
+	// the server mux is closed after the transport closed by the peer
+	_ = c.Close()
+	defer server.Close()
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	if err := <-served; err == nil {
+		t.Fatal("serve not returns the error of closed listeners")
+	}
+}
+
+func TestTransportProfile(t *testing.T) {
+	config := new(MuxConfig)
+	if config.profile("kcp") != ProfileKCPNormal || config.profile("tcp") != ProfileTCPWAN {
+		t.Fatal("wrong default profile")
+	}
+	if config.pingCheckThreshold("kcp") != 20 || config.pingCheckThreshold("tcp") != 60 {
+		t.Fatal("default ping check threshold changed")
+	}
+	config.Profile = ProfileKCPFast
+	if config.pingCheckThreshold("tcp") != uint32(ProfileKCPFast.PingCheckThreshold) {
+		t.Fatal("profile ping check threshold not used")
+	}
+	config.PingCheckThreshold = 3
+	if config.pingCheckThreshold("tcp") != 3 {
+		t.Fatal("ping check threshold not override the profile")
+	}
+	if ProfileKCPFast.windowSize(100) != 200 || ProfileTCPWAN.windowSize(100) != 100 {
+		t.Fatal("wrong window multiplier")
+	}
+}
+
+func TestWriteQueueDrained(t *testing.T) {
+	c1, c2 := net.Pipe()
+	drained := make(chan struct{}, 1)
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		WriteQueueHighWater: 4,
+		OnWriteQueueDrained: func(*Mux) {
+			select {
+			case drained <- struct{}{}:
+			default:
+			}
+		},
+	})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, maximumSegmentSize*16)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second * 5):
+		t.Fatal("drained not reported")
+	}
+	if client.Stats().WriteQueueHigh < 4 || client.WriteQueueLen() != 0 {
+		t.Fatal("wrong write queue stats", client.Stats())
+	}
+}
+
+type writeSizeConn struct {
+	net.Conn
+	sync.Mutex
+	sizes []int
+}
+
+func (s *writeSizeConn) Write(p []byte) (int, error) {
+	s.Lock()
+	s.sizes = append(s.sizes, len(p))
+	s.Unlock()
+	return s.Conn.Write(p)
+}
+
+func TestTLSRecordAlign(t *testing.T) {
+	c1, c2 := net.Pipe()
+	wc := &writeSizeConn{Conn: c1}
+	client := NewMuxWithConfig(wc, "tcp", &MuxConfig{Hints: &TransportHints{TLS: true}})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	data := bytes.Repeat([]byte("record"), maximumSegmentSize*7)
+	go func() {
+		conn, err := client.NewConn()
+		if err == nil {
+			_, _ = conn.Write(data)
+		}
+	}()
+	conn, err := server.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("wrong data", err)
+	}
+	var frames uint64
+	for _, f := range client.Stats().Flags {
+		frames += f.FramesOut
+	}
+	wc.Lock()
+	defer wc.Unlock()
+	for _, n := range wc.sizes {
+		if n > defaultRecordSize {
+			t.Fatal("write larger than a record", n)
+		}
+	}
+	if uint64(len(wc.sizes)) > frames {
+		t.Fatal("frames not gathered", len(wc.sizes), frames)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Pacing: true})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	const size = 4 << 20
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			received <- 0
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if n := <-received; n != size {
+		t.Fatal("want", size, "got", n)
+	}
+
+	clock := newFakeClock()
+	m := &Mux{clock: clock, closeChan: make(chan struct{}), ackedBw: &bandwidth{clock: clock}, sentBw: &bandwidth{clock: clock}}
+	p := newPacer(m)
+	m.ackedBw.add(1)
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Millisecond * 100)
+		m.ackedBw.add(100000)
+	}
+	bw, ok := m.ackedBw.Get()
+	if !ok || math.Abs(bw-1e6) > 1e4 {
+		t.Fatal("wrong delivery rate", bw)
+	}
+	if rate, _ := p.rate(); rate != bw*pacingGain {
+		t.Fatal("the rate without the sent bandwidth should follow the acked", rate)
+	}
+	p.wait(pacingBurst) // the burst is not paced
+	if d := p.bucket.take(1.25e5, bw*pacingGain); d != time.Millisecond*100 {
+		t.Fatal("want paced 100ms, got", d)
+	}
+}
+
+func TestCongestion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Pacing: true})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{CongestionThreshold: maximumSegmentSize * 4})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		// read slowly, the frames received pile up
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, maximumSegmentSize)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maximumSegmentSize)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if client.Stats().Congestions > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("congestion not notified")
+}
+
+type testSpan struct {
+	events []string
+	ended  chan ConnStats
+}
+
+func (s *testSpan) AddEvent(name string) { s.events = append(s.events, name) }
+func (s *testSpan) End(stats ConnStats)  { s.ended <- stats }
+
+type testTracer struct{ spans chan *testSpan }
+
+func (t *testTracer) StartStream(c *Conn) StreamSpan {
+	span := &testSpan{ended: make(chan ConnStats, 1)}
+	t.spans <- span
+	return span
+}
+
+func TestTracer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	tracer := &testTracer{spans: make(chan *testSpan, 2)}
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Tracer: tracer})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.Close()
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := <-tracer.spans
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	stats := <-span.ended
+	if stats.BytesIn != 5 || len(span.events) != 1 || span.events[0] != EventRemoteClose {
+		t.Fatal("wrong span", stats, span.events)
+	}
+}
+
+func TestMaxPendingOpens(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// nobody answers on the other side, the open keeps pending
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{MaxPendingOpens: 1, PendingOpensFailFast: true})
+	go func() {
+		_, _ = client.NewConn()
+	}()
+	for i := 0; i < 100 && len(client.openSlots) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.NewConn(); err == nil || !strings.Contains(err.Error(), "pending") {
+		t.Fatal("want fail fast, got", err)
+	}
+	_ = client.Close()
+}
+
+func TestTraffic(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	traffic := conn.Traffic()
+	if traffic.BytesIn != 5 || traffic.BytesOut != 5 || traffic.FramesIn != 1 || traffic.FramesOut != 1 {
+		t.Fatal("wrong stream traffic", traffic)
+	}
+	if stats := client.Stats(); stats.BytesOut <= 5 || stats.FramesIn == 0 || stats.Streams != 1 {
+		t.Fatal("wrong mux stats", stats)
+	}
+	var flags map[string]Traffic
+	for i := 0; i < 100; i++ {
+		// the write session counts the frame after the peer got it
+		if flags = client.Stats().Flags; flags["msg"].FramesOut == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if flags["msg"].FramesOut != 1 || flags["msg"].FramesIn != 1 || flags["newConn"].FramesOut != 1 {
+		t.Fatal("wrong flag stats", flags)
+	}
+	conn.ResetTraffic()
+	if traffic = conn.Traffic(); traffic.BytesIn != 0 || traffic.FramesOut != 0 {
+		t.Fatal("traffic not reset", traffic)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	c1, c2 := net.Pipe()
+	exceeded := make(chan *Conn, 1)
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		OnQuotaExceeded: func(m *Mux, c *Conn) {
+			exceeded <- c
+		},
+	})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetQuota(10)
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != ErrQuotaExceeded {
+		t.Fatal("want quota exceeded, got", err)
+	}
+	if c := <-exceeded; c != conn {
+		t.Fatal("wrong conn reported")
+	}
+	if client.Closed() {
+		t.Fatal("the mux should not be closed by the stream quota")
+	}
+}
+
+func TestNewConnRate(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Clock: clock, NewConnRate: 1})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			if _, err := server.AcceptConn(); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := client.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewConn(); err == nil {
+		t.Fatal("the stream beyond the rate should be refused")
+	}
+	clock.Advance(time.Second)
+	if _, err := client.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Stats().RefusedStreams; n != 1 {
+		t.Fatal("want 1 refused stream, got", n)
+	}
+}
+
+func TestNewConnRetry(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Clock: clock, NewConnRate: 1})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			if _, err := server.AcceptConn(); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := client.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		clock.Advance(time.Second)
+	}()
+	policy := RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 5}
+	if _, err := client.NewConnRetry(context.Background(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if server.Stats().RefusedStreams == 0 {
+		t.Fatal("the first attempts should be refused")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := client.NewConnRetry(ctx, policy); err != context.DeadlineExceeded {
+		t.Fatal("want deadline exceeded, got", err)
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Clock: clock, AcceptTimeout: time.Second})
+	defer client.Close()
+	defer server.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		// nobody accepts the stream
+		_, err := client.NewConn()
+		errCh <- err
+	}()
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Fatal("the stream not accepted should be refused")
+			}
+			if server.Stats().Streams != 0 {
+				t.Fatal("the refused stream is left")
+			}
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("the stream not refused")
+}
+
+func TestMaxIdleTime(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	idle := make(chan *Mux, 1)
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		Clock:       clock,
+		MaxIdleTime: time.Second * 10,
+		OnIdleClose: func(m *Mux) { idle <- m },
+	})
+	server := NewMux(c2, "tcp", 0)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		// the stream keeps the mux
+		clock.Advance(time.Second)
+	}
+	if client.Closed() {
+		t.Fatal("the mux with a stream is closed")
+	}
+	_ = conn.Close()
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		select {
+		case m := <-idle:
+			if m != client {
+				t.Fatal("wrong mux")
+			}
+			for !client.Closed() {
+				time.Sleep(time.Millisecond)
+			}
+			return
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	t.Fatal("the idle mux not closed")
+}
+
+func TestConnDrain(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	const size = 1 << 20
+	read := make(chan int64, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+		n, _ := io.Copy(ioutil.Discard, conn)
+		read <- n
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := conn.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("more")); err == nil {
+		t.Fatal("write on drained conn")
+	}
+	_ = conn.Close()
+	if n := <-read; n != size {
+		t.Fatal("want", size, "got", n)
+	}
+}
+
+func TestCloseAndConfirm(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	const size = 100000
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		// the traffic reset does not change the bytes confirmed
+		_, _ = io.CopyN(ioutil.Discard, conn, size/2)
+		conn.ResetTraffic()
+		_, _ = io.Copy(ioutil.Discard, conn)
+		_ = conn.Close()
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, size/2)); err != nil {
+		t.Fatal(err)
+	}
+	conn.ResetTraffic()
+	if _, err := conn.Write(make([]byte, size/2)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	delivered, err := conn.CloseAndConfirm(ctx)
+	if err != nil || delivered != size {
+		t.Fatal("want", size, "delivered, got", delivered, err)
+	}
+}
+
+func TestByteRing(t *testing.T) {
+	var ring byteRing
+	var want []byte
+	buf := make([]byte, maximumSegmentSize*3)
+	for i := 0; i < 1000; i++ {
+		p := make([]byte, (i*977)%maximumSegmentSize+1)
+		for j := range p {
+			p[j] = byte(i + j)
+		}
+		ring.write(p)
+		want = append(want, p...)
+		if i%3 == 0 {
+			n := ring.read(buf[:(i*131)%len(buf)])
+			if !bytes.Equal(buf[:n], want[:n]) {
+				t.Fatal("wrong data read at", i)
+			}
+			want = want[n:]
+		}
+	}
+	for len(want) > 0 {
+		n := ring.read(buf)
+		if !bytes.Equal(buf[:n], want[:n]) {
+			t.Fatal("wrong data read")
+		}
+		want = want[n:]
+	}
+	if k := len(ring.buf) / minRingSize; ring.n != 0 || len(ring.buf)%minRingSize != 0 || k&(k-1) != 0 {
+		t.Fatal("wrong ring status", ring.n, len(ring.buf))
+	}
+}
+
+func TestSlabAllocator(t *testing.T) {
+	a := newSlabAllocator()
+	var bufs [][]byte
+	for _, n := range []int{0, 1, 256, 257, 1024, 1025, poolSizeWindow} {
+		buf := a.Get(n)
+		if len(buf) != n || cap(buf) < n {
+			t.Fatal("wrong buffer size", n, len(buf), cap(buf))
+		}
+		bufs = append(bufs, buf)
+	}
+	// buffers carved from one slab must not overlap
+	b1, b2 := a.Get(10), a.Get(10)
+	b1 = b1[:cap(b1)]
+	for i := range b1 {
+		b1[i] = 0xff
+	}
+	if b2[0] == 0xff || cap(b1) != 256 {
+		t.Fatal("buffers overlap")
+	}
+	bufs = append(bufs, b1, b2)
+	stats := &a.classes
+	if stats[0].inUse != 5 || stats[1].inUse != 2 || stats[2].inUse != 2 || stats[0].slabs != 1 {
+		t.Fatal("wrong stats", stats[0].inUse, stats[1].inUse, stats[2].inUse, stats[0].slabs)
+	}
+	for _, buf := range bufs {
+		a.Put(buf)
+	}
+	a.Put(make([]byte, 100)) // foreign buffer dropped
+	for i := range a.classes {
+		if a.classes[i].inUse != 0 {
+			t.Fatal("buffers in use left", a.classes[i].size, a.classes[i].inUse)
+		}
+	}
+	if s := BufferPoolStats(); len(s) != len(bufferClasses) || s[2].Size != poolSizeWindow {
+		t.Fatal("wrong pool stats", s)
+	}
+}
+
+func TestSessionArena(t *testing.T) {
+	var arena sessionArena
+	packs := make([]*muxPackager, 100)
+	for i := range packs {
+		packs[i] = arena.getPack()
+		packs[i].id = int32(i)
+	}
+	for i, pack := range packs {
+		for _, other := range packs[:i] {
+			if pack == other {
+				t.Fatal("packager got twice")
+			}
+		}
+	}
+	for _, pack := range packs {
+		arena.putPack(pack)
+	}
+	if pack := arena.getPack(); pack.id != 0 {
+		t.Fatal("packager not reset")
+	} else {
+		arena.putPack(pack)
+	}
+	arena.release()
+	if pack := arena.getPack(); pack == nil {
+		t.Fatal("no packager after release")
+	}
+}
+
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (Self *countingReader) Read(p []byte) (int, error) {
+	Self.reads++
+	return Self.r.Read(p)
+}
+
+func TestStagingReader(t *testing.T) {
+	var wire bytes.Buffer
+	for i := 0; i < 100; i++ {
+		pack := new(muxPackager)
+		if err := pack.Set(muxNewMsg, int32(i), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pack.Pack(&wire); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter := &countingReader{r: &wire}
+	r := newStagingReader(counter)
+	for i := 0; i < 100; i++ {
+		pack := new(muxPackager)
+		if _, err := pack.UnPack(r); err != nil {
+			t.Fatal(err)
+		}
+		if pack.id != int32(i) || string(pack.content) != strconv.Itoa(i) {
+			t.Fatal("wrong frame", i, pack.id, string(pack.content))
+		}
+		windowBuff.Put(pack.content)
+	}
+	if counter.reads != 1 {
+		t.Fatal("the frames not parsed from one read", counter.reads)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("want eof", err)
+	}
+}
+
+func TestUnPackFrame(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		var wire bytes.Buffer
+		for i := 0; i < 2000; i++ {
+			pack := new(muxPackager)
+			pack.compact = compact
+			var err error
+			switch i % 3 {
+			case 0:
+				err = pack.Set(muxNewMsg, int32(i*1000), bytes.Repeat([]byte{byte(i)}, i%maximumSegmentSize+1))
+			case 1:
+				pack.SetWindow(int32(-i), uint64(i))
+			default:
+				err = pack.Set(muxConnClose, int32(i), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = pack.Pack(&wire); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := wire.Bytes()
+		framed, plain := newStagingReader(bytes.NewReader(data)), bytes.NewReader(data)
+		for i := 0; i < 2000; i++ {
+			p1, p2 := new(muxPackager), new(muxPackager)
+			p1.compact, p2.compact = compact, compact
+			n1, err1 := p1.UnPack(framed)
+			n2, err2 := p2.UnPack(iotest.OneByteReader(plain))
+			if err1 != nil || err2 != nil {
+				t.Fatal(err1, err2)
+			}
+			if n1 != n2 || p1.flag != p2.flag || p1.id != p2.id || p1.window != p2.window || !bytes.Equal(p1.content, p2.content) {
+				t.Fatal("frames differ", compact, i, n1, n2, p1.flag, p2.flag, p1.id, p2.id)
+			}
+			if p1.content != nil {
+				windowBuff.Put(p1.content)
+				windowBuff.Put(p2.content)
+			}
+		}
+	}
+}
+
+func BenchmarkStreamThroughput(b *testing.B) {
+	// over the loopback tcp, the net.Pipe copies without any buffer
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(<-accepted, "tcp", &MuxConfig{Server: true})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBidirectionalOpen(t *testing.T) {
+	// the roles configured, or negotiated with both sides configured the same
+	for _, configured := range []bool{true, false} {
+		testBidirectionalOpen(t, configured)
+	}
+}
+
+func testBidirectionalOpen(t *testing.T, configured bool) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Server: configured})
+	defer client.Close()
+	defer server.Close()
+	var wg sync.WaitGroup
+	for _, m := range []*Mux{client, server} {
+		m := m
+		go func() {
+			for {
+				conn, err := m.AcceptConn()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := m.NewConn()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if configured && (conn.ID()%2 == 0) != (m == server) {
+					t.Error("id not in the space of the side", conn.ID())
+				}
+				if _, err = conn.Write([]byte("hello")); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+					t.Error(err)
+				}
+				_ = conn.Close()
+			}()
+		}
+	}
+	wg.Wait()
+	a, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := server.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID()%2 == b.ID()%2 {
+		t.Fatal("the id spaces of the two sides not apart", configured, a.ID(), b.ID())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := NewMux(c, "tcp", 0)
+		defer server.Close()
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := NewMuxWithConfig(c, "tcp", &MuxConfig{Handoff: true})
+	conn, err := old.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	time.Sleep(time.Millisecond * 100)
+	f, state, err := old.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !old.Closed() {
+		t.Fatal("the exported mux should be closed")
+	}
+	m, err := Import(f, state, nil)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if conn, err = m.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.ID() == 1 {
+		t.Fatal("the stream id should not be reused")
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo through the imported mux failed", err)
+	}
+}
+
+func TestExportStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := NewMux(c, "tcp", 0)
+		defer server.Close()
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := NewMuxWithConfig(c, "tcp", &MuxConfig{Handoff: true})
+	conn, err := old.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	// the first part echoed, some read, the rest left in the window
+	const first, read = 1 << 16, 1 << 14
+	if _, err = conn.Write(data[:first]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, read, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; conn.Buffered() < first-read; i++ {
+		if i > 200 {
+			t.Fatal("the echo not buffered", conn.Buffered())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	id := conn.ID()
+	recv := atomic.LoadUint64(&conn.receiveWindow.maxSizeDone)
+	send := atomic.LoadUint64(&conn.sendWindow.maxSizeDone)
+	f, state, err := old.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Import(f, state, nil)
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	conn = nil
+	m.Range(func(c *Conn) bool {
+		if c.ID() == id {
+			conn = c
+		}
+		return conn == nil
+	})
+	if conn == nil {
+		t.Fatal("the stream is not imported")
+	}
+	if conn.Buffered() != first-read {
+		t.Fatal("the data buffered is not imported", conn.Buffered())
+	}
+	if conn.receiveWindow.maxSizeDone != recv || conn.sendWindow.maxSizeDone != send {
+		t.Fatal("the windows are not imported")
+	}
+	// the rest goes through the windows of the old process
+	go func() {
+		_, _ = conn.Write(data[first:])
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	got = got[:len(data)]
+	if _, err = io.ReadFull(conn, got[read:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the data echoed through the imported stream mismatched")
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fd passing is only supported on linux")
+	}
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "mux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mux.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	to, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	from, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		if err = conn.HandOff(from, []byte("lease")); err != nil {
+			t.Error(err)
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _, lease, err := ReceiveStream(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if string(lease) != "lease" {
+		t.Fatal("wrong lease", string(lease))
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(stream, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("data not relayed", err)
+	}
+	// the half close of the other process is passed on, the reply goes on
+	if err = stream.(*net.UnixConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(buf); err != io.EOF {
+		t.Fatal("want eof, got", err)
+	}
+	if _, err = conn.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(stream, buf); err != nil || string(buf) != "reply" {
+		t.Fatal("reply not relayed", err)
+	}
+}
+
+func TestCompactHeader(t *testing.T) {
+	for _, id := range []int32{muxPing, 0, 1, 63, 64, 1 << 20, math.MaxInt32} {
+		for _, flag := range []uint8{muxNewMsg, muxMsgSendOk, muxConnClose} {
+			var data []byte
+			window := uint64(id) << 20
+			if flag == muxNewMsg {
+				data = bytes.Repeat([]byte{1}, int(id&0x1ff)+1)
+			}
+			pack := muxPack.Get()
+			if flag == muxMsgSendOk {
+				pack.SetWindow(id, window)
+			} else if err := pack.Set(flag, id, data); err != nil {
+				t.Fatal(err)
+			}
+			pack.compact = true
+			var buf bytes.Buffer
+			if _, err := pack.Pack(&buf); err != nil {
+				t.Fatal(err)
+			}
+			muxPack.Put(pack)
+			pack = muxPack.Get()
+			pack.compact = true
+			if _, err := pack.UnPack(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if pack.flag != flag || pack.id != id || buf.Len() != 0 {
+				t.Fatal("wrong frame decoded", flag, id, pack.flag, pack.id)
+			}
+			switch flag {
+			case muxNewMsg:
+				if !bytes.Equal(pack.content, data) {
+					t.Fatal("wrong content decoded")
+				}
+				windowBuff.Put(pack.content)
+			case muxMsgSendOk:
+				if pack.window != window {
+					t.Fatal("wrong window decoded")
+				}
+			}
+			muxPack.Put(pack)
+		}
+	}
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{CompactHeader: true})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{CompactHeader: true})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("compact"), 10000)
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("echo with compact header failed", err)
+	}
+	if atomic.LoadUint32(&client.compactWrite) == 0 || atomic.LoadUint32(&server.compactRead) == 0 {
+		t.Fatal("compact header not negotiated")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		Padding: &PaddingProfile{Probability: 1, MinSize: 10, MaxSize: 100, MaxJitter: time.Millisecond},
+	})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("padding"), 1000)
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("echo with padding failed", err)
+	}
+	// every frame is followed by a padding frame
+	if client.Stats().FramesOut < 2*conn.Traffic().FramesOut {
+		t.Fatal("no padding frames sent")
+	}
+
+	// the jitter delays the bursts, not every frame of them
+	c3, c4 := net.Pipe()
+	client = NewMuxWithConfig(c3, "tcp", &MuxConfig{Padding: &PaddingProfile{MaxJitter: time.Millisecond * 50}})
+	server = NewMux(c4, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	// 50 frames, 1.25s on average if every frame delayed
+	const size = 50 * maximumSegmentSize
+	received := make(chan struct{})
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, make([]byte, size)); err == nil {
+			close(received)
+		}
+	}()
+	if conn, err = client.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	go func() { _, _ = conn.Write(make([]byte, size)) }()
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("not received")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("the frames of a burst delayed", d)
+	}
+}
+
+// streamTransform xors the bytes with a key stream, as a stream cipher
+type streamTransform struct {
+	key      byte
+	enc, dec byte // the positions in the key streams
+}
+
+func (s *streamTransform) Encode(p []byte) []byte {
+	out := make([]byte, len(p))
+	for i, b := range p {
+		out[i] = b ^ s.key ^ s.enc
+		s.enc++
+	}
+	return out
+}
+
+func (s *streamTransform) Decode(p []byte) ([]byte, error) {
+	out := make([]byte, len(p))
+	for i, b := range p {
+		out[i] = b ^ s.key ^ s.dec
+		s.dec++
+	}
+	return out, nil
+}
+
+// growTransform adds a byte to every write
+type growTransform struct{ streamTransform }
+
+func (s *growTransform) Encode(p []byte) []byte {
+	return append(s.streamTransform.Encode(p), 0)
+}
+
+// wireConn records the bytes written
+type wireConn struct {
+	net.Conn
+	sync.Mutex
+	wire bytes.Buffer
+}
+
+func (s *wireConn) Write(p []byte) (int, error) {
+	s.Lock()
+	s.wire.Write(p)
+	s.Unlock()
+	return s.Conn.Write(p)
+}
+
+func TestWireTransform(t *testing.T) {
+	c1, c2 := net.Pipe()
+	wc := &wireConn{Conn: c1}
+	client := NewMuxWithConfig(wc, "tcp", &MuxConfig{WireTransform: &streamTransform{key: 0x5a}})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{WireTransform: &streamTransform{key: 0x5a}})
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("transform"), 1000)
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("echo with wire transform failed", err)
+	}
+	// nothing is added on the wire, decoding it all back gives the frames
+	wc.Lock()
+	frames, _ := (&streamTransform{key: 0x5a}).Decode(wc.wire.Bytes())
+	wc.Unlock()
+	if !bytes.Contains(frames, data[:maximumSegmentSize/2]) {
+		t.Fatal("the wire is not the frames transformed")
+	}
+
+	c3, c4 := net.Pipe()
+	grow := NewMuxWithConfig(c3, "tcp", &MuxConfig{WireTransform: &growTransform{}})
+	peer := NewMuxWithConfig(c4, "tcp", &MuxConfig{WireTransform: &streamTransform{}})
+	defer grow.Close()
+	defer peer.Close()
+	go func() { _, _ = grow.NewConn() }()
+	deadline := time.Now().Add(time.Second * 5)
+	for !grow.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the transform changing the length is not refused")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clock := newFakeClock()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Clock: clock})
+	server := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	for i := 0; i < 2; i++ {
+		if _, err = conn.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(bwSampleInterval)
+	}
+	stats := conn.Stats()
+	if stats.WriteRate != 20000 || stats.ReadRate != 20000 {
+		t.Fatal("wrong rate", stats.WriteRate, stats.ReadRate)
+	}
+	if stats.BytesOut != 2000 || stats.QueueDelay < 0 {
+		t.Fatal("wrong stats", stats)
+	}
+}
+
+// panicSim panics in the read session
+type panicSim struct{}
+
+func (panicSim) yield(p simPoint) {
+	if p == simReceive {
+		panic("malformed frame")
+	}
+}
+
+func TestOnPanic(t *testing.T) {
+	c1, c2 := net.Pipe()
+	panics := make(chan interface{}, 1)
+	server := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		sim: panicSim{},
+		OnPanic: func(v interface{}, stack []byte) {
+			if !bytes.Contains(stack, []byte("panicSim")) {
+				t.Error("stack without the panic", string(stack))
+			}
+			panics <- v
+		},
+	})
+	client := NewMux(c2, "tcp", 0)
+	defer client.Close()
+	select {
+	case v := <-panics:
+		if v != "malformed frame" {
+			t.Fatal("wrong panic value", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("panic not handled")
+	}
+	for i := 0; !server.Closed(); i++ {
+		if i > 100 {
+			t.Fatal("mux not closed after panic")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// without OnPanic, the stack is logged before panic again
+	logger := new(testLogger)
+	m := &Mux{config: MuxConfig{Logger: logger}}
+	func() {
+		defer func() {
+			if v := recover(); v != "malformed frame" {
+				t.Fatal("wrong panic value", v)
+			}
+		}()
+		defer m.recoverPanic()
+		panicSim{}.yield(simReceive)
+	}()
+	if !strings.Contains(logger.String(), "panicSim") {
+		t.Fatal("stack not logged", logger.String())
+	}
+}
+
+func TestResumption(t *testing.T) {
+	clock := newFakeClock()
+	issuer := &ResumptionIssuer{Key: []byte("secret"), TTL: time.Minute, Clock: clock}
+	client, server := pipeMux()
+	server.SetQuota(1000)
+	server.goodput.addIn(300)
+	token, err := issuer.Issue("alice", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	_ = server.Close()
+	client, server = pipeMux()
+	defer client.Close()
+	defer server.Close()
+	identity, err := issuer.Resume(token, server)
+	if err != nil || identity != "alice" {
+		t.Fatal("resume fail", identity, err)
+	}
+	if q := atomic.LoadInt64(&server.quota); q != 700 {
+		t.Fatal("wrong quota left", q)
+	}
+	forged := []byte(token)
+	forged[5] ^= 1
+	if _, err = issuer.Resume(string(forged), server); err != ErrResumption {
+		t.Fatal("forged token resumed", err)
+	}
+	if _, err = (&ResumptionIssuer{Key: []byte("other")}).Resume(token, server); err != ErrResumption {
+		t.Fatal("token resumed by the other key", err)
+	}
+	clock.Advance(time.Minute * 2)
+	if _, err = issuer.Resume(token, server); err != ErrResumptionExpired {
+		t.Fatal("expired token resumed", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	accepted := make(chan *Conn, 8)
+	go func() {
+		for {
+			c, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- c
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+	// wait for the features exchanged
+	server.SetTenantLimits("a", TenantLimits{MaxStreams: 2})
+	var conns []*Conn
+	for i := 0; i < 2; i++ {
+		c, err := client.NewTenantConn("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Tenant() != "a" || (<-accepted).Tenant() != "a" {
+			t.Fatal("tenant not sent")
+		}
+		conns = append(conns, c)
+	}
+	if _, err := client.NewTenantConn("a"); err == nil {
+		t.Fatal("streams beyond the tenant limit opened")
+	}
+	if _, err := conns[0].Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conns[0], make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conns[0].Close()
+	var stats TenantStats
+	for i := 0; i < 100; i++ {
+		if stats = server.TenantStats()["a"]; stats.Streams == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stats.Streams != 1 || stats.Traffic.BytesIn != 1000 || stats.Traffic.BytesOut != 1000 {
+		t.Fatal("wrong tenant stats", stats)
+	}
+	if _, err := client.NewTenantConn("a"); err != nil {
+		t.Fatal("stream not opened after one closed", err)
+	}
+	client.SetTenantLimits("b", TenantLimits{Quota: 100})
+	c, err := client.NewTenantConn("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("x")); err != ErrQuotaExceeded {
+		t.Fatal("tenant quota not checked", err)
+	}
+	if c2, err := client.NewTenantConn("b"); err != nil {
+		t.Fatal(err)
+	} else if _, err = c2.Write([]byte("x")); err != ErrQuotaExceeded {
+		t.Fatal("tenant quota not shared by the streams", err)
+	}
+}
+
+func TestTenantsBound(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{MaxTenants: 2})
+	defer client.Close()
+	defer server.Close()
+	accepted := make(chan *Conn, 8)
+	go func() {
+		for {
+			c, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+	// wait for the features exchanged
+	server.SetTenantLimits("a", TenantLimits{MaxStreams: 10})
+	var conns []*Conn
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c, err := client.NewTenantConn(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c, <-accepted)
+	}
+	if conns[3].Tenant() != "b" || conns[5].Tenant() != "" || conns[7].Tenant() != "" {
+		t.Fatal("the tenants beyond the bound not accounted together", conns[3].Tenant(), conns[5].Tenant())
+	}
+	if stats := server.TenantStats(); len(stats) != 3 || stats[""].Streams != 2 {
+		t.Fatal("wrong tenant stats", stats)
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	var stats map[string]TenantStats
+	for i := 0; i < 100; i++ {
+		if stats = server.TenantStats(); len(stats) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, ok := stats["a"]; !ok || len(stats) != 1 || len(client.TenantStats()) != 0 {
+		t.Fatal("the tenants without the streams not dropped", stats, client.TenantStats())
+	}
+}
+
+func TestPriorityInheritance(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 100)
+	// wait for the features exchanged
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := server.AcceptConn()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := <-accepted
+	if p := sc.receiveWindow.ackPriority(); p != PriorityBulk {
+		t.Fatal("wrong initial ack class", p)
+	}
+	c.SetPriority(PriorityInteractive)
+	for i := 0; sc.receiveWindow.ackPriority() != PriorityInteractive; i++ {
+		if i > 100 {
+			t.Fatal("ack class not inherited from the peer")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if sc.Priority() != PriorityBulk {
+		t.Fatal("the data class of the peer changed")
+	}
+	if p := client.framePriority(muxConnClose, c.connId); p != PriorityInteractive {
+		t.Fatal("close not in the class of the stream", p)
+	}
+	if p := client.framePriority(muxWindowProbe, c.connId); p != PriorityRetransmit {
+		t.Fatal("probe lowered by the stream class", p)
+	}
+}
+
+func TestPingClass(t *testing.T) {
+	q := new(priorityQueue)
+	q.New(systemClock{}, 0)
+	q.Push(&muxPackager{priority: PriorityBulk})
+	q.Push(&muxPackager{priority: PriorityControl})
+	q.Push(&muxPackager{priority: flagPriority(muxPingReturn)})
+	if got := q.TryPop().priority; got != priorityPing {
+		t.Fatal("the ping should be sent first, got", got)
+	}
+	clock := newFakeClock()
+	m := &Mux{clock: clock, epoch: clock.Now(), sessionID: 7}
+	pack := new(muxPackager)
+	if err := pack.Set(muxPingFlag, muxPing, m.pingStamp()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second * 3)
+	// queued for a while
+	m.restampPing(pack)
+	sent, ok := m.pingSent(pack.content[:pack.length])
+	if !ok || sent != m.monotonic() {
+		t.Fatal("the time queued is in the latency", time.Duration(m.monotonic()-sent))
+	}
+	// the stamps of another mux, as the one exported, are dropped
+	other := &Mux{clock: clock, epoch: clock.Now(), sessionID: 8}
+	if _, ok = m.pingSent(other.pingStamp()); ok {
+		t.Fatal("the ping of another mux accepted")
+	}
+}
+
+func TestPingTimeoutConfig(t *testing.T) {
+	config := &MuxConfig{PingCheckThreshold: 3, PingInterval: time.Second}
+	if d := config.pingTimeout("tcp"); d != time.Second*3 {
+		t.Fatal("wrong ping timeout of the threshold", d)
+	}
+	c1, c2 := net.Pipe()
+	go func() { _, _ = io.Copy(ioutil.Discard, c2) }()
+	clock := newFakeClock()
+	timeout := make(chan struct{}, 1)
+	m := NewMuxWithConfig(c1, "tcp", &MuxConfig{
+		PingInterval: time.Second,
+		PingTimeout:  time.Second * 4,
+		Clock:        clock,
+		OnPingTimeout: func(*Mux) Action {
+			timeout <- struct{}{}
+			return ActionClose
+		},
+	})
+	defer m.Close()
+	advance := func(n int) bool {
+		for i := 0; i < n; i++ {
+			clock.Advance(time.Second)
+			select {
+			case <-timeout:
+				return true
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+		return false
+	}
+	if advance(4) {
+		t.Fatal("ping timeout too early")
+	}
+	if !advance(2) {
+		t.Fatal("ping not timeout after nothing received")
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	client, server := pipeMux()
+	defer client.Close()
+	defer server.Close()
+	if client.SessionID() == 0 || client.SessionID() == server.SessionID() {
+		t.Fatal("session ids not unique", client.SessionID(), server.SessionID())
+	}
+	if client.Stats().SessionID != client.SessionID() {
+		t.Fatal("session id not in the stats")
+	}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	client.logln(LogInfo, "hello")
+	log.SetOutput(os.Stderr)
+	if !strings.Contains(out.String(), fmt.Sprintf("mux[%d]: hello", client.SessionID())) {
+		t.Fatal("session id not in the log", out.String())
+	}
+	out.Reset()
+	client.Dump(&out)
+	if !strings.HasPrefix(out.String(), fmt.Sprintf("mux[%d] ", client.SessionID())) {
+		t.Fatal("session id not in the dump", out.String())
+	}
+}
+
+type testLogger struct {
+	sync.Mutex
+	logs []string
+}
+
+func (s *testLogger) Log(level LogLevel, msg string) {
+	s.Lock()
+	s.logs = append(s.logs, level.String()+" "+msg)
+	s.Unlock()
+}
+
+func (s *testLogger) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return strings.Join(s.logs, "\n")
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogInfo, LogDebug} {
+		logger := new(testLogger)
+		c1, c2 := net.Pipe()
+		m := NewMuxWithConfig(c1, "tcp", &MuxConfig{Logger: logger, LogLevel: level})
+		peer := NewMux(c2, "tcp", 0)
+		m.logln(LogWarn, "ping time out")
+		_ = m.Close()
+		_ = peer.Close()
+		time.Sleep(time.Millisecond * 50)
+		logs := logger.String()
+		if !strings.Contains(logs, fmt.Sprintf("warn mux[%d]: ping time out", m.SessionID())) {
+			t.Fatal("warn not logged", logs)
+		}
+		if closed := strings.Contains(logs, "debug mux"); closed != (level == LogDebug) {
+			t.Fatal("wrong debug logs of level", level, logs)
+		}
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	client, server, fc := closeRacePair(-1)
+	defer server.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := server.AcceptConn()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	// the peer never reads, the writer blocks on the window
+	errs := make(chan error, 2)
+	go func() {
+		_, err := c.Write(make([]byte, maximumWindowSize))
+		errs <- err
+	}()
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		errs <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	atomic.StoreUint32(&fc.broken, 1)
+	client.sendInfo(muxPingFlag, muxPing, client.pingStamp())
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-errs:
+		case <-time.After(time.Second * 5):
+			t.Fatal("the stream operation blocked after the transport failed")
+		}
+		if !errors.Is(err, errInjected) {
+			t.Fatal("the transport error not propagated", err)
+		}
+		var te *TransportError
+		if !errors.As(err, &te) || te.Op == nil {
+			t.Fatal("the error of the operation lost", err)
+		}
+	}
+	if client.Err() != errInjected {
+		t.Fatal("wrong error of the mux", client.Err())
+	}
+	m1, m2 := pipeMux()
+	_ = m1.Close()
+	_ = m2.Close()
+	if m1.Err() != nil {
+		t.Fatal("the mux closed by Close has error", m1.Err())
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	client, server := pipeMux()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := server.AcceptConn()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	_ = c.SetReadDeadline(time.Now().Add(time.Millisecond * 50))
+	_, err = c.Read(make([]byte, 10))
+	if ne, ok := err.(net.Error); !errors.Is(err, ErrTimeout) || !ok || !ne.Timeout() {
+		t.Fatal("the read deadline should be ErrTimeout", err)
+	}
+	_ = c.Close()
+	if _, err = c.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatal("the write on the closed stream should be ErrStreamClosed", err)
+	}
+	if !errors.Is(errTenantStreams, ErrRefused) || !errors.Is(errPingTimeout, ErrTimeout) {
+		t.Fatal("the wrapped errors lost the sentinel")
+	}
+	_ = client.Close()
+	_ = server.Close()
+	if _, err = client.NewConn(); err != ErrMuxClosed {
+		t.Fatal("the new conn on the closed mux should be ErrMuxClosed", err)
+	}
+	if _, err = server.Accept(); err != ErrMuxClosed {
+		t.Fatal("the accept on the closed mux should be ErrMuxClosed", err)
+	}
+	if !errors.Is(&TransportError{Op: ErrMuxClosed, Err: errInjected}, ErrMuxClosed) {
+		t.Fatal("the transport error should match its op")
+	}
+}
+
+func TestOnTransportClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, c2) }()
+	detached := make(chan net.Conn, 1)
+	// the deadline waking the sessions follows the clock of the mux
+	m := NewMuxWithConfig(c1, "tcp", &MuxConfig{Clock: newFakeClock(), OnTransportClose: func(conn net.Conn) error {
+		detached <- conn
+		return nil
+	}})
+	time.Sleep(time.Millisecond * 50)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-detached:
+		if conn != c1 {
+			t.Fatal("the hook got another conn")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the hook not invoked")
+	}
+	// the transport is still open, and the deadline cleared
+	if _, err := c1.Write([]byte("after the mux")); err != nil {
+		t.Fatal("the transport closed with the mux", err)
+	}
+	_ = c1.Close()
+}
+
+func TestWriteBandwidth(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	b := make([]byte, 32*1024)
+	for time.Now().Before(deadline) {
+		if _, err = conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := client.Stats()
+	if st.SentBandwidth <= 0 || st.AckedBandwidth <= 0 {
+		t.Fatal("the write bandwidth not estimated", st.SentBandwidth, st.AckedBandwidth)
+	}
+	if st := server.Stats(); st.ReadBandwidth <= 0 {
+		t.Fatal("the read bandwidth not estimated", st.ReadBandwidth)
+	}
+
+	// the pacing never goes above the bandwidth written
+	clock := newFakeClock()
+	m := &Mux{clock: clock, ackedBw: &bandwidth{clock: clock}, sentBw: &bandwidth{clock: clock}}
+	m.ackedBw.add(1)
+	m.sentBw.add(1)
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Millisecond * 100)
+		m.ackedBw.add(100000)
+		m.sentBw.add(50000)
+	}
+	sent, _ := m.sentBw.Get()
+	if rate, ok := newPacer(m).rate(); !ok || rate != sent*pacingGain {
+		t.Fatal("the pacing rate should be capped by the sent", rate, sent)
+	}
+}
+
+func TestGoodput(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	const size = 1 << 20
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	<-received
+	client.ResetTraffic()
+	st := client.Stats()
+	if st.Payload.BytesOut != size || st.Payload.FramesOut == 0 {
+		t.Fatal("wrong payload out", st.Payload)
+	}
+	if w := st.Wire(); w.BytesOut <= size || st.BytesOut != 0 {
+		t.Fatal("the wire traffic should not be reset, and above the payload", w, st.Traffic)
+	}
+	if _, out := st.Overhead(); out <= 0 || out >= 0.1 {
+		t.Fatal("wrong overhead of the bulk stream", out)
+	}
+	sst := server.Stats()
+	if sst.Payload.BytesIn != size {
+		t.Fatal("wrong payload in", sst.Payload)
+	}
+	if r := sst.WindowUpdateRatio(); r <= 0 {
+		t.Fatal("wrong window update ratio", r)
+	}
+}
+
+// fifoScheduler writes the frames in the order pushed
+type fifoScheduler struct {
+	frames []Frame
+	data   int
+}
+
+func (s *fifoScheduler) Push(f Frame, meta FrameMeta) {
+	if meta.Data && meta.Stream != 0 && meta.Size > 0 {
+		s.data++
+	}
+	s.frames = append(s.frames, f)
+}
+
+func (s *fifoScheduler) Pop() (f Frame, ok bool) {
+	if len(s.frames) == 0 {
+		return
+	}
+	f, s.frames = s.frames[0], s.frames[1:]
+	return f, true
+}
+
+func TestScheduler(t *testing.T) {
+	fifo := new(fifoScheduler)
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{NewScheduler: func() Scheduler { return fifo }})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{NewScheduler: func() Scheduler { return NewDefaultScheduler(0) }})
+	defer client.Close()
+	defer server.Close()
+	const size = 1 << 20
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = conn.Write(make([]byte, size))
+	}()
+	if n, err := io.CopyN(ioutil.Discard, conn, size); err != nil || n != size {
+		t.Fatal("the echo through the schedulers broken", n, err)
+	}
+	_ = conn.Close()
+	client.writeQueue.schedMu.Lock()
+	data := fifo.data
+	client.writeQueue.schedMu.Unlock()
+	if data == 0 {
+		t.Fatal("the data frames not scheduled by the custom scheduler")
+	}
+}
+
+func TestStreamGroup(t *testing.T) {
+	m := &Mux{}
+	var q priorityQueue
+	q.New(newFakeClock(), 0)
+	g := m.NewStreamGroup(3)
+	grouped := []*Conn{{connId: 1}, {connId: 3}}
+	for _, c := range grouped {
+		c.receiveWindow = new(receiveWindow)
+		c.receiveWindow.mux = m
+		if err := g.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plain, plain2 := &Conn{connId: 5}, &Conn{connId: 7}
+	frame := func(c *Conn) *muxPackager {
+		p := &muxPackager{id: c.connId, flag: muxNewMsg, priority: PriorityBulk, conn: c}
+		p.length = maximumSegmentSize
+		return p
+	}
+	for i := 0; i < 100; i++ {
+		q.Push(frame(grouped[i%2]))
+		q.Push(frame(plain))
+	}
+	counts := make(map[int32]int)
+	var last int32
+	for i := 0; i < 80; i++ {
+		p := q.TryPop()
+		if p == nil {
+			t.Fatal("the queue runs out")
+		}
+		if p.id != 5 && p.id == last {
+			t.Fatal("the streams of the group should take turns")
+		}
+		if p.id != 5 {
+			last = p.id
+		}
+		counts[p.id]++
+	}
+	if counts[1]+counts[3] != 60 || counts[5] != 20 {
+		t.Fatal("the group of weight 3 should take 3/4 of the writes", counts)
+	}
+	for q.TryPop() != nil {
+	}
+	if q.Len() != 0 || q.groups.lengths[PriorityBulk] != 0 {
+		t.Fatal("the frames left in the groups", q.Len())
+	}
+	// the streams not in any group share the weight 1 together
+	for i := 0; i < 100; i++ {
+		q.Push(frame(grouped[i%2]))
+		q.Push(frame(plain))
+		q.Push(frame(plain2))
+	}
+	counts = make(map[int32]int)
+	for i := 0; i < 80; i++ {
+		counts[q.TryPop().id]++
+	}
+	if counts[1]+counts[3] != 60 || counts[5] != 10 || counts[7] != 10 {
+		t.Fatal("the group of weight 3 should take 3 times of the streams not in any group together", counts)
+	}
+	for q.TryPop() != nil {
+	}
+
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		_ = server.NewStreamGroup(2).Add(conn)
+		_, _ = io.Copy(conn, conn)
+	}()
+	conn, err := client.NewStreamGroup(2).NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 1 << 20
+	go func() { _, _ = conn.Write(make([]byte, size)) }()
+	if n, err := io.CopyN(ioutil.Discard, conn, size); err != nil || n != size {
+		t.Fatal("the echo of the grouped stream broken", n, err)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	avail := conn.AvailableWriteBuffer()
+	if avail <= 0 {
+		t.Fatal("no window at the beginning", avail)
+	}
+	// the peer never reads, the window runs out
+	b := make([]byte, 4096)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := conn.TryWrite(b); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-done:
+		if err != ErrWouldBlock {
+			t.Fatal("want ErrWouldBlock, got", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("TryWrite blocked")
+	}
+	if n := conn.AvailableWriteBuffer(); n >= len(b) {
+		t.Fatal("the window should be used up", n)
+	}
+	go func() { _, _ = io.Copy(ioutil.Discard, peer) }()
+	deadline := time.Now().Add(time.Second * 5)
+	for conn.AvailableWriteBuffer() < len(b) {
+		if time.Now().After(deadline) {
+			t.Fatal("the window not reopened")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if _, err = conn.TryWrite(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTryWritePaused(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	avail := conn.AvailableWriteBuffer()
+	if err = client.Pause(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the window is open, but the mux paused, Write would wait for Resume
+	b := []byte("paused")
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.TryWrite(b)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != ErrWouldBlock {
+			t.Fatal("want ErrWouldBlock, got", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("TryWrite blocked on the mux paused")
+	}
+	if n := conn.AvailableWriteBuffer(); n != avail {
+		t.Fatal("the window used by the write refused", n, avail)
+	}
+	client.Resume()
+	if _, err = conn.TryWrite(b); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(b))
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err = io.ReadFull(peer, got); err != nil || !bytes.Equal(got, b) {
+		t.Fatal("the data after Resume", string(got), err)
+	}
+}
+
+func TestReadable(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	var conns [2]*Conn
+	for i := range conns {
+		c, err := client.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c
+	}
+	a, b := <-accepted, <-accepted
+	select {
+	case <-a.Readable():
+		t.Fatal("readable before any data")
+	default:
+	}
+	_, _ = conns[0].Write([]byte("hello"))
+	_ = conns[1].Close()
+	// one goroutine serves both streams
+	var got []byte
+	var eof bool
+	buf := make([]byte, 16)
+	for !eof || len(got) < 5 {
+		select {
+		case <-a.Readable():
+			for a.Buffered() > 0 {
+				n, _ := a.Read(buf)
+				got = append(got, buf[:n]...)
+			}
+		case <-b.Readable():
+			if _, err := b.Read(buf); err == io.EOF {
+				eof = true
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("not readable")
+		}
+	}
+	if string(got) != "hello" {
+		t.Fatal("wrong data", string(got))
+	}
+}
+
+func TestRelay(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	p1, p2 := net.Pipe()
+	type result struct {
+		stats RelayStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		st, err := Relay(context.Background(), conn, p1)
+		done <- result{st, err}
+	}()
+	// the far end echoes
+	go func() { _, _ = io.Copy(p2, p2) }()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 256 * 1024
+	go func() { _, _ = conn.Write(make([]byte, size)) }()
+	if n, err := io.CopyN(ioutil.Discard, conn, size); err != nil || n != size {
+		t.Fatal("the relay broken", n, err)
+	}
+	_ = conn.Close()
+	select {
+	case r := <-done:
+		if r.err != nil || r.stats.AToB != size || r.stats.BToA != size {
+			t.Fatal("wrong relay result", r.stats, r.err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the relay not ended after the stream closed")
+	}
+
+	// the tcp client half closes the request, the response is not truncated
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		stream, err := client.NewConn()
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		_, _ = Relay(context.Background(), c, stream)
+	}()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err != nil {
+			return
+		}
+		if req, err := ioutil.ReadAll(conn); err != nil || string(req) != "request" {
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write(make([]byte, size))
+		_ = conn.Close()
+	}()
+	tc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	if _, err = tc.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if resp, err := ioutil.ReadAll(tc); err != nil || len(resp) != size {
+		t.Fatal("the response truncated", len(resp), err)
+	}
+
+	// ctx done ends the relay
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	defer a2.Close()
+	defer b2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	if _, err = Relay(ctx, a1, b1); err != context.Canceled {
+		t.Fatal("want canceled, got", err)
+	}
+}
+
+func TestInitialWindow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{AcceptWindow: func(c *Conn) int {
+		return maximumSegmentSize * 2
+	}})
+	defer client.Close()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConnOptions(OpenOptions{ReceiveWindow: maximumSegmentSize * 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	deadline := time.Now().Add(time.Second * 5)
+	for conn.AvailableWriteBuffer() != maximumSegmentSize*2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the window of the acceptor not told", conn.AvailableWriteBuffer())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := peer.AvailableWriteBuffer(); n != maximumSegmentSize*100 {
+		t.Fatal("the window of the opener not told", n)
+	}
+	go func() { _, _ = io.Copy(peer, peer) }()
+	const size = 1 << 20
+	go func() { _, _ = conn.Write(make([]byte, size)) }()
+	if n, err := io.CopyN(ioutil.Discard, conn, size); err != nil || n != size {
+		t.Fatal("the echo broken", n, err)
+	}
+	if clampWindow(0) != 0 || clampWindow(1) != maximumSegmentSize || clampWindow(1<<40) != maximumWindowSize {
+		t.Fatal("wrong clamp")
+	}
+}
+
+func TestIdQuarantine(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 4)
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	old, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	id := old.ID()
+	// closed here, the peer does not close it yet, its frames may be late
+	_ = old.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for !peer.closing() {
+		if time.Now().After(deadline) {
+			t.Fatal("the close not received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the counter wraps around to the id of the old stream
+	atomic.StoreInt32(&client.id, id-2)
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ID() == id {
+		t.Fatal("the id reused before the peer closed it", id)
+	}
+	newPeer := <-accepted
+	// a late frame of the old stream, after the new stream opened
+	server.sendInfo(muxNewMsg, id, []byte("late"))
+	if _, err = newPeer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Fatal("the late frame delivered", string(b), err)
+	}
+	if n := client.Stats().StaleFrames; n != 1 {
+		t.Fatal("want 1 stale frame, got", n)
+	}
+	// the peer closes it, the id is released
+	_ = peer.Close()
+	for client.isQuarantined(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("the id not released by the close of the peer")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	atomic.StoreInt32(&client.id, id-2)
+	if conn, err = client.NewConn(); err != nil || conn.ID() != id {
+		t.Fatal("the id not reused after released", conn, err)
+	}
+}
+
+func TestSequencedData(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Sequenced: true})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Sequenced: true})
+	defer server.Close()
+	defer client.Close()
+	ch := make(chan *Conn, 1)
+	go func() {
+		c, _ := server.AcceptConn()
+		ch <- c
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := <-ch
+	if !client.sequenced() {
+		t.Fatal("the sequence not negotiated")
+	}
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	go func() { _, _ = conn.Write(data) }()
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(accepted, b); err != nil || !bytes.Equal(b, data) {
+		t.Fatal("the sequenced data differs", err)
+	}
+	if n := server.Stats().Flags["msgSeq"].FramesIn; n == 0 {
+		t.Fatal("the data not sent by the sequenced frames")
+	}
+	// the frames arrive out of order, and twice
+	frame := func(off uint64, p string) []byte {
+		b := make([]byte, seqHeaderSize, seqHeaderSize+len(p))
+		binary.LittleEndian.PutUint64(b, off+uint64(len(data)))
+		return append(b, p...)
+	}
+	client.sendInfo(muxMsgSeq, conn.ID(), frame(5, "world"))
+	client.sendInfo(muxMsgSeq, conn.ID(), frame(0, "hello"))
+	client.sendInfo(muxMsgSeq, conn.ID(), frame(0, "hello"))
+	client.sendInfo(muxMsgSeq, conn.ID(), frame(10, "!"))
+	b = make([]byte, 11)
+	if _, err = io.ReadFull(accepted, b); err != nil || string(b) != "helloworld!" {
+		t.Fatal("the frames out of order not reassembled", string(b), err)
+	}
+	if s := server.Stats(); s.ReorderedFrames != 1 || s.DuplicateFrames != 1 {
+		t.Fatal("want 1 reordered and 1 duplicate frame, got", s.ReorderedFrames, s.DuplicateFrames)
+	}
+}
+
+// lossyLink is a datagram conn of the pair by lossyPair, it drops the datagrams
+// written by the rate
+type lossyLink struct {
+	in, out chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	loss    float64
+	mtu     int     // the larger datagrams are dropped, zero means no limit
+	mtuLoss float64 // the rate the larger datagrams are dropped, zero means all
+	rand    *rand.Rand
+	mu      sync.Mutex
+}
+
+func lossyPair(loss float64) (a, b net.Conn) {
+	ab, ba := make(chan []byte, 1024), make(chan []byte, 1024)
+	a = &lossyLink{in: ba, out: ab, closed: make(chan struct{}), loss: loss, rand: rand.New(rand.NewSource(1))}
+	b = &lossyLink{in: ab, out: ba, closed: make(chan struct{}), loss: loss, rand: rand.New(rand.NewSource(2))}
+	return
+}
+
+func (l *lossyLink) Read(p []byte) (int, error) {
+	select {
+	case b := <-l.in:
+		return copy(p, b), nil
+	case <-l.closed:
+		return 0, io.EOF
+	}
+}
+
+func (l *lossyLink) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	drop := l.rand.Float64() < l.loss ||
+		l.mtu > 0 && len(p) > l.mtu && (l.mtuLoss == 0 || l.rand.Float64() < l.mtuLoss)
+	l.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	select {
+	case l.out <- append([]byte(nil), p...):
+	case <-l.closed:
+		return 0, io.ErrClosedPipe
+	default:
+		// the queue is full, dropped as a udp socket does
+	}
+	return len(p), nil
+}
+
+func (l *lossyLink) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *lossyLink) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (l *lossyLink) RemoteAddr() net.Addr               { return &net.UDPAddr{} }
+func (l *lossyLink) SetDeadline(t time.Time) error      { return nil }
+func (l *lossyLink) SetReadDeadline(t time.Time) error  { return nil }
+func (l *lossyLink) SetWriteDeadline(t time.Time) error { return nil }
+
+// packetLink is the lossyLink as a net.PacketConn, for kcp
+type packetLink struct{ *lossyLink }
+
+func (l packetLink) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := l.Read(p)
+	return n, l.RemoteAddr(), err
+}
+
+func (l packetLink) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return l.Write(p)
+}
+
+func TestARQ(t *testing.T) {
+	c1, c2 := lossyPair(0.1)
+	arq := &ARQConfig{Interval: time.Millisecond * 5, MinRTO: time.Millisecond * 20}
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{ARQ: arq, Pacing: true})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{ARQ: arq, Pacing: true})
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		for {
+			conn, err := server.AcceptConn()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn) }()
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 200000)
+	rand.Read(data)
+	go func() { _, _ = conn.Write(data) }()
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, b); err != nil || !bytes.Equal(b, data) {
+		t.Fatal("the data differs over the lossy link", err)
+	}
+	if n := client.Stats().Retransmits + server.Stats().Retransmits; n == 0 {
+		t.Fatal("nothing retransmitted over the lossy link")
+	}
+	_ = conn.Close()
+}
+
+func TestFEC(t *testing.T) {
+	enc, dec := newFECEncoder(4, 2), newFECDecoder(2)
+	var shards [][]byte
+	for i := 0; i < 4; i++ {
+		shards = append(shards, enc.add(bytes.Repeat([]byte{byte(i + 1)}, 10+i))...)
+	}
+	if len(shards) != 6 {
+		t.Fatal("want 4 data and 2 parity shards, got", len(shards))
+	}
+	// any 4 of the 6 shards recover the group
+	var got [][]byte
+	for _, i := range []int{1, 3, 4, 5} {
+		d, recovered := dec.input(shards[i])
+		if d != nil {
+			got = append(got, d)
+		}
+		got = append(got, recovered...)
+	}
+	if len(got) != 4 {
+		t.Fatal("want 4 datagrams, got", len(got))
+	}
+	for _, d := range got {
+		if len(d) < 10 || !bytes.Equal(d, bytes.Repeat(d[:1], 10+int(d[0])-1)) {
+			t.Fatal("the datagram recovered differs", d)
+		}
+	}
+	c1, c2 := lossyPair(0.1)
+	arq := &ARQConfig{Interval: time.Millisecond * 5, MinRTO: time.Millisecond * 20, DataShards: 8, ParityShards: 3}
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{ARQ: arq})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{ARQ: arq})
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go func() { _, _ = conn.Write(data) }()
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, b); err != nil || !bytes.Equal(b, data) {
+		t.Fatal("the data differs over the lossy link", err)
+	}
+	if n := client.Stats().Recovered + server.Stats().Recovered; n == 0 {
+		t.Fatal("nothing recovered by the parity")
+	}
+	_ = conn.Close()
+}
+
+func TestEarlyData(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConnOptions(OpenOptions{EarlyData: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if n := peer.Buffered(); n != 5 {
+		t.Fatal("the early data not received with the open", n)
+	}
+	if _, err = conn.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 11)
+	if _, err = io.ReadFull(peer, b); err != nil || string(b) != "hello world" {
+		t.Fatal("the early data differs", string(b), err)
+	}
+	if n := server.Stats().Flags["msg"].FramesIn; n != 1 {
+		t.Fatal("want 1 data frame after the early data, got", n)
+	}
+	if _, err = client.NewConnOptions(OpenOptions{EarlyData: make([]byte, MaxEarlyData+1)}); err == nil {
+		t.Fatal("the early data too large opened")
+	}
+	_ = conn.Close()
+}
+
+func TestRetryAfter(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMux(c1, "tcp", 0)
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{NewConnRate: 0.001, NewConnBurst: 1, RetryAfter: time.Second * 3})
+	defer client.Close()
+	defer server.Close()
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	go func() {
+		for {
+			if _, err := server.AcceptConn(); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := client.NewConn(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.NewConn()
+	if !errors.Is(err, ErrRefused) || RetryAfter(err) != time.Second*3 {
+		t.Fatal("want the refusal with the hint, got", err)
+	}
+	if RetryAfter(ErrRefused) != 0 {
+		t.Fatal("the hint of the refusal without it")
+	}
+}
+
+func TestPause(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	waitWindow := func(paused bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for (conn.AvailableWriteBuffer() == 0) != paused {
+			if time.Now().After(deadline) {
+				t.Fatal("the window not told, paused:", paused, conn.AvailableWriteBuffer())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	peer.Pause()
+	if !peer.Paused() {
+		t.Fatal("the stream not paused")
+	}
+	waitWindow(true)
+	if _, err = conn.TryWrite([]byte("hello")); err != ErrWouldBlock {
+		t.Fatal("written to the stream paused", err)
+	}
+	peer.Resume()
+	waitWindow(false)
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(peer, b); err != nil || string(b) != "hello" {
+		t.Fatal("the data after resumed differs", string(b), err)
+	}
+	_ = conn.Close()
+}
+
+func TestMuxPause(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err = client.Pause(ctx); err != nil || !client.Paused() {
+		t.Fatal("not paused", err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte("hello"))
+		written <- err
+	}()
+	if err = client.HealthCheck(ctx); err != nil {
+		t.Fatal("the ping stopped by the pause", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if peer.Buffered() != 0 {
+		t.Fatal("the data sent while paused")
+	}
+	client.Resume()
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(peer, b); err != nil || string(b) != "hello" {
+		t.Fatal("the data after resumed differs", string(b), err)
+	}
+	_ = conn.Close()
+}
+
+func TestSlowLog(t *testing.T) {
+	c1, c2 := net.Pipe()
+	clientLog, serverLog := new(testLogger), new(testLogger)
+	client := NewMuxWithConfig(c1, "tcp", &MuxConfig{Logger: clientLog,
+		SlowLog: &SlowLogConfig{FrameWrite: time.Nanosecond, Open: time.Nanosecond}})
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Logger: serverLog,
+		SlowLog: &SlowLogConfig{ReadStall: time.Millisecond * 100}})
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	go func() {
+		_, _ = peer.Read(make([]byte, 5))
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for !strings.Contains(serverLog.String(), "read stalled") {
+		if time.Now().After(deadline) {
+			t.Fatal("the read stalled not logged", serverLog.String())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	logs := clientLog.String()
+	if !strings.Contains(logs, "slow open") || !strings.Contains(logs, "slow frame write") {
+		t.Fatal("the slow operations not logged", logs)
+	}
+	if strings.Count(serverLog.String(), "read stalled") != 1 {
+		t.Fatal("the stall logged more than once", serverLog.String())
+	}
+}
+
+func TestOpenCancel(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	time.Sleep(time.Millisecond * 50)
+	cancel := make(chan struct{})
+	time.AfterFunc(time.Millisecond*50, func() { close(cancel) })
+	// nobody accepts, the opener gives up
+	if _, err := client.openConn(cancel, nil); err == nil {
+		t.Fatal("the open not canceled")
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for server.connMap.Size() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream canceled kept by the acceptor")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := server.Stats().Flags["connOpenCancel"].FramesIn; n != 1 {
+		t.Fatal("want 1 open cancel received, got", n)
+	}
+	// the hand over goes on
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestOpenContext(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	time.Sleep(time.Millisecond * 50)
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	deadline := time.Now().Add(time.Minute)
+	conn, err := client.NewConnOptions(OpenOptions{Context: &OpenContext{
+		Deadline: deadline,
+		Trace:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		Values:   map[string]string{"user": "alice", "empty": ""},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	ctx := peer.OpenContext()
+	if ctx == nil {
+		t.Fatal("the open context not received")
+	}
+	if d := ctx.Deadline.Sub(deadline); d < -time.Second || d > time.Second {
+		t.Fatal("the deadline differs", ctx.Deadline, deadline)
+	}
+	if ctx.Trace != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" ||
+		len(ctx.Values) != 2 || ctx.Values["user"] != "alice" {
+		t.Fatal("the open context differs", ctx)
+	}
+
+	// the deadline is counted by the clocks of the muxes
+	c1, c2 := net.Pipe()
+	clientClock, serverClock := newFakeClock(), newFakeClock()
+	serverClock.Advance(time.Hour)
+	client = NewMuxWithConfig(c1, "tcp", &MuxConfig{Clock: clientClock})
+	server = NewMuxWithConfig(c2, "tcp", &MuxConfig{Server: true, Clock: serverClock})
+	defer server.Close()
+	defer client.Close()
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err = client.NewConnOptions(OpenOptions{Context: &OpenContext{Deadline: clientClock.Now().Add(time.Minute)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ctx = (<-accepted).OpenContext(); ctx == nil || !ctx.Deadline.Equal(serverClock.Now().Add(time.Minute)) {
+		t.Fatal("the deadline not by the mux clock", ctx)
+	}
+}
+
+func TestRequireEncryption(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	m := NewMuxWithConfig(c1, "tcp", &MuxConfig{RequireEncryption: true})
+	if !m.Closed() || m.Err() != ErrPlaintext {
+		t.Fatal("the mux over the plaintext not failed", m.Err())
+	}
+	if _, err := m.NewConn(); err == nil {
+		t.Fatal("opened a stream over the plaintext")
+	}
+	// refused before started, the transport is left to the caller
+	c5, c6 := net.Pipe()
+	defer c5.Close()
+	defer c6.Close()
+	if m, err := NewMuxChecked(c5, "tcp", &MuxConfig{RequireEncryption: true}); m != nil || err != ErrPlaintext {
+		t.Fatal("the plaintext not refused", err)
+	}
+	go func() { _, _ = c5.Write([]byte("x")) }()
+	if _, err := c6.Read(make([]byte, 1)); err != nil {
+		t.Fatal("the transport closed by the refusal", err)
+	}
+	// told encrypted
+	c3, c4 := net.Pipe()
+	client := NewMuxWithConfig(c3, "tcp", &MuxConfig{RequireEncryption: true, Hints: &TransportHints{Encrypted: true}})
+	server := NewMux(c4, "tcp", 0)
+	defer server.Close()
+	defer client.Close()
+	if client.Closed() {
+		t.Fatal("the mux told encrypted failed", client.Err())
+	}
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	// the tls transport
+	cfg := &MuxConfig{RequireEncryption: true}
+	if !cfg.encrypted(tls.Client(c1, &tls.Config{})) {
+		t.Fatal("the tls transport not detected")
+	}
+}
+
+func TestReadWindowUpdates(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	// many frames buffered, within the window
+	data := bytes.Repeat([]byte("0123456789abcdef"), maximumSegmentSize)
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for peer.Buffered() < len(data) {
+		if time.Now().After(deadline) {
+			t.Fatal("the data not received", peer.Buffered())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	before := peer.Stats().WindowUpdates
+	b := make([]byte, len(data))
+	if n, err := peer.Read(b); err != nil || n != len(data) || !bytes.Equal(b, data) {
+		t.Fatal("the big read differs", n, err)
+	}
+	if n := peer.Stats().WindowUpdates - before; n > 1 {
+		t.Fatal("want at most one window update by a read, got", n)
+	}
+	// the updates without anything new are not sent for the frames received
+	if n, frames := peer.Stats().WindowUpdates, len(data)/maximumSegmentSize; n >= uint64(frames) {
+		t.Fatal("a window update for every frame received", n, frames)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("more")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatal("write after CloseWrite", err)
+	}
+	if got, err := ioutil.ReadAll(peer); err != nil || string(got) != "ping" {
+		t.Fatal("the peer did not read to the eof", string(got), err)
+	}
+	// the peer writes on after the eof
+	if _, err = peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.Close()
+	if got, err := ioutil.ReadAll(conn); err != nil || string(got) != "pong" {
+		t.Fatal("the reply lost", string(got), err)
+	}
+	_ = conn.Close()
+}
+
+func TestConnTag(t *testing.T) {
+	client, server := pipeMux()
+	defer server.Close()
+	defer client.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := server.AcceptConn()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := client.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	defer peer.Close()
+	if peer.Tag("user") != nil {
+		t.Fatal("tag before set")
+	}
+	peer.SetTag("user", "alice")
+	peer.SetTag("id", 7)
+	if peer.Tag("user") != "alice" || peer.Tag("id") != 7 || conn.Tag("user") != nil {
+		t.Fatal("wrong tags", peer.Tag("user"), peer.Tag("id"))
+	}
+	peer.SetTag("id", nil)
+	if peer.Tag("id") != nil {
+		t.Fatal("tag not deleted")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			for n := 0; n < 1000; n++ {
+				conn.SetTag(key, n)
+				if v, ok := conn.Tag(key).(int); !ok || v != n {
+					t.Error("wrong tag", key, v)
+					return
+				}
+				_ = conn.Tag("other")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBandwidthEstimator(t *testing.T) {
+	clock := newFakeClock()
+	bw := &bandwidth{clock: clock}
+	if _, ok := bw.Get(); ok {
+		t.Fatal("estimated before the first sample")
+	}
+	feed := func(rate int, d time.Duration) {
+		for step := time.Millisecond * 10; d > 0; d -= step {
+			clock.Advance(step)
+			bw.add(uint32(rate / 100))
+		}
+	}
+	// the first add only starts the sample
+	bw.add(1000)
+	if _, ok := bw.Get(); ok {
+		t.Fatal("estimated by the first read")
+	}
+	feed(2000000, time.Second)
+	if v, ok := bw.Get(); !ok || v < 1900000 || v > 2100000 {
+		t.Fatal("wrong estimate", v, ok)
+	}
+	// converges to the new rate
+	feed(1000000, time.Second*3)
+	if v, _ := bw.Get(); v < 990000 || v > 1010000 {
+		t.Fatal("not converged", v)
+	}
+	// halves every half life after idle
+	clock.Advance(bwIdleTimeout + bwHalfLife)
+	if v, ok := bw.Get(); !ok || v < 490000 || v > 510000 {
+		t.Fatal("not decayed", v, ok)
+	}
+	clock.Advance(bwHalfLife)
+	if v, _ := bw.Get(); v < 240000 || v > 260000 {
+		t.Fatal("not decayed", v)
+	}
+}
+
+func TestReceiveWindowOverflow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := NewMuxWithConfig(c2, "tcp", &MuxConfig{Server: true})
+	defer server.Close()
+	defer c1.Close()
+	peer := protocol.NewClient(c1)
+	go func() {
+		// accepted, but never read
+		_, _ = server.AcceptConn()
+	}()
+	go func() { _ = peer.Send(protocol.Frame{Flag: protocol.FlagNewConn, ID: 1}) }()
+	if _, err := peer.Expect(func(f protocol.Frame) bool {
+		return f.Flag == protocol.FlagNewConnOk && f.ID == 1
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a peer ignoring the window, the stream is closed instead of buffering all
+	go func() {
+		data := make([]byte, protocol.MaxContentSize)
+		for i := 0; i < 100; i++ {
+			if peer.Send(protocol.Frame{Flag: protocol.FlagMsg, ID: 1, Content: data}) != nil {
+				return
+			}
+		}
+	}()
+	if _, err := peer.Expect(func(f protocol.Frame) bool {
+		return f.Flag == protocol.FlagConnClose && f.ID == 1
+	}); err != nil {
+		t.Fatal("the stream beyond the window not closed", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package muxproxy forwards the tcp connections over a mux, as the reference
+// consumer of the mux. the dial side accepts the local connections, by a fixed
+// target or the socks5 connect, and opens a stream per connection, the serve
+// side dials the target of the stream and relays them:
+//
+//	// the side of the users
+//	go muxproxy.Forward(ctx, l, client, "10.0.0.2:22", nil)
+//	go muxproxy.ServeSOCKS5(ctx, l2, client, nil)
+//	// the side of the targets
+//	muxproxy.Serve(ctx, server, &muxproxy.ServeOptions{Allow: allow})
+//
+// the stream begins with the header of the target, len(1) target, the serve
+// side answers one byte, zero means connected, then the stream is relayed
+package muxproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"ehang.io/nps-mux"
+)
+
+const (
+	replyOk byte = iota
+	replyRefused
+	replyDialFail
+)
+
+// ErrDial is returned by the dial side if the serve side failed to connect the target
+var ErrDial = errors.New("muxproxy: the target is not connected")
+
+// ErrRefused is returned by the dial side if the serve side refused the target
+var ErrRefused = errors.New("muxproxy: the target refused by the serve side")
+
+// DialOptions tunes the dial side
+type DialOptions struct {
+	// Tenant is sent with the open of the streams, the serve side may limit
+	// the tenant by Mux.SetTenantLimits. as NewTenantConn, it is not sent
+	// before the features of the peer received
+	Tenant string
+	// Rate limits the bytes per second of the local connections, shared by all
+	// of them, nil means no limit
+	Rate *npsmux.Rate
+}
+
+// ServeOptions tunes the serve side
+type ServeOptions struct {
+	// Allow checks the target of the stream, nil allows all
+	Allow func(target string, stream *npsmux.Conn) bool
+	// DialTimeout limits the dial of the target, zero means 10s
+	DialTimeout time.Duration
+	// Rate limits the bytes per second of the target connections, shared by all
+	// of them, nil means no limit
+	Rate *npsmux.Rate
+}
+
+// Dial opens a stream to the target through the mux, the target is connected
+// by the serve side when it returns
+func Dial(m *npsmux.Mux, target string, opts *DialOptions) (*npsmux.Conn, error) {
+	if len(target) == 0 || len(target) > 255 {
+		return nil, errors.New("muxproxy: bad target " + target)
+	}
+	if opts == nil {
+		opts = new(DialOptions)
+	}
+	var stream *npsmux.Conn
+	var err error
+	if opts.Tenant != "" {
+		stream, err = m.NewTenantConn(opts.Tenant)
+	} else {
+		stream, err = m.NewConn()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = stream.Write(append([]byte{byte(len(target))}, target...)); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	reply := make([]byte, 1)
+	if _, err = io.ReadFull(stream, reply); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	switch reply[0] {
+	case replyOk:
+		return stream, nil
+	case replyRefused:
+		err = ErrRefused
+	default:
+		err = ErrDial
+	}
+	_ = stream.Close()
+	return nil, err
+}
+
+// Forward forwards the connections accepted by l to the target, until l or the
+// mux closed, or ctx done
+func Forward(ctx context.Context, l net.Listener, m *npsmux.Mux, target string, opts *DialOptions) error {
+	return accept(ctx, l, func(c net.Conn) {
+		stream, err := Dial(m, target, opts)
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		relay(ctx, limit(c, opts), stream)
+	})
+}
+
+// Serve dials the targets of the streams accepted by the mux, and relays them,
+// until the mux closed, or ctx done, the mux is closed then
+func Serve(ctx context.Context, m *npsmux.Mux, opts *ServeOptions) error {
+	if opts == nil {
+		opts = new(ServeOptions)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = m.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		stream, err := m.AcceptConn()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go serveStream(ctx, stream, opts)
+	}
+}
+
+func serveStream(ctx context.Context, stream *npsmux.Conn, opts *ServeOptions) {
+	target, err := readTarget(stream)
+	if err != nil {
+		_ = stream.Close()
+		return
+	}
+	if opts.Allow != nil && !opts.Allow(target, stream) {
+		_, _ = stream.Write([]byte{replyRefused})
+		_ = stream.Close()
+		return
+	}
+	timeout := opts.DialTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	c, err := new(net.Dialer).DialContext(dialCtx, "tcp", target)
+	cancel()
+	if err != nil {
+		_, _ = stream.Write([]byte{replyDialFail})
+		_ = stream.Close()
+		return
+	}
+	if _, err = stream.Write([]byte{replyOk}); err != nil {
+		_ = c.Close()
+		_ = stream.Close()
+		return
+	}
+	if opts.Rate != nil {
+		c = npsmux.NewRateConn(opts.Rate, c)
+	}
+	relay(ctx, c, stream)
+}
+
+func readTarget(r io.Reader) (string, error) {
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", err
+	}
+	target := make([]byte, l[0])
+	if _, err := io.ReadFull(r, target); err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// accept serves the connections of l, until l closed or ctx done
+func accept(ctx context.Context, l net.Listener, serve func(c net.Conn)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go serve(c)
+	}
+}
+
+func relay(ctx context.Context, c net.Conn, stream *npsmux.Conn) {
+	_, _ = npsmux.Relay(ctx, c, stream)
+}
+
+func limit(c net.Conn, opts *DialOptions) net.Conn {
+	if opts != nil && opts.Rate != nil {
+		return npsmux.NewRateConn(opts.Rate, c)
+	}
+	return c
+}
+
+// the socks5 of rfc 1928, only the connect without the authentication
+const (
+	socksVersion    = 5
+	socksNoAuth     = 0
+	socksNoMethod   = 0xff
+	socksConnect    = 1
+	socksIPv4       = 1
+	socksDomain     = 3
+	socksIPv6       = 4
+	socksOk         = 0
+	socksFailure    = 1
+	socksNotAllowed = 2
+	socksRefused    = 5
+	socksNoCommand  = 7
+)
+
+// ServeSOCKS5 serves the socks5 connect of the connections accepted by l, the
+// targets are dialed by the serve side, until l or the mux closed, or ctx done
+func ServeSOCKS5(ctx context.Context, l net.Listener, m *npsmux.Mux, opts *DialOptions) error {
+	return accept(ctx, l, func(c net.Conn) {
+		target, err := socksHandshake(c)
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		stream, err := Dial(m, target, opts)
+		if err != nil {
+			code := byte(socksRefused)
+			if err == ErrRefused {
+				code = socksNotAllowed
+			} else if err != ErrDial {
+				code = socksFailure
+			}
+			_ = socksReply(c, code)
+			_ = c.Close()
+			return
+		}
+		if err = socksReply(c, socksOk); err != nil {
+			_ = c.Close()
+			_ = stream.Close()
+			return
+		}
+		relay(ctx, limit(c, opts), stream)
+	})
+}
+
+// socksHandshake reads the methods and the request, returns the target
+func socksHandshake(c net.Conn) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksVersion {
+		return "", errors.New("muxproxy: not socks5")
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoMethod)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoMethod {
+		return "", errors.New("muxproxy: no acceptable socks5 method")
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != socksConnect {
+		_ = socksReply(c, socksNoCommand)
+		return "", errors.New("muxproxy: only the socks5 connect supported")
+	}
+	var host string
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if buf[3] == socksIPv6 {
+			size = net.IPv6len
+		}
+		if _, err := io.ReadFull(c, buf[:size]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:size]).String()
+	case socksDomain:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return "", err
+		}
+		name := buf[1 : 1+buf[0]]
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errors.New("muxproxy: bad socks5 address type")
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// socksReply answers the request, the bound address is not told
+func socksReply(c net.Conn, code byte) error {
+	_, err := c.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
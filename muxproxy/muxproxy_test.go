@@ -0,0 +1,176 @@
+package muxproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ehang.io/nps-mux"
+)
+
+// muxPair returns the dial side and the serve side of a mux over tcp, the
+// serve side serves the streams until ctx done
+func muxPair(t *testing.T, ctx context.Context, opts *ServeOptions) *npsmux.Mux {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, ok := <-accepted
+	if !ok {
+		t.Fatal("not accepted")
+	}
+	client := npsmux.NewMuxWithConfig(c1, "tcp", &npsmux.MuxConfig{})
+	server := npsmux.NewMuxWithConfig(c2, "tcp", &npsmux.MuxConfig{Server: true})
+	go func() { _ = Serve(ctx, server, opts) }()
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+	}()
+	time.Sleep(time.Millisecond * 50) // the features exchanged
+	return client
+}
+
+// listen serves the connections of a tcp listener by serve until ctx done
+func listen(t *testing.T, ctx context.Context, serve func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = accept(ctx, l, serve) }()
+	return l.Addr().String()
+}
+
+func echo(c net.Conn) {
+	_, _ = io.Copy(c, c)
+	_ = c.Close()
+}
+
+func TestForward(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := listen(t, ctx, echo)
+	client := muxPair(t, ctx, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = Forward(ctx, l, client, target, nil) }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data := bytes.Repeat([]byte("forward"), 10000)
+	go func() { _, _ = c.Write(data) }()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(c, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("wrong echo", err)
+	}
+
+	// the target refused by the serve side
+	refused, cancelRefused := context.WithCancel(ctx)
+	defer cancelRefused()
+	client = muxPair(t, refused, &ServeOptions{Allow: func(string, *npsmux.Conn) bool { return false }})
+	if _, err = Dial(client, target, nil); err != ErrRefused {
+		t.Fatal("want refused, got", err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := listen(t, ctx, echo)
+	client := muxPair(t, ctx, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = ServeSOCKS5(ctx, l, client, nil) }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = c.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(c, reply[:2]); err != nil || reply[1] != socksNoAuth {
+		t.Fatal("wrong method", reply[:2], err)
+	}
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	req := append([]byte{socksVersion, socksConnect, 0, socksDomain, byte(len(host))}, host...)
+	req = append(req, byte(p>>8), byte(p))
+	if _, err = c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(c, reply); err != nil || reply[1] != socksOk {
+		t.Fatal("not connected", reply, err)
+	}
+	if _, err = c.Write([]byte("socks")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(c, got); err != nil || string(got) != "socks" {
+		t.Fatal("wrong echo", string(got), err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const size = 256 * 1024
+	// the target answers after the whole request read
+	target := listen(t, ctx, func(c net.Conn) {
+		if req, err := ioutil.ReadAll(c); err == nil && string(req) == "request" {
+			_, _ = c.Write(make([]byte, size))
+		}
+		_ = c.Close()
+	})
+	rate := npsmux.NewRate(1 << 30)
+	rate.Start()
+	defer rate.Stop()
+	client := muxPair(t, ctx, &ServeOptions{Rate: rate})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = Forward(ctx, l, client, target, &DialOptions{Rate: rate}) }()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if resp, err := ioutil.ReadAll(c); err != nil || len(resp) != size {
+		t.Fatal("the response truncated", len(resp), err)
+	}
+}
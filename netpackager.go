@@ -1,4 +1,4 @@
-package nps_mux
+package npsmux
 
 import (
 	"encoding/binary"
@@ -38,13 +38,15 @@ func (Self *basePackager) Set(content []byte) (err error) {
 	return
 }
 
-func (Self *basePackager) Pack(writer io.Writer) (err error) {
+func (Self *basePackager) Pack(writer io.Writer) (n uint16, err error) {
 	binary.LittleEndian.PutUint16(Self.buf[5:7], Self.length)
-	_, err = writer.Write(Self.buf[:7])
+	l, err := writer.Write(Self.buf[:7])
+	n += uint16(l)
 	if err != nil {
 		return
 	}
-	_, err = writer.Write(Self.content[:Self.length])
+	l, err = writer.Write(Self.content[:Self.length])
+	n += uint16(l)
 	return
 }
 
@@ -56,17 +58,20 @@ func (Self *basePackager) UnPack(reader io.Reader) (n uint16, err error) {
 	}
 	n += uint16(l)
 	Self.length = binary.LittleEndian.Uint16(Self.buf[5:7])
-	if int(Self.length) > cap(Self.content) {
-		err = errors.New("mux:packer: unpack err, content length too large")
-		return
-	}
-	if Self.length > maximumSegmentSize {
-		err = errors.New("mux:packer: unpack content segment too large")
+	m, err := Self.readContent(reader)
+	n += m
+	return
+}
+
+// readContent reads the content, the length is set before
+func (Self *basePackager) readContent(reader io.Reader) (n uint16, err error) {
+	if int(Self.length) > cap(Self.content) || Self.length > maximumSegmentSize {
+		err = &ProtocolError{Length: Self.length, Reason: "content segment too large"}
 		return
 	}
 	Self.content = Self.content[:int(Self.length)]
-	l, err = io.ReadFull(reader, Self.content)
-	n += uint16(l)
+	l, err := io.ReadFull(reader, Self.content)
+	n = uint16(l)
 	return
 }
 
@@ -81,62 +86,116 @@ func (Self *basePackager) reset() {
 }
 
 type muxPackager struct {
-	flag   uint8
-	id     int32
-	window uint64
+	flag     uint8
+	id       int32
+	window   uint64
+	priority Priority // the class in the write queue, not sent
+	compact  bool     // use the compact header
+	conn     *Conn    // the stream of the data frame, for the stats
+	queued   int64    // unix nano pushed into the write queue
 	basePackager
 }
 
-func (Self *muxPackager) Set(flag uint8, id int32, content interface{}) (err error) {
-	Self.buf = windowBuff.Get()
+// hasContent reports whether the frame of flag carries the content
+func hasContent(flag uint8) bool {
+	switch flag {
+	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn, muxNewConnBatch, muxNewConnOkBatch, muxPadding,
+		muxConnCloseAck, muxChecksum, muxStreamMeta, muxMsgSeq:
+		return true
+	}
+	return false
+}
+
+// isData reports whether the frame of flag carries the data of a stream
+func isData(flag uint8) bool {
+	return flag == muxNewMsg || flag == muxNewMsgPart || flag == muxMsgSeq
+}
+
+// Set sets the frame, the content is copied, nil for the frames without the
+// content, or filled later as the batches. muxMsgSendOk is set by SetWindow
+func (Self *muxPackager) Set(flag uint8, id int32, content []byte) (err error) {
+	Self.buf = windowBuff.GetSize(poolSizeHeader)
 	Self.flag = flag
 	Self.id = id
 	switch flag {
-	case muxPingFlag, muxPingReturn, muxNewMsg, muxNewMsgPart:
-		Self.content = windowBuff.Get()
-		err = Self.basePackager.Set(content.([]byte))
-	case muxMsgSendOk:
-		// MUX_MSG_SEND_OK contains one data
-		Self.window = content.(uint64)
+	case muxPingFlag, muxPingReturn, muxNewMsg, muxNewMsgPart, muxPadding, muxConnCloseAck, muxChecksum, muxStreamMeta,
+		muxMsgSeq:
+		if len(content) <= poolSizeWindow {
+			// small frames take the buffers of a smaller class
+			Self.content = windowBuff.GetSize(len(content))
+		} else {
+			Self.content = windowBuff.Get()
+		}
+		err = Self.basePackager.Set(content)
 	}
 	return
 }
 
-func (Self *muxPackager) Pack(writer io.Writer) (err error) {
+// SetWindow sets the muxMsgSendOk frame of the window
+func (Self *muxPackager) SetWindow(id int32, window uint64) {
+	Self.buf = windowBuff.GetSize(poolSizeHeader)
+	Self.flag = muxMsgSendOk
+	Self.id = id
+	Self.window = window
+}
+
+func (Self *muxPackager) Pack(writer io.Writer) (n uint16, err error) {
+	if Self.compact {
+		return Self.packCompact(writer)
+	}
+	var l int
 	Self.buf = Self.buf[0:13]
 	Self.buf[0] = byte(Self.flag)
 	binary.LittleEndian.PutUint32(Self.buf[1:5], uint32(Self.id))
-	switch Self.flag {
-	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
-		err = Self.basePackager.Pack(writer)
+	switch {
+	case hasContent(Self.flag):
+		n, err = Self.basePackager.Pack(writer)
 		windowBuff.Put(Self.content)
-	case muxMsgSendOk:
+	case Self.flag == muxMsgSendOk:
 		binary.LittleEndian.PutUint64(Self.buf[5:13], Self.window)
-		_, err = writer.Write(Self.buf[:13])
+		l, err = writer.Write(Self.buf[:13])
+		n = uint16(l)
 	default:
-		_, err = writer.Write(Self.buf[:5])
+		l, err = writer.Write(Self.buf[:5])
+		n = uint16(l)
 	}
 	windowBuff.Put(Self.buf)
 	return
 }
 
 func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
-	Self.buf = windowBuff.Get()
+	if r, ok := reader.(frameReader); ok {
+		return Self.unPackFrame(r)
+	}
+	// the transform and the recorder read the bytes as they come
+	if Self.compact {
+		return Self.unPackCompact(reader)
+	}
+	Self.buf = windowBuff.GetSize(poolSizeHeader)
 	Self.buf = Self.buf[0:13]
 	l, err := io.ReadFull(reader, Self.buf[:5])
 	if err != nil {
+		windowBuff.Put(Self.buf)
 		return
 	}
 	n += uint16(l)
 	Self.flag = uint8(Self.buf[0])
 	Self.id = int32(binary.LittleEndian.Uint32(Self.buf[1:5]))
-	switch Self.flag {
-	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
+	switch {
+	case hasContent(Self.flag):
 		var m uint16
 		Self.content = windowBuff.Get() // need Get a window buf from pool
 		m, err = Self.basePackager.UnPack(reader)
 		n += m
-	case muxMsgSendOk:
+		if err != nil {
+			windowBuff.Put(Self.content)
+			Self.content = nil
+			if pErr, ok := err.(*ProtocolError); ok {
+				pErr.Flag, pErr.ID = Self.flag, Self.id
+				pErr.Header = append([]byte(nil), Self.buf[:7]...)
+			}
+		}
+	case Self.flag == muxMsgSendOk:
 		l, err = io.ReadFull(reader, Self.buf[5:13])
 		Self.window = binary.LittleEndian.Uint64(Self.buf[5:13])
 		n += uint16(l) // uint64
@@ -145,11 +204,213 @@ func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
 	return
 }
 
+// release puts the buffers of the packager not packed back to the pool
+func (Self *muxPackager) release() {
+	if Self.buf != nil {
+		windowBuff.Put(Self.buf)
+	}
+	if Self.content != nil {
+		windowBuff.Put(Self.content)
+	}
+}
+
+// group returns the stream group of the data frame, nil if not in any group
+func (Self *muxPackager) group() *StreamGroup {
+	if Self.conn == nil {
+		return nil
+	}
+	return Self.conn.Group()
+}
+
 func (Self *muxPackager) reset() {
 	Self.id = 0
 	Self.flag = 0
 	Self.length = 0
 	Self.content = nil
 	Self.window = 0
+	Self.priority = 0
+	Self.compact = false
+	Self.conn = nil
+	Self.queued = 0
 	Self.buf = nil
 }
+
+// the compact header, the first byte packs the flag, the size of the id and
+// the size of the length:
+//
+//	  1         2       5
+//	short   id size   flag
+//
+// the id is zigzag encoded in 1 to 4 bytes little endian, the length of the
+// content is 1 byte if short set, or 2 bytes. muxMsgSendOk carries 8 bytes window
+const (
+	compactFlagMask  = 1<<5 - 1
+	compactIdShift   = 5
+	compactShortFlag = 1 << 7
+)
+
+func (Self *muxPackager) packCompact(writer io.Writer) (n uint16, err error) {
+	var l int
+	Self.buf = Self.buf[0:16]
+	z := uint32(Self.id<<1) ^ uint32(Self.id>>31)
+	idSize := 1
+	for idSize < 4 && z>>(8*uint(idSize)) != 0 {
+		idSize++
+	}
+	head := Self.flag&compactFlagMask | byte(idSize-1)<<compactIdShift
+	for i := 0; i < idSize; i++ {
+		Self.buf[1+i] = byte(z >> (8 * uint(i)))
+	}
+	size := 1 + idSize
+	switch {
+	case hasContent(Self.flag):
+		if Self.length <= 0xff {
+			head |= compactShortFlag
+			Self.buf[size] = byte(Self.length)
+			size++
+		} else {
+			binary.LittleEndian.PutUint16(Self.buf[size:size+2], Self.length)
+			size += 2
+		}
+	case Self.flag == muxMsgSendOk:
+		binary.LittleEndian.PutUint64(Self.buf[size:size+8], Self.window)
+		size += 8
+	}
+	Self.buf[0] = head
+	l, err = writer.Write(Self.buf[:size])
+	n = uint16(l)
+	if err == nil && hasContent(Self.flag) {
+		l, err = writer.Write(Self.content[:Self.length])
+		n += uint16(l)
+	}
+	if hasContent(Self.flag) {
+		windowBuff.Put(Self.content)
+	}
+	windowBuff.Put(Self.buf)
+	return
+}
+
+func (Self *muxPackager) unPackCompact(reader io.Reader) (n uint16, err error) {
+	Self.buf = windowBuff.GetSize(poolSizeHeader)
+	Self.buf = Self.buf[0:16]
+	l, err := io.ReadFull(reader, Self.buf[:1])
+	if err != nil {
+		windowBuff.Put(Self.buf)
+		return
+	}
+	n += uint16(l)
+	size := frameHeaderSize(Self.buf[0], true) - 1
+	l, err = io.ReadFull(reader, Self.buf[1:1+size])
+	n += uint16(l)
+	if err != nil {
+		windowBuff.Put(Self.buf)
+		return
+	}
+	Self.decodeCompact(Self.buf[:1+size])
+	if hasContent(Self.flag) {
+		var m uint16
+		Self.content = windowBuff.Get()
+		m, err = Self.readContent(reader)
+		n += m
+		if err != nil {
+			windowBuff.Put(Self.content)
+			Self.content = nil
+			if pErr, ok := err.(*ProtocolError); ok {
+				pErr.Flag, pErr.ID = Self.flag, Self.id
+				pErr.Header = append([]byte(nil), Self.buf[:1+size]...)
+			}
+		}
+	}
+	windowBuff.Put(Self.buf)
+	return
+}
+
+// unPackFrame parses the frame in place from the buffered reader, the header
+// is not copied, only the content is copied into the window buffer
+func (Self *muxPackager) unPackFrame(r frameReader) (n uint16, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	size := frameHeaderSize(b[0], Self.compact)
+	if b, err = r.Peek(size); err != nil {
+		return
+	}
+	if Self.compact {
+		Self.decodeCompact(b)
+	} else {
+		Self.flag = b[0]
+		Self.id = int32(binary.LittleEndian.Uint32(b[1:5]))
+		switch {
+		case hasContent(Self.flag):
+			Self.length = binary.LittleEndian.Uint16(b[5:7])
+		case Self.flag == muxMsgSendOk:
+			Self.window = binary.LittleEndian.Uint64(b[5:13])
+		}
+	}
+	if hasContent(Self.flag) && Self.length > maximumSegmentSize {
+		err = &ProtocolError{Length: Self.length, Reason: "content segment too large",
+			Flag: Self.flag, ID: Self.id, Header: append([]byte(nil), b...)}
+	}
+	_, _ = r.Discard(size)
+	n = uint16(size)
+	if err != nil || !hasContent(Self.flag) {
+		return
+	}
+	if b, err = r.Peek(int(Self.length)); err != nil {
+		return
+	}
+	Self.content = windowBuff.Get()
+	Self.content = Self.content[:copy(Self.content, b)]
+	_, _ = r.Discard(len(b))
+	n += Self.length
+	return
+}
+
+// frameHeaderSize returns the header size of the frame by its first byte
+func frameHeaderSize(head byte, compact bool) int {
+	if !compact {
+		switch {
+		case hasContent(head):
+			return 7
+		case head == muxMsgSendOk:
+			return 13
+		}
+		return 5
+	}
+	size := 1 + int(head>>compactIdShift&3) + 1
+	switch {
+	case hasContent(head & compactFlagMask):
+		if head&compactShortFlag != 0 {
+			size++
+		} else {
+			size += 2
+		}
+	case head&compactFlagMask == muxMsgSendOk:
+		size += 8
+	}
+	return size
+}
+
+// decodeCompact decodes the compact header b, which is complete
+func (Self *muxPackager) decodeCompact(b []byte) {
+	head := b[0]
+	Self.flag = head & compactFlagMask
+	idSize := int(head>>compactIdShift&3) + 1
+	var z uint32
+	for i := 0; i < idSize; i++ {
+		z |= uint32(b[1+i]) << (8 * uint(i))
+	}
+	Self.id = int32(z>>1) ^ -int32(z&1)
+	p := 1 + idSize
+	switch {
+	case hasContent(Self.flag):
+		if head&compactShortFlag != 0 {
+			Self.length = uint16(b[p])
+		} else {
+			Self.length = binary.LittleEndian.Uint16(b[p : p+2])
+		}
+	case Self.flag == muxMsgSendOk:
+		Self.window = binary.LittleEndian.Uint64(b[p : p+8])
+	}
+}
@@ -0,0 +1,67 @@
+// Package nps_mux is a compatibility layer of the old package name,
+// new code should import ehang.io/nps-mux as npsmux directly.
+package nps_mux
+
+import (
+	"net"
+	"time"
+
+	"ehang.io/nps-mux"
+)
+
+type (
+	Mux       = npsmux.Mux
+	MuxConfig = npsmux.MuxConfig
+	Rate      = npsmux.Rate
+	RateConn  = npsmux.RateConn
+	// Stream is the stream of the mux, npsmux.Conn
+	Stream = npsmux.Conn
+	// Conn is the rate limited conn, as in the old package.
+	//
+	// Deprecated: use RateConn, the stream of the mux is Stream
+	Conn = npsmux.RateConn
+
+	RefusedError   = npsmux.RefusedError
+	TransportError = npsmux.TransportError
+	ProtocolError  = npsmux.ProtocolError
+	IntegrityError = npsmux.IntegrityError
+)
+
+// the errors of the mux, the same values as npsmux, so errors.Is works with either
+var (
+	ErrMuxClosed         = npsmux.ErrMuxClosed
+	ErrStreamClosed      = npsmux.ErrStreamClosed
+	ErrTimeout           = npsmux.ErrTimeout
+	ErrRefused           = npsmux.ErrRefused
+	ErrQuotaExceeded     = npsmux.ErrQuotaExceeded
+	ErrQuota             = npsmux.ErrQuota
+	ErrWouldBlock        = npsmux.ErrWouldBlock
+	ErrPlaintext         = npsmux.ErrPlaintext
+	ErrIntegrity         = npsmux.ErrIntegrity
+	ErrResumption        = npsmux.ErrResumption
+	ErrResumptionExpired = npsmux.ErrResumptionExpired
+)
+
+func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
+	return npsmux.NewMux(c, connType, pingCheckThreshold)
+}
+
+func NewMuxWithConfig(c net.Conn, connType string, config *MuxConfig) *Mux {
+	return npsmux.NewMuxWithConfig(c, connType, config)
+}
+
+func NewMuxChecked(c net.Conn, connType string, config *MuxConfig) (*Mux, error) {
+	return npsmux.NewMuxChecked(c, connType, config)
+}
+
+func RetryAfter(err error) time.Duration {
+	return npsmux.RetryAfter(err)
+}
+
+func NewRate(addSize int64) *Rate {
+	return npsmux.NewRate(addSize)
+}
+
+func NewRateConn(rate *Rate, conn net.Conn) *RateConn {
+	return npsmux.NewRateConn(rate, conn)
+}
@@ -0,0 +1,21 @@
+// Package npsmuxtest is the helpers of the tests using the mux, it is kept
+// out of npsmux, so the programs do not link the testing package
+package npsmuxtest
+
+import (
+	"testing"
+
+	"ehang.io/nps-mux"
+)
+
+// VerifyNoLeaks fails the test if any mux goroutine is still running,
+// or any pooled buffer or packager is not returned after all the muxes closed,
+// see npsmux.CheckLeaks. use it at the end of the test, like this
+//
+//	defer npsmuxtest.VerifyNoLeaks(t)
+func VerifyNoLeaks(t testing.TB) {
+	t.Helper()
+	if err := npsmux.CheckLeaks(); err != nil {
+		t.Error(err)
+	}
+}
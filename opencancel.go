@@ -0,0 +1,45 @@
+package npsmux
+
+import "sync/atomic"
+
+// if the peer announced featureOpenCancel, the NewConn gave up waiting for the
+// reply sends muxConnOpenCancel, the peer drops the stream if it is not accepted
+// yet, instead of holding it until accepted. the stream accepted already is
+// closed by the muxConnClose answering its late reply
+
+func (s *Mux) sendOpenCancel(id int32) {
+	if atomic.LoadUint32(&s.peerFeatures)&featureOpenCancel != 0 {
+		s.sendInfo(muxConnOpenCancel, id, nil) // in the control class after the open
+	}
+}
+
+// pendingOpen keeps the stream opened by the peer, until it is handed over
+func (s *Mux) pendingOpen(c *Conn) {
+	c.openCanceled = make(chan struct{})
+	s.pendingLock.Lock()
+	if s.pendingOpens == nil {
+		s.pendingOpens = make(map[int32]*Conn)
+	}
+	s.pendingOpens[c.connId] = c
+	s.pendingLock.Unlock()
+}
+
+// openHandled forgets the stream accepted or refused
+func (s *Mux) openHandled(id int32) {
+	s.pendingLock.Lock()
+	delete(s.pendingOpens, id)
+	s.pendingLock.Unlock()
+}
+
+// cancelOpen wakes up the hand over of the stream canceled by the opener
+func (s *Mux) cancelOpen(id int32) {
+	s.pendingLock.Lock()
+	c := s.pendingOpens[id]
+	delete(s.pendingOpens, id)
+	s.pendingLock.Unlock()
+	if c == nil {
+		return // accepted or refused already
+	}
+	s.logln(LogDebug, "stream open canceled by the peer, conn id:", id)
+	close(c.openCanceled)
+}
@@ -0,0 +1,91 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// OpenContext is carried from the opener of a stream to the acceptor with the
+// open, as the metadata of grpc, so the deadlines and the traces go through the
+// tunnel. it is dropped by the old peers
+type OpenContext struct {
+	// Deadline is the deadline of the work the stream serves, zero means none.
+	// it is sent as the time left, the acceptor counts it from the open received,
+	// so the clocks of the sides need not agree
+	Deadline time.Time
+	// Trace is the trace context, as the traceparent of w3c
+	Trace string
+	// Values are the other entries, the keys are at most 255 bytes
+	Values map[string]string
+}
+
+var errOpenContext = errors.New("mux: bad open context")
+
+// OpenContext returns the context the opener attached to the stream, nil if none
+func (s *Conn) OpenContext() *OpenContext {
+	return s.openCtx
+}
+
+// encode puts the context into the entries of the metadata
+func (s *OpenContext) encode(entries map[uint8][]byte, now time.Time) error {
+	if !s.Deadline.IsZero() {
+		left := s.Deadline.Sub(now)
+		if left < 0 {
+			left = 0 // expired, the acceptor sees it expired too
+		}
+		entries[metaDeadline] = make([]byte, 8)
+		binary.LittleEndian.PutUint64(entries[metaDeadline], uint64(left))
+	}
+	if s.Trace != "" {
+		entries[metaTrace] = []byte(s.Trace)
+	}
+	if len(s.Values) == 0 {
+		return nil
+	}
+	// key length(1) key value length(2) value
+	var b []byte
+	for k, v := range s.Values {
+		if len(k) > 255 || len(v) > maximumSegmentSize {
+			return errOpenContext
+		}
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		b = append(b, 0, 0)
+		binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(len(v)))
+		b = append(b, v...)
+	}
+	entries[metaValues] = b
+	return nil
+}
+
+// decodeOpenContext returns the context in the metadata of the open received
+// at now, nil if none or malformed
+func decodeOpenContext(entries map[uint8][]byte, now time.Time) *OpenContext {
+	deadline, trace, values := entries[metaDeadline], entries[metaTrace], entries[metaValues]
+	if deadline == nil && trace == nil && values == nil {
+		return nil
+	}
+	c := &OpenContext{Trace: string(trace)}
+	if len(deadline) == 8 {
+		c.Deadline = now.Add(time.Duration(binary.LittleEndian.Uint64(deadline)))
+	}
+	if len(values) > 0 {
+		c.Values = make(map[string]string)
+	}
+	for len(values) > 0 {
+		kl := int(values[0])
+		if len(values) < 3+kl {
+			return nil
+		}
+		k := string(values[1 : 1+kl])
+		vl := int(binary.LittleEndian.Uint16(values[1+kl:]))
+		values = values[3+kl:]
+		if len(values) < vl {
+			return nil
+		}
+		c.Values[k] = string(values[:vl])
+		values = values[vl:]
+	}
+	return c
+}
@@ -0,0 +1,61 @@
+package npsmux
+
+const (
+	pacingGain  = 1.25 // pace a little faster than the estimated, so the estimate can grow
+	pacingBurst = maximumSegmentSize * 16
+)
+
+// pacer spreads the data frames at the rate the peer acknowledged, instead of
+// filling the socket buffer at once, the interactive frames behind bulk ones wait less
+type pacer struct {
+	bucket *tokenBucket
+	mux    *Mux
+}
+
+func newPacer(mux *Mux) *pacer {
+	return &pacer{
+		bucket: newTokenBucket(mux.clock, 0, pacingBurst),
+		mux:    mux,
+	}
+}
+
+// rate returns the pacing rate, ok is false if not estimated yet. it follows the
+// acknowledged bandwidth, but never above the bandwidth written, the acknowledged
+// bursts after a stall are not the capacity of the path
+func (Self *pacer) rate() (bw float64, ok bool) {
+	acked, ok := Self.mux.ackedBw.Get()
+	if !ok {
+		return
+	}
+	if sent, sentOk := Self.mux.sentBw.Get(); sentOk && sent < acked {
+		acked = sent
+	}
+	return acked * pacingGain, true
+}
+
+// wait blocks the write session until n bytes can be sent
+func (Self *pacer) wait(n int) {
+	bw, ok := Self.rate()
+	if !ok {
+		return // no estimate yet, not paced
+	}
+	d := Self.bucket.take(float64(n), bw)
+	if d <= 0 {
+		return
+	}
+	timer := Self.mux.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-Self.mux.closeChan:
+	}
+}
+
+// PacingRate returns the pacing rate in bytes per second, zero means not paced
+func (s *Mux) PacingRate() float64 {
+	if s.pacer == nil {
+		return 0
+	}
+	bw, _ := s.pacer.rate()
+	return bw
+}
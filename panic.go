@@ -0,0 +1,25 @@
+package npsmux
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// recoverPanic recovers the panic of a mux goroutine, and passes it to
+// OnPanic with the stack, the mux is closed then. it panics again if
+// OnPanic is nil, the stack of the panic is logged before, the stack of
+// the panic again only shows the recovery. it must be deferred directly
+func (s *Mux) recoverPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	if s.config.OnPanic == nil {
+		s.logf(LogError, "goroutine panic: %v\n%s", v, stack)
+		panic(v)
+	}
+	s.logln(LogError, "goroutine panic, close the mux:", v)
+	s.config.OnPanic(v, stack)
+	s.fail(fmt.Errorf("mux: goroutine panic: %v", v))
+}
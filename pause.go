@@ -0,0 +1,111 @@
+package npsmux
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const pauseCheckInterval = time.Millisecond * 10
+
+// Pause stops scheduling the data frames of all the streams, for the
+// maintenance, the writes block until Resume, the control frames and the
+// pings go on, so the session and the streams keep alive. it waits for the
+// data frames queued written, or the ctx done, the mux keeps paused anyway
+func (s *Mux) Pause(ctx context.Context) error {
+	s.pauseLock.Lock()
+	if s.resumeCh == nil {
+		s.resumeCh = make(chan struct{})
+		atomic.StoreUint32(&s.paused, 1)
+		s.logln(LogInfo, "paused")
+	}
+	s.pauseLock.Unlock()
+	ticker := s.clock.NewTicker(pauseCheckInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&s.dataQueued) > 0 {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.closeChan:
+			return ErrMuxClosed
+		}
+	}
+	return nil
+}
+
+// Resume lets the data frames paused by Pause go on
+func (s *Mux) Resume() {
+	s.pauseLock.Lock()
+	if s.resumeCh != nil {
+		atomic.StoreUint32(&s.paused, 0)
+		close(s.resumeCh)
+		s.resumeCh = nil
+		s.logln(LogInfo, "resumed")
+	}
+	s.pauseLock.Unlock()
+}
+
+// Paused reports whether the mux is paused by Pause
+func (s *Mux) Paused() bool {
+	return atomic.LoadUint32(&s.paused) == 1
+}
+
+// admitData counts the data frame to be queued, waits for Resume if paused.
+// it is counted before the check, Pause sees it or it sees the pause, and
+// after the window got, a write waiting for the window is not waited by Pause
+func (Self *sendWindow) admitData() error {
+	s := Self.mux
+	for {
+		atomic.AddInt32(&s.dataQueued, 1)
+		if atomic.LoadUint32(&s.paused) == 0 {
+			return nil
+		}
+		atomic.AddInt32(&s.dataQueued, -1)
+		s.pauseLock.Lock()
+		resume := s.resumeCh
+		s.pauseLock.Unlock()
+		if resume == nil {
+			continue
+		}
+		if err := Self.waitResume(resume); err != nil {
+			return err
+		}
+	}
+}
+
+// tryAdmit counts the n data frames to be queued, unless the mux is paused
+func (Self *sendWindow) tryAdmit(n int32) bool {
+	s := Self.mux
+	atomic.AddInt32(&s.dataQueued, n)
+	if atomic.LoadUint32(&s.paused) == 0 {
+		return true
+	}
+	atomic.AddInt32(&s.dataQueued, -n)
+	return false
+}
+
+// unadmit drops the count of the n frames admitted, but not queued
+func (Self *sendWindow) unadmit(n int32) {
+	atomic.AddInt32(&Self.mux.dataQueued, -n)
+}
+
+func (Self *sendWindow) waitResume(resume chan struct{}) error {
+	s := Self.mux
+	var timeout <-chan time.Time
+	if t := Self.timeout.Sub(s.clock.Now()); t >= 0 {
+		timer := s.clock.NewTimer(t)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-Self.closeOpCh:
+		return ErrStreamClosed
+	case <-s.closeChan:
+		return ErrMuxClosed
+	}
+}
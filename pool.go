@@ -1,26 +1,23 @@
-package nps_mux
+package npsmux
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 const (
 	poolSizeBuffer = 4096                           // a mux packager total length
 	poolSizeWindow = poolSizeBuffer - 2 - 4 - 4 - 1 // content length
+	poolSizeHeader = 16                             // a mux packager header length
 )
 
+// windowBufferPool hands out the buffers of the frame content, by the slab allocator
 type windowBufferPool struct {
-	pool sync.Pool
+	slab *slabAllocator
 }
 
-func newWindowBufferPool() *windowBufferPool {
-	return &windowBufferPool{
-		pool: sync.Pool{
-			New: func() interface{} {
-				return make([]byte, poolSizeWindow, poolSizeWindow)
-			},
-		},
-	}
+func newWindowBufferPool(slab *slabAllocator) *windowBufferPool {
+	return &windowBufferPool{slab: slab}
 }
 
 //func trace(buf []byte, ty string) {
@@ -34,14 +31,21 @@ func newWindowBufferPool() *windowBufferPool {
 //}
 
 func (Self *windowBufferPool) Get() (buf []byte) {
-	buf = Self.pool.Get().([]byte)
+	return Self.GetSize(poolSizeWindow)
+}
+
+// GetSize returns a buffer of length n, from the smallest size class fits
+func (Self *windowBufferPool) GetSize(n int) (buf []byte) {
+	buf = Self.slab.Get(n)
+	atomic.AddInt64(&pooledBuffers, 1)
 	//trace(buf, "get")
-	return buf[:poolSizeWindow]
+	return buf
 }
 
 func (Self *windowBufferPool) Put(x []byte) {
 	//trace(x, "put")
-	Self.pool.Put(x[:poolSizeWindow]) // make buf to full
+	atomic.AddInt64(&pooledBuffers, -1)
+	Self.slab.Put(x)
 }
 
 type muxPackagerPool struct {
@@ -60,40 +64,18 @@ func newMuxPackagerPool() *muxPackagerPool {
 }
 
 func (Self *muxPackagerPool) Get() *muxPackager {
+	atomic.AddInt64(&pooledPackagers, 1)
 	return Self.pool.Get().(*muxPackager)
 }
 
 func (Self *muxPackagerPool) Put(pack *muxPackager) {
+	atomic.AddInt64(&pooledPackagers, -1)
 	pack.reset()
 	Self.pool.Put(pack)
 }
 
-type listElementPool struct {
-	pool sync.Pool
-}
-
-func newListElementPool() *listElementPool {
-	return &listElementPool{
-		pool: sync.Pool{
-			New: func() interface{} {
-				element := listElement{}
-				return &element
-			},
-		},
-	}
-}
-
-func (Self *listElementPool) Get() *listElement {
-	return Self.pool.Get().(*listElement)
-}
-
-func (Self *listElementPool) Put(element *listElement) {
-	element.Reset()
-	Self.pool.Put(element)
-}
-
 var (
 	muxPack    = newMuxPackagerPool()
-	windowBuff = newWindowBufferPool()
-	listEle    = newListElementPool()
+	slab       = newSlabAllocator()
+	windowBuff = newWindowBufferPool(slab)
 )
@@ -0,0 +1,114 @@
+package npsmux
+
+import "sync/atomic"
+
+// Priority is the class of the frames in the write queue, the frames of
+// a higher class are sent first, the lower classes are protected from starving
+type Priority uint8
+
+const (
+	// PriorityControl is the class of ping and the connection setup frames
+	PriorityControl Priority = iota
+	// PriorityRetransmit is the class of the frames sent again, as the window status probed
+	PriorityRetransmit
+	// PriorityInteractive is for the latency sensitive streams
+	PriorityInteractive
+	// PriorityBulk is the default class of the streams
+	PriorityBulk
+	numPriorities
+)
+
+// priorityPing is the dedicated class of the ping and the ping return, served before
+// all the others, a congested write queue does not delay them into a false timeout.
+// it is internal, the classes of the streams are not changed
+const (
+	priorityPing = numPriorities
+	numClasses   = numPriorities + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityRetransmit:
+		return "retransmit"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// higherPriority returns the higher class of a and b
+func higherPriority(a, b Priority) Priority {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+// framePriority returns the class of the frame, the frames of a stream take the class
+// of the stream if it is higher, as a close is not stuck behind the bulk data
+func (s *Mux) framePriority(flag uint8, id int32) Priority {
+	p := flagPriority(flag)
+	if p == PriorityControl || p == priorityPing || id == muxPing {
+		return p
+	}
+	if c, ok := s.connMap.Get(id); ok {
+		p = higherPriority(p, c.Priority())
+	}
+	return p
+}
+
+// flagPriority returns the class of the frames not belonging to any stream
+func flagPriority(flag uint8) Priority {
+	switch flag {
+	case muxPingFlag, muxPingReturn:
+		return priorityPing
+	case muxNewConn, muxNewConnOk, muxNewConnFail,
+		muxNewConnBatch, muxNewConnOkBatch, muxFeatures, muxGoAway, muxCompactHeader, muxCongestion, muxConnCloseAck, muxStreamMeta, muxIdRole:
+		return PriorityControl
+	case muxWindowProbe:
+		return PriorityRetransmit
+	}
+	return PriorityBulk
+}
+
+// SetPriority sets the class of the frames the stream sends,
+// includes the data, the window updates and the close signal
+func (s *Conn) SetPriority(p Priority) {
+	if p >= numPriorities {
+		p = PriorityBulk
+	}
+	atomic.StoreUint32(&s.sendWindow.priority, uint32(p))
+	atomic.StoreUint32(&s.receiveWindow.priority, uint32(p))
+	s.sendPriority(p)
+}
+
+// sendPriority tells the peer the class of the stream data, the peer sends the
+// window updates of the stream in the class, if it is higher than its own
+func (s *Conn) sendPriority(p Priority) {
+	mux := s.receiveWindow.mux
+	if s.closed() || atomic.LoadUint32(&mux.peerFeatures)&featureStreamMeta == 0 {
+		return
+	}
+	meta, _ := encodeMeta(map[uint8][]byte{metaPriority: {uint8(p)}})
+	mux.sendInfo(muxStreamMeta, s.connId, meta)
+}
+
+// ackPriority returns the class of the window updates, the higher of the stream and
+// the data of the peer, the acks of an interactive upload are not stuck behind the
+// bulk data of this side
+func (Self *receiveWindow) ackPriority() Priority {
+	return higherPriority(Self.getPriority(), Priority(atomic.LoadUint32(&Self.peerPriority)))
+}
+
+// Priority returns the class of the frames the stream sends
+func (s *Conn) Priority() Priority {
+	return s.sendWindow.getPriority()
+}
+
+func (Self *window) getPriority() Priority {
+	return Priority(atomic.LoadUint32(&Self.priority))
+}
@@ -0,0 +1,56 @@
+package npsmux
+
+// TransportProfile is the tuning of the mux for a kind of transport
+type TransportProfile struct {
+	Name string
+
+	// Lossy means the frames may be dropped by the transport, as kcp in the
+	// fast modes, the stalled send windows are probed then
+	Lossy bool
+
+	// StallRtts is the count of rtt a send window waits, before it is probed
+	// on a lossy transport, zero means 8
+	StallRtts int
+
+	// PingCheckThreshold is the count of ping intervals without anything received,
+	// the ping times out after it, MuxConfig.PingCheckThreshold overrides it
+	PingCheckThreshold int
+
+	// WindowMultiplier scales the receive window calculated from the bandwidth
+	// and the latency, zero means 1
+	WindowMultiplier float64
+}
+
+var (
+	// ProfileKCPFast is for kcp in the fast modes, drops are common, the window is larger
+	// to keep the pipe full during the retransmission
+	ProfileKCPFast = &TransportProfile{Name: "kcp-fast", Lossy: true, StallRtts: 4, PingCheckThreshold: 12, WindowMultiplier: 2}
+	// ProfileKCPNormal is for kcp in the normal mode, it is the default of kcp
+	ProfileKCPNormal = &TransportProfile{Name: "kcp-normal", Lossy: true, StallRtts: stallRtts, PingCheckThreshold: 20, WindowMultiplier: 1}
+	// ProfileTCPLAN is for tcp in the local network, a dead peer is found earlier
+	ProfileTCPLAN = &TransportProfile{Name: "tcp-lan", PingCheckThreshold: 12, WindowMultiplier: 1}
+	// ProfileTCPWAN is for tcp through the internet, it is the default of others
+	ProfileTCPWAN = &TransportProfile{Name: "tcp-wan", PingCheckThreshold: 60, WindowMultiplier: 1}
+)
+
+// defaultProfile returns the profile of the conn type, as the mux did before profiles
+func defaultProfile(connType string) *TransportProfile {
+	if connType == "kcp" {
+		return ProfileKCPNormal
+	}
+	return ProfileTCPWAN
+}
+
+func (s *TransportProfile) stallRtts() int {
+	if s.StallRtts > 0 {
+		return s.StallRtts
+	}
+	return stallRtts
+}
+
+func (s *TransportProfile) windowSize(n uint32) uint32 {
+	if s.WindowMultiplier <= 0 || s.WindowMultiplier == 1 {
+		return n
+	}
+	return uint32(float64(n) * s.WindowMultiplier)
+}
@@ -0,0 +1,236 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// CheckTimeout is the time a check waits for the answer of the peer
+var CheckTimeout = time.Second * 5
+
+// Check is a step of the conformance test
+type Check struct {
+	Name string
+	Run  func(c *Client) error
+}
+
+// Client speaks the protocol by the raw frames, it announces no feature,
+// so the peer sends only the frames of the base protocol with the normal header
+type Client struct {
+	rw      io.ReadWriter
+	compact bool
+	sendOk  map[int32]bool
+	data    map[int32][]byte
+	closed  map[int32]bool
+}
+
+// NewClient returns the client on the transport connected to the peer
+func NewClient(rw io.ReadWriter) *Client {
+	return &Client{rw: rw, sendOk: make(map[int32]bool), data: make(map[int32][]byte), closed: make(map[int32]bool)}
+}
+
+// Send writes the frame, with the compact header after CompactHeader sent
+func (c *Client) Send(f Frame) (err error) {
+	var b []byte
+	if c.compact {
+		b, err = f.AppendCompact(nil)
+	} else {
+		b, err = f.Append(nil)
+	}
+	if err != nil {
+		return
+	}
+	if _, err = c.rw.Write(b); err == nil && f.Flag == FlagCompactHeader {
+		c.compact = true
+	}
+	return
+}
+
+// Expect reads the frames until match returns true, the pings of the peer are
+// answered, the data and the window updates are recorded
+func (c *Client) Expect(match func(f Frame) bool) (f Frame, err error) {
+	if d, ok := c.rw.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = d.SetReadDeadline(time.Now().Add(CheckTimeout))
+		defer d.SetReadDeadline(time.Time{})
+	}
+	for {
+		if f, err = ReadFrame(c.rw); err != nil {
+			return
+		}
+		switch f.Flag {
+		case FlagPing:
+			if err = c.Send(Frame{Flag: FlagPingReturn, ID: f.ID, Content: f.Content}); err != nil {
+				return
+			}
+		case FlagSendOk:
+			c.sendOk[f.ID] = true
+		case FlagMsg, FlagMsgPart:
+			c.data[f.ID] = append(c.data[f.ID], f.Content...)
+		case FlagConnClose:
+			c.closed[f.ID] = true
+		}
+		if match(f) {
+			return
+		}
+	}
+}
+
+// wait reads the frames until cond returns true, cond may be true already
+func (c *Client) wait(cond func() bool) error {
+	if cond() {
+		return nil
+	}
+	_, err := c.Expect(func(Frame) bool { return cond() })
+	return err
+}
+
+// expectData waits for the data of the stream echoed
+func (c *Client) expectData(id int32, want []byte) error {
+	if err := c.wait(func() bool { return len(c.data[id]) >= len(want) }); err != nil {
+		return err
+	}
+	got := c.data[id]
+	c.data[id] = nil
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("data echoed %d bytes, want %d bytes", len(got), len(want))
+	}
+	return nil
+}
+
+// ping checks the peer is still live
+func (c *Client) ping(content string) error {
+	if err := c.Send(Frame{Flag: FlagPing, ID: PingID, Content: []byte(content)}); err != nil {
+		return err
+	}
+	_, err := c.Expect(func(f Frame) bool {
+		return f.Flag == FlagPingReturn && string(f.Content) == content
+	})
+	return err
+}
+
+func (c *Client) open(id int32) error {
+	if err := c.Send(Frame{Flag: FlagNewConn, ID: id}); err != nil {
+		return err
+	}
+	f, err := c.Expect(func(f Frame) bool {
+		return (f.Flag == FlagNewConnOk || f.Flag == FlagNewConnFail) && f.ID == id
+	})
+	if err == nil && f.Flag == FlagNewConnFail {
+		err = errors.New("stream refused")
+	}
+	return err
+}
+
+// write sends p split into the frames
+func (c *Client) write(id int32, p []byte) error {
+	for len(p) > MaxContentSize {
+		if err := c.Send(Frame{Flag: FlagMsgPart, ID: id, Content: p[:MaxContentSize]}); err != nil {
+			return err
+		}
+		p = p[MaxContentSize:]
+	}
+	return c.Send(Frame{Flag: FlagMsg, ID: id, Content: p})
+}
+
+// Checks are the steps of the conformance test, run in order on one transport,
+// the peer must accept the streams and echo their data back
+var Checks = []Check{
+	{"features", func(c *Client) error {
+		if err := c.Send(Frame{Flag: FlagFeatures}); err != nil {
+			return err
+		}
+		_, err := c.Expect(func(f Frame) bool { return f.Flag == FlagFeatures })
+		return err
+	}},
+	{"ping", func(c *Client) error { return c.ping("conformance ping") }},
+	{"open", func(c *Client) error { return c.open(1) }},
+	{"msg", func(c *Client) error {
+		if err := c.write(1, []byte("hello")); err != nil {
+			return err
+		}
+		return c.expectData(1, []byte("hello"))
+	}},
+	{"msg part", func(c *Client) error {
+		if err := c.Send(Frame{Flag: FlagMsgPart, ID: 1, Content: []byte("hel")}); err != nil {
+			return err
+		}
+		if err := c.Send(Frame{Flag: FlagMsg, ID: 1, Content: []byte("lo!")}); err != nil {
+			return err
+		}
+		return c.expectData(1, []byte("hello!"))
+	}},
+	{"large write", func(c *Client) error {
+		p := bytes.Repeat([]byte("0123456789abcdef"), MaxContentSize/4)
+		if err := c.write(1, p); err != nil {
+			return err
+		}
+		return c.expectData(1, p)
+	}},
+	{"send ok", func(c *Client) error {
+		return c.wait(func() bool { return c.sendOk[1] })
+	}},
+	{"duplicate id", func(c *Client) error {
+		if c.open(1) == nil {
+			return errors.New("stream id in use accepted")
+		}
+		return nil
+	}},
+	{"unknown stream", func(c *Client) error {
+		if err := c.write(99, []byte("lost")); err != nil {
+			return err
+		}
+		return c.ping("after unknown stream")
+	}},
+	{"padding", func(c *Client) error {
+		if err := c.Send(Frame{Flag: FlagPadding, Content: make([]byte, 100)}); err != nil {
+			return err
+		}
+		return c.ping("after padding")
+	}},
+	{"compact header", func(c *Client) error {
+		if err := c.Send(Frame{Flag: FlagCompactHeader}); err != nil {
+			return err
+		}
+		if err := c.ping("compact ping"); err != nil {
+			return err
+		}
+		if err := c.open(2); err != nil {
+			return err
+		}
+		p := bytes.Repeat([]byte("compact"), 100)
+		if err := c.write(2, p); err != nil {
+			return err
+		}
+		return c.expectData(2, p)
+	}},
+	{"close", func(c *Client) error {
+		for _, id := range []int32{1, 2} {
+			if err := c.Send(Frame{Flag: FlagConnClose, ID: id}); err != nil {
+				return err
+			}
+			if err := c.wait(func() bool { return c.closed[id] }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// Run runs the checks on the transport, report is invoked after every check,
+// the checks after a failed one are skipped, it returns the first error
+func Run(rw io.ReadWriter, report func(name string, err error)) error {
+	c := NewClient(rw)
+	for _, check := range Checks {
+		err := check.Run(c)
+		if report != nil {
+			report(check.Name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", check.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+// Package protocol describes the wire protocol of the mux, for the
+// implementations in other languages, the frames are:
+//
+//	flag(1) id(4)                          no content
+//	flag(1) id(4) length(2) content        ping, ping return, msg, msg part, batches, padding, close ack, checksum, stream meta, msg seq
+//	flag(1) id(4) window(8)                send ok
+//
+// all the integers are little endian. both sides send the Features frame
+// first, the feature bits in the id field, the optional frames are sent only
+// if the peer announced the feature. after the CompactHeader frame sent, the
+// frames of that direction use the compact header:
+//
+//	head(1) id(1-4) [length(1-2) | window(8)] content
+//
+// the head packs the flag in the low 5 bits, the id size minus one in bit 5
+// and 6, bit 7 is set if the length is one byte. the id is zigzag encoded.
+//
+// a stream is opened by NewConn with an id unused, the peer answers NewConnOk
+// or NewConnFail. the data is sent as Msg frames, a write larger than
+// MaxContentSize is split into MsgPart frames ended by a Msg frame. the sender
+// may send InitialWindow bytes, the receiver tells its window and the bytes
+// read by SendOk frames. ConnClose closes the stream of both directions.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// the frame flags
+const (
+	FlagPing uint8 = iota
+	FlagNewConnOk
+	FlagNewConnFail
+	FlagMsg
+	FlagMsgPart
+	FlagSendOk
+	FlagNewConn
+	FlagConnClose
+	FlagPingReturn
+	FlagFeatures
+	FlagNewConnBatch
+	FlagNewConnOkBatch
+	FlagWindowProbe
+	FlagGoAway
+	FlagCompactHeader
+	FlagPadding
+	FlagCongestion
+	FlagConnCloseConfirm
+	FlagConnCloseAck
+	FlagChecksum
+	FlagStreamMeta
+	FlagMsgSeq
+	FlagConnOpenCancel
+	FlagConnCloseWrite
+	FlagIdRole
+	NumFlags
+)
+
+// LatestRevision is the protocol revision described, revision 1 is the base
+// protocol without the Features frame, every later revision adds the next feature
+const LatestRevision = 13
+
+// the feature bits of the Features frame
+const (
+	FeatureOpenBatch uint32 = 1 << iota
+	FeatureWindowProbe
+	FeatureCompactHeader
+	FeaturePadding
+	FeatureCongestion
+	FeatureCloseConfirm
+	// FeatureIntegrity is optional, not in any revision, the sender of a stream
+	// sends the Checksum frame of every 1MB data, and of the data left before
+	// ConnClose, the content is offset(8) length(4) crc32 ieee(4)
+	FeatureIntegrity
+	// FeatureStreamMeta is the revision 8, the opener of a stream may send the
+	// StreamMeta frame just before NewConn, the content is the entries of
+	// key(1) length(2) value, the key 1 is the tenant of the stream. the frame is
+	// sent for an open stream too, the key 2 is the priority class(1) of the stream
+	// data, the receiver sends the SendOk of the stream in the class then, the
+	// priority of an unknown stream is dropped. the key 3 is the initial receive
+	// window(4) of the opener, instead of InitialWindow. the acceptor may tell its
+	// initial window by a SendOk with zero bytes read before NewConnOk. the key 4
+	// is the early data, the first bytes of the stream, counted in the window. the
+	// key 5 is the milliseconds(4) the opener should wait before opening again,
+	// sent by the acceptor just before NewConnFail. the keys 6 to 8 are the context
+	// of the open, the nanoseconds(8) left to the deadline, the trace context, and
+	// the values of the entries of key length(1) key value length(2) value
+	FeatureStreamMeta
+	// FeatureIdQuarantine is the revision 9, the side closed a stream first does
+	// not open its id again until the ConnClose of the peer received, the frames
+	// of the id in between are late, dropped, so they never reach a new stream of
+	// the same id after the ids wrapped around. there is no frame of it, the side
+	// announces it keeps the ids so
+	FeatureIdQuarantine
+	// FeatureSequence is the revision 10, the data may be sent by the MsgSeq frames
+	// instead of Msg and MsgPart, the content is offset(8) data, the offset of the
+	// data in the stream counts the data of all the frames before. the receiver
+	// delivers the data in the order of the offsets, and drops the data received twice
+	FeatureSequence
+	// FeatureOpenCancel is the revision 11, the opener gave up waiting for the reply
+	// of NewConn sends ConnOpenCancel, the acceptor drops the stream if it is not
+	// accepted yet, without any reply. the stream accepted already is answered as
+	// usual, the opener closes it by ConnClose then
+	FeatureOpenCancel
+	// FeatureHalfClose is the revision 12, the side writes no more sends
+	// ConnCloseWrite after the data of the stream, the receiver reads the end of
+	// the stream after the data, and writes on, until ConnClose of either side
+	FeatureHalfClose
+	// FeatureIdRole is the revision 13, both sides send IdRole after the Features
+	// frame, the id field is a random nonce, the low bit set if the side is
+	// configured to open the even ids. the sides configured apart keep the ids,
+	// otherwise the greater id opens the even ids, the equal ones are sent again
+	// with the new nonces. the opens refused as both sides used the id before it
+	// are sent again with the new ids
+	FeatureIdRole
+)
+
+const (
+	// PingID is the id of the ping and ping return
+	PingID int32 = -1
+	// MaxContentSize is the largest content of a frame
+	MaxContentSize = 4096 - 2 - 4 - 4 - 1
+	// InitialWindow is the bytes a stream may send before the first SendOk
+	InitialWindow = MaxContentSize * 30
+	// MaxWindow is the largest receive window
+	MaxWindow = 1 << 27
+)
+
+const (
+	compactFlagMask  = 1<<5 - 1
+	compactIdShift   = 5
+	compactShortFlag = 1 << 7
+	windowBits       = 31
+	windowShift      = 32
+	waitShift        = windowShift + windowBits
+	mask31           = 1<<windowBits - 1
+)
+
+// ErrTooLarge is returned if the content is larger than MaxContentSize
+var ErrTooLarge = errors.New("protocol: content too large")
+
+// Frame is a mux frame
+type Frame struct {
+	Flag    uint8
+	ID      int32
+	Content []byte // the flags HasContent reports
+	Window  uint64 // FlagSendOk only
+}
+
+// HasContent reports whether the frames of the flag carry the length and content
+func HasContent(flag uint8) bool {
+	switch flag {
+	case FlagMsg, FlagMsgPart, FlagPing, FlagPingReturn, FlagNewConnBatch, FlagNewConnOkBatch, FlagPadding,
+		FlagConnCloseAck, FlagChecksum, FlagStreamMeta, FlagMsgSeq:
+		return true
+	}
+	return false
+}
+
+// Append appends the frame encoded with the normal header to b
+func (f *Frame) Append(b []byte) ([]byte, error) {
+	if len(f.Content) > MaxContentSize {
+		return b, ErrTooLarge
+	}
+	b = append(b, f.Flag)
+	b = appendUint32(b, uint32(f.ID))
+	switch {
+	case HasContent(f.Flag):
+		b = appendUint16(b, uint16(len(f.Content)))
+		b = append(b, f.Content...)
+	case f.Flag == FlagSendOk:
+		b = appendUint64(b, f.Window)
+	}
+	return b, nil
+}
+
+// AppendCompact appends the frame encoded with the compact header to b
+func (f *Frame) AppendCompact(b []byte) ([]byte, error) {
+	if len(f.Content) > MaxContentSize {
+		return b, ErrTooLarge
+	}
+	z := uint32(f.ID<<1) ^ uint32(f.ID>>31)
+	idSize := 1
+	for idSize < 4 && z>>(8*uint(idSize)) != 0 {
+		idSize++
+	}
+	head := f.Flag&compactFlagMask | byte(idSize-1)<<compactIdShift
+	short := HasContent(f.Flag) && len(f.Content) <= 0xff
+	if short {
+		head |= compactShortFlag
+	}
+	b = append(b, head)
+	for i := 0; i < idSize; i++ {
+		b = append(b, byte(z>>(8*uint(i))))
+	}
+	switch {
+	case short:
+		b = append(b, byte(len(f.Content)))
+		b = append(b, f.Content...)
+	case HasContent(f.Flag):
+		b = appendUint16(b, uint16(len(f.Content)))
+		b = append(b, f.Content...)
+	case f.Flag == FlagSendOk:
+		b = appendUint64(b, f.Window)
+	}
+	return b, nil
+}
+
+// ReadFrame reads a frame with the normal header
+func ReadFrame(r io.Reader) (f Frame, err error) {
+	var head [7]byte
+	if _, err = io.ReadFull(r, head[:5]); err != nil {
+		return
+	}
+	f.Flag = head[0]
+	f.ID = int32(binary.LittleEndian.Uint32(head[1:5]))
+	switch {
+	case HasContent(f.Flag):
+		if _, err = io.ReadFull(r, head[5:7]); err != nil {
+			return
+		}
+		err = f.readContent(r, int(binary.LittleEndian.Uint16(head[5:7])))
+	case f.Flag == FlagSendOk:
+		var window [8]byte
+		if _, err = io.ReadFull(r, window[:]); err == nil {
+			f.Window = binary.LittleEndian.Uint64(window[:])
+		}
+	}
+	return
+}
+
+// ReadCompactFrame reads a frame with the compact header
+func ReadCompactFrame(r io.Reader) (f Frame, err error) {
+	var b [13]byte
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return
+	}
+	head := b[0]
+	f.Flag = head & compactFlagMask
+	idSize := int(head>>compactIdShift&3) + 1
+	if _, err = io.ReadFull(r, b[1:1+idSize]); err != nil {
+		return
+	}
+	var z uint32
+	for i := 0; i < idSize; i++ {
+		z |= uint32(b[1+i]) << (8 * uint(i))
+	}
+	f.ID = int32(z>>1) ^ -int32(z&1)
+	switch {
+	case HasContent(f.Flag) && head&compactShortFlag != 0:
+		if _, err = io.ReadFull(r, b[:1]); err != nil {
+			return
+		}
+		err = f.readContent(r, int(b[0]))
+	case HasContent(f.Flag):
+		if _, err = io.ReadFull(r, b[:2]); err != nil {
+			return
+		}
+		err = f.readContent(r, int(binary.LittleEndian.Uint16(b[:2])))
+	case f.Flag == FlagSendOk:
+		if _, err = io.ReadFull(r, b[:8]); err == nil {
+			f.Window = binary.LittleEndian.Uint64(b[:8])
+		}
+	}
+	return
+}
+
+func (f *Frame) readContent(r io.Reader, n int) (err error) {
+	if n > MaxContentSize {
+		return ErrTooLarge
+	}
+	f.Content = make([]byte, n)
+	_, err = io.ReadFull(r, f.Content)
+	return
+}
+
+// PackWindow encodes the window of the SendOk frame, size is the receive window,
+// read is the bytes read by the application since the last SendOk
+func PackWindow(size, read uint32, wait bool) uint64 {
+	w := uint64(size&mask31)<<windowShift | uint64(read&mask31)
+	if wait {
+		w |= 1 << waitShift
+	}
+	return w
+}
+
+// UnpackWindow decodes the window of the SendOk frame
+func UnpackWindow(w uint64) (size, read uint32, wait bool) {
+	return uint32(w >> windowShift & mask31), uint32(w & mask31), w>>waitShift&1 == 1
+}
+
+// EncodeIDs encodes the ids of the NewConnBatch and NewConnOkBatch frames
+func EncodeIDs(ids []int32) []byte {
+	b := make([]byte, 0, len(ids)*4)
+	for _, id := range ids {
+		b = appendUint32(b, uint32(id))
+	}
+	return b
+}
+
+// DecodeIDs decodes the ids of the NewConnBatch and NewConnOkBatch frames
+func DecodeIDs(b []byte) []int32 {
+	ids := make([]int32, 0, len(b)/4)
+	for i := 0; i+4 <= len(b); i += 4 {
+		ids = append(ids, int32(binary.LittleEndian.Uint32(b[i:i+4])))
+	}
+	return ids
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
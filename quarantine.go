@@ -0,0 +1,56 @@
+package npsmux
+
+import "sync/atomic"
+
+// the id of a stream closed here before the peer closed it is quarantined
+// until the muxConnClose of the peer received, the peer sends nothing of the
+// stream after it. the frames of the id in between are late, they are dropped
+// and counted, and getId does not open the id again, so even after the counter
+// wrapped around, they never reach a new stream of the same id
+
+// quarantine keeps the id of the stream closing, unless the peer closed it
+func (s *Mux) quarantine(c *Conn) {
+	s.quarantineLock.Lock()
+	if !c.closing() {
+		if s.quarantined == nil {
+			s.quarantined = make(map[int32]struct{})
+		}
+		s.quarantined[c.connId] = struct{}{}
+	}
+	s.quarantineLock.Unlock()
+}
+
+// isQuarantined reports whether the id waits for the close of the peer
+func (s *Mux) isQuarantined(id int32) bool {
+	s.quarantineLock.Lock()
+	_, ok := s.quarantined[id]
+	s.quarantineLock.Unlock()
+	return ok
+}
+
+// quarantinedIds returns the ids quarantined, for Export
+func (s *Mux) quarantinedIds() (ids []int32) {
+	s.quarantineLock.Lock()
+	for id := range s.quarantined {
+		ids = append(ids, id)
+	}
+	s.quarantineLock.Unlock()
+	return
+}
+
+// lateFrame handles the frame of the stream closed here, c is nil if it is
+// gone, the close of the peer releases the id, the other frames are late
+func (s *Mux) lateFrame(c *Conn, flag uint8, id int32) {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	if flag == muxConnClose || flag == muxConnCloseConfirm {
+		if c != nil {
+			atomic.StoreUint32(&c.closingFlag, 1) // seen by quarantine
+		}
+		delete(s.quarantined, id)
+		return
+	}
+	if _, ok := s.quarantined[id]; ok {
+		atomic.AddUint64(&s.staleFrames, 1)
+	}
+}
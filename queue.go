@@ -1,7 +1,6 @@
-package nps_mux
+package npsmux
 
 import (
-	"errors"
 	"io"
 	"math"
 	"runtime"
@@ -12,21 +11,34 @@ import (
 )
 
 type priorityQueue struct {
-	highestChain *bufChain
-	middleChain  *bufChain
-	lowestChain  *bufChain
-	starving     uint8
-	stop         bool
-	cond         *sync.Cond
-}
-
-func (Self *priorityQueue) New() {
-	Self.highestChain = new(bufChain)
-	Self.highestChain.new(4)
-	Self.middleChain = new(bufChain)
-	Self.middleChain.new(32)
-	Self.lowestChain = new(bufChain)
-	Self.lowestChain.new(256)
+	length   int32 // accessed atomically
+	high     int32 // the high watermark of length, accessed atomically
+	lengths  [numClasses]int32
+	chains   [numClasses]*bufChain
+	served   []int64 // unix nano the class served or got frames, allocated for 64bit alignment
+	maxDelay int64
+	clock    Clock
+	starving uint8
+	stop     uint32 // accessed atomically
+	cond     *sync.Cond
+	sched    Scheduler // replaces the classes if not nil, called under schedMu
+	schedMu  sync.Mutex
+	groups   groupSched // the frames of the stream groups
+}
+
+// initial size of the chain of each priority class
+var priorityChainSize = [numClasses]int{32, 32, 64, 256, 8}
+
+// New initials the queue, a waiting class is served at least
+// once per maxDelay, zero maxDelay disables the aging
+func (Self *priorityQueue) New(clock Clock, maxDelay time.Duration) {
+	Self.clock = clock
+	Self.maxDelay = int64(maxDelay)
+	Self.served = make([]int64, numClasses)
+	for i := range Self.chains {
+		Self.chains[i] = new(bufChain)
+		Self.chains[i].new(priorityChainSize[i])
+	}
 	locker := new(sync.Mutex)
 	Self.cond = sync.NewCond(locker)
 }
@@ -38,19 +50,40 @@ func (Self *priorityQueue) Push(packager *muxPackager) {
 }
 
 func (Self *priorityQueue) push(packager *muxPackager) {
-	switch packager.flag {
-	case muxPingFlag, muxPingReturn:
-		Self.highestChain.pushHead(unsafe.Pointer(packager))
-	// the ping package need highest priority
-	// prevent ping calculation error
-	case muxNewConn, muxNewConnOk, muxNewConnFail:
-		// the New conn package need some priority too
-		Self.middleChain.pushHead(unsafe.Pointer(packager))
-	default:
-		Self.lowestChain.pushHead(unsafe.Pointer(packager))
+	if Self.sched != nil {
+		Self.schedMu.Lock()
+		Self.sched.Push(Frame{packager}, frameMeta(packager, Self.clock.Now()))
+		Self.schedMu.Unlock()
+	} else {
+		p := packager.priority
+		if p >= numClasses {
+			p = PriorityBulk
+		}
+		if g := packager.group(); g != nil {
+			Self.groups.push(g, p, packager)
+		} else {
+			Self.chains[p].pushHead(unsafe.Pointer(packager))
+		}
+		// count it after pushed, the popper never sees a count without the packager
+		if atomic.AddInt32(&Self.lengths[p], 1) == 1 && Self.maxDelay > 0 {
+			atomic.StoreInt64(&Self.served[p], Self.clock.Now().UnixNano())
+			// the class begins to wait
+		}
+	}
+	n := atomic.AddInt32(&Self.length, 1)
+	for {
+		high := atomic.LoadInt32(&Self.high)
+		if n <= high || atomic.CompareAndSwapInt32(&Self.high, high, n) {
+			break
+		}
 	}
 }
 
+// High returns the high watermark of the length
+func (Self *priorityQueue) High() int {
+	return int(atomic.LoadInt32(&Self.high))
+}
+
 const maxStarving uint8 = 8
 
 func (Self *priorityQueue) Pop() (packager *muxPackager) {
@@ -60,7 +93,7 @@ func (Self *priorityQueue) Pop() (packager *muxPackager) {
 		if packager != nil {
 			return
 		}
-		if Self.stop {
+		if atomic.LoadUint32(&Self.stop) == 1 {
 			return
 		}
 		if iter {
@@ -73,7 +106,7 @@ func (Self *priorityQueue) Pop() (packager *muxPackager) {
 	Self.cond.L.Lock()
 	defer Self.cond.L.Unlock()
 	for packager = Self.TryPop(); packager == nil; {
-		if Self.stop {
+		if atomic.LoadUint32(&Self.stop) == 1 {
 			return
 		}
 		Self.cond.Wait()
@@ -84,48 +117,123 @@ func (Self *priorityQueue) Pop() (packager *muxPackager) {
 }
 
 func (Self *priorityQueue) TryPop() (packager *muxPackager) {
-	ptr, ok := Self.highestChain.popTail()
-	if ok {
-		packager = (*muxPackager)(ptr)
+	packager = Self.tryPop()
+	if packager != nil {
+		atomic.AddInt32(&Self.length, -1)
+	}
+	return
+}
+
+// Len returns the count of the packagers waiting in the queue
+func (Self *priorityQueue) Len() int {
+	return int(atomic.LoadInt32(&Self.length))
+}
+
+// tryPop pops the ping class first, then from the highest class, but if the lower classes keep waiting
+// for maxStarving frames, pops one from the lowest class waiting.
+// the class waiting longer than maxDelay is served first, the lowest first
+func (Self *priorityQueue) tryPop() (packager *muxPackager) {
+	if Self.sched != nil {
+		Self.schedMu.Lock()
+		f, _ := Self.sched.Pop()
+		Self.schedMu.Unlock()
+		return f.pack
+	}
+	if atomic.LoadInt32(&Self.lengths[priorityPing]) > 0 {
+		if packager = Self.popClass(priorityPing); packager != nil {
+			return
+		}
+	}
+	high, low := numPriorities, numPriorities
+	for p := Priority(0); p < numPriorities; p++ {
+		if atomic.LoadInt32(&Self.lengths[p]) > 0 {
+			if high == numPriorities {
+				high = p
+			}
+			low = p
+		}
+	}
+	if high == numPriorities {
 		return
 	}
-	if Self.starving < maxStarving {
-		// not pop too much, lowestChain will wait too long
-		ptr, ok = Self.middleChain.popTail()
-		if ok {
-			packager = (*muxPackager)(ptr)
-			Self.starving++
+	if Self.maxDelay > 0 && high != low {
+		if packager = Self.popAged(high); packager != nil {
 			return
 		}
 	}
-	ptr, ok = Self.lowestChain.popTail()
-	if ok {
-		packager = (*muxPackager)(ptr)
-		if Self.starving > 0 {
+	p := high
+	if high != low {
+		if Self.starving < maxStarving {
+			Self.starving++
+		} else {
+			p = low
 			Self.starving = Self.starving / 2
 		}
+	} else if Self.starving > 0 {
+		Self.starving = Self.starving / 2
+	}
+	if packager = Self.popClass(p); packager != nil {
 		return
 	}
-	if Self.starving > 0 {
-		ptr, ok = Self.middleChain.popTail()
-		if ok {
-			packager = (*muxPackager)(ptr)
-			Self.starving++
+	for p = 0; p < numPriorities; p++ {
+		if packager = Self.popClass(p); packager != nil {
 			return
 		}
 	}
 	return
 }
 
+// popAged pops from the lowest class waiting longer than maxDelay,
+// the high class is served anyway, not checked
+func (Self *priorityQueue) popAged(high Priority) (packager *muxPackager) {
+	now := Self.clock.Now().UnixNano()
+	for p := numPriorities - 1; p > high; p-- {
+		if atomic.LoadInt32(&Self.lengths[p]) > 0 && now-atomic.LoadInt64(&Self.served[p]) > Self.maxDelay {
+			if packager = Self.popClass(p); packager != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (Self *priorityQueue) popClass(p Priority) (packager *muxPackager) {
+	if n := atomic.LoadInt32(&Self.groups.lengths[p]); n > 0 {
+		packager = Self.groups.pop(p, Self.chains[p], atomic.LoadInt32(&Self.lengths[p])-n)
+	} else if ptr, ok := Self.chains[p].popTail(); ok {
+		packager = (*muxPackager)(ptr)
+	}
+	if packager == nil {
+		return
+	}
+	atomic.AddInt32(&Self.lengths[p], -1)
+	if Self.maxDelay > 0 {
+		atomic.StoreInt64(&Self.served[p], Self.clock.Now().UnixNano())
+	}
+	return
+}
+
+// Stop wakes up the poppers, the flag is set under the lock,
+// a popper checked it just before waiting is not missed
 func (Self *priorityQueue) Stop() {
-	Self.stop = true
+	Self.cond.L.Lock()
+	atomic.StoreUint32(&Self.stop, 1)
 	Self.cond.Broadcast()
+	Self.cond.L.Unlock()
+}
+
+// Resume makes the queue stopped usable again
+func (Self *priorityQueue) Resume() {
+	Self.cond.L.Lock()
+	atomic.StoreUint32(&Self.stop, 0)
+	Self.cond.L.Unlock()
 }
 
 type connQueue struct {
+	length   int32 // accessed atomically
 	chain    *bufChain
 	starving uint8
-	stop     bool
+	stop     uint32 // accessed atomically
 	cond     *sync.Cond
 }
 
@@ -136,20 +244,21 @@ func (Self *connQueue) New() {
 	Self.cond = sync.NewCond(locker)
 }
 
-func (Self *connQueue) Push(connection *conn) {
+func (Self *connQueue) Push(connection *Conn) {
+	atomic.AddInt32(&Self.length, 1)
 	Self.chain.pushHead(unsafe.Pointer(connection))
 	Self.cond.Broadcast()
 	return
 }
 
-func (Self *connQueue) Pop() (connection *conn) {
+func (Self *connQueue) Pop() (connection *Conn) {
 	var iter bool
 	for {
 		connection = Self.TryPop()
 		if connection != nil {
 			return
 		}
-		if Self.stop {
+		if atomic.LoadUint32(&Self.stop) == 1 {
 			return
 		}
 		if iter {
@@ -162,7 +271,7 @@ func (Self *connQueue) Pop() (connection *conn) {
 	Self.cond.L.Lock()
 	defer Self.cond.L.Unlock()
 	for connection = Self.TryPop(); connection == nil; {
-		if Self.stop {
+		if atomic.LoadUint32(&Self.stop) == 1 {
 			return
 		}
 		Self.cond.Wait()
@@ -172,47 +281,104 @@ func (Self *connQueue) Pop() (connection *conn) {
 	return
 }
 
-func (Self *connQueue) TryPop() (connection *conn) {
+func (Self *connQueue) TryPop() (connection *Conn) {
 	ptr, ok := Self.chain.popTail()
 	if ok {
-		connection = (*conn)(ptr)
+		connection = (*Conn)(ptr)
+		atomic.AddInt32(&Self.length, -1)
 		return
 	}
 	return
 }
 
+// Len returns the count of the connections waiting in the queue
+func (Self *connQueue) Len() int {
+	return int(atomic.LoadInt32(&Self.length))
+}
+
 func (Self *connQueue) Stop() {
-	Self.stop = true
+	Self.cond.L.Lock()
+	atomic.StoreUint32(&Self.stop, 1)
 	Self.cond.Broadcast()
+	Self.cond.L.Unlock()
 }
 
-type listElement struct {
-	Buf  []byte
-	L    uint16
-	Part bool
+// minRingSize is the initial size of the ring buffer of the receive window,
+// it grows with the data buffered, up to the window size
+const minRingSize = maximumSegmentSize * 4
+
+// byteRing is a ring buffer of bytes, it grows when full, not safe for concurrent use
+type byteRing struct {
+	buf []byte
+	r   int // the read offset
+	n   int // the bytes buffered
 }
 
-func (Self *listElement) Reset() {
-	Self.L = 0
-	Self.Buf = nil
-	Self.Part = false
+// write appends p, the buffer grows to the power of 2 times minRingSize if not enough.
+// it is bounded by the receive window, which refuses the data beyond the largest
+// window told, so the peer can not grow it at will
+func (Self *byteRing) write(p []byte) {
+	if Self.n+len(p) > len(Self.buf) {
+		size := len(Self.buf)
+		if size < minRingSize {
+			size = minRingSize
+		}
+		for size < Self.n+len(p) {
+			size *= 2
+		}
+		buf := make([]byte, size)
+		n := Self.n
+		Self.read(buf[:n])
+		Self.buf, Self.r, Self.n = buf, 0, n
+	}
+	w := (Self.r + Self.n) % len(Self.buf)
+	l := copy(Self.buf[w:], p)
+	copy(Self.buf, p[l:])
+	Self.n += len(p)
 }
 
-func newListElement(buf []byte, l uint16, part bool) (element *listElement, err error) {
-	if uint16(len(buf)) != l {
-		err = errors.New("listElement: buf length not match")
-		return
+// read takes the bytes buffered into p, returns the count
+func (Self *byteRing) read(p []byte) (n int) {
+	if Self.n == 0 {
+		return 0
+	}
+	if len(p) > Self.n {
+		p = p[:Self.n]
+	}
+	n = copy(p, Self.buf[Self.r:])
+	n += copy(p[n:], Self.buf[:Self.r])
+	Self.r = (Self.r + n) % len(Self.buf)
+	Self.n -= n
+	if Self.n == 0 {
+		Self.r = 0
 	}
-	element = listEle.Get()
-	element.Buf = buf
-	element.L = l
-	element.Part = part
 	return
 }
 
+// peek copies the bytes buffered, they are not taken
+func (Self *byteRing) peek() []byte {
+	if Self.n == 0 {
+		return nil
+	}
+	p := make([]byte, Self.n)
+	n := copy(p, Self.buf[Self.r:])
+	copy(p[n:], Self.buf[:Self.r])
+	return p
+}
+
+// reset drops the bytes buffered, and frees the buffer
+func (Self *byteRing) reset() (n int) {
+	n = Self.n
+	Self.buf, Self.r, Self.n = nil, 0, 0
+	return
+}
+
+// receiveWindowQueue buffers the data received by the stream in a ring buffer,
+// the read session writes it, and the reader of the stream reads it
 type receiveWindowQueue struct {
-	lengthWait uint64
-	chain      *bufChain
+	lengthWait uint64 // the bytes buffered and the reader waiting, accessed atomically
+	ring       byteRing
+	ringLock   sync.Mutex
 	stopOp     chan struct{}
 	readOp     chan struct{}
 	// https://golang.org/pkg/sync/atomic/#pkg-note-BUG
@@ -223,43 +389,60 @@ type receiveWindowQueue struct {
 
 	// if there are implicit struct, careful the first word
 	timeout time.Time
+	clock   Clock
 }
 
-func newReceiveWindowQueue() *receiveWindowQueue {
+func newReceiveWindowQueue(clock Clock) *receiveWindowQueue {
 	queue := receiveWindowQueue{
-		chain:  new(bufChain),
+		clock:  clock,
 		stopOp: make(chan struct{}, 2),
 		readOp: make(chan struct{}),
 	}
-	queue.chain.new(64)
 	return &queue
 }
 
-func (Self *receiveWindowQueue) Push(element *listElement) {
+func unpackLengthWait(ptrs uint64) (length, wait uint32) {
+	const mask = 1<<dequeueBits - 1
+	length = uint32((ptrs >> dequeueBits) & mask)
+	wait = uint32(ptrs & mask)
+	return
+}
+
+func packLengthWait(length, wait uint32) uint64 {
+	const mask = 1<<dequeueBits - 1
+	return (uint64(length) << dequeueBits) | uint64(wait&mask)
+}
+
+// Push copies p into the ring buffer, and wakes up the reader waiting
+func (Self *receiveWindowQueue) Push(p []byte) {
+	Self.ringLock.Lock()
+	Self.ring.write(p)
+	Self.ringLock.Unlock()
+	// count it after written, the reader never sees a length without the data
 	var length, wait uint32
 	for {
 		ptrs := atomic.LoadUint64(&Self.lengthWait)
-		length, wait = Self.chain.head.unpack(ptrs)
-		length += uint32(element.L)
-		if atomic.CompareAndSwapUint64(&Self.lengthWait, ptrs, Self.chain.head.pack(length, 0)) {
+		length, wait = unpackLengthWait(ptrs)
+		length += uint32(len(p))
+		if atomic.CompareAndSwapUint64(&Self.lengthWait, ptrs, packLengthWait(length, 0)) {
 			break
 		}
 		// another goroutine change the length or into wait, make sure
 	}
-	Self.chain.pushHead(unsafe.Pointer(element))
 	if wait == 1 {
 		Self.allowPop()
 	}
 	return
 }
 
-func (Self *receiveWindowQueue) Pop() (element *listElement, err error) {
+// Read takes the bytes buffered into p, waits until some data pushed if empty
+func (Self *receiveWindowQueue) Read(p []byte) (n int, err error) {
 	var length uint32
 startPop:
 	ptrs := atomic.LoadUint64(&Self.lengthWait)
-	length, _ = Self.chain.head.unpack(ptrs)
+	length, _ = unpackLengthWait(ptrs)
 	if length == 0 {
-		if !atomic.CompareAndSwapUint64(&Self.lengthWait, ptrs, Self.chain.head.pack(0, 1)) {
+		if !atomic.CompareAndSwapUint64(&Self.lengthWait, ptrs, packLengthWait(0, 1)) {
 			goto startPop // another goroutine is pushing
 		}
 		err = Self.waitPush()
@@ -269,24 +452,26 @@ startPop:
 		}
 		goto startPop // wait finish, trying to Get the New status
 	}
-	// length is not zero, so try to pop
-	for {
-		element = Self.TryPop()
-		if element != nil {
-			return
-		}
-		runtime.Gosched() // another goroutine is still pushing
-	}
+	Self.ringLock.Lock()
+	n = Self.ring.read(p)
+	Self.ringLock.Unlock()
+	atomic.AddUint64(&Self.lengthWait, ^(uint64(n)<<dequeueBits - 1))
+	return
 }
 
-func (Self *receiveWindowQueue) TryPop() (element *listElement) {
-	ptr, ok := Self.chain.popTail()
-	if ok {
-		element = (*listElement)(ptr)
-		atomic.AddUint64(&Self.lengthWait, ^(uint64(element.L)<<dequeueBits - 1))
-		return
-	}
-	return nil
+// bytes returns a copy of the bytes buffered, for Export
+func (Self *receiveWindowQueue) bytes() []byte {
+	Self.ringLock.Lock()
+	defer Self.ringLock.Unlock()
+	return Self.ring.peek()
+}
+
+// Reset drops all the bytes buffered
+func (Self *receiveWindowQueue) Reset() {
+	Self.ringLock.Lock()
+	n := Self.ring.reset()
+	Self.ringLock.Unlock()
+	atomic.AddUint64(&Self.lengthWait, ^(uint64(n)<<dequeueBits - 1))
 }
 
 func (Self *receiveWindowQueue) allowPop() (closed bool) {
@@ -299,7 +484,7 @@ func (Self *receiveWindowQueue) allowPop() (closed bool) {
 }
 
 func (Self *receiveWindowQueue) waitPush() (err error) {
-	t := Self.timeout.Sub(time.Now())
+	t := Self.timeout.Sub(Self.clock.Now())
 	if t <= 0 {
 		// not Set the timeout, so wait for it without timeout, just like a tcp connection
 		select {
@@ -310,7 +495,7 @@ func (Self *receiveWindowQueue) waitPush() (err error) {
 			return
 		}
 	}
-	timer := time.NewTimer(t)
+	timer := Self.clock.NewTimer(t)
 	defer timer.Stop()
 	select {
 	case <-Self.readOp:
@@ -318,16 +503,14 @@ func (Self *receiveWindowQueue) waitPush() (err error) {
 	case <-Self.stopOp:
 		err = io.EOF
 		return
-	case <-timer.C:
-		err = errors.New("mux.queue: read time out")
+	case <-timer.C():
+		err = ErrTimeout
 		return
 	}
 }
 
 func (Self *receiveWindowQueue) Len() (n uint32) {
-	ptrs := atomic.LoadUint64(&Self.lengthWait)
-	n, _ = Self.chain.head.unpack(ptrs)
-	// just for unpack method use
+	n, _ = unpackLengthWait(atomic.LoadUint64(&Self.lengthWait))
 	return
 }
 
@@ -420,8 +603,8 @@ func (d *bufDequeue) pushHead(val unsafe.Pointer) bool {
 			atomic.StoreUint32(&d.starving, 1)
 		}
 	}
-	// The head slot is free, so we own it.
-	*slot = val
+	// The head slot is free, so we own it, popTail loads it atomically
+	atomic.StorePointer(slot, val)
 	return true
 }
 
@@ -0,0 +1,57 @@
+package npsmux
+
+import "sync/atomic"
+
+// SetQuota limits the payload bytes of all the streams, both read and written,
+// once used up, Read and Write return ErrQuotaExceeded, and the mux is closed.
+// zero means no limit
+func (s *Mux) SetQuota(bytes int64) {
+	atomic.StoreInt64(&s.quota, bytes)
+}
+
+// SetQuota limits the payload bytes of the stream, both read and written,
+// once used up, Read and Write return ErrQuotaExceeded, and the stream is closed.
+// zero means no limit
+func (s *Conn) SetQuota(bytes int64) {
+	atomic.StoreInt64(&s.quota, bytes)
+}
+
+func quotaUsedUp(quota *int64, traffic *trafficCounter) bool {
+	q := atomic.LoadInt64(quota)
+	if q <= 0 {
+		return false
+	}
+	t := traffic.get()
+	return t.BytesIn+t.BytesOut >= uint64(q)
+}
+
+// checkQuota returns ErrQuotaExceeded if the quota of the stream or the mux used up,
+// the write may exceed the quota by one buffer, it is checked before write
+func (s *Conn) checkQuota() error {
+	mux := s.receiveWindow.mux
+	if atomic.LoadUint32(&mux.quotaHit) != 0 || atomic.LoadUint32(&s.quotaHit) != 0 {
+		return ErrQuotaExceeded
+	}
+	if quotaUsedUp(&mux.quota, &mux.goodput) {
+		if atomic.CompareAndSwapUint32(&mux.quotaHit, 0, 1) {
+			mux.logln(LogInfo, "quota exceeded")
+			if mux.config.OnQuotaExceeded != nil {
+				mux.config.OnQuotaExceeded(mux, nil)
+			}
+			_ = mux.Close()
+		}
+		return ErrQuotaExceeded
+	}
+	if quotaUsedUp(&s.quota, &s.traffic) {
+		if atomic.CompareAndSwapUint32(&s.quotaHit, 0, 1) {
+			mux.logln(LogInfo, "stream quota exceeded, conn id:", s.connId)
+			s.traceEvent(EventQuotaExceeded)
+			if mux.config.OnQuotaExceeded != nil {
+				mux.config.OnQuotaExceeded(mux, s)
+			}
+			_ = s.Close()
+		}
+		return ErrQuotaExceeded
+	}
+	return s.checkTenantQuota()
+}
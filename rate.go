@@ -1,6 +1,7 @@
-package nps_mux
+package npsmux
 
 import (
+	"errors"
 	"net"
 	"sync/atomic"
 	"time"
@@ -81,52 +82,61 @@ func (s *Rate) session() {
 	}
 }
 
-type Conn struct {
+type RateConn struct {
 	conn net.Conn
 	rate *Rate
 }
 
-func NewRateConn(rate *Rate, conn net.Conn) *Conn {
-	return &Conn{
+func NewRateConn(rate *Rate, conn net.Conn) *RateConn {
+	return &RateConn{
 		conn: conn,
 		rate: rate,
 	}
 }
 
-func (conn *Conn) Read(b []byte) (n int, err error) {
+func (conn *RateConn) Read(b []byte) (n int, err error) {
 	defer func() {
 		conn.rate.Get(int64(n))
 	}()
 	return conn.conn.Read(b)
 }
 
-func (conn *Conn) Write(b []byte) (n int, err error) {
+func (conn *RateConn) Write(b []byte) (n int, err error) {
 	defer func() {
 		conn.rate.Get(int64(n))
 	}()
 	return conn.conn.Write(b)
 }
 
-func (conn *Conn) LocalAddr() net.Addr {
+func (conn *RateConn) LocalAddr() net.Addr {
 	return conn.conn.LocalAddr()
 }
 
-func (conn *Conn) RemoteAddr() net.Addr {
+func (conn *RateConn) RemoteAddr() net.Addr {
 	return conn.conn.RemoteAddr()
 }
 
-func (conn *Conn) SetDeadline(t time.Time) error {
+func (conn *RateConn) SetDeadline(t time.Time) error {
 	return conn.conn.SetDeadline(t)
 }
 
-func (conn *Conn) SetWriteDeadline(t time.Time) error {
+func (conn *RateConn) SetWriteDeadline(t time.Time) error {
 	return conn.conn.SetWriteDeadline(t)
 }
 
-func (conn *Conn) SetReadDeadline(t time.Time) error {
+func (conn *RateConn) SetReadDeadline(t time.Time) error {
 	return conn.conn.SetReadDeadline(t)
 }
 
-func (conn *Conn) Close() error {
+func (conn *RateConn) Close() error {
 	return conn.conn.Close()
 }
+
+// CloseWrite closes the write side of the conn if it supports, as tcp, so the
+// half close goes through the limit
+func (conn *RateConn) CloseWrite() error {
+	if cw, ok := conn.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("mux: the conn does not support CloseWrite")
+}
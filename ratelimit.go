@@ -0,0 +1,69 @@
+package npsmux
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of the events, the tokens are refilled
+// lazily when taken, no goroutine needed
+type tokenBucket struct {
+	tokens float64
+	burst  float64
+	rate   float64 // tokens per second
+	last   time.Time
+	clock  Clock
+	sync.Mutex
+}
+
+func newTokenBucket(clock Clock, rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		tokens: float64(burst),
+		burst:  float64(burst),
+		rate:   rate,
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// allow takes one token, returns false if the bucket is empty
+func (Self *tokenBucket) allow() bool {
+	Self.Lock()
+	defer Self.Unlock()
+	now := Self.clock.Now()
+	Self.tokens += now.Sub(Self.last).Seconds() * Self.rate
+	Self.last = now
+	if Self.tokens > Self.burst {
+		Self.tokens = Self.burst
+	}
+	if Self.tokens < 1 {
+		return false
+	}
+	Self.tokens--
+	return true
+}
+
+// take takes n tokens at the rate, the tokens may go negative,
+// returns the time to wait until the debt paid off
+func (Self *tokenBucket) take(n float64, rate float64) time.Duration {
+	Self.Lock()
+	defer Self.Unlock()
+	now := Self.clock.Now()
+	Self.tokens += now.Sub(Self.last).Seconds() * Self.rate
+	Self.last = now
+	Self.rate = rate
+	if Self.tokens > Self.burst {
+		Self.tokens = Self.burst
+	}
+	Self.tokens -= n
+	if Self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-Self.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,93 @@
+package npsmux
+
+import (
+	"errors"
+	"io"
+)
+
+// stagingSize is the size of the buffer the transport read into
+const stagingSize = 64 * 1024
+
+// frameReader is the reader the frames parsed from in place, Peek returns
+// the next n bytes without copying, they are valid until the next call,
+// Discard skips them
+type frameReader interface {
+	io.Reader
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+// stagingReader reads the transport into a large buffer, the frames in it
+// are parsed without more syscalls, instead of several small reads per frame
+type stagingReader struct {
+	r    io.Reader
+	buf  []byte
+	head int
+	tail int
+}
+
+func newStagingReader(r io.Reader) *stagingReader {
+	return &stagingReader{r: r, buf: make([]byte, stagingSize)}
+}
+
+func (Self *stagingReader) Read(p []byte) (n int, err error) {
+	if Self.head == Self.tail {
+		if len(p) >= len(Self.buf) {
+			// large enough, read into p directly
+			return Self.r.Read(p)
+		}
+		Self.head, Self.tail = 0, 0
+		n, err = Self.r.Read(Self.buf)
+		if n == 0 {
+			return
+		}
+		Self.tail = n
+		err = nil
+		// the error comes again with the next read
+	}
+	n = copy(p, Self.buf[Self.head:Self.tail])
+	Self.head += n
+	return
+}
+
+// buffered returns the bytes read from the transport, but not parsed yet
+func (Self *stagingReader) buffered() []byte {
+	return Self.buf[Self.head:Self.tail]
+}
+
+// Peek returns the next n bytes, reads the transport until enough
+func (Self *stagingReader) Peek(n int) (b []byte, err error) {
+	if n > len(Self.buf) {
+		return nil, errors.New("mux: peek larger than the staging buffer")
+	}
+	for Self.tail-Self.head < n {
+		if Self.head+n > len(Self.buf) {
+			// no room left at the tail, move the bytes to the head
+			copy(Self.buf, Self.buf[Self.head:Self.tail])
+			Self.tail -= Self.head
+			Self.head = 0
+		}
+		var m int
+		m, err = Self.r.Read(Self.buf[Self.tail:])
+		Self.tail += m
+		if err != nil {
+			if Self.tail-Self.head >= n {
+				break
+			}
+			if err == io.EOF && Self.tail > Self.head {
+				err = io.ErrUnexpectedEOF
+			}
+			return Self.buf[Self.head:Self.tail], err
+		}
+	}
+	return Self.buf[Self.head : Self.head+n], nil
+}
+
+// Discard skips the next n bytes buffered
+func (Self *stagingReader) Discard(n int) (int, error) {
+	if m := Self.tail - Self.head; n > m {
+		n = m
+	}
+	Self.head += n
+	return n, nil
+}
@@ -0,0 +1,105 @@
+package npsmux
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// defaultRecordSize is the payload of a tls record, 16KB minus the room
+// for the overhead of the layers under the tls
+const defaultRecordSize = 16*1024 - 256
+
+// TransportHints tells the mux more about the transport
+type TransportHints struct {
+	// TLS aligns the frames to the tls records, the frames are gathered
+	// and written as one record, none of them crosses two records, instead
+	// of a small record for every header and every content. the *tls.Conn
+	// is detected, set it if the tls conn is wrapped
+	TLS bool
+
+	// RecordSize is the payload of a record, zero means 16KB minus the overhead
+	RecordSize int
+
+	// Encrypted tells the transport is encrypted by other than tls, as a channel
+	// of ssh or a wireguard tunnel, for MuxConfig.RequireEncryption
+	Encrypted bool
+}
+
+// encrypted reports whether the transport is known encrypted, the tls conn
+// wrapped is detected by its ConnectionState
+func (s *MuxConfig) encrypted(c net.Conn) bool {
+	if s.Hints != nil && (s.Hints.TLS || s.Hints.Encrypted) {
+		return true
+	}
+	switch c.(type) {
+	case *tls.Conn, interface{ ConnectionState() tls.ConnectionState }:
+		return true
+	}
+	return false
+}
+
+// check returns the error if the config refuses the transport c
+func (s *MuxConfig) check(c net.Conn) error {
+	if s.RequireEncryption && !s.encrypted(c) {
+		return ErrPlaintext
+	}
+	return nil
+}
+
+func (s *MuxConfig) recordSize(c net.Conn) int {
+	if s.ARQ != nil {
+		// a segment per record
+		return s.ARQ.payload()
+	}
+	if s.Hints == nil {
+		return 0
+	}
+	if _, ok := c.(*tls.Conn); !ok && !s.Hints.TLS {
+		return 0
+	}
+	if s.Hints.RecordSize > 0 {
+		return s.Hints.RecordSize
+	}
+	return defaultRecordSize
+}
+
+// recordWriter gathers the frames, and writes them in one write when the
+// next frame does not fit, or flushed
+type recordWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newRecordWriter(w io.Writer, size int) *recordWriter {
+	return &recordWriter{w: w, buf: make([]byte, 0, size)}
+}
+
+func (Self *recordWriter) Write(p []byte) (n int, err error) {
+	if len(Self.buf)+len(p) > cap(Self.buf) {
+		if err = Self.Flush(); err != nil {
+			return
+		}
+		if len(p) > cap(Self.buf) {
+			return Self.w.Write(p)
+		}
+	}
+	Self.buf = append(Self.buf, p...)
+	return len(p), nil
+}
+
+// begin is invoked before a frame packed, it flushes if the frame may not fit
+func (Self *recordWriter) begin(size int) error {
+	if len(Self.buf)+size > cap(Self.buf) {
+		return Self.Flush()
+	}
+	return nil
+}
+
+func (Self *recordWriter) Flush() (err error) {
+	if len(Self.buf) > 0 {
+		_, err = Self.w.Write(Self.buf)
+		Self.buf = Self.buf[:0]
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package npsmux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+const relayBufferSize = 32 * 1024
+
+var relayBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufferSize)
+		return &b
+	},
+}
+
+// RelayStats is the bytes copied by Relay in each direction
+type RelayStats struct {
+	AToB int64
+	BToA int64
+}
+
+// Relay copies between a and b in both directions, as the streams of the muxes
+// or a stream and a net.Conn, until both directions end, or ctx done. once a
+// direction reaches the eof, the write side of its destination is closed if it
+// supports CloseWrite, as tcp and the streams of the peers with the half close,
+// and the other direction goes on, otherwise both are closed. a and b are
+// closed when it returns. the copy uses the ReaderFrom and WriterTo of the
+// conns, as the splice between the tcp conns. err is the first error other
+// than the eof and the close
+func Relay(ctx context.Context, a, b net.Conn) (stats RelayStats, err error) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = a.Close()
+			_ = b.Close()
+		})
+	}
+	defer closeBoth()
+	errs := make(chan error, 2)
+	relay := func(dst, src net.Conn, n *int64) {
+		buf := relayBuffers.Get().(*[]byte)
+		var e error
+		*n, e = io.CopyBuffer(dst, src, *buf)
+		relayBuffers.Put(buf)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && e == nil && cw.CloseWrite() == nil {
+			// half closed, the other direction goes on
+		} else {
+			closeBoth()
+		}
+		errs <- e
+	}
+	go relay(b, a, &stats.AToB)
+	go relay(a, b, &stats.BToA)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-errs:
+			if err == nil && !relayClosed(e) {
+				err = e
+			}
+		case <-ctx.Done():
+			closeBoth()
+			<-errs
+			if i == 0 {
+				<-errs
+			}
+			return stats, ctx.Err()
+		}
+	}
+	return
+}
+
+// relayClosed reports whether err is the end of the relay, not a failure
+func relayClosed(err error) bool {
+	return err == nil || err == io.EOF || err == io.ErrClosedPipe ||
+		errors.Is(err, ErrStreamClosed) || errors.Is(err, ErrMuxClosed) ||
+		strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,102 @@
+package npsmux
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// the mux has no auth handshake of its own, the application authenticates the
+// peer and passes the resumption token in its handshake. the token restores the
+// identity and the quota left, on the reconnect of a flapping link, without
+// running the full auth again
+
+const (
+	resumptionVersion = 1
+	resumptionHeader  = 1 + 8 + 8 + 2 // version, expires, quota left, identity length
+)
+
+var (
+	// ErrResumption is returned by Resume if the token is malformed or forged
+	ErrResumption = errors.New("mux: invalid resumption token")
+	// ErrResumptionExpired is returned by Resume if the token is too old
+	ErrResumptionExpired = errors.New("mux: resumption token expired")
+)
+
+// ResumptionIssuer issues the resumption tokens signed by Key, and resumes them,
+// the servers sharing the key resume the tokens issued by each other.
+// a token is valid for TTL, anyone holding it can resume in the time
+type ResumptionIssuer struct {
+	Key   []byte
+	TTL   time.Duration // zero means 10 minutes
+	Clock Clock         // nil means the system time
+}
+
+func (s *ResumptionIssuer) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return time.Minute * 10
+}
+
+func (s *ResumptionIssuer) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Issue returns a token of the identity authenticated on the mux, with the quota
+// left of the mux, it returns ErrQuotaExceeded if the quota used up
+func (s *ResumptionIssuer) Issue(identity string, m *Mux) (string, error) {
+	if len(identity) > 0xffff {
+		return "", errors.New("mux: identity too long")
+	}
+	left := atomic.LoadInt64(&m.quota)
+	if left > 0 {
+		t := m.goodput.get()
+		left -= int64(t.BytesIn + t.BytesOut)
+		if left <= 0 {
+			return "", ErrQuotaExceeded
+		}
+	}
+	b := make([]byte, resumptionHeader, resumptionHeader+len(identity)+sha256.Size)
+	b[0] = resumptionVersion
+	binary.BigEndian.PutUint64(b[1:9], uint64(s.now().Add(s.ttl()).UnixNano()))
+	binary.BigEndian.PutUint64(b[9:17], uint64(left))
+	binary.BigEndian.PutUint16(b[17:19], uint16(len(identity)))
+	b = append(b, identity...)
+	b = append(b, s.sign(b)...)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Resume checks the token, and sets the quota left to the mux of the reconnect,
+// returns the identity in the token
+func (s *ResumptionIssuer) Resume(token string, m *Mux) (identity string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < resumptionHeader+sha256.Size || b[0] != resumptionVersion {
+		return "", ErrResumption
+	}
+	body, sum := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(sum, s.sign(body)) {
+		return "", ErrResumption
+	}
+	if int(binary.BigEndian.Uint16(body[17:19])) != len(body)-resumptionHeader {
+		return "", ErrResumption
+	}
+	if s.now().UnixNano() > int64(binary.BigEndian.Uint64(body[1:9])) {
+		return "", ErrResumptionExpired
+	}
+	m.SetQuota(int64(binary.BigEndian.Uint64(body[9:17])))
+	return string(body[resumptionHeader:]), nil
+}
+
+func (s *ResumptionIssuer) sign(b []byte) []byte {
+	h := hmac.New(sha256.New, s.Key)
+	_, _ = h.Write(b)
+	return h.Sum(nil)
+}
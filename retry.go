@@ -0,0 +1,77 @@
+package npsmux
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy is the backoff of NewConnRetry
+type RetryPolicy struct {
+	// MaxAttempts is the count of NewConn tried, zero means until ctx done
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failure, zero means 100ms
+	InitialBackoff time.Duration
+	// MaxBackoff limits the wait, zero means 10s
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every failure, zero means 2
+	Multiplier float64
+}
+
+// DefaultRetryPolicy tries 5 times, waits 100ms, 200ms, 400ms and 800ms between
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5}
+
+func (s *RetryPolicy) backoff(d time.Duration) time.Duration {
+	if d == 0 {
+		if s.InitialBackoff > 0 {
+			return s.InitialBackoff
+		}
+		return time.Millisecond * 100
+	}
+	multiplier := s.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	d = time.Duration(float64(d) * multiplier)
+	max := s.MaxBackoff
+	if max <= 0 {
+		max = time.Second * 10
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// NewConnRetry is NewConn, but retries with backoff if the peer refused the stream or
+// not replied, until the policy gives up or the ctx done. it never retries on a closed
+// or going away mux
+func (s *Mux) NewConnRetry(ctx context.Context, policy RetryPolicy) (conn *Conn, err error) {
+	var backoff time.Duration
+	for attempt := 1; ; attempt++ {
+		if conn, err = s.openConn(ctx.Done(), nil); err == nil {
+			return
+		}
+		if s.Closed() || atomic.LoadUint32(&s.goAway) != 0 {
+			return
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return
+		}
+		backoff = policy.backoff(backoff)
+		wait := backoff
+		if hint := RetryAfter(err); hint > wait {
+			wait = hint // the peer knows its overload better
+		}
+		timer := s.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-s.closeChan:
+			timer.Stop()
+			return nil, ErrMuxClosed
+		}
+	}
+}
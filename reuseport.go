@@ -0,0 +1,70 @@
+package npsmux
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// ListenReusePort opens n listeners on the same address with SO_REUSEPORT,
+// the system distributes the incoming connections across them.
+// n <= 0 means the count of cpus
+func ListenReusePort(network, address string, n int) (listeners []net.Listener, err error) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+		cErr := c.Control(func(fd uintptr) {
+			err = setReusePort(fd)
+		})
+		if cErr != nil {
+			return cErr
+		}
+		return
+	}}
+	for i := 0; i < n; i++ {
+		var l net.Listener
+		l, err = lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		if i == 0 {
+			// the port may be chosen by the system, listen the same one
+			address = l.Addr().String()
+		}
+	}
+	return
+}
+
+// ServeReusePort runs one accept loop per listener, every transport accepted is
+// wrapped by a mux with the config, and passed to the handler in a new goroutine.
+// it returns after all the listeners closed, with the first error
+func ServeReusePort(listeners []net.Listener, connType string, config *MuxConfig, handler func(*Mux)) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Temporary() {
+						continue
+					}
+					errCh <- err
+					return
+				}
+				go handler(NewMuxWithConfig(c, connType, config))
+			}
+		}(l)
+	}
+	wg.Wait()
+	return <-errCh
+}
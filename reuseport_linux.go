@@ -0,0 +1,12 @@
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package npsmux
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, not defined in the syscall package on linux
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
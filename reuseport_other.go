@@ -0,0 +1,9 @@
+// +build !linux mips mipsle mips64 mips64le
+
+package npsmux
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("mux: SO_REUSEPORT is not supported on this platform")
+}
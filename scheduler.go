@@ -0,0 +1,71 @@
+package npsmux
+
+import (
+	"time"
+)
+
+// Frame is a frame waiting in the write queue, it is opaque to the schedulers,
+// a scheduler only keeps it and gives it back by Pop
+type Frame struct {
+	pack *muxPackager
+}
+
+// FrameMeta describes the frame pushed into the scheduler
+type FrameMeta struct {
+	// Stream is the id of the stream, zero for the frames of the mux
+	Stream int32
+	// Data reports whether it is a data frame, the others are the control frames
+	Data bool
+	// Priority is the class of the frame, the ping frames are PriorityControl
+	Priority Priority
+	// Size is the length of the content, the header not included
+	Size int
+	// Queued is when the frame pushed
+	Queued time.Time
+}
+
+// Scheduler decides the order the frames are written, as the strict priority,
+// the weighted fair queuing or by the deadlines. the calls are serialized by
+// the mux, Pop must not block, it returns false if nothing to write
+type Scheduler interface {
+	Push(f Frame, meta FrameMeta)
+	Pop() (f Frame, ok bool)
+}
+
+// defaultScheduler is the built-in classes of the write queue as a Scheduler
+type defaultScheduler struct {
+	q priorityQueue
+}
+
+// NewDefaultScheduler returns the scheduler the mux uses by default, the frames
+// are written by the priority classes, a waiting class is served at least once
+// per maxDelay. it is for the schedulers wrapping the default one
+func NewDefaultScheduler(maxDelay time.Duration) Scheduler {
+	s := new(defaultScheduler)
+	s.q.New(systemClock{}, maxDelay)
+	return s
+}
+
+func (s *defaultScheduler) Push(f Frame, meta FrameMeta) {
+	s.q.push(f.pack)
+}
+
+func (s *defaultScheduler) Pop() (f Frame, ok bool) {
+	f.pack = s.q.TryPop()
+	return f, f.pack != nil
+}
+
+// frameMeta returns the meta of the packager for the scheduler
+func frameMeta(pack *muxPackager, now time.Time) FrameMeta {
+	p := pack.priority
+	if p >= numPriorities {
+		p = PriorityControl
+	}
+	return FrameMeta{
+		Stream:   pack.id,
+		Data:     isData(pack.flag),
+		Priority: p,
+		Size:     int(pack.length),
+		Queued:   now,
+	}
+}
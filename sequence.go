@@ -0,0 +1,99 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// the data frames of a stream may arrive out of order, as the frames moved to
+// another class by SetPriority or into a group, or sent over the links of a
+// bonding. if Sequenced configured and the peer announced featureSequence, the
+// data is sent by muxMsgSeq, the content begins with the offset(8) of the data
+// in the stream. the receiver holds the frames arriving early and delivers them
+// in order, the frames received twice are dropped. the offsets count the plain
+// data frames too, so a stream may begin with them
+const seqHeaderSize = 8
+
+func (s *Mux) sequenced() bool {
+	return s.config.Sequenced && atomic.LoadUint32(&s.peerFeatures)&featureSequence != 0
+}
+
+// seqFrame returns the content of the muxMsgSeq frame of the data at the offset,
+// the buffer is reused by the next frame
+func (Self *sendWindow) seqFrame(p []byte) []byte {
+	if Self.seqBuf == nil {
+		Self.seqBuf = make([]byte, maximumSegmentSize)
+	}
+	binary.LittleEndian.PutUint64(Self.seqBuf, atomic.LoadUint64(&Self.seqOffset))
+	return Self.seqBuf[:seqHeaderSize+copy(Self.seqBuf[seqHeaderSize:], p)]
+}
+
+// receiveData delivers the data frame of the stream in order, the content is
+// taken, the read session owns the held frames of the streams
+func (s *Mux) receiveData(c *Conn, pack *muxPackager) {
+	content, length := pack.content, pack.length
+	pack.content = nil
+	if pack.flag == muxMsgSeq {
+		if length <= seqHeaderSize {
+			windowBuff.Put(content)
+			s.logln(LogWarn, "sequenced frame too short, conn id:", pack.id)
+			_ = c.Close()
+			return
+		}
+		off := binary.LittleEndian.Uint64(content)
+		length = uint16(copy(content, content[seqHeaderSize:length]))
+		content = content[:length]
+		switch {
+		case off < c.seqNext:
+			windowBuff.Put(content)
+			atomic.AddUint64(&s.duplicateFrames, 1)
+			return
+		case off > c.seqNext:
+			if _, ok := c.seqHeld[off]; ok {
+				windowBuff.Put(content)
+				atomic.AddUint64(&s.duplicateFrames, 1)
+				return
+			}
+			if off-c.seqNext > maximumWindowSize {
+				// the sender never sends beyond the window
+				windowBuff.Put(content)
+				s.logln(LogWarn, "sequenced frame beyond the window, conn id:", pack.id, "offset:", off)
+				_ = c.Close()
+				return
+			}
+			if c.seqHeld == nil {
+				c.seqHeld = make(map[uint64][]byte)
+			}
+			c.seqHeld[off] = content
+			atomic.AddUint64(&s.reorderedFrames, 1)
+			return
+		}
+	}
+	if !s.deliver(c, content, length) {
+		return
+	}
+	for len(c.seqHeld) > 0 {
+		b, ok := c.seqHeld[c.seqNext]
+		if !ok {
+			return
+		}
+		delete(c.seqHeld, c.seqNext)
+		if !s.deliver(c, b, uint16(len(b))) {
+			return
+		}
+	}
+}
+
+// deliver writes the data of the stream in order into the receive window
+func (s *Mux) deliver(c *Conn, content []byte, length uint16) bool {
+	c.seqNext += uint64(length)
+	if s.integrity() {
+		c.received.add(content[:length])
+	}
+	if err := s.newMsg(c, content, length); err != nil {
+		s.logln(LogWarn, "read session new msg err", err)
+		_ = c.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package npsmux
+
+// simPoint is a point the goroutines of the mux yield to the simulation
+// scheduler, the interleavings around them decide the window deadlocks
+type simPoint uint8
+
+const (
+	simQueuePop   simPoint = iota // the write session pops the write queue
+	simReceive                    // the read session handles a frame
+	simWindowWait                 // a writer waits for the send window
+)
+
+// simScheduler drives the interleavings of the simulation tests by a seed,
+// with the fake clock and the fake network, it is nil except the tests
+type simScheduler interface {
+	yield(p simPoint)
+}
+
+func (s *Mux) simYield(p simPoint) {
+	if s.config.sim != nil {
+		s.config.sim.yield(p)
+	}
+}
@@ -0,0 +1,100 @@
+package npsmux
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// slabSize is the memory allocated at once for a size class, carved into buffers
+const slabSize = 64 * 1024
+
+// bufferClasses are the sizes of the buffers, the last one is a full frame content
+var bufferClasses = [...]int{256, 1024, poolSizeWindow}
+
+type sizeClass struct {
+	inUse int64 // buffers got, but not put back, accessed atomically
+	slabs int64 // slabs allocated, accessed atomically
+	size  int
+	pool  sync.Pool // sync.Pool keeps a cache per P
+}
+
+// get returns a buffer of the class, if the pool is empty, a new slab is
+// allocated and carved, the buffers left are put into the pool
+func (Self *sizeClass) get() []byte {
+	atomic.AddInt64(&Self.inUse, 1)
+	if buf, ok := Self.pool.Get().([]byte); ok {
+		return buf
+	}
+	atomic.AddInt64(&Self.slabs, 1)
+	n := slabSize / Self.size
+	slab := make([]byte, n*Self.size)
+	for i := 1; i < n; i++ {
+		Self.pool.Put(slab[i*Self.size : (i+1)*Self.size : (i+1)*Self.size])
+	}
+	return slab[:Self.size:Self.size]
+}
+
+func (Self *sizeClass) put(buf []byte) {
+	atomic.AddInt64(&Self.inUse, -1)
+	Self.pool.Put(buf[:Self.size])
+}
+
+// slabAllocator hands out the buffers by size classes
+type slabAllocator struct {
+	classes [len(bufferClasses)]sizeClass
+}
+
+func newSlabAllocator() *slabAllocator {
+	s := new(slabAllocator)
+	for i, size := range bufferClasses {
+		s.classes[i].size = size
+	}
+	return s
+}
+
+// Get returns a buffer of length n, n must not be larger than a frame content
+func (Self *slabAllocator) Get(n int) []byte {
+	for i := range Self.classes {
+		if n <= Self.classes[i].size {
+			return Self.classes[i].get()[:n]
+		}
+	}
+	panic("mux: buffer larger than the frame content")
+}
+
+// Put returns the buffer got by Get, the class is found by the capacity,
+// the buffers not from Get are dropped
+func (Self *slabAllocator) Put(buf []byte) {
+	for i := range Self.classes {
+		if cap(buf) == Self.classes[i].size {
+			Self.classes[i].put(buf)
+			return
+		}
+	}
+}
+
+// BufferStats is the status of a size class of the buffer allocator
+type BufferStats struct {
+	Size  int   // the buffer size of the class
+	InUse int64 // the buffers got by the muxes, not put back
+	Slabs int64 // the slabs allocated, 64KB each
+}
+
+// BufferPoolStats returns the status of every size class of the buffers shared by all muxes
+func BufferPoolStats() []BufferStats {
+	stats := make([]BufferStats, len(slab.classes))
+	for i := range slab.classes {
+		c := &slab.classes[i]
+		stats[i] = BufferStats{Size: c.size, InUse: atomic.LoadInt64(&c.inUse), Slabs: atomic.LoadInt64(&c.slabs)}
+	}
+	return stats
+}
+
+// BufferMemoryHeld returns the bytes of the buffers in use by all muxes,
+// it can be exported as a metric
+func BufferMemoryHeld() (n int64) {
+	for _, s := range BufferPoolStats() {
+		n += s.InUse * int64(s.Size)
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const slowConsumerCheckInterval = time.Second
+
+// SetSlowConsumerTimeout sets the longest time the receive window of the stream keeps full,
+// the stream is reset after it, as MuxConfig.SlowConsumerTimeout. zero means the mux default,
+// negative means no limit
+func (s *Conn) SetSlowConsumerTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.slowTimeout, int64(d))
+	if d > 0 {
+		s.receiveWindow.mux.startSlowConsumer()
+	}
+}
+
+func (s *Conn) slowConsumerTimeout() time.Duration {
+	d := time.Duration(atomic.LoadInt64(&s.slowTimeout))
+	if d == 0 {
+		return s.receiveWindow.mux.config.SlowConsumerTimeout
+	}
+	return d
+}
+
+func (s *Mux) startSlowConsumer() {
+	s.slowConsumerOnce.Do(func() {
+		s.goroutine(s.slowConsumerSession)
+	})
+}
+
+// slowConsumerSession finds the streams whose receive window keeps full too long
+func (s *Mux) slowConsumerSession() {
+	ticker := s.clock.NewTicker(slowConsumerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+		now := s.clock.Now().UnixNano()
+		s.connMap.Range(func(id int32, c *Conn) bool {
+			timeout := c.slowConsumerTimeout()
+			if timeout <= 0 || c.closed() {
+				return true
+			}
+			_, _, wait := c.receiveWindow.unpack(atomic.LoadUint64(&c.receiveWindow.maxSizeDone))
+			if !wait {
+				// the window is not full, the peer is not waiting
+				atomic.StoreInt64(&c.fullSince, 0)
+				return true
+			}
+			since := atomic.LoadInt64(&c.fullSince)
+			if since == 0 {
+				atomic.StoreInt64(&c.fullSince, now)
+				return true
+			}
+			if now-since < int64(timeout) {
+				return true
+			}
+			action := ActionClose
+			if s.config.OnSlowConsumer != nil {
+				action = s.config.OnSlowConsumer(c)
+			}
+			if action == ActionIgnore {
+				atomic.StoreInt64(&c.fullSince, now)
+				return true
+			}
+			s.logln(LogWarn, "slow consumer, reset the stream, conn id:", id)
+			c.traceEvent(EventSlowConsumerReset)
+			_ = c.Close()
+			return true
+		})
+	}
+}
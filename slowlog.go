@@ -0,0 +1,96 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SlowLogConfig logs the operations slower than the thresholds at LogWarn,
+// so a vague hang is told by the logs, zero disables the threshold
+type SlowLogConfig struct {
+	// FrameWrite is the longest write of a frame to the transport
+	FrameWrite time.Duration
+	// Open is the longest NewConn, until the peer accepted or refused
+	Open time.Duration
+	// ReadStall is the longest Read waiting for the data, the windows of the
+	// stream are logged with it, once per stall
+	ReadStall time.Duration
+}
+
+const slowReadCheckInterval = time.Second
+
+var noSlowLog SlowLogConfig
+
+func (s *Mux) slowLog() *SlowLogConfig {
+	if s.config.SlowLog != nil {
+		return s.config.SlowLog
+	}
+	return &noSlowLog
+}
+
+// slowFrameWrite logs the frame written since start, if it is slow
+func (s *Mux) slowFrameWrite(pack *muxPackager, size uint16, start time.Time) {
+	limit := s.slowLog().FrameWrite
+	if limit <= 0 {
+		return
+	}
+	if d := s.clock.Now().Sub(start); d > limit {
+		s.logf(LogWarn, "slow frame write: %s flag: %s conn id: %d size: %d write queue: %d",
+			d, flagName(pack.flag), pack.id, size, s.writeQueue.Len())
+	}
+}
+
+// slowOpen logs the open begun at start, if it is slow
+func (s *Mux) slowOpen(id int32, start time.Time, err error) {
+	limit := s.slowLog().Open
+	if limit <= 0 {
+		return
+	}
+	if d := s.clock.Now().Sub(start); d > limit {
+		s.logf(LogWarn, "slow open: %s conn id: %d err: %v pending opens: %d", d, id, err, s.connMap.Size())
+	}
+}
+
+// readStart marks the Read begins to wait for the data, it returns the func
+// marking the wait ended, the stall is only watched if ReadStall set
+func (Self *receiveWindow) readStart() func() {
+	if Self.mux.slowLog().ReadStall <= 0 || Self.bufQueue.Len() > 0 {
+		return func() {}
+	}
+	atomic.StoreUint32(&Self.stallReported, 0)
+	atomic.StoreInt64(&Self.readSince, Self.mux.clock.Now().UnixNano())
+	return func() { atomic.StoreInt64(&Self.readSince, 0) }
+}
+
+// slowReadSession logs the Reads waiting for the data longer than ReadStall,
+// with the snapshot of the windows of the stream
+func (s *Mux) slowReadSession() {
+	limit := s.slowLog().ReadStall
+	interval := slowReadCheckInterval
+	if limit/2 < interval {
+		interval = limit / 2
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+		now := s.clock.Now().UnixNano()
+		s.connMap.Range(func(id int32, c *Conn) bool {
+			w := c.receiveWindow
+			since := atomic.LoadInt64(&w.readSince)
+			if since == 0 || now-since < int64(limit) || !atomic.CompareAndSwapUint32(&w.stallReported, 0, 1) {
+				return true
+			}
+			maxSize, read, wait := w.unpack(atomic.LoadUint64(&w.maxSizeDone))
+			peerMax, send, sendWait := c.sendWindow.unpack(atomic.LoadUint64(&c.sendWindow.maxSizeDone))
+			s.logf(LogWarn, "read stalled: %s conn id: %d receive max size: %d read: %d wait: %v paused: %v "+
+				"send max size: %d send: %d wait: %v buffered: %d",
+				time.Duration(now-since), id, maxSize, read, wait, c.Paused(), peerMax, send, sendWait, w.bufQueue.Len())
+			return true
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package npsmux
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic is the snapshot of the traffic counters, the bytes of the mux
+// are counted on the wire, includes the frame headers, the bytes of
+// the stream are the payload only
+type Traffic struct {
+	BytesIn   uint64
+	BytesOut  uint64
+	FramesIn  uint64
+	FramesOut uint64
+}
+
+// trafficCounter counts the traffic, the 64bit counters take hundreds
+// of years to roll over, it must be 64bit aligned
+type trafficCounter struct {
+	bytesIn   uint64
+	bytesOut  uint64
+	framesIn  uint64
+	framesOut uint64
+}
+
+func (Self *trafficCounter) addIn(n int) {
+	atomic.AddUint64(&Self.bytesIn, uint64(n))
+	atomic.AddUint64(&Self.framesIn, 1)
+}
+
+func (Self *trafficCounter) addOut(n int) {
+	atomic.AddUint64(&Self.bytesOut, uint64(n))
+	atomic.AddUint64(&Self.framesOut, 1)
+}
+
+func (Self *trafficCounter) get() Traffic {
+	return Traffic{
+		BytesIn:   atomic.LoadUint64(&Self.bytesIn),
+		BytesOut:  atomic.LoadUint64(&Self.bytesOut),
+		FramesIn:  atomic.LoadUint64(&Self.framesIn),
+		FramesOut: atomic.LoadUint64(&Self.framesOut),
+	}
+}
+
+// reset sets the counters to zero, returns the values before,
+// nothing is lost between the two calls of reset
+func (Self *trafficCounter) reset() Traffic {
+	return Traffic{
+		BytesIn:   atomic.SwapUint64(&Self.bytesIn, 0),
+		BytesOut:  atomic.SwapUint64(&Self.bytesOut, 0),
+		FramesIn:  atomic.SwapUint64(&Self.framesIn, 0),
+		FramesOut: atomic.SwapUint64(&Self.framesOut, 0),
+	}
+}
+
+// Stats is the snapshot of the mux status
+type Stats struct {
+	Traffic
+	SessionID uint64
+	Streams   int
+	// RefusedStreams is the count of the streams refused by NewConnRate
+	RefusedStreams uint64
+	// StaleFrames is the count of the late frames of the streams closed here,
+	// received before the peer closed them, they are dropped
+	StaleFrames uint64
+	// ReorderedFrames is the count of the sequenced frames arrived early, held until
+	// the frames before them arrived, DuplicateFrames is the count received twice
+	ReorderedFrames uint64
+	DuplicateFrames uint64
+	// Retransmits is the count of the segments sent again in the ARQ mode,
+	// Recovered is the count of the datagrams recovered by the parity
+	Retransmits uint64
+	Recovered   uint64
+	// WriteQueueLen is the count of the frames waiting to be written,
+	// WriteQueueHigh is the most ever waiting
+	WriteQueueLen  int
+	WriteQueueHigh int
+	// Congestions is the count of the congestion notifications received
+	Congestions uint64
+	// the estimated bandwidths in bytes per second, zero if not estimated yet,
+	// see Bandwidth and WriteBandwidth
+	ReadBandwidth  float64
+	SentBandwidth  float64
+	AckedBandwidth float64
+	// Payload is the payload traffic of all the streams, the goodput, the frames
+	// are the data frames. it is not reset by ResetTraffic
+	Payload Traffic
+	// Flags is the traffic of each kind of frames, by the flag name,
+	// they are not reset by ResetTraffic
+	Flags map[string]Traffic
+}
+
+// Wire returns the total traffic on the wire by the flags, unlike the Traffic,
+// it is not reset by ResetTraffic, as the Payload
+func (st *Stats) Wire() (t Traffic) {
+	for _, f := range st.Flags {
+		t.BytesIn += f.BytesIn
+		t.BytesOut += f.BytesOut
+		t.FramesIn += f.FramesIn
+		t.FramesOut += f.FramesOut
+	}
+	return
+}
+
+// Overhead returns the part of the wire bytes not the payload, as the headers,
+// the control frames and the padding, from 0 to 1 in each direction
+func (st *Stats) Overhead() (in, out float64) {
+	w := st.Wire()
+	return overhead(st.Payload.BytesIn, w.BytesIn), overhead(st.Payload.BytesOut, w.BytesOut)
+}
+
+func overhead(payload, wire uint64) float64 {
+	if wire == 0 || payload >= wire {
+		return 0
+	}
+	return float64(wire-payload) / float64(wire)
+}
+
+// WindowUpdateRatio returns the window updates sent per data frame received,
+// it is far above 1 in the window update storms
+func (st *Stats) WindowUpdateRatio() float64 {
+	if st.Payload.FramesIn == 0 {
+		return 0
+	}
+	return float64(st.Flags[flagName(muxMsgSendOk)].FramesOut) / float64(st.Payload.FramesIn)
+}
+
+// Stats returns the current status of the mux
+func (s *Mux) Stats() Stats {
+	read, _ := s.Bandwidth()
+	sent, acked, _ := s.WriteBandwidth()
+	retransmits, recovered := s.arqStats()
+	return Stats{
+		Traffic:         s.traffic.get(),
+		SessionID:       s.sessionID,
+		Streams:         s.connMap.Size(),
+		RefusedStreams:  atomic.LoadUint64(&s.refusedConns),
+		StaleFrames:     atomic.LoadUint64(&s.staleFrames),
+		ReorderedFrames: atomic.LoadUint64(&s.reorderedFrames),
+		DuplicateFrames: atomic.LoadUint64(&s.duplicateFrames),
+		Retransmits:     retransmits,
+		Recovered:       recovered,
+		WriteQueueLen:   s.writeQueue.Len(),
+		WriteQueueHigh:  s.writeQueue.High(),
+		Congestions:     atomic.LoadUint64(&s.congestion),
+		Payload:         s.goodput.get(),
+		Flags:           s.flagTraffic(),
+		ReadBandwidth:   read,
+		SentBandwidth:   sent,
+		AckedBandwidth:  acked,
+	}
+}
+
+// Latency is the rtt of the mux measured by the pings
+type Latency struct {
+	Min      time.Duration
+	Smoothed time.Duration
+	Variance time.Duration
+}
+
+// Adjusted is the smoothed rtt with four times of the variance, a frame takes
+// about the time on the lossy transports, with the retransmissions
+func (l Latency) Adjusted() time.Duration {
+	return l.Smoothed + 4*l.Variance
+}
+
+// Latency returns the rtt measured, it is zero before the first ping returned
+func (s *Mux) Latency() Latency {
+	min, srtt, rttVar := s.counter.Get()
+	return Latency{Min: seconds(min), Smoothed: seconds(srtt), Variance: seconds(rttVar)}
+}
+
+// ResetTraffic sets the traffic counters of the mux to zero,
+// returns the values before reset
+func (s *Mux) ResetTraffic() Traffic {
+	return s.traffic.reset()
+}
+
+// Traffic returns the payload traffic of the stream
+func (s *Conn) Traffic() Traffic {
+	return s.traffic.get()
+}
+
+// ResetTraffic sets the traffic counters of the stream to zero,
+// returns the values before reset
+func (s *Conn) ResetTraffic() Traffic {
+	return s.traffic.reset()
+}
+
+// ConnStats is the snapshot of the stream status, the applications can adapt to it
+type ConnStats struct {
+	Traffic
+	// ReadRate and WriteRate are the smoothed payload bytes per second
+	ReadRate  float64
+	WriteRate float64
+	// QueueDelay is the smoothed time the data frames wait in the write queue
+	QueueDelay time.Duration
+	// RTT is the smoothed rtt of the mux, the streams share it
+	RTT time.Duration
+	// SessionID is the id of the mux
+	SessionID uint64
+	// WindowUpdates is the count of the window updates sent for the stream, a Read
+	// sends at most one, however many frames it takes
+	WindowUpdates uint64
+}
+
+// Stats returns the current status of the stream
+func (s *Conn) Stats() ConnStats {
+	mux := s.receiveWindow.mux
+	_, srtt, _ := mux.counter.Get()
+	return ConnStats{
+		Traffic:       s.traffic.get(),
+		ReadRate:      s.stats.readRate.get(),
+		WriteRate:     s.stats.writeRate.get(),
+		QueueDelay:    time.Duration(atomic.LoadInt64(&s.stats.queueDelay)),
+		RTT:           seconds(srtt),
+		SessionID:     mux.sessionID,
+		WindowUpdates: atomic.LoadUint64(&s.receiveWindow.updates),
+	}
+}
+
+// streamStats samples the rate and the queue delay of the stream
+type streamStats struct {
+	queueDelay int64 // nanoseconds, only updated by the write session
+	readRate   rateMeter
+	writeRate  rateMeter
+}
+
+func (Self *streamStats) init(clock Clock) {
+	Self.readRate.clock = clock
+	Self.writeRate.clock = clock
+}
+
+// frameSent smooths the queue delay as the srtt, the gain is 1/8
+func (Self *streamStats) frameSent(delay time.Duration) {
+	old := atomic.LoadInt64(&Self.queueDelay)
+	atomic.StoreInt64(&Self.queueDelay, old+(int64(delay)-old)/8)
+}
+
+// rateMeter samples the bytes per second in bwSampleInterval, and smooths
+// them by EWMA, it returns zero after bwIdleTimeout without bytes
+type rateMeter struct {
+	start time.Time
+	last  time.Time
+	bytes int
+	rate  float64
+	clock Clock
+	sync.Mutex
+}
+
+func (Self *rateMeter) add(n int) {
+	if Self.clock == nil {
+		return
+	}
+	now := Self.clock.Now()
+	Self.Lock()
+	defer Self.Unlock()
+	if Self.start.IsZero() || now.Sub(Self.last) > bwIdleTimeout {
+		Self.start, Self.bytes, Self.rate = now, 0, 0
+	}
+	Self.last = now
+	Self.bytes += n
+	if t := now.Sub(Self.start); t >= bwSampleInterval {
+		sample := float64(Self.bytes) / t.Seconds()
+		if Self.rate == 0 {
+			Self.rate = sample
+		} else {
+			Self.rate = Self.rate*(1-bwAlpha) + sample*bwAlpha
+		}
+		Self.start, Self.bytes = now, 0
+	}
+}
+
+func (Self *rateMeter) get() float64 {
+	if Self.clock == nil {
+		return 0
+	}
+	now := Self.clock.Now()
+	Self.Lock()
+	defer Self.Unlock()
+	if now.Sub(Self.last) > bwIdleTimeout {
+		return 0
+	}
+	return Self.rate
+}
+
+// WriteQueueLen returns the count of the frames waiting to be written
+func (s *Mux) WriteQueueLen() int {
+	return s.writeQueue.Len()
+}
+
+func (s *Mux) writeQueueDrained() {
+	if f := s.config.OnWriteQueueDrained; f != nil {
+		s.goroutine(func() {
+			f(s)
+		})
+	}
+}
+
+// numFlags is the count of the frame flags, the last one is muxIdRole
+const numFlags = muxIdRole + 1
+
+var flagNames = [numFlags]string{
+	muxPingFlag:         "ping",
+	muxNewConnOk:        "newConnOk",
+	muxNewConnFail:      "newConnFail",
+	muxNewMsg:           "msg",
+	muxNewMsgPart:       "msgPart",
+	muxMsgSendOk:        "sendOk",
+	muxNewConn:          "newConn",
+	muxConnClose:        "close",
+	muxPingReturn:       "pingReturn",
+	muxFeatures:         "features",
+	muxNewConnBatch:     "newConnBatch",
+	muxNewConnOkBatch:   "newConnOkBatch",
+	muxWindowProbe:      "windowProbe",
+	muxGoAway:           "goAway",
+	muxCompactHeader:    "compactHeader",
+	muxPadding:          "padding",
+	muxCongestion:       "congestion",
+	muxConnCloseConfirm: "closeConfirm",
+	muxConnCloseAck:     "closeAck",
+	muxChecksum:         "checksum",
+	muxStreamMeta:       "streamMeta",
+	muxMsgSeq:           "msgSeq",
+	muxConnOpenCancel:   "connOpenCancel",
+	muxConnCloseWrite:   "connCloseWrite",
+	muxIdRole:           "idRole",
+}
+
+// flagName returns the name of the frame flag, for the stats and logs
+func flagName(flag uint8) string {
+	if flag < numFlags {
+		return flagNames[flag]
+	}
+	return "unknown"
+}
+
+// flagTraffic returns the traffic of the flags ever sent or received
+func (s *Mux) flagTraffic() map[string]Traffic {
+	m := make(map[string]Traffic)
+	for flag := range s.flags {
+		if t := s.flags[flag].get(); t.FramesIn > 0 || t.FramesOut > 0 {
+			m[flagName(uint8(flag))] = t
+		}
+	}
+	return m
+}
+
+// countFrame counts the frame on the wire, in the mux and the flag counters
+func (s *Mux) countFrame(flag uint8, n int, in bool) {
+	var flagCounter *trafficCounter
+	if flag < numFlags {
+		flagCounter = &s.flags[flag]
+	}
+	if in {
+		s.traffic.addIn(n)
+		if flagCounter != nil {
+			flagCounter.addIn(n)
+		}
+		return
+	}
+	s.traffic.addOut(n)
+	if flagCounter != nil {
+		flagCounter.addOut(n)
+	}
+}
@@ -1,6 +1,6 @@
 // +build !windows
 
-package nps_mux
+package npsmux
 
 import (
 	"errors"
@@ -12,7 +12,18 @@ import (
 
 func sysGetSock(fd *os.File) (bufferSize int, err error) {
 	if fd != nil {
-		return syscall.GetsockoptInt(int(fd.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		// not by Fd, it puts the socket shared with the conn into the blocking mode,
+		// a read blocked in the system call blocks the Close of the conn then
+		raw, err := fd.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		if cerr := raw.Control(func(s uintptr) {
+			bufferSize, err = syscall.GetsockoptInt(int(s), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		}); cerr != nil {
+			return 0, cerr
+		}
+		return bufferSize, err
 	} else {
 		return 5 * 1024 * 1024, nil
 	}
@@ -1,6 +1,6 @@
 // +build windows
 
-package nps_mux
+package npsmux
 
 import (
 	"errors"
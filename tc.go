@@ -1,4 +1,4 @@
-package nps_mux
+package npsmux
 
 import (
 	"bytes"
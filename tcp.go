@@ -0,0 +1,53 @@
+package npsmux
+
+import (
+	"net"
+	"time"
+)
+
+// TCPConfig is the tuning of the tcp transport, applied by the mux on start
+type TCPConfig struct {
+	// Nagle enables the Nagle algorithm, go disables it by default,
+	// the mux writes the frames in large blocks, most time it is not needed
+	Nagle bool
+
+	// KeepAlive is the keep alive period of the tcp connection,
+	// zero keeps the system setting, negative disables the keep alive
+	KeepAlive time.Duration
+
+	// UserTimeout is the longest time the data sent stays unacknowledged,
+	// before the connection closed by the system, zero keeps the system setting.
+	// it works on linux only
+	UserTimeout time.Duration
+}
+
+// tuneTCP applies the config to the tcp transport, other transports are ignored
+func (s *Mux) tuneTCP() {
+	config := s.config.TCP
+	conn, ok := s.conn.(*net.TCPConn)
+	if !ok || config == nil {
+		return
+	}
+	if err := conn.SetNoDelay(!config.Nagle); err != nil {
+		s.logln(LogWarn, "set tcp no delay err", err)
+	}
+	switch {
+	case config.KeepAlive > 0:
+		if err := conn.SetKeepAlive(true); err != nil {
+			s.logln(LogWarn, "set tcp keep alive err", err)
+			break
+		}
+		if err := conn.SetKeepAlivePeriod(config.KeepAlive); err != nil {
+			s.logln(LogWarn, "set tcp keep alive period err", err)
+		}
+	case config.KeepAlive < 0:
+		if err := conn.SetKeepAlive(false); err != nil {
+			s.logln(LogWarn, "set tcp keep alive err", err)
+		}
+	}
+	if config.UserTimeout > 0 {
+		if err := setUserTimeout(conn, config.UserTimeout); err != nil {
+			s.logln(LogWarn, "set tcp user timeout err", err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// +build linux
+
+package npsmux
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, not defined in the syscall package
+const tcpUserTimeout = 0x12
+
+func setUserTimeout(c *net.TCPConn, d time.Duration) (err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	ms := int(d / time.Millisecond)
+	cErr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, ms)
+	})
+	if cErr != nil {
+		return cErr
+	}
+	return
+}
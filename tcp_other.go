@@ -0,0 +1,13 @@
+// +build !linux
+
+package npsmux
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+func setUserTimeout(c *net.TCPConn, d time.Duration) error {
+	return errors.New("mux: tcp user timeout is not supported on this platform")
+}
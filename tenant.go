@@ -0,0 +1,177 @@
+package npsmux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// the streams of a mux may belong to the tenants, as the users of a multi user
+// server, the tenant is sent with the open, the both sides account the traffic
+// and the streams of the tenant, and police them by the limits
+
+var errTenantStreams = fmt.Errorf("mux: too many streams of the tenant: %w", ErrRefused)
+
+type tenant struct {
+	traffic    trafficCounter // 64bit alignment
+	quota      int64          // the payload bytes limit, zero means no limit
+	name       string
+	streams    int32 // the streams open, accessed atomically
+	maxStreams int32 // zero means no limit
+	quotaHit   uint32
+	limited    bool // the limits set, it is kept without the streams, guarded by tenantLock
+}
+
+// TenantLimits are the limits of a tenant in the mux
+type TenantLimits struct {
+	// Quota limits the payload bytes of all the streams of the tenant, both read
+	// and written, once used up, Read and Write return ErrQuotaExceeded, and the
+	// streams of the tenant are closed. zero means no limit
+	Quota int64
+	// MaxStreams limits the streams of the tenant open at once, the streams beyond
+	// it are refused. zero means no limit
+	MaxStreams int
+}
+
+// TenantStats is the accounting of a tenant in the mux
+type TenantStats struct {
+	Traffic Traffic
+	Streams int // the streams open
+}
+
+// NewTenantConn is NewConn, the stream belongs to the tenant. the tenant is
+// not sent if the peer does not support, as an old version
+func (s *Mux) NewTenantConn(name string) (*Conn, error) {
+	return s.openConn(nil, &OpenOptions{Tenant: name})
+}
+
+// SetTenantLimits sets the limits of the tenant, both the streams opened by
+// this side and the other side are limited
+func (s *Mux) SetTenantLimits(name string, limits TenantLimits) {
+	s.tenantLock.Lock()
+	defer s.tenantLock.Unlock()
+	t := s.tenants[name]
+	if t == nil {
+		t = s.addTenant(name)
+	}
+	t.limited = true
+	atomic.StoreInt64(&t.quota, limits.Quota)
+	atomic.StoreInt32(&t.maxStreams, int32(limits.MaxStreams))
+}
+
+// TenantStats returns the accounting of the tenants with the limits set, and
+// of the others with the streams open, they are dropped once the streams closed
+func (s *Mux) TenantStats() map[string]TenantStats {
+	s.tenantLock.Lock()
+	defer s.tenantLock.Unlock()
+	stats := make(map[string]TenantStats, len(s.tenants))
+	for name, t := range s.tenants {
+		stats[name] = TenantStats{Traffic: t.traffic.get(), Streams: int(atomic.LoadInt32(&t.streams))}
+	}
+	return stats
+}
+
+// Tenant returns the tenant of the stream, empty if none, or the tenant of the
+// stream opened by the peer is beyond MaxTenants
+func (s *Conn) Tenant() string {
+	if s.tenant == nil {
+		return ""
+	}
+	return s.tenant.name
+}
+
+// addTenant adds the tenant of name, the caller holds tenantLock
+func (s *Mux) addTenant(name string) *tenant {
+	if s.tenants == nil {
+		s.tenants = make(map[string]*tenant)
+	}
+	t := &tenant{name: name}
+	s.tenants[name] = t
+	return t
+}
+
+// joinTenant counts the stream into the tenant of name, returns false if the
+// tenant has too many streams. the new tenant beyond MaxTenants is replaced by
+// the tenant of the empty name
+func (s *Conn) joinTenant(name string) bool {
+	mux := s.receiveWindow.mux
+	mux.tenantLock.Lock()
+	defer mux.tenantLock.Unlock()
+	t := mux.tenants[name]
+	if t == nil && len(mux.tenants) >= mux.config.maxTenants() {
+		name = ""
+		t = mux.tenants[name]
+	}
+	if t == nil {
+		t = mux.addTenant(name)
+	}
+	n := atomic.LoadInt32(&t.streams)
+	if max := atomic.LoadInt32(&t.maxStreams); max > 0 && n >= max {
+		return false
+	}
+	atomic.AddInt32(&t.streams, 1)
+	s.tenant = t
+	return true
+}
+
+// leaveTenant is invoked when the stream closed or failed to open, the tenant
+// without the limits set is dropped with its last stream
+func (s *Conn) leaveTenant() {
+	t := s.tenant
+	if t == nil || !atomic.CompareAndSwapUint32(&s.tenantLeft, 0, 1) {
+		return
+	}
+	mux := s.receiveWindow.mux
+	mux.tenantLock.Lock()
+	if atomic.AddInt32(&t.streams, -1) == 0 && !t.limited && mux.tenants[t.name] == t {
+		delete(mux.tenants, t.name)
+	}
+	mux.tenantLock.Unlock()
+}
+
+// applyMeta sets the metadata of the stream opened by the other side,
+// returns false if the stream should be refused
+func (s *Conn) applyMeta(meta []byte) bool {
+	entries, err := decodeMeta(meta)
+	if err != nil {
+		s.receiveWindow.mux.logln(LogWarn, err, "conn id:", s.connId)
+		return true // the stream works without the metadata
+	}
+	if name := entries[metaTenant]; len(name) > 0 {
+		if !s.joinTenant(string(name)) {
+			s.receiveWindow.mux.logln(LogInfo, "too many streams of the tenant, refuse it, conn id:", s.connId)
+			return false
+		}
+	}
+	if w := entries[metaWindow]; len(w) == 4 {
+		s.sendWindow.setInitial(clampWindow(int(binary.LittleEndian.Uint32(w))))
+	}
+	s.openCtx = decodeOpenContext(entries, s.receiveWindow.mux.clock.Now())
+	return true
+}
+
+// checkTenantQuota returns ErrQuotaExceeded if the quota of the tenant used up,
+// the stream is closed then
+func (s *Conn) checkTenantQuota() error {
+	t := s.tenant
+	if t == nil {
+		return nil
+	}
+	if atomic.LoadUint32(&t.quotaHit) == 0 {
+		if !quotaUsedUp(&t.quota, &t.traffic) {
+			return nil
+		}
+		if atomic.CompareAndSwapUint32(&t.quotaHit, 0, 1) {
+			s.receiveWindow.mux.logln(LogInfo, "tenant quota exceeded, tenant:", t.name)
+		}
+	}
+	mux := s.receiveWindow.mux
+	if atomic.CompareAndSwapUint32(&s.quotaHit, 0, 1) {
+		s.traceEvent(EventQuotaExceeded)
+		if mux.config.OnQuotaExceeded != nil {
+			mux.config.OnQuotaExceeded(mux, s)
+		}
+		_ = s.Close()
+	}
+	return ErrQuotaExceeded
+}
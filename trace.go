@@ -0,0 +1,41 @@
+package npsmux
+
+// Tracer creates a span for every stream, it is the hook of the tracing
+// systems, such as OpenTelemetry, the mux does not depend on any of them
+type Tracer interface {
+	// StartStream is invoked when the stream created, by NewConn or the peer
+	StartStream(c *Conn) StreamSpan
+}
+
+// StreamSpan records the life of a stream, from open to close
+type StreamSpan interface {
+	// AddEvent records something happened to the stream, such as a window stall
+	AddEvent(name string)
+	// End is invoked once the stream closed, or failed to open, with the final stats
+	End(stats ConnStats)
+}
+
+// the events of the stream span
+const (
+	EventOpenFailed        = "open failed"
+	EventWindowStall       = "window stall"
+	EventWatchdogReset     = "watchdog reset"
+	EventSlowConsumerReset = "slow consumer reset"
+	EventKeepAliveTimeout  = "keep alive timeout"
+	EventPeerNotReading    = "peer not reading"
+	EventQuotaExceeded     = "quota exceeded"
+	EventRemoteClose       = "remote close"
+	EventRemoteCloseWrite  = "remote close write"
+)
+
+func (s *Conn) traceEvent(name string) {
+	if s.span != nil {
+		s.span.AddEvent(name)
+	}
+}
+
+func (s *Conn) traceEnd() {
+	if s.span != nil {
+		s.span.End(s.Stats())
+	}
+}
@@ -0,0 +1,68 @@
+package npsmux
+
+import (
+	"errors"
+	"io"
+)
+
+// WireTransform scrambles the bytes on the wire, it is applied after the
+// frames packed and before the transport written, both sides must use the same.
+// the bytes are transformed as a stream, as a stream cipher does, Encode and
+// Decode return as many bytes as given, and the output does not depend on how
+// the stream is split into the calls, nothing is added on the wire
+type WireTransform interface {
+	Encode(p []byte) []byte
+	Decode(p []byte) ([]byte, error)
+}
+
+var errTransformLength = errors.New("mux: the wire transform changed the length")
+
+// transformWriter encodes the writes
+type transformWriter struct {
+	t WireTransform
+	w io.Writer
+}
+
+func (Self *transformWriter) Write(p []byte) (n int, err error) {
+	enc := Self.t.Encode(p)
+	if len(enc) != len(p) {
+		return 0, errTransformLength
+	}
+	return Self.w.Write(enc)
+}
+
+// transformReader decodes the bytes read
+type transformReader struct {
+	t WireTransform
+	r io.Reader
+}
+
+func (Self *transformReader) Read(p []byte) (n int, err error) {
+	n, err = Self.r.Read(p)
+	if n > 0 {
+		dec, e := Self.t.Decode(p[:n])
+		if e != nil {
+			return 0, e
+		}
+		if len(dec) != n {
+			return 0, errTransformLength
+		}
+		copy(p, dec)
+	}
+	return
+}
+
+// newWriter returns the writer of the frames to the transport,
+// records is not nil if the frames aligned to the tls records
+func (s *Mux) newWriter() (w io.Writer, records *recordWriter) {
+	w = &retryWriter{w: s.conn, mux: s}
+	size := s.config.recordSize(s.conn)
+	if s.config.WireTransform != nil {
+		w = &transformWriter{t: s.config.WireTransform, w: w}
+	}
+	if size > 0 {
+		records = newRecordWriter(w, size)
+		w = records
+	}
+	return
+}
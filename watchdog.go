@@ -0,0 +1,48 @@
+package npsmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const watchdogCheckInterval = time.Second
+
+// watchdogSession looks for the streams deadlocked on the send window,
+// the writer waits for the window update, but the update never comes
+func (s *Mux) watchdogSession() {
+	ticker := s.clock.NewTicker(watchdogCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.closeChan:
+			return
+		}
+		now := s.clock.Now().UnixNano()
+		timeout := int64(s.rttTimeout(s.config.WindowWatchdogRtts))
+		s.connMap.Range(func(id int32, c *Conn) bool {
+			if c.closed() || c.closing() {
+				return true
+			}
+			w := c.sendWindow
+			since := atomic.LoadInt64(&w.waitSince)
+			if since == 0 {
+				return true
+			}
+			if update := atomic.LoadInt64(&w.lastUpdate); update > since {
+				since = update
+			}
+			if now-since < timeout || !atomic.CompareAndSwapUint32(&w.reported, 0, 1) {
+				return true
+			}
+			maxSize, send, wait := w.unpack(atomic.LoadUint64(&w.maxSizeDone))
+			s.logf(LogWarn, "window deadlock, conn id: %d waiting: %s max size: %d send: %d wait: %v receive pending: %d reset: %v",
+				id, time.Duration(now-since), maxSize, send, wait, c.receiveWindow.bufQueue.Len(), s.config.WindowWatchdogReset)
+			if s.config.WindowWatchdogReset {
+				c.traceEvent(EventWatchdogReset)
+				_ = c.Close()
+			}
+			return true
+		})
+	}
+}